@@ -1,3 +1,15 @@
 module github.com/snasphysicist/go-copy
 
-go 1.19
+go 1.24.0
+
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/pkg/sftp v1.13.9
+	github.com/ulikunitz/xz v0.5.15
+	golang.org/x/crypto v0.47.0
+	golang.org/x/net v0.49.0
+	golang.org/x/sys v0.40.0
+	golang.org/x/term v0.39.0
+)
+
+require github.com/kr/fs v0.1.0 // indirect
@@ -1,7 +1,11 @@
 package main
 
-import "github.com/snasphysicist/go-copy/pkg/command"
+import (
+	"os"
+
+	"github.com/snasphysicist/go-copy/pkg/command"
+)
 
 func main() {
-	command.Copy()
+	command.Run(os.Args[1:])
 }
@@ -0,0 +1,99 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/copy"
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+// Bench implements the bench command, copying synthetic data into
+// a directory on the device to tune for with combinations of settings,
+// recommending those which copy fastest while keeping the progress
+// honest, args being the arguments after "bench"
+func Bench(args []string) {
+	fs := newFlagSet("bench", "DIR", "Copies synthetic data into DIR with combinations of buffer size, write block size & flush interval, recommending the fastest whose progress isn't too far ahead of what's really on the device.")
+	size := fs.String("size", "256mb", "how much data to copy with each combination")
+	bufferSizes := fs.String("buffer-sizes", "1mb,16mb,100mb", "comma separated buffer sizes to try")
+	writeBlocks := fs.String("write-blocks", "1kb,64kb,1mb", "comma separated write block sizes to try")
+	syncEach := fs.String("sync-each", fmt.Sprintf("%d,16mb,64mb,0", syncEachBytes), "comma separated numbers of bytes to write between flushes to try, 0 leaving flushing to the system")
+	maxGap := fs.Duration("max-gap", time.Second, "how far the progress may be ahead of what's flushed to the device at the end")
+	saveProfile := fs.String("save-profile", "", "save the recommended settings as a profile with this name (or path), to use with copy --profile")
+	dirs := parseArgs(fs, args)
+	if len(dirs) != 1 {
+		panic("Must give the directory to benchmark")
+	}
+	o := copy.BenchOptions{
+		SizeBytes:       parseSize(*size),
+		BufferSizes:     parseSizes(*bufferSizes),
+		WriteBlockSizes: parseSizes(*writeBlocks),
+		SyncEach:        parseSizes(*syncEach),
+	}
+	runs := len(o.BufferSizes) * len(o.WriteBlockSizes) * len(o.SyncEach)
+	fmt.Fprintf(os.Stderr, "Copying %s into %s %d times\n", internal.FormatSize(o.SizeBytes), dirs[0], runs)
+	fmt.Printf("%-10s %-10s %-10s %12s %10s\n", "BUFFER", "BLOCK", "SYNC EACH", "SPEED", "GAP")
+	results := copy.Bench(dirs[0], o, func(r copy.BenchResult) {
+		fmt.Printf(
+			"%-10s %-10s %-10s %10s/s %10s\n",
+			internal.FormatSize(r.Profile.BufferSizeBytes),
+			internal.FormatSize(r.Profile.WriteBlockBytes),
+			formatSyncEach(r.Profile.SyncEachBytes),
+			internal.FormatSize(uint64(r.Throughput())),
+			r.Gap().Round(time.Millisecond),
+		)
+	})
+	best := copy.Recommend(results, *maxGap)
+	fmt.Printf(
+		"\nRecommended: buffer %s, write block %s, sync each %s (%s/s, progress %s ahead at the end)\n",
+		internal.FormatSize(best.Profile.BufferSizeBytes),
+		internal.FormatSize(best.Profile.WriteBlockBytes),
+		formatSyncEach(best.Profile.SyncEachBytes),
+		internal.FormatSize(uint64(best.Throughput())),
+		best.Gap().Round(time.Millisecond),
+	)
+	if best.Gap() > *maxGap {
+		fmt.Printf("No combination kept the progress within %s, this is the most honest\n", *maxGap)
+	}
+	if *saveProfile == "" {
+		return
+	}
+	path, err := internal.ProfilePath(*saveProfile)
+	if err != nil {
+		panic(err)
+	}
+	best.Profile.ThroughputBytesPerSecond = uint64(best.Throughput())
+	err = best.Profile.WriteJSON(path)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Saved as profile %s in %s\n", *saveProfile, path)
+}
+
+// formatSyncEach formats the number of bytes written between flushes
+func formatSyncEach(syncEach uint64) string {
+	if syncEach == 0 {
+		return "system"
+	}
+	return internal.FormatSize(syncEach)
+}
+
+// parseSize parses a size given in an argument, panicing if it isn't one
+func parseSize(s string) uint64 {
+	size, err := internal.ParseSize(s)
+	if err != nil {
+		panic(err)
+	}
+	return size
+}
+
+// parseSizes parses a comma separated list of sizes given in an argument
+func parseSizes(s string) []uint64 {
+	sizes := make([]uint64, 0)
+	for _, size := range strings.Split(s, ",") {
+		sizes = append(sizes, parseSize(size))
+	}
+	return sizes
+}
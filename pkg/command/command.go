@@ -1,9 +1,15 @@
 package command
 
 import (
-	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/snasphysicist/go-copy/pkg/copy"
+	"github.com/snasphysicist/go-copy/pkg/internal"
 )
 
 // bufferSizeBytes is the default bufer size, around 100MB
@@ -14,32 +20,241 @@ const bufferSizeBytes = 100 * 1024 * 1024
 // force to flush to disk
 const syncEachBytes = uint64(1000000)
 
-// Copy implements the copy command, to copy a single source file to a single destination
-func Copy() {
-	arguments := parseFlags()
-	from := arguments.from
-	to := arguments.to
-	copy.FileToFile(from, to, bufferSizeBytes, syncEachBytes)
+// Copy implements the copy command, to copy a single source file
+// (or directory) to a single destination, args being the arguments
+// after "copy" (or all of them, when no command is given)
+func Copy(args []string) {
+	arguments := parseFlags(args)
+	tuning := internal.Profile{BufferSizeBytes: bufferSizeBytes, SyncEachBytes: syncEachBytes}
+	if arguments.profile != "" {
+		tuning = profile(arguments.profile)
+	}
+	var key internal.Key
+	if arguments.encrypt != "" || arguments.decrypt {
+		key = encryptionKey(arguments.keyFile, arguments.passphraseEnv, arguments.encrypt != "")
+	}
+	o := copy.Options{
+		BufferSizeBytes: tuning.BufferSizeBytes,
+		SyncEachBytes:   tuning.SyncEachBytes,
+		WriteBlockBytes: tuning.WriteBlockBytes,
+		SyncGap:         arguments.syncGap,
+		Retry:           arguments.retryPolicy(),
+		SizeBytes:       arguments.size,
+		Decompress:      arguments.decompress,
+		Compress:        arguments.compress,
+		Decrypt:         arguments.decrypt,
+		Encrypt:         arguments.encrypt,
+		Key:             key,
+		Delta:           arguments.delta,
+		DeltaBlockBytes: parseSize(arguments.deltaBlockSize),
+		SkipIdentical:   arguments.skipIdentical,
+		Update:          arguments.update,
+		Checksum:        arguments.checksum,
+		Filter:          arguments.filter(),
+		Extract:         arguments.extract,
+		ArchiveTime:     archiveTime(arguments.reproducible),
+		ZipStore:        arguments.zipStore,
+		Manifest:        arguments.manifest,
+		SHA256Sums:      arguments.sha256Sums,
+		Endpoints:       arguments.endpoints.options(),
+	}
+	if arguments.dryRun {
+		err := copy.Plannable(arguments.to, o)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't --dry-run this copy, %v\n", err)
+			os.Exit(1)
+		}
+		throughput := tuning.ThroughputBytesPerSecond
+		if arguments.throughput != "" {
+			throughput = parseSize(arguments.throughput)
+		}
+		printPlan(copy.PlanCopy(arguments.from, arguments.to, o), throughput)
+		return
+	}
+	copy.Copy(arguments.from, arguments.to, o)
 }
 
 // arguments contains the parsed and validated arguments to the Copy command
 type arguments struct {
-	from string
-	to   string
+	from           string
+	to             string
+	size           uint64
+	decompress     bool
+	compress       string
+	decrypt        bool
+	encrypt        string
+	keyFile        string
+	passphraseEnv  string
+	skipIdentical  bool
+	update         bool
+	checksum       bool
+	delta          bool
+	dryRun         bool
+	filterRules    []internal.FilterRule
+	ignoreFile     string
+	excludeCaches  bool
+	minSize        string
+	maxSize        string
+	newerThan      string
+	throughput     string
+	deltaBlockSize string
+	endpoints      endpointArguments
+	extract        bool
+	reproducible   bool
+	zipStore       bool
+	manifest       string
+	sha256Sums     string
+	profile        string
+	syncGap        time.Duration
+	retries        int
+	retryBackoff   time.Duration
+	retryMax       time.Duration
+	retryOn        string
 }
 
 // parseFlags extracts the flags/arguments for the Copy command
-// panicing if anything is invalid or missing
-func parseFlags() arguments {
+// from args, the source & destination being given either by
+// flags or positionally, panicing if anything is invalid or missing
+func parseFlags(args []string) arguments {
 	var a arguments
-	flag.StringVar(&a.from, "from", "", "source file to be copied")
-	flag.StringVar(&a.to, "to", "", "destination file to copy to")
-	flag.Parse()
+	fs := newFlagSet("copy", "[FROM TO]", "Copies FROM (or --from) to TO (or --to).")
+	fs.StringVar(&a.from, "from", "", "source file or directory to be copied, - for stdin, or an http(s), sftp, s3, gocopy(s) or ssh URL")
+	fs.StringVar(&a.to, "to", "", "destination file to copy to, - for stdout, an http(s) URL to upload to, or an sftp, s3, gocopy(s) or ssh URL")
+	fs.Uint64Var(&a.size, "size", 0, "size of the source in bytes, for progress when it can't be determined (e.g. stdin)")
+	fs.BoolVar(&a.decompress, "decompress", false, "decompress the source, detecting the compression format")
+	fs.StringVar(&a.compress, "compress", "", fmt.Sprintf("compress the destination with one of %v", internal.Compressions))
+	fs.BoolVar(&a.decrypt, "decrypt", false, "decrypt the source, which was encrypted by go-copy")
+	fs.StringVar(&a.encrypt, "encrypt", "", fmt.Sprintf("encrypt the destination with one of %v", internal.Ciphers))
+	fs.StringVar(&a.keyFile, "key-file", "", "file containing the 32 byte (optionally hex encoded) key to encrypt/decrypt with")
+	fs.StringVar(&a.passphraseEnv, "passphrase-env", "", "environment variable containing the passphrase to encrypt/decrypt with")
+	fs.BoolVar(&a.skipIdentical, "skip-identical", false, "when copying a directory, skip files which already exist identically at the destination")
+	fs.BoolVar(&a.update, "update", false, "when copying a directory, skip files which are identical or newer at the destination")
+	fs.BoolVar(&a.checksum, "checksum", false, "with --update, also skip files whose content is the same at the destination, by hashing both")
+	fs.BoolVar(&a.delta, "delta", false, "copy onto an existing destination in place, only writing the blocks which differ from it")
+	fs.StringVar(&a.deltaBlockSize, "delta-block-size", "64kb", "size of the blocks compared with --delta")
+	fs.Func("include", "when copying a directory, include what matches this glob (repeatable, the first --include or --exclude matching deciding)", func(pattern string) error {
+		a.filterRules = append(a.filterRules, internal.FilterRule{Pattern: pattern, Include: true})
+		return nil
+	})
+	fs.Func("exclude", "when copying a directory, exclude what matches this glob (repeatable, the first --include or --exclude matching deciding)", func(pattern string) error {
+		a.filterRules = append(a.filterRules, internal.FilterRule{Pattern: pattern})
+		return nil
+	})
+	fs.Func("exclude-from", "exclude what matches the globs in this file, one per line (or include those starting with \"+ \")", func(path string) error {
+		rules, err := internal.ReadFilterRules(path)
+		a.filterRules = append(a.filterRules, rules...)
+		return err
+	})
+	fs.StringVar(&a.ignoreFile, "ignore-file", "", "when copying a directory, exclude what's listed in files with this name (e.g. .gitignore), as git does")
+	fs.BoolVar(&a.excludeCaches, "exclude-caches", false, "when copying a directory, exclude directories tagged as caches with a CACHEDIR.TAG file")
+	fs.StringVar(&a.minSize, "min-size", "", "when copying a directory, exclude files smaller than this")
+	fs.StringVar(&a.maxSize, "max-size", "", "when copying a directory, exclude files larger than this")
+	fs.StringVar(&a.newerThan, "newer-than", "", "when copying a directory, exclude files not modified since this long ago (e.g. 36h or 7d) or this date (2006-01-02)")
+	fs.BoolVar(&a.dryRun, "dry-run", false, "show what would be copied & how long it would take, without copying anything")
+	fs.StringVar(&a.throughput, "throughput", "", "bytes per second to estimate how long a --dry-run copy would take with, by default that measured by bench for --profile")
+	fs.BoolVar(&a.extract, "extract", false, "extract the source, a tar (compressed or not) or zip archive, into the destination directory")
+	fs.BoolVar(&a.reproducible, "reproducible", false, "when archiving a directory, give every entry the time in $SOURCE_DATE_EPOCH (default 0) and no owner")
+	fs.BoolVar(&a.zipStore, "zip-store", false, "when archiving a directory as a zip, store files as they are rather than deflating them")
+	fs.StringVar(&a.manifest, "manifest", "", "when copying a directory, write a JSON manifest of every file to this local file at the end")
+	fs.StringVar(&a.sha256Sums, "sha256sums", "", "when copying a directory, write a manifest of every file in the format of sha256sum to this local file at the end")
+	fs.StringVar(&a.profile, "profile", "", "copy with the settings in the profile with this name (or path), as saved by bench --save-profile")
+	fs.DurationVar(&a.syncGap, "sync-gap", time.Second, "adjust how often written bytes are flushed so each flush takes about this long, keeping the progress honest on fast & slow devices alike (0 to flush at a fixed interval, the default with --profile)")
+	fs.IntVar(&a.retries, "retries", 3, "times to retry opening, reading or writing when it fails with a transient error (failed flushes are never retried)")
+	fs.DurationVar(&a.retryBackoff, "retry-backoff", 500*time.Millisecond, "how long to wait before the first retry, doubling each retry")
+	fs.DurationVar(&a.retryMax, "retry-max-backoff", 30*time.Second, "the longest to wait between retries")
+	fs.StringVar(&a.retryOn, "retry-on", strings.Join(internal.DefaultTransientErrors, ","), "comma separated errors to retry on, from EIO, EAGAIN, ETIMEDOUT, EINTR, EBUSY & ENXIO")
+	a.endpoints.register(fs)
+	positional := parseArgs(fs, args)
+	if a.profile != "" && !isSet(fs, "sync-gap") {
+		// the profile's flush interval is kept unless asked otherwise
+		a.syncGap = 0
+	}
+	if a.from == "" && len(positional) > 0 {
+		a.from, positional = positional[0], positional[1:]
+	}
+	if a.to == "" && len(positional) > 0 {
+		a.to, positional = positional[0], positional[1:]
+	}
+	if len(positional) > 0 {
+		panic(fmt.Sprintf("Unexpected arguments %v", positional))
+	}
 	if a.from == "" {
 		panic("Must have from argument")
 	}
 	if a.to == "" {
 		panic("Must have to argument")
 	}
+	if a.compress != "" && !slices.Contains(internal.Compressions, a.compress) {
+		panic(fmt.Sprintf("Unknown compression %s, should be one of %v", a.compress, internal.Compressions))
+	}
 	return a
 }
+
+// retryPolicy returns the policy for retrying given by the arguments
+func (a arguments) retryPolicy() internal.RetryPolicy {
+	transient, err := internal.ParseTransientErrors(a.retryOn)
+	if err != nil {
+		panic(err)
+	}
+	return internal.RetryPolicy{
+		Retries:    a.retries,
+		Backoff:    a.retryBackoff,
+		MaxBackoff: a.retryMax,
+		Transient:  transient,
+	}
+}
+
+// filter returns the filter for directory entries given by the arguments
+func (a arguments) filter() internal.Filter {
+	f := internal.Filter{Rules: a.filterRules, IgnoreFile: a.ignoreFile, ExcludeCaches: a.excludeCaches}
+	if a.minSize != "" {
+		f.MinSizeBytes = parseSize(a.minSize)
+	}
+	if a.maxSize != "" {
+		f.MaxSizeBytes = parseSize(a.maxSize)
+	}
+	if a.newerThan != "" {
+		var err error
+		f.NewerThan, err = internal.ParseNewerThan(a.newerThan, time.Now())
+		if err != nil {
+			panic(err)
+		}
+	}
+	return f
+}
+
+// profile reads the profile called name, any settings
+// it doesn't give being left at their defaults
+func profile(name string) internal.Profile {
+	path, err := internal.ProfilePath(name)
+	if err != nil {
+		panic(err)
+	}
+	p, err := internal.ReadProfile(path)
+	if err != nil {
+		panic(err)
+	}
+	if p.BufferSizeBytes == 0 {
+		p.BufferSizeBytes = bufferSizeBytes
+	}
+	return p
+}
+
+// archiveTime returns the time to give every entry in an archive,
+// that in $SOURCE_DATE_EPOCH (or the epoch itself) if reproducible,
+// else nil, for the actual modification times to be kept
+func archiveTime(reproducible bool) *time.Time {
+	if !reproducible {
+		return nil
+	}
+	seconds := int64(0)
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch != "" {
+		var err error
+		seconds, err = strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			panic(fmt.Sprintf("SOURCE_DATE_EPOCH %s is not a number of seconds", epoch))
+		}
+	}
+	return internal.From(time.Unix(seconds, 0).UTC())
+}
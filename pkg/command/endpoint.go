@@ -0,0 +1,52 @@
+package command
+
+import (
+	"flag"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+// endpointArguments are the arguments configuring
+// access to sources & destinations which aren't local
+type endpointArguments struct {
+	segments      int
+	header        headerFlag
+	sshKey        string
+	knownHosts    string
+	s3Endpoint    string
+	s3Region      string
+	tlsCA         string
+	tlsCert       string
+	tlsKey        string
+	remoteCommand string
+}
+
+// register adds the flags for the endpoint arguments to fs
+func (ea *endpointArguments) register(fs *flag.FlagSet) {
+	fs.IntVar(&ea.segments, "segments", 1, "number of segments of an http(s) source to download in parallel")
+	fs.Var(&ea.header, "header", "header to add to http(s) requests, as \"Name: value\", may be repeated")
+	fs.StringVar(&ea.sshKey, "ssh-key", "", "private key to authenticate to sftp servers with, as well as those in the ssh agent (default the keys in ~/.ssh)")
+	fs.StringVar(&ea.knownHosts, "known-hosts", "", "known hosts file to check sftp servers' keys against (default ~/.ssh/known_hosts)")
+	fs.StringVar(&ea.s3Endpoint, "s3-endpoint", "", "URL of the S3 compatible service for s3 URLs (default $AWS_ENDPOINT_URL or AWS)")
+	fs.StringVar(&ea.s3Region, "s3-region", "", "region of the S3 service (default $AWS_REGION or us-east-1)")
+	fs.StringVar(&ea.tlsCA, "tls-ca", "", "CA certificate to trust go-copy servers (gocopys URLs) with (default the system's)")
+	fs.StringVar(&ea.tlsCert, "tls-cert", "", "certificate to identify this client to go-copy servers with")
+	fs.StringVar(&ea.tlsKey, "tls-key", "", "key for --tls-cert")
+	fs.StringVar(&ea.remoteCommand, "remote-command", internal.DefaultRemoteCommand, "command run to reach go-copy serve --stdio for ssh URLs, with {destination}, {host}, {user} & {port} replaced from the URL")
+}
+
+// options returns the endpoint options given by the arguments
+func (ea *endpointArguments) options() internal.EndpointOptions {
+	return internal.EndpointOptions{
+		HTTPSegments:      ea.segments,
+		HTTPHeader:        ea.header.h,
+		SSHKeyFile:        ea.sshKey,
+		SSHKnownHostsFile: ea.knownHosts,
+		S3Endpoint:        ea.s3Endpoint,
+		S3Region:          ea.s3Region,
+		TLSCAFile:         ea.tlsCA,
+		TLSCertFile:       ea.tlsCert,
+		TLSKeyFile:        ea.tlsKey,
+		RemoteCommand:     ea.remoteCommand,
+	}
+}
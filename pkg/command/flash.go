@@ -0,0 +1,50 @@
+package command
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/copy"
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+// Flash implements the flash command, writing an image to a removable
+// drive once checked & confirmed, then reading it back to verify it,
+// args being the arguments after "flash"
+func Flash(args []string) {
+	fs := newFlagSet("flash", "IMAGE DEVICE", "Writes IMAGE (decompressing it if it's compressed) to DEVICE, a whole removable drive which isn't in use, once confirmed, then reads it back to check it.")
+	yes := fs.Bool("yes", false, "don't ask for confirmation before writing")
+	noVerify := fs.Bool("no-verify", false, "don't read the image back from the drive to check it")
+	syncGap := fs.Duration("sync-gap", time.Second, "adjust how often written bytes are flushed so each flush takes about this long (0 to flush at a fixed interval)")
+	paths := parseArgs(fs, args)
+	if len(paths) != 2 {
+		panic("Must give the image & the device to flash it to")
+	}
+	image, device := paths[0], paths[1]
+	flashed := copy.Flash(image, device, copy.FlashOptions{
+		Options: copy.Options{
+			BufferSizeBytes: bufferSizeBytes,
+			SyncEachBytes:   syncEachBytes,
+			SyncGap:         *syncGap,
+		},
+		Drives: internal.DefaultDrives,
+		Confirm: func(d internal.Drive) bool {
+			fmt.Fprintf(os.Stderr, "%s is %s\n", device, d.Describe())
+			if *yes {
+				return true
+			}
+			fmt.Fprintf(os.Stderr, "Everything on it will be lost. Type yes to write %s to it: ", image)
+			answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			return strings.TrimSpace(answer) == "yes"
+		},
+		SkipVerify: *noVerify,
+	})
+	if !flashed {
+		fmt.Fprintln(os.Stderr, "Not flashed")
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Flashed %s to %s\n", image, device)
+}
@@ -0,0 +1,35 @@
+package command
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// headerFlag collects repeated --header "Name: value"
+// flags into http headers
+type headerFlag struct {
+	h http.Header
+}
+
+// String implements flag.Value on headerFlag
+func (hf *headerFlag) String() string {
+	if hf.h == nil {
+		return ""
+	}
+	return fmt.Sprint(hf.h)
+}
+
+// Set implements flag.Value on headerFlag,
+// adding the header given as "Name: value"
+func (hf *headerFlag) Set(s string) error {
+	name, value, found := strings.Cut(s, ":")
+	if !found || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("header %s should be like Name: value", s)
+	}
+	if hf.h == nil {
+		hf.h = make(http.Header)
+	}
+	hf.h.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	return nil
+}
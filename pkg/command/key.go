@@ -0,0 +1,57 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"golang.org/x/term"
+)
+
+// encryptionKey gets the key to encrypt/decrypt with from the key
+// file if given, else the passphrase in the environment variable
+// if given, else by prompting for a passphrase on the terminal
+// (twice when confirm, to catch typos before encrypting).
+// Panics if the key can't be obtained.
+func encryptionKey(keyFile string, passphraseEnv string, confirm bool) internal.Key {
+	if keyFile != "" {
+		k, err := internal.KeyFromFile(keyFile)
+		if err != nil {
+			panic(err)
+		}
+		return k
+	}
+	if passphraseEnv != "" {
+		p, ok := os.LookupEnv(passphraseEnv)
+		if !ok || p == "" {
+			panic(fmt.Sprintf("No passphrase in environment variable %s", passphraseEnv))
+		}
+		return internal.PassphraseKey([]byte(p))
+	}
+	p := promptPassphrase("Passphrase: ")
+	if confirm && !bytes.Equal(p, promptPassphrase("Confirm passphrase: ")) {
+		panic("Passphrases did not match")
+	}
+	return internal.PassphraseKey(p)
+}
+
+// promptPassphrase asks for a passphrase on the terminal
+// (not stdin, which may be the copy source) without echoing it
+func promptPassphrase(prompt string) []byte {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		panic(fmt.Sprintf("No terminal to prompt for passphrase on, use a key file or environment variable: %v", err))
+	}
+	defer tty.Close()
+	fmt.Fprint(tty, prompt)
+	p, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		panic(err)
+	}
+	if len(p) == 0 {
+		panic("Passphrase must not be empty")
+	}
+	return p
+}
@@ -0,0 +1,43 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/copy"
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+// printPlan prints what a copy would do, item by item, then totalled
+// as du does, whether it would fit & how long it would take at
+// throughput bytes per second (0 if that's unknown), exiting
+// with status 1 if it's known not to fit
+func printPlan(p copy.Plan, throughput uint64) {
+	for _, i := range p.Items {
+		fmt.Printf("%-10s %10s  %s\n", i.Action, internal.FormatSize(i.Bytes), filepath.Join(p.To, filepath.FromSlash(i.Path)))
+	}
+	fmt.Println()
+	for _, t := range p.Breakdown() {
+		fmt.Printf("%s\t%s\n", internal.FormatSize(t.Bytes), filepath.Join(p.To, filepath.FromSlash(t.Path)))
+	}
+	fmt.Printf("%s\ttotal\n\n", internal.FormatSize(p.ToCopy()))
+	for _, a := range []copy.Action{copy.Create, copy.Overwrite, copy.Skip} {
+		fmt.Printf("%-10s %6d %10s\n", a, p.Count(a), internal.FormatSize(p.Bytes(a)))
+	}
+	if p.FreeBytes == nil {
+		fmt.Printf("Needs %s, the space free at %s is unknown\n", internal.FormatSize(p.NeededBytes()), p.To)
+	} else {
+		fmt.Printf("Needs %s, %s free at %s\n", internal.FormatSize(p.NeededBytes()), internal.FormatSize(*p.FreeBytes), p.To)
+	}
+	if throughput != 0 {
+		fmt.Printf("Would take about %s at %s/s\n", p.Duration(throughput).Round(time.Second), internal.FormatSize(throughput))
+	} else {
+		fmt.Println("How long it would take is unknown, as no throughput was given with --throughput or measured by bench for --profile")
+	}
+	if !p.Fits() {
+		fmt.Fprintf(os.Stderr, "Not enough space free at %s\n", p.To)
+		os.Exit(1)
+	}
+}
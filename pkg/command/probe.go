@@ -0,0 +1,80 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+// Probe implements the probe command, printing what go-copy makes
+// of each of the paths in args (the arguments after "probe"),
+// the kind of source or destination & its size where known
+func Probe(args []string) {
+	var endpoints endpointArguments
+	fs := newFlagSet("probe", "PATH...", "Shows what kind of source or destination each PATH is, and its size if it exists.")
+	endpoints.register(fs)
+	paths := parseArgs(fs, args)
+	if len(paths) == 0 {
+		panic("Must give at least one path to probe")
+	}
+	for _, p := range paths {
+		kind := internal.EndpointKind(p)
+		fmt.Printf("%s\n  kind: %s\n", p, kind)
+		if compression, ok := internal.TarCompression(p); ok {
+			if compression == "" {
+				compression = "none"
+			}
+			fmt.Printf("  archive: tar (compression %s)\n", compression)
+		}
+		if internal.IsZip(p) {
+			fmt.Println("  archive: zip")
+		}
+		switch kind {
+		case "missing local file", "inaccessible local file", "standard stream":
+			continue
+		case "local directory":
+			probeTree(p)
+			continue
+		case "local block device":
+			probeDevice(p)
+		}
+		size := internal.EstimatedSizeOf(internal.SourceFor(p, endpoints.options()))
+		if size == 0 {
+			fmt.Println("  size: unknown")
+			continue
+		}
+		fmt.Printf("  size: %s (%d bytes)\n", internal.FormatSize(size), size)
+	}
+}
+
+// probeTree prints the number of files in
+// the local directory root & their total size
+func probeTree(root string) {
+	entries, err := internal.WalkTree(root)
+	if err != nil {
+		panic(err)
+	}
+	files, total := 0, uint64(0)
+	for _, e := range entries {
+		if e.Info.Mode().IsRegular() {
+			files++
+			total += uint64(e.Info.Size())
+		}
+	}
+	fmt.Printf("  files: %d\n  size: %s (%d bytes)\n", files, internal.FormatSize(total), total)
+}
+
+// probeDevice prints the logical block size of the block device at path
+func probeDevice(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	device, err := internal.DeviceOf(f)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("  logical block size: %d bytes\n", device.LogicalBlockSize)
+}
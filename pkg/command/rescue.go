@@ -0,0 +1,52 @@
+package command
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/snasphysicist/go-copy/pkg/copy"
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+// Rescue implements the rescue command, copying what can be read
+// of a failing local file or device, as ddrescue does, args being
+// the arguments after "rescue"
+func Rescue(args []string) {
+	fs := newFlagSet("rescue", "FROM TO", "Copies what can be read of FROM, a failing local file or device, into TO, filling what can't be read. Run again with the same map to retry only what's left.")
+	mapFile := fs.String("map", "", "map of what's been rescued & what's bad, in ddrescue's format, read at the start if it exists (default TO.map)")
+	blockSize := fs.String("block-size", "1mb", "how much to read at once, until a read fails")
+	sectorSize := fs.String("sector-size", "512", "the smallest amount the source can read, read one at a time around errors")
+	fill := fs.String("fill", "00", "hex pattern to fill what can't be read with")
+	retryPasses := fs.Int("retry-passes", 1, "times to retry what can't be read, once everything has been tried")
+	paths := parseArgs(fs, args)
+	if len(paths) != 2 {
+		panic("Must give the source to rescue & where to rescue it to")
+	}
+	if *mapFile == "" {
+		*mapFile = paths[1] + ".map"
+	}
+	pattern, err := hex.DecodeString(*fill)
+	if err != nil {
+		panic(fmt.Sprintf("fill %s is not hex: %v", *fill, err))
+	}
+	m := copy.Rescue(paths[0], paths[1], *mapFile, internal.RescueOptions{
+		BlockSize:   int64(parseSize(*blockSize)),
+		SectorSize:  int64(parseSize(*sectorSize)),
+		Fill:        pattern,
+		RetryPasses: *retryPasses,
+	})
+	bad := m.With(internal.Bad)
+	if len(bad) == 0 {
+		fmt.Fprintf(os.Stderr, "Rescued all of %s\n", internal.FormatSize(uint64(m.Size())))
+		return
+	}
+	fmt.Fprintf(
+		os.Stderr,
+		"Rescued %s, %s in %d ranges could not be read (listed in %s)\n",
+		internal.FormatSize(uint64(m.Bytes(internal.Rescued))),
+		internal.FormatSize(uint64(m.Bytes(internal.Bad))),
+		len(bad),
+		*mapFile,
+	)
+}
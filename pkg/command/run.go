@@ -0,0 +1,130 @@
+package command
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// subcommand is an operation go-copy can carry out,
+// given as the first argument, e.g. go-copy verify
+type subcommand struct {
+	name string
+	// summary describes what the command does in a line
+	summary string
+	// run runs the command with the arguments after its name
+	run func(args []string)
+}
+
+// subcommands returns all of the subcommands, in the order listed in help
+func subcommands() []subcommand {
+	return []subcommand{
+		{name: "copy", summary: "copy a file or directory (the default, if only flags are given)", run: Copy},
+		{name: "flash", summary: "write an image to a removable drive & verify it", run: Flash},
+		{name: "rescue", summary: "copy what can be read of a failing disk, as ddrescue does", run: Rescue},
+		{name: "sum", summary: "print or check checksums of files, as sha256sum etc. do", run: Sum},
+		{name: "verify", summary: "check a directory against a manifest written by a copy", run: Verify},
+		{name: "bench", summary: "find the buffer & flush settings which suit a device", run: Bench},
+		{name: "serve", summary: "serve directories to go-copy clients", run: Serve},
+		{name: "probe", summary: "show what go-copy makes of sources & destinations", run: Probe},
+		{name: "version", summary: "show the version of go-copy", run: Version},
+	}
+}
+
+// Run runs the subcommand named by the first of args, the arguments
+// after the program name. For compatibility with before there were
+// subcommands, arguments starting with a flag are given to copy.
+func Run(args []string) {
+	if len(args) == 0 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	name := args[0]
+	switch {
+	case name == "-h" || name == "-help" || name == "--help":
+		usage(os.Stdout)
+		return
+	case name == "help":
+		help(args[1:])
+		return
+	case strings.HasPrefix(name, "-"):
+		Copy(args)
+		return
+	}
+	for _, c := range subcommands() {
+		if c.name == name {
+			c.run(args[1:])
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "go-copy: unknown command %s\n\n", name)
+	usage(os.Stderr)
+	os.Exit(2)
+}
+
+// help prints the help for the command named in args, or
+// the list of commands if there isn't one
+func help(args []string) {
+	if len(args) == 0 {
+		usage(os.Stdout)
+		return
+	}
+	for _, c := range subcommands() {
+		if c.name == args[0] {
+			c.run([]string{"-h"})
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "go-copy: unknown command %s\n", args[0])
+	os.Exit(2)
+}
+
+// usage prints the list of commands to f
+func usage(f *os.File) {
+	fmt.Fprint(f, "Usage: go-copy <command> [arguments]\n\nCommands:\n")
+	for _, c := range subcommands() {
+		fmt.Fprintf(f, "  %-8s %s\n", c.name, c.summary)
+	}
+	fmt.Fprint(f, "\nRun go-copy help <command> for the arguments of each command.\n")
+}
+
+// newFlagSet creates the flags for the command called name,
+// whose help shows its positional arguments & describes it
+func newFlagSet(name string, positional string, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: go-copy %s [flags] %s\n\n%s\n\nFlags:\n", name, positional, description)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses args with fs, allowing flags to come
+// after positional arguments (until a --), returning
+// the positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	positional := make([]string, 0)
+	for {
+		_ = fs.Parse(args)
+		rest := fs.Args()
+		consumed := len(args) - len(rest)
+		if consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...)
+		}
+		if len(rest) == 0 {
+			return positional
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// isSet returns true if the flag called name was given in fs
+func isSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
@@ -0,0 +1,88 @@
+package command
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+// testFlagSet returns flags with a string flag called name
+// & a bool flag called verbose, for testing parseArgs
+func testFlagSet() (*flag.FlagSet, *string, *bool) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	name := fs.String("name", "", "")
+	verbose := fs.Bool("verbose", false, "")
+	return fs, name, verbose
+}
+
+func TestParseArgsAllowsFlagsAfterPositionalArguments(t *testing.T) {
+	for description, c := range map[string]struct {
+		args       []string
+		positional []string
+		name       string
+		verbose    bool
+	}{
+		"flags only":                 {args: []string{"--name", "n", "--verbose"}, positional: []string{}, name: "n", verbose: true},
+		"flags first":                {args: []string{"--name", "n", "a", "b"}, positional: []string{"a", "b"}, name: "n"},
+		"flags after":                {args: []string{"a", "b", "--name", "n", "--verbose"}, positional: []string{"a", "b"}, name: "n", verbose: true},
+		"flags between":              {args: []string{"a", "--verbose", "b"}, positional: []string{"a", "b"}, verbose: true},
+		"dash as positional":         {args: []string{"-", "b", "--name", "n"}, positional: []string{"-", "b"}, name: "n"},
+		"double dash ends flags":     {args: []string{"a", "--", "--name", "n"}, positional: []string{"a", "--name", "n"}},
+		"flags before double dash":   {args: []string{"--verbose", "--", "-b"}, positional: []string{"-b"}, verbose: true},
+		"no arguments":               {args: []string{}, positional: []string{}},
+		"double dash with no others": {args: []string{"--"}, positional: []string{}},
+	} {
+		t.Run(description, func(t *testing.T) {
+			fs, name, verbose := testFlagSet()
+			positional := parseArgs(fs, c.args)
+			if !reflect.DeepEqual(positional, c.positional) {
+				t.Errorf("Positional arguments %q, expected %q", positional, c.positional)
+			}
+			if *name != c.name || *verbose != c.verbose {
+				t.Errorf("Flags name %q verbose %t, expected %q & %t", *name, *verbose, c.name, c.verbose)
+			}
+		})
+	}
+}
+
+func TestParseFlagsTakesSourceAndDestinationFromFlagsOrPositionally(t *testing.T) {
+	for description, c := range map[string]struct {
+		args     []string
+		from, to string
+		update   bool
+	}{
+		"flags only, as before subcommands": {args: []string{"--from", "a", "--to", "b", "--update"}, from: "a", to: "b", update: true},
+		"positional":                        {args: []string{"a", "b"}, from: "a", to: "b"},
+		"flags after positional":            {args: []string{"a", "b", "--update"}, from: "a", to: "b", update: true},
+		"from flag & positional":            {args: []string{"--from", "a", "b"}, from: "a", to: "b"},
+		"to flag & positional":              {args: []string{"--to", "b", "a"}, from: "a", to: "b"},
+		"stdin to stdout":                   {args: []string{"-", "-"}, from: "-", to: "-"},
+		"destination after double dash":     {args: []string{"--update", "a", "--", "--b"}, from: "a", to: "--b", update: true},
+	} {
+		t.Run(description, func(t *testing.T) {
+			a := parseFlags(c.args)
+			if a.from != c.from || a.to != c.to || a.update != c.update {
+				t.Errorf("From %q to %q update %t, expected %q to %q update %t", a.from, a.to, a.update, c.from, c.to, c.update)
+			}
+		})
+	}
+}
+
+func TestParseFlagsPanicsOnMissingExtraOrInvalidArguments(t *testing.T) {
+	for description, args := range map[string][]string{
+		"nothing":          {},
+		"no destination":   {"a"},
+		"extra positional": {"a", "b", "c"},
+		"extra after flag": {"--from", "a", "--to", "b", "c"},
+		"unknown compress": {"--compress", "zip", "a", "b"},
+	} {
+		t.Run(description, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("No panic parsing %q", args)
+				}
+			}()
+			parseFlags(args)
+		})
+	}
+}
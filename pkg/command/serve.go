@@ -0,0 +1,101 @@
+package command
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+// Serve implements the serve command, serving the exported
+// directories to go-copy clients over the go-copy protocol
+// until killed, args being the arguments after "serve"
+func Serve(args []string) {
+	fs := newFlagSet("serve", "", "Serves directories to go-copy clients over gocopy(s) URLs, or a single session over stdin & stdout for ssh URLs.")
+	listen := fs.String("listen", "127.0.0.1:7070", "address to listen for go-copy clients on, only this machine by default, as clients are only authenticated with --tls-client-ca")
+	var exports exportFlag
+	fs.Var(&exports, "export", "directory to serve as name=dir, with :rw appended to allow writing, may be repeated")
+	tlsCert := fs.String("tls-cert", "", "certificate to serve TLS (gocopys URLs) with")
+	tlsKey := fs.String("tls-key", "", "key for --tls-cert")
+	tlsClientCA := fs.String("tls-client-ca", "", "CA certificate clients must present certificates signed by (mutual TLS)")
+	stdio := fs.Bool("stdio", false, "serve a single session over stdin & stdout (as run for ssh URLs), by default exporting the whole filesystem with ~ as the home directory")
+	if len(parseArgs(fs, args)) > 0 {
+		panic("serve takes no arguments, directories are given with --export")
+	}
+	if *stdio {
+		serveStdio(exports.e)
+		return
+	}
+	if len(exports.e) == 0 {
+		panic("Must export at least one directory")
+	}
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		panic(err)
+	}
+	if *tlsCert != "" {
+		config, err := internal.ServerTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			panic(err)
+		}
+		l = tls.NewListener(l, config)
+	}
+	log.Printf("Serving %s on %s", exports.String(), l.Addr())
+	err = internal.NewServer(exports.e, bufferSizeBytes, syncEachBytes).Serve(l)
+	if err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+}
+
+// serveStdio serves a single session over stdin & stdout, of
+// exports if any are given, otherwise of the whole filesystem
+// with the home directory as the export ~
+func serveStdio(exports []internal.Export) {
+	if len(exports) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			panic(err)
+		}
+		exports = []internal.Export{
+			{Name: "", Dir: "/", Writable: true},
+			{Name: "~", Dir: home, Writable: true},
+		}
+	}
+	// stdout is the session, errors are sent to the client in it
+	log.SetOutput(io.Discard)
+	internal.NewServer(exports, bufferSizeBytes, syncEachBytes).ServeConn(internal.StdioConn())
+}
+
+// exportFlag collects repeated --export flags
+type exportFlag struct {
+	e []internal.Export
+}
+
+// String implements flag.Value on exportFlag
+func (ef *exportFlag) String() string {
+	s := make([]string, 0, len(ef.e))
+	for _, e := range ef.e {
+		mode := "ro"
+		if e.Writable {
+			mode = "rw"
+		}
+		s = append(s, e.Name+"="+e.Dir+":"+mode)
+	}
+	return strings.Join(s, " ")
+}
+
+// Set implements flag.Value on exportFlag,
+// adding the export given as name=dir[:rw]
+func (ef *exportFlag) Set(s string) error {
+	e, err := internal.ParseExport(s)
+	if err != nil {
+		return err
+	}
+	ef.e = append(ef.e, e)
+	return nil
+}
@@ -0,0 +1,128 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+// Sum implements the sum command, hashing files (in parallel) with
+// progress & printing their checksums as coreutils' md5sum, sha256sum
+// etc. do, or checking the checksums in files written by them with -c,
+// args being the arguments after "sum". Exits with status 1 if any
+// file can't be read or (when checking) doesn't match its checksum.
+func Sum(args []string) {
+	fs := newFlagSet("sum", "FILE...", "Prints the checksums of each FILE (- for stdin), or with -c checks the checksums listed in each FILE.")
+	algorithm := fs.String("a", internal.SHA256, fmt.Sprintf("hash algorithm, one of %v", internal.HashAlgorithms))
+	check := fs.Bool("c", false, "read checksums from the FILEs (in GNU or BSD format) and check them")
+	tag := fs.Bool("tag", false, "print checksums in BSD format, ALGORITHM (FILE) = SUM")
+	quiet := fs.Bool("quiet", false, "when checking, don't print OK for each file which matches")
+	workers := fs.Int("workers", runtime.NumCPU(), "number of files to hash in parallel")
+	paths := parseArgs(fs, args)
+	_, err := internal.NewHash(*algorithm)
+	if err != nil {
+		panic(err)
+	}
+	if len(paths) == 0 {
+		panic("Must give at least one file")
+	}
+	if *check {
+		checkSums(paths, *algorithm, *workers, *quiet)
+		return
+	}
+	files := make([]internal.Checksum, 0, len(paths))
+	for _, p := range paths {
+		files = append(files, internal.Checksum{Path: p, Algorithm: *algorithm})
+	}
+	failed := false
+	for _, r := range hashWithProgress(files, *workers) {
+		if r.Err != nil {
+			fmt.Fprintf(os.Stderr, "go-copy: %s: %v\n", r.Checksum.Path, r.Err)
+			failed = true
+			continue
+		}
+		fmt.Println(internal.FormatChecksum(r.Checksum, *tag))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// checkSums checks the checksums in the files listed in paths,
+// lines in GNU format being taken to be hashed with algorithm
+func checkSums(paths []string, algorithm string, workers int, quiet bool) {
+	expected := make([]internal.Checksum, 0)
+	improper := 0
+	for _, p := range paths {
+		f := os.Stdin
+		if p != internal.StandardStream {
+			var err error
+			f, err = os.Open(p)
+			if err != nil {
+				panic(err)
+			}
+		}
+		checksums, n, err := internal.ReadChecksums(f, algorithm)
+		_ = f.Close()
+		if err != nil {
+			panic(err)
+		}
+		if len(checksums) == 0 {
+			fmt.Fprintf(os.Stderr, "go-copy: %s: no properly formatted checksum lines found\n", p)
+			os.Exit(1)
+		}
+		expected = append(expected, checksums...)
+		improper += n
+	}
+	mismatched, unreadable := 0, 0
+	for i, r := range hashWithProgress(expected, workers) {
+		switch {
+		case r.Err != nil:
+			fmt.Fprintf(os.Stderr, "go-copy: %s: %v\n", r.Checksum.Path, r.Err)
+			fmt.Printf("%s: FAILED open or read\n", r.Checksum.Path)
+			unreadable++
+		case r.Checksum.Sum != expected[i].Sum:
+			fmt.Printf("%s: FAILED\n", r.Checksum.Path)
+			mismatched++
+		case !quiet:
+			fmt.Printf("%s: OK\n", r.Checksum.Path)
+		}
+	}
+	if improper > 0 {
+		fmt.Fprintf(os.Stderr, "go-copy: WARNING: %d lines are improperly formatted\n", improper)
+	}
+	if unreadable > 0 {
+		fmt.Fprintf(os.Stderr, "go-copy: WARNING: %d listed files could not be read\n", unreadable)
+	}
+	if mismatched > 0 {
+		fmt.Fprintf(os.Stderr, "go-copy: WARNING: %d computed checksums did NOT match\n", mismatched)
+	}
+	if unreadable > 0 || mismatched > 0 {
+		os.Exit(1)
+	}
+}
+
+// hashWithProgress hashes files with internal.HashFiles,
+// reporting progress against their total size
+func hashWithProgress(files []internal.Checksum, workers int) []internal.HashResult {
+	total := uint64(0)
+	for _, f := range files {
+		info, err := os.Stat(f.Path)
+		if err == nil && info.Mode().IsRegular() {
+			total += uint64(info.Size())
+		}
+	}
+
+	shutdown := make(chan struct{})
+	pr := internal.NewProgressReporter(total, shutdown)
+	go pr.Report(time.Now())
+
+	results := internal.HashFiles(files, workers, &pr)
+
+	close(shutdown)
+	time.Sleep(10 * time.Millisecond)
+	return results
+}
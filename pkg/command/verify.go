@@ -0,0 +1,50 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+// Verify implements the verify command, re-hashing the files in a
+// directory & checking them against a manifest written by a copy,
+// args being the arguments after "verify". Exits with status 1
+// if any file is missing, extra or doesn't match.
+func Verify(args []string) {
+	fs := newFlagSet("verify", "DIR", "Re-hashes the files in DIR, checking them against a manifest written by a copy.")
+	manifest := fs.String("manifest", "", "manifest to verify against, JSON or SHA256SUMS as written by --manifest or --sha256sums")
+	workers := fs.Int("workers", runtime.NumCPU(), "number of files to hash in parallel")
+	dirs := parseArgs(fs, args)
+	if *manifest == "" {
+		panic("Must have manifest argument")
+	}
+	if len(dirs) != 1 {
+		panic("Must give the directory to verify")
+	}
+	m, err := internal.ReadManifest(*manifest)
+	if err != nil {
+		panic(err)
+	}
+	v, err := internal.VerifyWith(dirs[0], m, func(files []internal.Checksum) []internal.HashResult {
+		return hashWithProgress(files, *workers)
+	})
+	if err != nil {
+		panic(err)
+	}
+	for _, p := range v.Missing {
+		fmt.Println("MISSING", p)
+	}
+	for _, p := range v.Extra {
+		fmt.Println("EXTRA", p)
+	}
+	for _, p := range v.Mismatched {
+		fmt.Println("MISMATCHED", p)
+	}
+	if !v.OK() {
+		fmt.Fprintf(os.Stderr, "%s does not match manifest %s\n", dirs[0], m.Root)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "All %d files in %s match manifest %s\n", len(m.Files), dirs[0], m.Root)
+}
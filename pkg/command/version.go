@@ -0,0 +1,27 @@
+package command
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is the version of go-copy, set when building
+// releases with -ldflags "-X github.com/snasphysicist/go-copy/pkg/command.version=..."
+var version = "dev"
+
+// Version implements the version command, printing the version
+// of go-copy & what it was built with, args being the
+// arguments after "version" (of which there are none)
+func Version(args []string) {
+	fs := newFlagSet("version", "", "Shows the version of go-copy.")
+	if len(parseArgs(fs, args)) > 0 {
+		panic("version takes no arguments")
+	}
+	v := version
+	if info, ok := debug.ReadBuildInfo(); ok && v == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		// installed with go install, which records the module version
+		v = info.Main.Version
+	}
+	fmt.Printf("go-copy %s %s %s/%s\n", v, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
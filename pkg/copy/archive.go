@@ -0,0 +1,159 @@
+package copy
+
+import (
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+// Archive copies the whole tree under the directory at the from path
+// (except what o.Filter excludes) into a tar or (if to ends in .zip)
+// zip archive at the to path (which may be anything Copy can write
+// to), as configured by o. Entries are archived in lexical order with
+// their permissions, modification times & symlinks, so that the same
+// tree always gives the same archive (given o.ArchiveTime, even if the
+// files are touched). Tar archives are compressed as implied by the
+// suffix of to, unless o.Compress is given, files in zip archives are
+// deflated unless o.ZipStore is set. Panics on any error.
+func Archive(from string, to string, o Options) {
+	entries := walk(from, o)
+	var source source
+	if internal.IsZip(to) {
+		source = internal.NewZipSource(from, entries, o.ArchiveTime, o.ZipStore)
+	} else {
+		if o.Compress == "" {
+			o.Compress, _ = internal.TarCompression(to)
+		}
+		source = internal.NewTarSource(from, entries, o.ArchiveTime)
+	}
+	s := internal.EstimatedSizeOf(source)
+
+	shutdown := make(chan struct{})
+	pr := internal.NewProgressReporter(s, shutdown)
+	go pr.Report(time.Now())
+
+	transfer(source, s, func(size uint64) target { return internal.TargetFor(to, size, o.Endpoints) }, &pr, o)
+
+	close(shutdown)
+	time.Sleep(10 * time.Millisecond)
+}
+
+// Extract extracts the tar archive (compressed or not) at the from path
+// (which may be anything Copy can read from), or the zip archive if from
+// ends in .zip (which must be a local file), into the directory at the
+// to path (which may be anything Tree can copy to), as configured by o.
+// The content of zip entries is checked against their CRC-32s.
+// Each file is written & flushed as in any other copy, preserving
+// permissions, modification times & symlinks (where the target supports
+// them). Progress is reported for the archive as a whole, as well as
+// for the file being extracted. Panics on any error.
+func Extract(from string, to string, o Options) {
+	source := internal.SourceFor(from, o.Endpoints)
+	s := o.SizeBytes
+	if s == 0 {
+		s = internal.EstimatedSizeOf(source)
+	}
+	destination := internal.TreeTargetFor(to, o.Endpoints)
+
+	shutdown := make(chan struct{})
+	pr := internal.NewProgressReporter(s, shutdown)
+	pr.TrackSource()
+	go pr.Report(time.Now())
+
+	consumption := &pr
+	if o.Decrypt {
+		source = internal.NewDecryptingSource(source, o.Key, consumption)
+		consumption = nil
+	}
+	archive := internal.ArchiveFor(from, source, consumption)
+	err := archive.Open()
+	if err != nil {
+		panic(err)
+	}
+	defer archive.Close()
+	// each entry is copied as configured, except that the archive
+	// as a whole has already been decrypted & decompressed
+	entryOptions := o
+	entryOptions.Decrypt = false
+	entryOptions.Decompress = false
+
+	err = destination.Mkdir("")
+	if err != nil {
+		panic(err)
+	}
+	directories := make([]internal.TreeEntry, 0)
+	made := map[string]bool{".": true}
+	for {
+		e, link, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+		// archives often leave out the entries of the
+		// directories their files & symlinks are in
+		if !e.Info.IsDir() {
+			mkdirParents(destination, e.Path, made)
+		}
+		switch {
+		case e.Info.IsDir():
+			err = destination.Mkdir(e.Path)
+			made[e.Path] = true
+			directories = append(directories, e)
+		case e.Info.Mode()&os.ModeSymlink != 0:
+			err = destination.Symlink(e.Path, link)
+		case e.Info.Mode().IsRegular():
+			path := e.Path
+			pr.ReportItem(path, uint64(e.Info.Size()))
+			transfer(
+				archive.Entry(),
+				uint64(e.Info.Size()),
+				func(size uint64) target { return destination.File(path, size) },
+				&pr,
+				entryOptions,
+			)
+			err = destination.Finish(e.Path, e.Info)
+		default:
+			log.Printf("WARNING: skipping %s, which is not a file, directory or symlink", e.Path)
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	// directories last, deepest first, as adding their
+	// contents changes their modification times
+	for i := len(directories) - 1; i >= 0; i-- {
+		err = destination.Finish(directories[i].Path, directories[i].Info)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	close(shutdown)
+	time.Sleep(10 * time.Millisecond)
+}
+
+// mkdirParents creates the directories at destination which the entry
+// at p (relative to its root) is in, except those already in made
+func mkdirParents(destination mkdirer, p string, made map[string]bool) {
+	dir := path.Dir(p)
+	if made[dir] {
+		return
+	}
+	mkdirParents(destination, dir, made)
+	err := destination.Mkdir(dir)
+	if err != nil {
+		panic(err)
+	}
+	made[dir] = true
+}
+
+// mkdirer is the part of a tree target which creates directories
+type mkdirer interface {
+	Mkdir(path string) error
+}
@@ -0,0 +1,134 @@
+package copy_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/copy"
+)
+
+func TestArchiveThenExtractRoundTripsTree(t *testing.T) {
+	for _, name := range []string{"backup.tar", "backup.tar.gz", "backup.tar.zst", "backup.tar.xz", "backup.zip"} {
+		files := testTree()
+		from := t.TempDir()
+		writeTree(t, from, files)
+		mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+		_ = os.Chmod(filepath.Join(from, "top.bin"), 0600)
+		_ = os.Chtimes(filepath.Join(from, "top.bin"), mtime, mtime)
+		_ = os.Symlink("top.bin", filepath.Join(from, "link"))
+		archive := filepath.Join(t.TempDir(), name)
+		copy.Copy(from, archive, copy.Options{BufferSizeBytes: 500, SyncEachBytes: 1000})
+		to := filepath.Join(t.TempDir(), "extracted")
+		copy.Copy(archive, to, copy.Options{BufferSizeBytes: 500, SyncEachBytes: 1000, Extract: true})
+		for path, content := range files {
+			written, err := os.ReadFile(filepath.Join(to, filepath.FromSlash(path)))
+			if err != nil {
+				t.Errorf("Failed to read extracted %s from %s with %v", path, name, err)
+			}
+			if !reflect.DeepEqual(content, written) && len(content) != 0 {
+				t.Errorf("Extracted content of %s from %s did not match source", path, name)
+			}
+		}
+		info, err := os.Stat(filepath.Join(to, "top.bin"))
+		if err != nil {
+			t.Fatalf("Failed to stat extracted file with %v", err)
+		}
+		if info.Mode().Perm() != 0600 || !info.ModTime().Equal(mtime) {
+			t.Errorf("Extracted file has mode %v & modification time %v, expected 0600 & %v", info.Mode(), info.ModTime(), mtime)
+		}
+		link, err := os.Readlink(filepath.Join(to, "link"))
+		if err != nil || link != "top.bin" {
+			t.Errorf("Extracted symlink links to %s (error %v), expected top.bin", link, err)
+		}
+	}
+}
+
+func TestArchiveIsReproducibleWithArchiveTime(t *testing.T) {
+	files := testTree()
+	from := t.TempDir()
+	writeTree(t, from, files)
+	epoch := time.Unix(0, 0).UTC()
+	o := copy.Options{BufferSizeBytes: 500, SyncEachBytes: 1000, ArchiveTime: &epoch}
+	first := filepath.Join(t.TempDir(), "first.tar.gz")
+	copy.Copy(from, first, o)
+	later := time.Now().Add(time.Hour)
+	for path := range files {
+		_ = os.Chtimes(filepath.Join(from, filepath.FromSlash(path)), later, later)
+	}
+	second := filepath.Join(t.TempDir(), "second.tar.gz")
+	copy.Copy(from, second, o)
+	a, _ := os.ReadFile(first)
+	b, _ := os.ReadFile(second)
+	if len(a) == 0 || !bytes.Equal(a, b) {
+		t.Error("Archives of the same files with a fixed time were not identical")
+	}
+}
+
+func TestExtractKeepsEntriesInsideDestination(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	outside := t.TempDir()
+	entries := []struct {
+		header  tar.Header
+		content string
+	}{
+		{tar.Header{Name: "../../escaped", Mode: 0644, Size: 4}, "up.."},
+		{tar.Header{Name: "/absolute", Mode: 0644, Size: 4}, "abs!"},
+		{tar.Header{Name: "out", Typeflag: tar.TypeSymlink, Linkname: outside}, ""},
+		{tar.Header{Name: "out/through", Mode: 0644, Size: 4}, "evil"},
+		{tar.Header{Name: "out", Mode: 0644, Size: 4}, "over"},
+	}
+	for _, e := range entries {
+		_ = tw.WriteHeader(&e.header)
+		_, _ = tw.Write([]byte(e.content))
+	}
+	_ = tw.Close()
+	from := filepath.Join(t.TempDir(), "evil.tar")
+	writeFile(from, archive.Bytes())
+	to := filepath.Join(t.TempDir(), "extracted")
+	copy.Copy(from, to, copy.Options{BufferSizeBytes: 500, SyncEachBytes: 1000, Extract: true})
+	for path, content := range map[string]string{"escaped": "up..", "absolute": "abs!"} {
+		written, err := os.ReadFile(filepath.Join(to, path))
+		if err != nil || string(written) != content {
+			t.Errorf("%s extracted as %q (error %v), expected %q inside the destination", path, written, err, content)
+		}
+	}
+	inside, _ := os.ReadDir(outside)
+	if len(inside) != 0 {
+		t.Errorf("%d entries were extracted through a symlink out of the destination", len(inside))
+	}
+}
+
+func TestExtractCreatesDirectoriesArchivesLeaveOut(t *testing.T) {
+	files := map[string]string{"a/b.txt": "in a", "a/c/d.txt": "deeper", "e.txt": "top"}
+	var tarred bytes.Buffer
+	tw := tar.NewWriter(&tarred)
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	for name, content := range files {
+		_ = tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})
+		_, _ = tw.Write([]byte(content))
+		w, _ := zw.Create(name)
+		_, _ = w.Write([]byte(content))
+	}
+	_ = tw.Close()
+	_ = zw.Close()
+	for name, archive := range map[string][]byte{"a.tar": tarred.Bytes(), "a.zip": zipped.Bytes()} {
+		from := filepath.Join(t.TempDir(), name)
+		writeFile(from, archive)
+		to := filepath.Join(t.TempDir(), "out")
+		copy.Copy(from, to, copy.Options{BufferSizeBytes: 500, SyncEachBytes: 1000, Extract: true})
+		for path, content := range files {
+			written, err := os.ReadFile(filepath.Join(to, filepath.FromSlash(path)))
+			if err != nil || string(written) != content {
+				t.Errorf("%s extracted from %s as %q (error %v), expected %q", path, name, written, err, content)
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package copy
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"github.com/snasphysicist/go-copy/pkg/random"
+)
+
+// BenchOptions configures a benchmark run by Bench, which
+// copies synthetic data with every combination of the settings
+type BenchOptions struct {
+	// SizeBytes is how much data is copied with each combination
+	SizeBytes uint64
+	// BufferSizes are the sizes of the buffer between
+	// the reader & the writer to try, in bytes
+	BufferSizes []uint64
+	// WriteBlockSizes are the most bytes written at once to try
+	WriteBlockSizes []uint64
+	// SyncEach are the numbers of bytes written between flushes
+	// to storage to try, 0 meaning flushing is left to the system
+	SyncEach []uint64
+}
+
+// BenchResult is the result of copying with one combination of settings
+type BenchResult struct {
+	Profile internal.Profile
+	// SizeBytes is how much data was copied
+	SizeBytes uint64
+	// Reported is how long it took until the
+	// progress reported everything written
+	Reported time.Duration
+	// Durable is how long it took until everything
+	// written had actually been flushed to storage
+	Durable time.Duration
+}
+
+// Throughput returns the bytes per second which
+// were copied until everything was flushed to storage
+func (br BenchResult) Throughput() float64 {
+	if br.Durable <= 0 {
+		return 0
+	}
+	return float64(br.SizeBytes) / br.Durable.Seconds()
+}
+
+// Gap returns how long the progress reported everything
+// written before it had all been flushed to storage
+func (br BenchResult) Gap() time.Duration {
+	return br.Durable - br.Reported
+}
+
+// Bench copies synthetic data into a file in the local directory dir
+// with every combination of the settings in o, calling done with the
+// result of each as it finishes & returning them all. The file is
+// removed after each copy.
+func Bench(dir string, o BenchOptions, done func(BenchResult)) []BenchResult {
+	path := filepath.Join(dir, ".go-copy-bench")
+	// data which doesn't compress, in case the device compresses
+	block := random.Bytes(1024 * 1024)
+	results := make([]BenchResult, 0)
+	for _, bufferSize := range o.BufferSizes {
+		for _, writeBlock := range o.WriteBlockSizes {
+			for _, syncEach := range o.SyncEach {
+				p := internal.Profile{BufferSizeBytes: bufferSize, WriteBlockBytes: writeBlock, SyncEachBytes: syncEach}
+				r := benchOnce(path, block, p, o.SizeBytes)
+				results = append(results, r)
+				done(r)
+			}
+		}
+	}
+	return results
+}
+
+// benchOnce copies size bytes of the repeated block to
+// the file at path with the settings in p, then removes it
+func benchOnce(path string, block []byte, p internal.Profile, size uint64) BenchResult {
+	defer os.Remove(path)
+	pr := internal.NewProgressReporter(size, nil)
+	start := time.Now()
+	transfer(
+		&syntheticSource{block: block, size: size},
+		size,
+		func(uint64) target { return internal.TargetFor(path, size, internal.EndpointOptions{}) },
+		&pr,
+		Options{BufferSizeBytes: p.BufferSizeBytes, WriteBlockBytes: p.WriteBlockBytes, SyncEachBytes: p.SyncEachBytes},
+	)
+	reported := time.Since(start)
+	f, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	err = f.Sync()
+	if err != nil {
+		panic(err)
+	}
+	return BenchResult{Profile: p, SizeBytes: size, Reported: reported, Durable: time.Since(start)}
+}
+
+// Recommend returns the result with the highest throughput among those
+// whose progress was no more than maxGap ahead of what was flushed to
+// storage, or the one with the smallest gap if none were that close
+func Recommend(results []BenchResult, maxGap time.Duration) BenchResult {
+	var best BenchResult
+	found := false
+	for _, r := range results {
+		if r.Gap() <= maxGap && (!found || r.Throughput() > best.Throughput()) {
+			best = r
+			found = true
+		}
+	}
+	if found {
+		return best
+	}
+	for i, r := range results {
+		if i == 0 || r.Gap() < best.Gap() {
+			best = r
+		}
+	}
+	return best
+}
+
+// syntheticSource is a source of size bytes, block repeated
+type syntheticSource struct {
+	block []byte
+	size  uint64
+	read  uint64
+}
+
+// Open implements source on syntheticSource
+func (ss *syntheticSource) Open() error {
+	ss.read = 0
+	return nil
+}
+
+// Read implements source on syntheticSource
+func (ss *syntheticSource) Read(b []byte) (int, error) {
+	if ss.read == ss.size {
+		return 0, io.EOF
+	}
+	offset := ss.read % uint64(len(ss.block))
+	n := copy(b[:internal.Minimum(uint64(len(b)), ss.size-ss.read)], ss.block[offset:])
+	ss.read += uint64(n)
+	return n, nil
+}
+
+// Close implements source on syntheticSource
+func (ss *syntheticSource) Close() error {
+	return nil
+}
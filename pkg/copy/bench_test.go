@@ -0,0 +1,63 @@
+package copy_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/copy"
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+func TestBenchTriesEveryCombinationAndCleansUp(t *testing.T) {
+	dir := t.TempDir()
+	o := copy.BenchOptions{
+		SizeBytes:       3*1024*1024 + 17,
+		BufferSizes:     []uint64{64 * 1024, 1024 * 1024},
+		WriteBlockSizes: []uint64{1024, 64 * 1024},
+		SyncEach:        []uint64{1024 * 1024, 0},
+	}
+	reported := 0
+	results := copy.Bench(dir, o, func(copy.BenchResult) { reported++ })
+	if len(results) != 8 || reported != 8 {
+		t.Fatalf("Got %d results & %d reported for 8 combinations", len(results), reported)
+	}
+	seen := make(map[internal.Profile]bool)
+	for _, r := range results {
+		seen[r.Profile] = true
+		if r.SizeBytes != o.SizeBytes || r.Throughput() <= 0 || r.Gap() < 0 {
+			t.Errorf("Result %#v has size %d, throughput %f & gap %s", r, r.SizeBytes, r.Throughput(), r.Gap())
+		}
+	}
+	if len(seen) != 8 {
+		t.Errorf("Only %d distinct combinations were tried", len(seen))
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("%d files (error %v) left behind in the benchmarked directory", len(entries), err)
+	}
+}
+
+func TestRecommendPicksFastestWithinGapElseMostHonest(t *testing.T) {
+	result := func(buffer uint64, reported time.Duration, durable time.Duration) copy.BenchResult {
+		return copy.BenchResult{
+			Profile:   internal.Profile{BufferSizeBytes: buffer},
+			SizeBytes: 1000,
+			Reported:  reported,
+			Durable:   durable,
+		}
+	}
+	results := []copy.BenchResult{
+		result(1, 2*time.Second, 2*time.Second),
+		result(2, 1*time.Second, 1500*time.Millisecond),
+		result(3, 100*time.Millisecond, 1200*time.Millisecond),
+	}
+	best := copy.Recommend(results, time.Second)
+	if best.Profile.BufferSizeBytes != 2 {
+		t.Errorf("Recommended %#v, expected the fastest with progress less than 1s ahead", best)
+	}
+	best = copy.Recommend(results, 100*time.Millisecond)
+	if best.Profile.BufferSizeBytes != 1 {
+		t.Errorf("Recommended %#v, expected the one with the smallest gap", best)
+	}
+}
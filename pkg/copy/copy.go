@@ -1,37 +1,219 @@
 package copy
 
 import (
+	"fmt"
+	"io"
 	"time"
 
 	"github.com/snasphysicist/go-copy/pkg/internal"
 )
 
+// Options configures how a copy is carried out
+type Options struct {
+	// BufferSizeBytes is the size of the buffer
+	// between the reader & the writer in bytes
+	BufferSizeBytes uint64
+	// SyncEachBytes is approximately how many bytes
+	// are written between forcing writes to target
+	// durable storage, 0 leaving it to the target
+	SyncEachBytes uint64
+	// SyncGap, if not 0, adapts SyncEachBytes during the
+	// copy so that each sync takes about this long, by measuring
+	// how quickly the target flushes, so the progress is never
+	// much more than SyncGap ahead of what's really been written
+	SyncGap time.Duration
+	// Retry configures retrying reading & writing
+	// when they fail with transient errors
+	Retry internal.RetryPolicy
+	// WriteBlockBytes is the most bytes written to the
+	// target at once, 0 for internal.DefaultWriteBlockBytes
+	WriteBlockBytes uint64
+	// SizeBytes is the size of the source in bytes, when it
+	// can't be determined from the source itself (e.g. stdin).
+	// It is only used for reporting progress, the copy always
+	// continues until the source is exhausted.
+	// 0 means the size isn't known at all.
+	SizeBytes uint64
+	// Decompress the source as it's read, the
+	// compression format is detected from the source
+	Decompress bool
+	// Compress is the compression (one of internal.Compressions)
+	// to compress the source with as it's read, or empty to
+	// not compress. If Decompress is also set, the source is
+	// decompressed before being compressed.
+	Compress string
+	// Decrypt the source with Key as it's read, before
+	// any decompression
+	Decrypt bool
+	// Encrypt is the cipher (one of internal.Ciphers) to encrypt
+	// the source with using Key as it's read, after any compression,
+	// or empty to not encrypt
+	Encrypt string
+	// Key is the key to decrypt and/or encrypt with
+	Key internal.Key
+	// Endpoints configures access to sources
+	// & targets which aren't local files
+	Endpoints internal.EndpointOptions
+	// Delta copies onto an existing local destination in place,
+	// only writing the blocks of DeltaBlockBytes (0 for
+	// internal.DefaultDeltaBlockBytes) which differ from it
+	Delta           bool
+	DeltaBlockBytes uint64
+	// SkipIdentical skips files in a tree copy when
+	// there is already a file at the destination
+	// which appears to be identical, which can't be
+	// done when compressing, encrypting etc.
+	SkipIdentical bool
+	// Update skips files in a tree copy which are already up
+	// to date at the destination, because they appear to be
+	// identical or the destination is newer, see internal.UpToDate,
+	// which, as with SkipIdentical, can't be done when transforming
+	Update bool
+	// Checksum, with Update, also skips files whose content
+	// is the same at the destination, by hashing both
+	Checksum bool
+	// Filter decides which entries of a directory source
+	// are copied (into a tree or archive)
+	Filter internal.Filter
+	// Extract the source, an archive, into
+	// the destination directory with Extract
+	Extract bool
+	// ArchiveTime, if not nil, is given to every entry in
+	// archives written by Archive as its modification time,
+	// with no owner, so that archives are reproducible
+	ArchiveTime *time.Time
+	// ZipStore stores files in zip archives written by
+	// Archive as they are, rather than deflating them
+	ZipStore bool
+	// Manifest is the local file to write a JSON manifest of
+	// every file copied by Tree to, if not empty, which can't
+	// be combined with compression or encryption
+	Manifest string
+	// SHA256Sums is the local file to write a manifest of every
+	// file copied by Tree to, in the format of sha256sum, if not empty
+	SHA256Sums string
+}
+
 // FileToFile copies a single file, from the from path to the to path,
 // using a buffer of size bufferSizeBytes in bytes & forcing write
 // to target durable storage after each approximately syncEachBytes
 func FileToFile(from string, to string, bufferSizeBytes uint64, syncEachBytes uint64) {
-	s := internal.SizeOf(from)
+	Copy(from, to, Options{BufferSizeBytes: bufferSizeBytes, SyncEachBytes: syncEachBytes})
+}
+
+// source is anything which the internal.Reader can read from
+type source interface {
+	Open() error
+	io.ReadCloser
+}
 
-	crossBuffer := internal.NewBuffer(bufferSizeBytes)
+// target is anything which the internal.Writer can write to
+type target interface {
+	Initialise() error
+	Sync() error
+	io.WriteCloser
+}
+
+// Copy copies from the from path to the to path as configured by o.
+// The size of the source is treated only as an estimate, sources
+// reporting a size of zero (like those in /proc) or which grow or
+// shrink during the copy are copied until they are exhausted.
+// Either path may be internal.StandardStream to read from stdin
+// or write to stdout respectively, either may be an sftp, s3 or
+// gocopy(s) URL (of a file served by go-copy serve) or an ssh URL
+// (of a file served by go-copy serve --stdio run over ssh),
+// from may be an http(s) URL and to may be an http(s) URL
+// to upload to with PUT.
+// If from is a directory, the whole tree is copied with Tree,
+// or into a tar or zip archive with Archive if to names one.
+// If o.Extract is set, from is extracted into to with Extract.
+// If o.Delta is set, to must be local & only what differs is written.
+func Copy(from string, to string, o Options) {
+	if internal.IsDir(from) && (internal.IsTar(to) || internal.IsZip(to)) {
+		Archive(from, to, o)
+		return
+	}
+	if internal.IsDir(from) {
+		Tree(from, to, o)
+		return
+	}
+	if o.Extract {
+		Extract(from, to, o)
+		return
+	}
+	source := internal.SourceFor(from, o.Endpoints)
+	s := o.SizeBytes
+	if s == 0 {
+		s = internal.EstimatedSizeOf(source)
+	}
 
 	shutdown := make(chan struct{})
+	pr := internal.NewProgressReporter(s, shutdown)
+	go pr.Report(time.Now())
+
+	targetFor := func(size uint64) target { return internal.TargetFor(to, size, o.Endpoints) }
+	if o.Delta {
+		if !internal.IsLocal(to) {
+			panic(fmt.Sprintf("Can only copy onto a local destination in place, not %s", to))
+		}
+		pr.CompareTarget()
+		targetFor = func(uint64) target { return internal.NewDeltaTarget(to, o.DeltaBlockBytes, &pr) }
+	}
+	transfer(source, s, targetFor, &pr, o)
+
+	close(shutdown)
+	time.Sleep(10 * time.Millisecond)
+}
+
+// transfer moves all of the bytes from the source, whose size is s
+// (0 if unknown), to the target created by targetFor, applying
+// any transformations in o & reporting progress to pr.
+// targetFor is given the size which will be written, if known exactly
+// (see internal.ExactSizeOf), else 0.
+func transfer(source source, s uint64, targetFor func(uint64) target, pr *internal.ProgressReporter, o Options) {
+	crossBuffer := internal.NewBlockBuffer(o.BufferSizeBytes, o.WriteBlockBytes)
+	exactSize, exact := internal.ExactSizeOf(source)
 
 	readerDone := make(chan struct{})
 	writerDone := make(chan struct{})
 
-	pr := internal.NewProgressReporter(s, shutdown)
-	readingFile := internal.NewSourceFile(from)
-	reader := internal.NewReader(&readingFile, &crossBuffer, readerDone, &pr, s, internal.Minimum(1000, bufferSizeBytes))
-	writingFile := internal.NewWritingFile(to)
-	writer := internal.NewWriter(&writingFile, &crossBuffer, writerDone, &pr, s, syncEachBytes)
+	// only the first transformation of the source
+	// sees the bytes consumed from the source itself
+	consumption := pr
+	if o.Decrypt {
+		source = internal.NewDecryptingSource(source, o.Key, consumption)
+		consumption = nil
+	}
+	if o.Decompress {
+		source = internal.NewDecompressingSource(source, consumption)
+		consumption = nil
+	}
+	if o.Compress != "" {
+		source = internal.NewCompressingSource(source, o.Compress, consumption)
+		consumption = nil
+	}
+	if o.Encrypt != "" {
+		source = internal.NewEncryptingSource(source, o.Encrypt, o.Key, consumption)
+		consumption = nil
+	}
+	readSize := s
+	if consumption == nil {
+		pr.TrackSource()
+		readSize = 0
+		exact = false
+	}
+	if !exact {
+		exactSize = 0
+	}
+	reader := internal.NewReader(source, &crossBuffer, readerDone, pr, readSize, internal.Minimum(1000, o.BufferSizeBytes))
+	writer := internal.NewWriter(targetFor(exactSize), &crossBuffer, readerDone, writerDone, pr, o.SyncEachBytes)
+	writer.AdaptSyncTo(o.SyncGap)
+	reader.RetryWith(o.Retry)
+	writer.RetryWith(o.Retry)
 
-	go pr.Report(time.Now())
 	go reader.Start()
 	go writer.Start()
 
 	<-readerDone
 	<-writerDone
-
-	close(shutdown)
-	time.Sleep(10 * time.Millisecond)
 }
@@ -2,12 +2,16 @@ package copy_test
 
 import (
 	"fmt"
+	"io"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"testing"
 
 	"github.com/snasphysicist/go-copy/pkg/copy"
+	"github.com/snasphysicist/go-copy/pkg/internal"
 	"github.com/snasphysicist/go-copy/pkg/random"
 )
 
@@ -52,3 +56,132 @@ func TestCopyCopiesFileBetweenFromAndToPaths(t *testing.T) {
 		t.Error("Copied content did not match source content")
 	}
 }
+
+func TestCopyCopiesFromStandardInputWhenSizeUnknown(t *testing.T) {
+	content := random.Bytes(2780)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe with %v", err)
+	}
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	go func() {
+		_, _ = w.Write(content)
+		_ = w.Close()
+	}()
+	to := randomFilePath()
+	defer deleteFile(to)
+	copy.Copy(internal.StandardStream, to, copy.Options{BufferSizeBytes: 50, SyncEachBytes: 250})
+	written, err := os.ReadFile(to)
+	if err != nil {
+		t.Errorf("Failed to read target file with %v", err)
+	}
+	if !reflect.DeepEqual(content, written) {
+		t.Error("Copied content did not match content written to stdin")
+	}
+}
+
+func TestCopyCopiesFileWhichReportsZeroSize(t *testing.T) {
+	from := "/proc/self/status"
+	if _, err := os.Stat(from); err != nil {
+		t.Skipf("No %s to copy on this system: %v", from, err)
+	}
+	to := randomFilePath()
+	defer deleteFile(to)
+	copy.FileToFile(from, to, 50, 250)
+	written, err := os.ReadFile(to)
+	if err != nil {
+		t.Errorf("Failed to read target file with %v", err)
+	}
+	if len(written) == 0 {
+		t.Errorf("Nothing was copied from %s", from)
+	}
+}
+
+func TestCopyCompressesThenDecompressesToOriginalContent(t *testing.T) {
+	content := random.Bytes(2780)
+	from := randomFilePath()
+	writeFile(from, content)
+	defer deleteFile(from)
+	compressed := randomFilePath()
+	defer deleteFile(compressed)
+	copy.Copy(from, compressed, copy.Options{BufferSizeBytes: 50, SyncEachBytes: 250, Compress: internal.Zstd})
+	to := randomFilePath()
+	defer deleteFile(to)
+	copy.Copy(compressed, to, copy.Options{BufferSizeBytes: 50, SyncEachBytes: 250, Decompress: true})
+	written, err := os.ReadFile(to)
+	if err != nil {
+		t.Errorf("Failed to read target file with %v", err)
+	}
+	if !reflect.DeepEqual(content, written) {
+		t.Error("Decompressed content did not match source content")
+	}
+}
+
+func TestCopyDeltaUpdatesExistingDestinationInPlace(t *testing.T) {
+	content := random.Bytes(10000)
+	from := randomFilePath()
+	writeFile(from, content)
+	defer deleteFile(from)
+	to := randomFilePath()
+	stale := append([]byte{}, content...)
+	stale[5000] ^= 0xff
+	writeFile(to, append(stale, random.Bytes(500)...))
+	defer deleteFile(to)
+	before, _ := os.Stat(to)
+	copy.Copy(from, to, copy.Options{BufferSizeBytes: 500, SyncEachBytes: 2500, Delta: true, DeltaBlockBytes: 1024})
+	written, err := os.ReadFile(to)
+	if err != nil {
+		t.Errorf("Failed to read target file with %v", err)
+	}
+	if !reflect.DeepEqual(content, written) {
+		t.Error("Destination did not match source content after delta copy")
+	}
+	after, _ := os.Stat(to)
+	if !os.SameFile(before, after) {
+		t.Error("Destination was replaced rather than updated in place")
+	}
+}
+
+// uploadServer starts a server recording the
+// Content-Length & body of the last PUT to it
+func uploadServer(t *testing.T) (*httptest.Server, *int64, *[]byte) {
+	var length int64
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		length = r.ContentLength
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(server.Close)
+	return server, &length, &body
+}
+
+func TestCopyUploadsWithContentLengthOnlyWhenSizeIsExact(t *testing.T) {
+	content := random.Bytes(2780)
+	from := randomFilePath()
+	writeFile(from, content)
+	defer deleteFile(from)
+	server, length, body := uploadServer(t)
+	copy.Copy(from, server.URL+"/file", copy.Options{BufferSizeBytes: 50, SyncEachBytes: 250, SizeBytes: 1000})
+	if *length != int64(len(content)) || !reflect.DeepEqual(*body, content) {
+		t.Errorf("File uploaded with Content-Length %d & %d bytes, expected its size %d", *length, len(*body), len(content))
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe with %v", err)
+	}
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	go func() {
+		_, _ = w.Write(content)
+		_ = w.Close()
+	}()
+	copy.Copy(internal.StandardStream, server.URL+"/stdin", copy.Options{BufferSizeBytes: 50, SyncEachBytes: 250, SizeBytes: 1000})
+	if *length != -1 || !reflect.DeepEqual(*body, content) {
+		t.Errorf("Stdin with a wrong --size uploaded with Content-Length %d & %d bytes, expected chunked", *length, len(*body))
+	}
+}
@@ -0,0 +1,131 @@
+package copy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+// FlashOptions configures how Flash writes an image to a drive
+type FlashOptions struct {
+	// Options configures the copy of the image to the drive,
+	// except that it's decompressed if it's compressed
+	Options
+	// Drives looks up the drive to flash
+	Drives internal.Drives
+	// Confirm is shown the drive to be flashed, once it's been
+	// checked, which is only flashed if it returns true
+	Confirm func(internal.Drive) bool
+	// SkipVerify skips reading the image back from the
+	// drive to check it was written correctly
+	SkipVerify bool
+}
+
+// Flash writes the local image (which is decompressed if compressed)
+// to the local drive device, from its start, only if it's removable
+// & not in use, going by o.Drives, the image fits (where its size is
+// known, see internal.DecompressedSize) & o.Confirm confirms it, then
+// reads it back to check it was written correctly. Returns false if
+// not confirmed.
+func Flash(image string, device string, o FlashOptions) bool {
+	drive, err := o.Drives.Lookup(device)
+	if err != nil {
+		panic(err)
+	}
+	err = drive.CheckFlashable()
+	if err != nil {
+		panic(err)
+	}
+	o.Decompress = isCompressed(image)
+	source := internal.SourceFor(image, o.Endpoints)
+	s := internal.EstimatedSizeOf(source)
+	needed := s
+	if o.Decompress {
+		needed = decompressedSize(image)
+	}
+	if needed > drive.Size {
+		panic(fmt.Sprintf("%s is %s, too large for %s", image, internal.FormatSize(needed), drive.Describe()))
+	}
+	if !o.Confirm(drive) {
+		return false
+	}
+	var written hashedTarget
+
+	shutdown := make(chan struct{})
+	pr := internal.NewProgressReporter(s, shutdown)
+	go pr.Report(time.Now())
+
+	transfer(source, s, func(size uint64) target {
+		written = internal.NewHashingTarget(internal.NewDeviceTarget(device, size))
+		return written
+	}, &pr, o.Options)
+
+	close(shutdown)
+	time.Sleep(10 * time.Millisecond)
+	if o.SkipVerify {
+		return true
+	}
+	verify(device, written)
+	return true
+}
+
+// decompressedSize returns the size of the compressed local image
+// once decompressed, where that's recorded, otherwise warning that
+// it can't be told whether it will fit & returning 0
+func decompressedSize(image string) uint64 {
+	size, ok, err := internal.DecompressedSize(image)
+	if err != nil {
+		panic(err)
+	}
+	if !ok {
+		log.Printf("WARNING: the size of %s once decompressed is not known, so it may not fit", image)
+	}
+	return size
+}
+
+// verify reads back the bytes written to device, checking them
+// against those written, reporting progress as it goes
+func verify(device string, written hashedTarget) {
+	fmt.Fprintf(os.Stderr, "Verifying %s\n", device)
+	shutdown := make(chan struct{})
+	pr := internal.NewProgressReporter(written.Written(), shutdown)
+	go pr.Report(time.Now())
+
+	sum, err := internal.SHA256Device(device, written.Written(), func(n uint64) {
+		pr.ReportBytesRead(n)
+		pr.ReportBytesWritten(n)
+	})
+
+	close(shutdown)
+	time.Sleep(10 * time.Millisecond)
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(sum, written.Sum()) {
+		panic(fmt.Sprintf("%s does not match what was written to it, the drive may be faulty or fake", device))
+	}
+}
+
+// hashedTarget is a target which hashes what's written to it
+type hashedTarget interface {
+	target
+	Sum() []byte
+	Written() uint64
+}
+
+// isCompressed returns true if the local file at path
+// is compressed in one of internal.Compressions
+func isCompressed(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	_, err = internal.DetectCompression(bufio.NewReader(f))
+	return err == nil
+}
@@ -0,0 +1,114 @@
+package copy_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/snasphysicist/go-copy/pkg/copy"
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"github.com/snasphysicist/go-copy/pkg/random"
+)
+
+// fakeStick creates a stand-in device file for a removable 4KiB
+// drive, called sdz in a fake sysfs tree, returning its path & the tree
+func fakeStick(t *testing.T) (string, internal.Drives) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string][]byte{
+		"sys/class/block/sdz/removable":    []byte("1\n"),
+		"sys/class/block/sdz/size":         []byte("8\n"),
+		"sys/class/block/sdz/device/model": []byte("Stick\n"),
+		"mounts":                           []byte("/dev/sda1 / ext4 rw 0 0\n"),
+		"dev/sdz":                          make([]byte, 4096),
+	})
+	return filepath.Join(dir, "dev", "sdz"), internal.Drives{
+		SysRoot:    filepath.Join(dir, "sys"),
+		MountsFile: filepath.Join(dir, "mounts"),
+	}
+}
+
+// flashOptions are options for flashing to drives, confirming with confirm
+func flashOptions(drives internal.Drives, confirm bool) copy.FlashOptions {
+	return copy.FlashOptions{
+		Options: copy.Options{BufferSizeBytes: 512, SyncEachBytes: 1024},
+		Drives:  drives,
+		Confirm: func(internal.Drive) bool { return confirm },
+	}
+}
+
+func TestFlashWritesImageToDriveAndVerifiesIt(t *testing.T) {
+	device, drives := fakeStick(t)
+	content := random.Bytes(3000)
+	image := filepath.Join(t.TempDir(), "image.img")
+	writeFile(image, content)
+	if !copy.Flash(image, device, flashOptions(drives, true)) {
+		t.Fatal("Flash was not confirmed")
+	}
+	written, _ := os.ReadFile(device)
+	if !bytes.Equal(content, written[:len(content)]) {
+		t.Error("Flashed content does not match the image")
+	}
+}
+
+func TestFlashDecompressesCompressedImage(t *testing.T) {
+	device, drives := fakeStick(t)
+	content := random.Bytes(3000)
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	_, _ = w.Write(content)
+	_ = w.Close()
+	image := filepath.Join(t.TempDir(), "image.img.gz")
+	writeFile(image, compressed.Bytes())
+	copy.Flash(image, device, flashOptions(drives, true))
+	written, _ := os.ReadFile(device)
+	if !bytes.Equal(content, written[:len(content)]) {
+		t.Error("Flashed content does not match the decompressed image")
+	}
+}
+
+func TestFlashLeavesDriveUntouchedUnlessConfirmed(t *testing.T) {
+	device, drives := fakeStick(t)
+	image := filepath.Join(t.TempDir(), "image.img")
+	writeFile(image, random.Bytes(3000))
+	if copy.Flash(image, device, flashOptions(drives, false)) {
+		t.Error("Flash went ahead without confirmation")
+	}
+	written, _ := os.ReadFile(device)
+	if !bytes.Equal(make([]byte, 4096), written) {
+		t.Error("Drive was written to without confirmation")
+	}
+}
+
+func TestFlashRefusesImageTooLargeForDrive(t *testing.T) {
+	device, drives := fakeStick(t)
+	image := filepath.Join(t.TempDir(), "image.img")
+	writeFile(image, random.Bytes(5000))
+	defer func() {
+		if recover() == nil {
+			t.Error("Flashed an image larger than the drive")
+		}
+	}()
+	copy.Flash(image, device, flashOptions(drives, true))
+}
+
+func TestFlashRefusesCompressedImageTooLargeForDriveBeforeConfirming(t *testing.T) {
+	device, drives := fakeStick(t)
+	e, _ := zstd.NewWriter(nil)
+	image := filepath.Join(t.TempDir(), "image.img.zst")
+	writeFile(image, e.EncodeAll(make([]byte, 5000), nil))
+	confirmed := false
+	o := flashOptions(drives, true)
+	o.Confirm = func(internal.Drive) bool {
+		confirmed = true
+		return true
+	}
+	defer func() {
+		if recover() == nil || confirmed {
+			t.Errorf("Asked to confirm flashing (%t) a compressed image larger than the drive", confirmed)
+		}
+	}()
+	copy.Flash(image, device, o)
+}
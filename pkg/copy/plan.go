@@ -0,0 +1,234 @@
+package copy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+// Action is what a copy would do with something at the destination
+type Action string
+
+const (
+	// Create is creating something which isn't at the destination yet
+	Create Action = "create"
+	// Overwrite is replacing what's already at the destination
+	Overwrite Action = "overwrite"
+	// Skip is leaving what's at the destination, as it's up to date
+	Skip Action = "skip"
+)
+
+// PlannedItem is a file, directory or symlink a copy would write
+type PlannedItem struct {
+	// Path is the path relative to the destination
+	// with / separators, empty for the destination itself
+	Path   string
+	Action Action
+	// Bytes is the size of the source (an estimate, 0
+	// if unknown) or 0 for directories & symlinks
+	Bytes uint64
+	// ExistingBytes is the size of what's already
+	// at the destination, which would be overwritten
+	ExistingBytes uint64
+}
+
+// PlanTotal is the total bytes to copy under a path
+type PlanTotal struct {
+	Path  string
+	Bytes uint64
+}
+
+// Plan is what a copy would do, without doing it. go-copy never
+// deletes anything at the destination which isn't in the source,
+// so nothing is ever planned to be deleted.
+type Plan struct {
+	From  string
+	To    string
+	Items []PlannedItem
+	// FreeBytes is the space available at the
+	// destination, nil if that can't be told
+	FreeBytes *uint64
+}
+
+// Plannable returns why PlanCopy can't plan a copy to the to path
+// as configured by o, or nil if it can. Only copies to local paths
+// can be planned, & not extracting, as what an archive contains
+// isn't known until it's read.
+func Plannable(to string, o Options) error {
+	if !internal.IsLocal(to) {
+		return fmt.Errorf("can only plan copies to local destinations, not %s", to)
+	}
+	if o.Extract {
+		return errors.New("can't plan extracting an archive")
+	}
+	return nil
+}
+
+// PlanCopy works out what Copy would do copying from the from path
+// to the to path as configured by o, without touching the destination.
+// Panics on any error, including the copy not being Plannable.
+func PlanCopy(from string, to string, o Options) Plan {
+	err := Plannable(to, o)
+	if err != nil {
+		panic(err)
+	}
+	p := Plan{From: from, To: to}
+	switch {
+	case internal.IsDir(from) && (internal.IsTar(to) || internal.IsZip(to)):
+		total := uint64(0)
+		for _, e := range walk(from, o) {
+			if e.Info.Mode().IsRegular() {
+				total += uint64(e.Info.Size())
+			}
+		}
+		p.Items = []PlannedItem{plannedItem("", to, total)}
+	case internal.IsDir(from):
+		p.Items = planTree(from, to, o)
+	default:
+		s := o.SizeBytes
+		if s == 0 {
+			s = internal.EstimatedSizeOf(internal.SourceFor(from, o.Endpoints))
+		}
+		p.Items = []PlannedItem{plannedItem("", to, s)}
+	}
+	free, err := internal.FreeSpace(to)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		panic(err)
+	}
+	if err == nil {
+		p.FreeBytes = &free
+	}
+	return p
+}
+
+// planTree plans copying the tree under the directory at
+// the from path into the local directory at the to path
+func planTree(from string, to string, o Options) []PlannedItem {
+	checkSkippable(o)
+	entries := walk(from, o)
+	destination := internal.TreeTargetFor(to, o.Endpoints)
+	items := make([]PlannedItem, 0, len(entries))
+	for _, e := range entries {
+		local := filepath.Join(to, filepath.FromSlash(e.Path))
+		switch {
+		case e.Info.IsDir():
+			if !internal.IsDir(local) {
+				items = append(items, PlannedItem{Path: e.Path, Action: Create})
+			}
+		case e.Info.Mode()&os.ModeSymlink != 0:
+			items = append(items, plannedItem(e.Path, local, 0))
+		case e.Info.Mode().IsRegular():
+			skip := false
+			if o.SkipIdentical || o.Update {
+				var err error
+				skip, err = upToDate(destination, e, sourceSum(filepath.Join(from, filepath.FromSlash(e.Path))), o)
+				if err != nil {
+					panic(err)
+				}
+			}
+			if skip {
+				items = append(items, PlannedItem{Path: e.Path, Action: Skip, Bytes: uint64(e.Info.Size())})
+				continue
+			}
+			items = append(items, plannedItem(e.Path, local, uint64(e.Info.Size())))
+		}
+	}
+	return items
+}
+
+// plannedItem plans writing bytes to path relative to the
+// destination, which is at the local path local
+func plannedItem(path string, local string, bytes uint64) PlannedItem {
+	info, err := os.Lstat(local)
+	if os.IsNotExist(err) {
+		return PlannedItem{Path: path, Action: Create, Bytes: bytes}
+	}
+	if err != nil {
+		panic(err)
+	}
+	existing := uint64(0)
+	if info.Mode().IsRegular() {
+		existing = uint64(info.Size())
+	}
+	return PlannedItem{Path: path, Action: Overwrite, Bytes: bytes, ExistingBytes: existing}
+}
+
+// Count returns how many of the plan's items have the action a
+func (p Plan) Count(a Action) int {
+	count := 0
+	for _, i := range p.Items {
+		if i.Action == a {
+			count++
+		}
+	}
+	return count
+}
+
+// Bytes returns the total bytes of the plan's items with the action a
+func (p Plan) Bytes(a Action) uint64 {
+	total := uint64(0)
+	for _, i := range p.Items {
+		if i.Action == a {
+			total += i.Bytes
+		}
+	}
+	return total
+}
+
+// ToCopy returns the total bytes the plan would copy
+func (p Plan) ToCopy() uint64 {
+	return p.Bytes(Create) + p.Bytes(Overwrite)
+}
+
+// NeededBytes returns how much more space the destination needs for
+// the plan, what's overwritten making space for what replaces it
+func (p Plan) NeededBytes() uint64 {
+	needed := p.Bytes(Create)
+	for _, i := range p.Items {
+		if i.Action == Overwrite && i.Bytes > i.ExistingBytes {
+			needed += i.Bytes - i.ExistingBytes
+		}
+	}
+	return needed
+}
+
+// Fits returns false only if the destination is known
+// not to have enough space available for the plan
+func (p Plan) Fits() bool {
+	return p.FreeBytes == nil || p.NeededBytes() <= *p.FreeBytes
+}
+
+// Duration estimates how long the plan would take to
+// copy at throughput bytes per second, 0 if not known
+func (p Plan) Duration(throughput uint64) time.Duration {
+	if throughput == 0 {
+		return 0
+	}
+	return time.Duration(float64(p.ToCopy()) / float64(throughput) * float64(time.Second))
+}
+
+// Breakdown returns the total bytes the plan would copy
+// under each path at the top of the destination, in order,
+// as du does, or just the destination itself for a single file
+func (p Plan) Breakdown() []PlanTotal {
+	totals := make(map[string]uint64)
+	for _, i := range p.Items {
+		if i.Action == Skip {
+			continue
+		}
+		top, _, _ := strings.Cut(i.Path, "/")
+		totals[top] += i.Bytes
+	}
+	breakdown := make([]PlanTotal, 0, len(totals))
+	for path, bytes := range totals {
+		breakdown = append(breakdown, PlanTotal{Path: path, Bytes: bytes})
+	}
+	sort.Slice(breakdown, func(i, j int) bool { return breakdown[i].Path < breakdown[j].Path })
+	return breakdown
+}
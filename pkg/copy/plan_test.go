@@ -0,0 +1,85 @@
+package copy_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/copy"
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"github.com/snasphysicist/go-copy/pkg/random"
+)
+
+func TestPlanCopyPlansTreeWithoutTouchingDestination(t *testing.T) {
+	from := t.TempDir()
+	to := t.TempDir()
+	same := random.Bytes(500)
+	writeTree(t, from, map[string][]byte{"new/file": random.Bytes(1000), "same": same, "changed": random.Bytes(2000)})
+	writeTree(t, to, map[string][]byte{"same": same, "changed": random.Bytes(300)})
+	mtime := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	_ = os.Chtimes(filepath.Join(from, "same"), mtime, mtime)
+	_ = os.Chtimes(filepath.Join(to, "same"), mtime, mtime)
+	_ = os.Chtimes(filepath.Join(to, "changed"), mtime, mtime)
+	p := copy.PlanCopy(from, to, copy.Options{Update: true})
+	expected := []copy.PlannedItem{
+		{Path: "changed", Action: copy.Overwrite, Bytes: 2000, ExistingBytes: 300},
+		{Path: "new", Action: copy.Create},
+		{Path: "new/file", Action: copy.Create, Bytes: 1000},
+		{Path: "same", Action: copy.Skip, Bytes: 500},
+	}
+	if !reflect.DeepEqual(expected, p.Items) {
+		t.Errorf("Planned %+v, expected %+v", p.Items, expected)
+	}
+	if p.ToCopy() != 3000 || p.NeededBytes() != 2700 || p.Bytes(copy.Skip) != 500 {
+		t.Errorf("Plan copies %d bytes needing %d, skipping %d", p.ToCopy(), p.NeededBytes(), p.Bytes(copy.Skip))
+	}
+	breakdown := []copy.PlanTotal{{Path: "changed", Bytes: 2000}, {Path: "new", Bytes: 1000}}
+	if !reflect.DeepEqual(breakdown, p.Breakdown()) {
+		t.Errorf("Plan broken down as %+v, expected %+v", p.Breakdown(), breakdown)
+	}
+	if p.Duration(1000) != 3*time.Second {
+		t.Errorf("Plan would take %s at 1000 bytes per second, expected 3s", p.Duration(1000))
+	}
+	if _, err := os.Stat(filepath.Join(to, "new")); err == nil {
+		t.Error("Planning created a directory at the destination")
+	}
+}
+
+func TestPlanCopyChecksFreeSpace(t *testing.T) {
+	from := filepath.Join(t.TempDir(), "file")
+	writeFile(from, random.Bytes(1000))
+	p := copy.PlanCopy(from, filepath.Join(t.TempDir(), "missing", "file"), copy.Options{})
+	if p.FreeBytes == nil {
+		t.Skip("Free space can't be told here")
+	}
+	if !p.Fits() {
+		t.Errorf("1000 bytes don't fit in %s free", internal.FormatSize(*p.FreeBytes))
+	}
+	p.FreeBytes = internal.From(uint64(999))
+	if p.Fits() {
+		t.Error("1000 bytes fit in 999 free")
+	}
+}
+
+func TestPlannableRefusesRemoteDestinationsAndExtracting(t *testing.T) {
+	for description, c := range map[string]struct {
+		to        string
+		o         copy.Options
+		plannable bool
+	}{
+		"local":      {to: t.TempDir(), plannable: true},
+		"sftp":       {to: "sftp://host/backup"},
+		"s3":         {to: "s3://bucket/backup"},
+		"webdav":     {to: "https://host/backup"},
+		"extracting": {to: t.TempDir(), o: copy.Options{Extract: true}},
+	} {
+		t.Run(description, func(t *testing.T) {
+			err := copy.Plannable(c.to, c.o)
+			if (err == nil) != c.plannable {
+				t.Errorf("Plannable gave %v, expected plannable %t", err, c.plannable)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package copy
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+// Rescue copies what can be read of the local file (or device) from
+// into the same place in the local file to, which isn't truncated,
+// with internal.Rescue, for when from is failing. What was rescued & what
+// was bad is recorded in mapFile, which (if it exists) also says what
+// was rescued by earlier runs, so that only what's left is tried.
+// Returns the map once done.
+func Rescue(from string, to string, mapFile string, o internal.RescueOptions) *internal.RescueMap {
+	source, err := os.Open(from)
+	if err != nil {
+		panic(err)
+	}
+	defer source.Close()
+	// unlike its Stat, this is also the size of a device
+	size, err := source.Seek(0, io.SeekEnd)
+	if err != nil {
+		panic(err)
+	}
+	if size == 0 {
+		panic(from + " is empty, or its size can't be known, so it can't be rescued")
+	}
+	m, err := internal.ReadRescueMap(mapFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		m, err = internal.NewRescueMap(size), nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	m.Resize(size)
+	target, err := os.OpenFile(to, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		panic(err)
+	}
+	defer target.Close()
+	save := func() error {
+		// the map mustn't claim more than is really in the target
+		err := target.Sync()
+		if err != nil {
+			return err
+		}
+		return m.WriteFile(mapFile)
+	}
+
+	shutdown := make(chan struct{})
+	pr := internal.NewProgressReporter(uint64(m.Bytes(internal.Untried)), shutdown)
+	go pr.Report(time.Now())
+
+	err = internal.Rescue(source, target, m, o, &pr, save)
+
+	close(shutdown)
+	time.Sleep(10 * time.Millisecond)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
@@ -0,0 +1,208 @@
+package copy
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+// Tree copies the whole tree under the directory at the from path
+// (except what o.Filter excludes) to the to path, which may be a local
+// directory, an sftp URL of a directory, an s3 URL of a prefix or an
+// http(s) URL of a WebDAV collection, as configured by o. Directories
+// are created as needed, files copied and symlinks recreated (where
+// the target supports them), preserving permissions & modification
+// times (where the target supports them). Progress is reported for the
+// whole tree, rather than each file. If o.Manifest or o.SHA256Sums are
+// given, a manifest of every file in the tree (including any skipped
+// as up to date, as they are at the destination) is written to them at
+// the end, hashing the files as they're copied, which can't be done if
+// o transforms them (compressing, encrypting, decompressing or
+// decrypting), nor can files be skipped (see checkSkippable).
+// Panics on any error.
+func Tree(from string, to string, o Options) {
+	checkSkippable(o)
+	entries := walk(from, o)
+	destination := internal.TreeTargetFor(to, o.Endpoints)
+
+	manifest := o.Manifest != "" || o.SHA256Sums != ""
+	if manifest && transforms(o) {
+		panic("Can't write a manifest of a tree copied with compression or encryption, as it would describe the source rather than the copy")
+	}
+	files := make([]internal.ManifestFile, 0)
+
+	toCopy := make([]internal.TreeEntry, 0, len(entries))
+	total := uint64(0)
+	skipped := uint64(0)
+	for _, e := range entries {
+		if (o.SkipIdentical || o.Update) && e.Info.Mode().IsRegular() {
+			sum := sourceSum(filepath.Join(from, filepath.FromSlash(e.Path)))
+			skip, err := upToDate(destination, e, sum, o)
+			if err != nil {
+				panic(err)
+			}
+			if skip && manifest {
+				files = append(files, skippedManifestFile(destination, e, sum))
+			}
+			if skip {
+				skipped += uint64(e.Info.Size())
+				continue
+			}
+		}
+		toCopy = append(toCopy, e)
+		if e.Info.Mode().IsRegular() {
+			total += uint64(e.Info.Size())
+		}
+	}
+
+	shutdown := make(chan struct{})
+	pr := internal.NewProgressReporter(total, shutdown)
+	pr.ReportBytesSkipped(skipped)
+	go pr.Report(time.Now())
+
+	err := destination.Mkdir("")
+	if err != nil {
+		panic(err)
+	}
+	for _, e := range toCopy {
+		local := filepath.Join(from, filepath.FromSlash(e.Path))
+		switch {
+		case e.Info.IsDir():
+			err = destination.Mkdir(e.Path)
+		case e.Info.Mode()&os.ModeSymlink != 0:
+			var link string
+			link, err = os.Readlink(local)
+			if err == nil {
+				err = destination.Symlink(e.Path, link)
+			}
+		case e.Info.Mode().IsRegular():
+			path := e.Path
+			// opened as the local file it is, whatever its path looks like
+			source := internal.NewHashingSource(internal.From(internal.NewSourceFile(local)))
+			transfer(
+				source,
+				uint64(e.Info.Size()),
+				func(size uint64) target { return destination.File(path, size) },
+				&pr,
+				o,
+			)
+			files = append(files, internal.ManifestFileOf(e, source.Sum()))
+			err = destination.Finish(e.Path, e.Info)
+		default:
+			log.Printf("WARNING: skipping %s, which is not a file, directory or symlink", local)
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	// directories last, deepest first, as adding their
+	// contents changes their modification times
+	for i := len(toCopy) - 1; i >= 0; i-- {
+		if toCopy[i].Info.IsDir() {
+			err = destination.Finish(toCopy[i].Path, toCopy[i].Info)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	if manifest {
+		writeManifest(internal.NewManifest(files), o)
+	}
+
+	close(shutdown)
+	time.Sleep(10 * time.Millisecond)
+}
+
+// walk returns the entries in the tree under the
+// directory at the from path which o.Filter includes
+func walk(from string, o Options) []internal.TreeEntry {
+	entries, err := internal.WalkTree(from)
+	if err != nil {
+		panic(err)
+	}
+	entries, err = o.Filter.Apply(from, entries)
+	if err != nil {
+		panic(err)
+	}
+	return entries
+}
+
+// upToDate returns true if the file described by e needn't be copied
+// to destination, as configured by o, sum returning its SHA-256
+func upToDate(destination internal.Identifier, e internal.TreeEntry, sum func() ([]byte, error), o Options) (bool, error) {
+	if !o.Update {
+		return destination.Identical(e.Path, e.Info)
+	}
+	if !o.Checksum {
+		sum = nil
+	}
+	return internal.UpToDate(destination, e.Path, e.Info, sum)
+}
+
+// transforms returns true if o transforms what's copied,
+// so it's not the same at the destination as in the source
+func transforms(o Options) bool {
+	return o.Compress != "" || o.Encrypt != "" || o.Decompress || o.Decrypt
+}
+
+// checkSkippable panics if o skips files which are up to date at
+// the destination but also transforms them, as then they would
+// be compared with the source & always found to be out of date
+func checkSkippable(o Options) {
+	if (o.SkipIdentical || o.Update) && transforms(o) {
+		panic("Can't skip up to date files in a tree copied with compression or encryption, as the copies can't be compared with the source")
+	}
+}
+
+// skippedManifestFile returns the entry in a manifest of the file described
+// by e, skipped as up to date at destination, as it is at destination
+// where that can be inspected (the destination may be newer, with other
+// content), otherwise (it being identical) as it is in the source
+func skippedManifestFile(destination internal.Identifier, e internal.TreeEntry, sum func() ([]byte, error)) internal.ManifestFile {
+	f, ok, err := internal.ExistingManifestFile(destination, e.Path)
+	if err != nil {
+		panic(err)
+	}
+	if ok {
+		return f
+	}
+	s, err := sum()
+	if err != nil {
+		panic(err)
+	}
+	return internal.ManifestFileOf(e, s)
+}
+
+// sourceSum returns a function returning the SHA-256 of the
+// local file at path, only hashing it the first time it's called
+func sourceSum(path string) func() ([]byte, error) {
+	var sum []byte
+	return func() ([]byte, error) {
+		if sum != nil {
+			return sum, nil
+		}
+		var err error
+		sum, _, err = internal.SHA256File(path, func(uint64) {})
+		return sum, err
+	}
+}
+
+// writeManifest writes m to the manifest files in o, if any
+func writeManifest(m internal.Manifest, o Options) {
+	if o.Manifest != "" {
+		err := m.WriteJSON(o.Manifest)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if o.SHA256Sums != "" {
+		err := m.WriteSHA256Sums(o.SHA256Sums)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
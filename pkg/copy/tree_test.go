@@ -0,0 +1,270 @@
+package copy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/copy"
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"github.com/snasphysicist/go-copy/pkg/random"
+	"golang.org/x/net/webdav"
+)
+
+// writeTree writes files (relative path to content) under dir
+func writeTree(t *testing.T, dir string, files map[string][]byte) {
+	for path, content := range files {
+		full := filepath.Join(dir, filepath.FromSlash(path))
+		err := os.MkdirAll(filepath.Dir(full), 0755)
+		if err != nil {
+			t.Fatalf("Failed to create directory for %s with %v", path, err)
+		}
+		writeFile(full, content)
+	}
+}
+
+// verifyTree verifies the tree under root against m,
+// hashing the files with HashFiles, 2 in parallel
+func verifyTree(root string, m internal.Manifest) (internal.Verification, error) {
+	pr := internal.NewProgressReporter(0, nil)
+	return internal.VerifyWith(root, m, func(files []internal.Checksum) []internal.HashResult {
+		return internal.HashFiles(files, 2, &pr)
+	})
+}
+
+// testTree returns the content of a small tree of files
+func testTree() map[string][]byte {
+	return map[string][]byte{
+		"top.bin":           random.Bytes(1000),
+		"sub/middle.bin":    random.Bytes(2000),
+		"sub/deeper/bottom": random.Bytes(3000),
+		"empty":             {},
+	}
+}
+
+func TestTreeCopiesTreePreservingMetadata(t *testing.T) {
+	files := testTree()
+	from := t.TempDir()
+	writeTree(t, from, files)
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	_ = os.Chmod(filepath.Join(from, "top.bin"), 0600)
+	_ = os.Chtimes(filepath.Join(from, "top.bin"), mtime, mtime)
+	_ = os.Symlink("top.bin", filepath.Join(from, "link"))
+	to := filepath.Join(t.TempDir(), "copy")
+	copy.Copy(from, to, copy.Options{BufferSizeBytes: 500, SyncEachBytes: 1000})
+	for path, content := range files {
+		written, err := os.ReadFile(filepath.Join(to, filepath.FromSlash(path)))
+		if err != nil {
+			t.Errorf("Failed to read copied %s with %v", path, err)
+		}
+		if !reflect.DeepEqual(content, written) && len(content) != 0 {
+			t.Errorf("Copied content of %s did not match source", path)
+		}
+	}
+	info, err := os.Stat(filepath.Join(to, "top.bin"))
+	if err != nil {
+		t.Fatalf("Failed to stat copy with %v", err)
+	}
+	if info.Mode().Perm() != 0600 || !info.ModTime().Equal(mtime) {
+		t.Errorf("Copy has mode %v & modification time %v, expected 0600 & %v", info.Mode(), info.ModTime(), mtime)
+	}
+	link, err := os.Readlink(filepath.Join(to, "link"))
+	if err != nil || link != "top.bin" {
+		t.Errorf("Copied symlink links to %s (error %v), expected top.bin", link, err)
+	}
+}
+
+func TestTreeUploadsToWebDAVSkippingIdenticalFiles(t *testing.T) {
+	files := testTree()
+	from := t.TempDir()
+	writeTree(t, from, files)
+	past := time.Now().Add(-time.Hour)
+	for path := range files {
+		_ = os.Chtimes(filepath.Join(from, filepath.FromSlash(path)), past, past)
+	}
+	var puts int32
+	handler := &webdav.Handler{FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			atomic.AddInt32(&puts, 1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	copy.Copy(from, server.URL+"/backup", copy.Options{BufferSizeBytes: 500, SyncEachBytes: 1000, SkipIdentical: true})
+	if atomic.LoadInt32(&puts) != int32(len(files)) {
+		t.Errorf("%d files uploaded, expected %d", atomic.LoadInt32(&puts), len(files))
+	}
+	resp, err := http.Get(server.URL + "/backup/sub/deeper/bottom")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to download uploaded file, error %v", err)
+	}
+	_ = resp.Body.Close()
+	writeFile(filepath.Join(from, "top.bin"), random.Bytes(10))
+	copy.Copy(from, server.URL+"/backup", copy.Options{BufferSizeBytes: 500, SyncEachBytes: 1000, SkipIdentical: true})
+	if atomic.LoadInt32(&puts) != int32(len(files))+1 {
+		t.Errorf("%d files uploaded in total, expected only the changed file again", atomic.LoadInt32(&puts))
+	}
+}
+
+func TestTreeCopiesFilesWhosePathsLookLikeZipMembers(t *testing.T) {
+	files := map[string][]byte{"x.zip!/y": random.Bytes(100)}
+	from := t.TempDir()
+	writeTree(t, from, files)
+	to := filepath.Join(t.TempDir(), "copy")
+	copy.Copy(from, to, copy.Options{BufferSizeBytes: 500, SyncEachBytes: 1000})
+	written, err := os.ReadFile(filepath.Join(to, "x.zip!", "y"))
+	if err != nil || !reflect.DeepEqual(written, files["x.zip!/y"]) {
+		t.Errorf("x.zip!/y copied as %d bytes (error %v), expected its content", len(written), err)
+	}
+}
+
+func TestTreeWritesManifestOfEveryFileIncludingSkipped(t *testing.T) {
+	files := testTree()
+	from := t.TempDir()
+	writeTree(t, from, files)
+	to := filepath.Join(t.TempDir(), "copy")
+	copy.Copy(from, to, copy.Options{BufferSizeBytes: 500, SyncEachBytes: 1000})
+	dir := t.TempDir()
+	o := copy.Options{
+		BufferSizeBytes: 500,
+		SyncEachBytes:   1000,
+		SkipIdentical:   true,
+		Manifest:        filepath.Join(dir, "m.json"),
+		SHA256Sums:      filepath.Join(dir, "SHA256SUMS"),
+	}
+	writeFile(filepath.Join(from, "top.bin"), random.Bytes(10))
+	copy.Copy(from, to, o)
+	m, err := internal.ReadManifest(o.Manifest)
+	if err != nil {
+		t.Fatalf("Failed to read manifest with %v", err)
+	}
+	if len(m.Files) != len(files) {
+		t.Errorf("Manifest lists %d files, expected %d", len(m.Files), len(files))
+	}
+	sums, err := internal.ReadManifest(o.SHA256Sums)
+	if err != nil || sums.Root != m.Root {
+		t.Errorf("SHA256SUMS has root %s (error %v), expected %s as in the JSON manifest", sums.Root, err, m.Root)
+	}
+	v, err := verifyTree(to, m)
+	if err != nil || !v.OK() {
+		t.Errorf("Copy did not verify against its manifest, %+v (error %v)", v, err)
+	}
+}
+
+func TestTreeRefusesManifestOfCompressedCopy(t *testing.T) {
+	from := t.TempDir()
+	writeTree(t, from, testTree())
+	to := filepath.Join(t.TempDir(), "copy")
+	defer func() {
+		if recover() == nil {
+			t.Error("Wrote a manifest of a compressed copy")
+		}
+		if _, err := os.Stat(to); !os.IsNotExist(err) {
+			t.Errorf("Copied before refusing the manifest, destination %v", err)
+		}
+	}()
+	copy.Copy(from, to, copy.Options{BufferSizeBytes: 500, SyncEachBytes: 1000, Compress: internal.Gzip, Manifest: filepath.Join(t.TempDir(), "m.json")})
+}
+
+func TestTreeRefusesSkippingUpToDateFilesOfEncryptedCopy(t *testing.T) {
+	for description, o := range map[string]copy.Options{
+		"skip identical":  {SkipIdentical: true},
+		"update":          {Update: true},
+		"update checksum": {Update: true, Checksum: true},
+	} {
+		t.Run(description, func(t *testing.T) {
+			from := t.TempDir()
+			writeTree(t, from, testTree())
+			to := filepath.Join(t.TempDir(), "copy")
+			defer func() {
+				if recover() == nil {
+					t.Error("Skipped up to date files of an encrypted copy")
+				}
+				if _, err := os.Stat(to); !os.IsNotExist(err) {
+					t.Errorf("Copied before refusing to skip, destination %v", err)
+				}
+			}()
+			o.BufferSizeBytes = 500
+			o.SyncEachBytes = 1000
+			o.Encrypt = internal.ChaCha20Poly1305
+			o.Key = internal.PassphraseKey([]byte("secret"))
+			copy.Copy(from, to, o)
+		})
+	}
+}
+
+func TestTreeUpdateOnlyCopiesFilesWhichAreOutOfDate(t *testing.T) {
+	from := t.TempDir()
+	to := t.TempDir()
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	same := random.Bytes(1000)
+	writeTree(t, from, map[string][]byte{"newer": []byte("source"), "same": same, "changed": []byte("source")})
+	writeTree(t, to, map[string][]byte{"newer": []byte("destination"), "same": same, "changed": []byte("stale!")})
+	for path, mtime := range map[string]time.Time{"newer": old, "same": recent, "changed": recent} {
+		_ = os.Chtimes(filepath.Join(from, path), mtime, mtime)
+	}
+	for path, mtime := range map[string]time.Time{"newer": recent, "same": old, "changed": old} {
+		_ = os.Chtimes(filepath.Join(to, path), mtime, mtime)
+	}
+	copy.Copy(from, to, copy.Options{BufferSizeBytes: 500, SyncEachBytes: 1000, Update: true, Checksum: true})
+	for path, expected := range map[string]string{"newer": "destination", "same": string(same), "changed": "source"} {
+		written, _ := os.ReadFile(filepath.Join(to, path))
+		if string(written) != expected {
+			t.Errorf("%s contains %q after update, expected %q", path, written, expected)
+		}
+	}
+	info, _ := os.Stat(filepath.Join(to, "same"))
+	if !info.ModTime().Equal(old) {
+		t.Errorf("File with the same content was copied, modification time now %v", info.ModTime())
+	}
+}
+
+func TestTreeUpdateManifestDescribesNewerFilesAsAtTheDestination(t *testing.T) {
+	from := t.TempDir()
+	to := t.TempDir()
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeTree(t, from, map[string][]byte{"newer": []byte("source"), "changed": []byte("source")})
+	writeTree(t, to, map[string][]byte{"newer": []byte("destination"), "changed": []byte("stale!")})
+	for path, mtime := range map[string]time.Time{"newer": old, "changed": recent} {
+		_ = os.Chtimes(filepath.Join(from, path), mtime, mtime)
+	}
+	for path, mtime := range map[string]time.Time{"newer": recent, "changed": old} {
+		_ = os.Chtimes(filepath.Join(to, path), mtime, mtime)
+	}
+	manifest := filepath.Join(t.TempDir(), "m.json")
+	copy.Copy(from, to, copy.Options{BufferSizeBytes: 500, SyncEachBytes: 1000, Update: true, Manifest: manifest})
+	m, err := internal.ReadManifest(manifest)
+	if err != nil {
+		t.Fatalf("Failed to read manifest with %v", err)
+	}
+	v, err := verifyTree(to, m)
+	if err != nil || !v.OK() {
+		t.Errorf("Updated copy did not verify against its manifest, %+v (error %v)", v, err)
+	}
+}
+
+func TestTreeCopiesOnlyWhatFilterIncludes(t *testing.T) {
+	from := t.TempDir()
+	writeTree(t, from, map[string][]byte{"keep.txt": random.Bytes(100), "drop.tmp": random.Bytes(100), ".git/HEAD": random.Bytes(10)})
+	to := filepath.Join(t.TempDir(), "copy")
+	copy.Copy(from, to, copy.Options{
+		BufferSizeBytes: 500,
+		SyncEachBytes:   1000,
+		Filter:          internal.Filter{Rules: []internal.FilterRule{{Pattern: "*.tmp"}, {Pattern: ".git/"}}},
+	})
+	entries, err := internal.WalkTree(to)
+	if err != nil {
+		t.Fatalf("Failed to walk copy with %v", err)
+	}
+	if len(entries) != 1 || entries[0].Path != "keep.txt" {
+		t.Errorf("Copied %v, expected only keep.txt", entries)
+	}
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"strings"
+)
+
+// extractionGuard keeps the entries of an archive being
+// extracted inside the destination, by cleaning their
+// paths and refusing any which would be written through
+// a symlink extracted earlier
+type extractionGuard struct {
+	symlinks map[string]bool
+}
+
+// newExtractionGuard creates a guard for a new extraction
+func newExtractionGuard() extractionGuard {
+	return extractionGuard{symlinks: make(map[string]bool)}
+}
+
+// allow returns the path relative to the destination at which to
+// extract the entry called name described by info, & false if it
+// shouldn't be extracted at all (which is logged, if not obvious)
+func (eg extractionGuard) allow(name string, info fs.FileInfo) (string, bool) {
+	// anything trying to climb out of the destination is kept in it
+	p := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if p == "" {
+		return "", false
+	}
+	isSymlink := info.Mode()&fs.ModeSymlink != 0
+	if eg.underSymlink(p) || (eg.symlinks[p] && !isSymlink) {
+		log.Printf("WARNING: skipping %s, which would be written through a symlink in the archive", p)
+		return "", false
+	}
+	if isSymlink {
+		eg.symlinks[p] = true
+	}
+	return p, true
+}
+
+// underSymlink returns true if any parent
+// of p was extracted as a symlink
+func (eg extractionGuard) underSymlink(p string) bool {
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		if eg.symlinks[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveEntry is an rsource reading the content
+// of an entry in an archive which is already open
+type archiveEntry struct {
+	r io.Reader
+}
+
+// Open implements rsource on archiveEntry,
+// the archive is already open so this does nothing
+func (ae *archiveEntry) Open() error {
+	return nil
+}
+
+// Read implements rsource on archiveEntry
+func (ae *archiveEntry) Read(b []byte) (int, error) {
+	return ae.r.Read(b)
+}
+
+// Close implements rsource on archiveEntry, the archive
+// is closed once extracted, so this does nothing
+func (ae *archiveEntry) Close() error {
+	return nil
+}
+
+// extractable is an archive whose entries can be extracted
+type extractable interface {
+	// Open starts reading the archive
+	Open() error
+	// Next moves on to the next entry in the archive, returning
+	// it & what it links to if it's a symlink, or io.EOF at the end
+	Next() (TreeEntry, string, error)
+	// Entry returns a source reading the content of the current
+	// entry, which must be read before moving on to the next
+	Entry() rsource
+	// Close closes the archive
+	Close() error
+}
+
+// ArchiveFor returns the archive to extract at path, as given by the
+// user, read from source (which may be decrypting the archive), the
+// bytes consumed from the source being reported to pr, unless pr is nil.
+// Zip archives (by their suffix) are read from path itself, which must
+// be a local, unencrypted file, as their index is at their end.
+// Anything else is read as a tar archive, compressed or not.
+func ArchiveFor(path string, source rsource, pr *ProgressReporter) extractable {
+	if !IsZip(path) {
+		return NewTarArchive(source, pr)
+	}
+	_, local := source.(*SourceFile)
+	if !local {
+		panic(fmt.Sprintf("Cannot extract %s, zip archives can only be extracted from local, unencrypted files", path))
+	}
+	return NewZipArchive(path, pr)
+}
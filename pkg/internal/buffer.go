@@ -5,14 +5,29 @@ import "sync"
 // buffer offers a synchronised byte buffer with
 // and upper limit on its size
 type buffer struct {
-	b   []byte
-	max uint64
-	l   *sync.Mutex
+	b     []byte
+	max   uint64
+	block uint64
+	l     *sync.Mutex
 }
 
+// DefaultWriteBlockBytes is the most bytes popped
+// from a buffer at once, unless configured otherwise
+const DefaultWriteBlockBytes = 1024
+
 // NewBuffer returns a new buffer with default size
 func NewBuffer(size uint64) buffer {
-	return buffer{b: make([]byte, 0), max: size, l: &sync.Mutex{}}
+	return NewBlockBuffer(size, DefaultWriteBlockBytes)
+}
+
+// NewBlockBuffer returns a new buffer holding up to size bytes,
+// from which up to block bytes are popped at once (0 meaning
+// DefaultWriteBlockBytes), so that they're written in blocks of that size
+func NewBlockBuffer(size uint64, block uint64) buffer {
+	if block == 0 {
+		block = DefaultWriteBlockBytes
+	}
+	return buffer{b: make([]byte, 0), max: size, block: block, l: &sync.Mutex{}}
 }
 
 // Offer attempts to add the provided bytes to the buffer,
@@ -28,12 +43,12 @@ func (b *buffer) Offer(byt []byte) bool {
 	return true
 }
 
-// Pop returns the first available up to 1024 bytes
-// from the buffer, and removes them from the buffer
+// Pop returns the first available bytes (up to the
+// buffer's block size) & removes them from the buffer
 func (b *buffer) Pop() ([]byte, error) {
 	b.l.Lock()
 	defer b.l.Unlock()
-	n := Minimum(1024, uint64(len(b.b)))
+	n := Minimum(b.block, uint64(len(b.b)))
 	toPop := b.b[:n]
 	b.b = b.b[n:]
 	return toPop, nil
@@ -104,3 +104,13 @@ func TestBytesPoppedAreRemovedFromBufferTest(t *testing.T) {
 		t.Errorf("%v error returned from pop, expected none", err)
 	}
 }
+
+func TestBlockBufferPopsUpToItsBlockSize(t *testing.T) {
+	b := internal.NewBlockBuffer(10000, 4096)
+	b.Offer(make([]byte, 5000))
+	first, _ := b.Pop()
+	second, _ := b.Pop()
+	if len(first) != 4096 || len(second) != 904 {
+		t.Errorf("Popped %d then %d bytes, expected 4096 then 904", len(first), len(second))
+	}
+}
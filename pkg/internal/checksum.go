@@ -1,11 +1,20 @@
 package internal
 
 import (
+	"bufio"
 	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
+	"fmt"
 	"hash"
 	"io"
 	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
 )
 
 // appendToHash append the complete content of b to h,
@@ -44,3 +53,181 @@ func MD5Sum(r io.Reader, bufferSizeBytes int) string {
 		appendToHash(h, b[:n], false)
 	}
 }
+
+// Hash algorithms which files can be hashed with, by their
+// names in the BSD format of checksums (also that of --tag)
+const (
+	MD5    = "MD5"
+	SHA1   = "SHA1"
+	SHA256 = "SHA256"
+	SHA512 = "SHA512"
+)
+
+// HashAlgorithms lists all supported hash algorithms
+var HashAlgorithms = []string{MD5, SHA1, SHA256, SHA512}
+
+// NewHash returns a new hash for algorithm, matched
+// case insensitively against HashAlgorithms
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch strings.ToUpper(algorithm) {
+	case MD5:
+		return md5.New(), nil
+	case SHA1:
+		return sha1.New(), nil
+	case SHA256:
+		return sha256.New(), nil
+	case SHA512:
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %s, must be one of %v", algorithm, HashAlgorithms)
+}
+
+// HashFile returns the hash with algorithm of the content of the
+// local file at path (or stdin for -) & its size, calling count
+// with the bytes hashed as it goes
+func HashFile(path string, algorithm string, count func(uint64)) ([]byte, int64, error) {
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return nil, 0, err
+	}
+	var r io.Reader = os.Stdin
+	if path != StandardStream {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer f.Close()
+		r = f
+	}
+	n, err := io.Copy(h, &countingReader{r: r, count: count})
+	return h.Sum(nil), n, err
+}
+
+// Checksum is the hex encoded Sum of the file at Path with Algorithm,
+// as in a line of the output of (e.g.) sha256sum
+type Checksum struct {
+	Path      string
+	Algorithm string
+	Sum       string
+}
+
+// checksumEscaper escapes the paths in checksums
+// as coreutils does, so each is on a single line
+var checksumEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r")
+
+// checksumUnescaper reverses checksumEscaper
+var checksumUnescaper = strings.NewReplacer("\\\\", "\\", "\\n", "\n", "\\r", "\r")
+
+// bsdChecksum matches a checksum in BSD format, ALGORITHM (path) = sum
+var bsdChecksum = regexp.MustCompile(`^([A-Za-z0-9]+) \((.*)\) = ([0-9a-fA-F]+)$`)
+
+// FormatChecksum formats c as coreutils does, in GNU format
+// (sum  path) or in BSD format (ALGORITHM (path) = sum) if bsd.
+// Paths with backslashes or newlines are escaped & the line
+// starts with a backslash, as coreutils does.
+func FormatChecksum(c Checksum, bsd bool) string {
+	escaped := checksumEscaper.Replace(c.Path)
+	prefix := ""
+	if escaped != c.Path {
+		prefix = "\\"
+	}
+	if bsd {
+		return fmt.Sprintf("%s%s (%s) = %s", prefix, strings.ToUpper(c.Algorithm), escaped, c.Sum)
+	}
+	return fmt.Sprintf("%s%s  %s", prefix, c.Sum, escaped)
+}
+
+// ParseChecksum parses a line formatted by FormatChecksum (or coreutils),
+// lines in GNU format being taken to be hashed with algorithm
+func ParseChecksum(line string, algorithm string) (Checksum, error) {
+	line = strings.TrimSuffix(line, "\r")
+	escaped := strings.HasPrefix(line, "\\")
+	line = strings.TrimPrefix(line, "\\")
+	var c Checksum
+	if m := bsdChecksum.FindStringSubmatch(line); m != nil {
+		c = Checksum{Path: m[2], Algorithm: strings.ToUpper(m[1]), Sum: strings.ToLower(m[3])}
+	} else {
+		sum, p, found := strings.Cut(line, " ")
+		if !found || (!strings.HasPrefix(p, " ") && !strings.HasPrefix(p, "*")) {
+			return Checksum{}, fmt.Errorf("%q is not a checksum", line)
+		}
+		// coreutils marks files read in binary mode with *
+		c = Checksum{Path: p[1:], Algorithm: strings.ToUpper(algorithm), Sum: strings.ToLower(sum)}
+	}
+	if escaped {
+		c.Path = checksumUnescaper.Replace(c.Path)
+	}
+	h, err := NewHash(c.Algorithm)
+	if err != nil {
+		return Checksum{}, err
+	}
+	_, err = hex.DecodeString(c.Sum)
+	if err != nil || len(c.Sum) != 2*h.Size() {
+		return Checksum{}, fmt.Errorf("%s is not a %s sum", c.Sum, c.Algorithm)
+	}
+	return c, nil
+}
+
+// ReadChecksums reads the checksums in r, one per line, in GNU (taken
+// to be hashed with algorithm) or BSD format, also returning the number
+// of lines which weren't checksums (empty lines & comments are ignored)
+func ReadChecksums(r io.Reader, algorithm string) ([]Checksum, int, error) {
+	checksums := make([]Checksum, 0)
+	improper := 0
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if s.Text() == "" || strings.HasPrefix(s.Text(), "#") {
+			continue
+		}
+		c, err := ParseChecksum(s.Text(), algorithm)
+		if err != nil {
+			improper++
+			continue
+		}
+		checksums = append(checksums, c)
+	}
+	return checksums, improper, s.Err()
+}
+
+// HashResult is the result of hashing a file with HashFiles
+type HashResult struct {
+	// Checksum is that of the file as calculated,
+	// Sum being empty if it couldn't be
+	Checksum Checksum
+	Err      error
+}
+
+// HashFiles hashes the local files in files with their algorithms, workers
+// in parallel, reporting the bytes hashed to pr as both read & written
+// (there being nothing to write, they're done once read). The results are
+// in the same order as files, whose sums (if any) are ignored.
+func HashFiles(files []Checksum, workers int, pr *ProgressReporter) []HashResult {
+	hashed := func(n uint64) {
+		pr.ReportBytesRead(n)
+		pr.ReportBytesWritten(n)
+	}
+	results := make([]HashResult, len(files))
+	toHash := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < max(workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range toHash {
+				c := files[i]
+				sum, _, err := HashFile(c.Path, c.Algorithm, hashed)
+				c.Sum = ""
+				if err == nil {
+					c.Sum = hex.EncodeToString(sum)
+				}
+				results[i] = HashResult{Checksum: c, Err: err}
+			}
+		}()
+	}
+	for i := range files {
+		toHash <- i
+	}
+	close(toHash)
+	wg.Wait()
+	return results
+}
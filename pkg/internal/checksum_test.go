@@ -2,6 +2,8 @@ package internal_test
 
 import (
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/snasphysicist/go-copy/pkg/internal"
@@ -17,3 +19,67 @@ func TestMD5SumTestFileMatchesCommandLineMD5Sum(t *testing.T) {
 		t.Errorf("Calculated md5sum %s, expected 7915fab42d254ffc3fbd14174217775f", sum)
 	}
 }
+
+func TestFormattedChecksumsParseBackInGNUAndBSDFormats(t *testing.T) {
+	for _, bsd := range []bool{false, true} {
+		for _, p := range []string{"plain.txt", "with space", "back\\slash", "new\nline"} {
+			c := internal.Checksum{Path: p, Algorithm: internal.MD5, Sum: "7915fab42d254ffc3fbd14174217775f"}
+			line := internal.FormatChecksum(c, bsd)
+			parsed, err := internal.ParseChecksum(line, internal.MD5)
+			if err != nil {
+				t.Fatalf("Failed to parse %q: %v", line, err)
+			}
+			if parsed != c {
+				t.Errorf("Formatted %#v as %q, which parsed as %#v", c, line, parsed)
+			}
+		}
+	}
+}
+
+func TestChecksumsInCoreutilsFormatsAreRead(t *testing.T) {
+	sums := "7915fab42d254ffc3fbd14174217775f  checksumme.txt\n" +
+		"7915fab42d254ffc3fbd14174217775f *binary.txt\n" +
+		"SHA1 (tagged.txt) = da39a3ee5e6b4b0d3255bfef95601890afd80709\n" +
+		"\n" +
+		"7915fab4  too-short.txt\n" +
+		"not a checksum\n"
+	checksums, improper, err := internal.ReadChecksums(strings.NewReader(sums), internal.MD5)
+	if err != nil {
+		t.Fatalf("Failed to read checksums: %v", err)
+	}
+	expected := []internal.Checksum{
+		{Path: "checksumme.txt", Algorithm: internal.MD5, Sum: "7915fab42d254ffc3fbd14174217775f"},
+		{Path: "binary.txt", Algorithm: internal.MD5, Sum: "7915fab42d254ffc3fbd14174217775f"},
+		{Path: "tagged.txt", Algorithm: internal.SHA1, Sum: "da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+	}
+	if !reflect.DeepEqual(checksums, expected) {
+		t.Errorf("Read %#v, expected %#v", checksums, expected)
+	}
+	if improper != 2 {
+		t.Errorf("Counted %d improperly formatted lines, expected 2", improper)
+	}
+}
+
+func TestHashFilesReturnsSumsInOrderWithErrorsForUnreadableFiles(t *testing.T) {
+	files := []internal.Checksum{
+		{Path: "checksumme.txt", Algorithm: internal.MD5},
+		{Path: "does-not-exist.txt", Algorithm: internal.MD5},
+		{Path: "checksumme.txt", Algorithm: internal.MD5},
+	}
+	pr := internal.NewProgressReporter(0, nil)
+	results := internal.HashFiles(files, 2, &pr)
+	if len(results) != 3 {
+		t.Fatalf("Got %d results for 3 files", len(results))
+	}
+	for _, i := range []int{0, 2} {
+		if results[i].Err != nil || results[i].Checksum.Sum != "7915fab42d254ffc3fbd14174217775f" {
+			t.Errorf("Result %d was %#v, expected the md5sum of checksumme.txt", i, results[i])
+		}
+	}
+	if results[1].Err == nil {
+		t.Errorf("Hashing a missing file did not fail")
+	}
+	if pr.BytesRead() == 0 || pr.BytesRead() != pr.BytesWritten() {
+		t.Errorf("Reported %d bytes read & %d written while hashing", pr.BytesRead(), pr.BytesWritten())
+	}
+}
@@ -0,0 +1,328 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// The compression formats which can be used
+// to compress a source as it is read
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+	Xz   = "xz"
+)
+
+// Compressions lists all supported compression formats
+var Compressions = []string{Gzip, Zstd, Xz}
+
+// magicBytes are the bytes each compression
+// format's streams start with, used to detect it
+var magicBytes = map[string][]byte{
+	Gzip: {0x1f, 0x8b},
+	Zstd: {0x28, 0xb5, 0x2f, 0xfd},
+	Xz:   {0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00},
+}
+
+// countingReader passes reads through to r,
+// calling count with the number of bytes read each time
+type countingReader struct {
+	r     io.Reader
+	count func(uint64)
+}
+
+// Read implements io.Reader on countingReader
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.count(uint64(n))
+	return n, err
+}
+
+// consumedFrom returns a reader which reads from r, reporting
+// the bytes read as consumed from the source to pr,
+// or just r if pr is nil
+func consumedFrom(r io.Reader, pr *ProgressReporter) io.Reader {
+	if pr == nil {
+		return r
+	}
+	return &countingReader{r: r, count: pr.ReportSourceBytesConsumed}
+}
+
+// compressingSource is an rsource which compresses
+// the bytes from another rsource as they are read
+type compressingSource struct {
+	source      rsource
+	compression string
+	pr          *ProgressReporter
+	r           *io.PipeReader
+}
+
+// NewCompressingSource wraps source such that reading
+// it reads the source compressed with compression
+// (one of Compressions), the bytes consumed from the
+// source itself are reported to pr, unless pr is nil
+// (e.g. when source is itself a transformation which
+// reports the bytes consumed from the original source)
+func NewCompressingSource(source rsource, compression string, pr *ProgressReporter) *compressingSource {
+	return &compressingSource{source: source, compression: compression, pr: pr}
+}
+
+// Open implements rsource on compressingSource, opening
+// the wrapped source and starting compressing its content
+func (cs *compressingSource) Open() error {
+	err := cs.source.Open()
+	if err != nil {
+		return err
+	}
+	if !contains(Compressions, cs.compression) {
+		return fmt.Errorf("unknown compression %s, should be one of %v", cs.compression, Compressions)
+	}
+	r, w := io.Pipe()
+	cs.r = r
+	source := consumedFrom(cs.source, cs.pr)
+	go func() {
+		// some compressors write a header on creation,
+		// which would block on the pipe if done outside here
+		c, err := compressor(cs.compression, w)
+		if err != nil {
+			w.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(c, source)
+		if err == nil {
+			err = c.Close()
+		}
+		w.CloseWithError(err)
+	}()
+	return nil
+}
+
+// Read implements rsource on compressingSource,
+// reading the compressed bytes
+func (cs *compressingSource) Read(b []byte) (int, error) {
+	return cs.r.Read(b)
+}
+
+// Close implements rsource on compressingSource,
+// closing the wrapped source
+func (cs *compressingSource) Close() error {
+	_ = cs.r.Close()
+	return cs.source.Close()
+}
+
+// compressor returns a writer which compresses bytes written
+// to it with compression and writes them on to w
+func compressor(compression string, w io.Writer) (io.WriteCloser, error) {
+	switch compression {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	case Xz:
+		return xz.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression %s, should be one of %v", compression, Compressions)
+}
+
+// decompressingSource is an rsource which decompresses
+// the bytes from another rsource as they are read,
+// detecting the compression format from its first bytes
+type decompressingSource struct {
+	source rsource
+	pr     *ProgressReporter
+	r      io.ReadCloser
+}
+
+// NewDecompressingSource wraps source such that reading
+// it reads the source decompressed, the bytes consumed
+// from the (compressed) source itself are reported to pr,
+// unless pr is nil
+func NewDecompressingSource(source rsource, pr *ProgressReporter) *decompressingSource {
+	return &decompressingSource{source: source, pr: pr}
+}
+
+// Open implements rsource on decompressingSource, opening
+// the wrapped source and detecting its compression format,
+// erroring if it isn't compressed in a supported format
+func (ds *decompressingSource) Open() error {
+	err := ds.source.Open()
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(consumedFrom(ds.source, ds.pr))
+	compression, err := DetectCompression(br)
+	if err != nil {
+		return err
+	}
+	ds.r, err = decompressor(compression, br)
+	return err
+}
+
+// Read implements rsource on decompressingSource,
+// reading the decompressed bytes
+func (ds *decompressingSource) Read(b []byte) (int, error) {
+	return ds.r.Read(b)
+}
+
+// Close implements rsource on decompressingSource,
+// closing the wrapped source
+func (ds *decompressingSource) Close() error {
+	if ds.r != nil {
+		_ = ds.r.Close()
+	}
+	return ds.source.Close()
+}
+
+// DetectCompression peeks at the first bytes from br
+// and returns which of Compressions they are compressed with,
+// erroring if none match
+func DetectCompression(br *bufio.Reader) (string, error) {
+	for _, compression := range Compressions {
+		magic := magicBytes[compression]
+		start, err := br.Peek(len(magic))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		if bytes.Equal(start, magic) {
+			return compression, nil
+		}
+	}
+	return "", fmt.Errorf("source is not compressed with any of %v", Compressions)
+}
+
+// DecompressedSize returns the size of the local file at path once
+// decompressed, where its compression format records it (in zstd frame
+// headers & xz indexes, not gzip, which only records it modulo 4GiB),
+// ok being false if it doesn't. Where a file has several zstd frames
+// or xz streams, only the first frame or last stream is counted,
+// so the size is only ever too small.
+func DecompressedSize(path string) (size uint64, ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	compression, err := DetectCompression(bufio.NewReader(f))
+	if err != nil {
+		return 0, false, nil
+	}
+	switch compression {
+	case Zstd:
+		return zstdContentSize(f)
+	case Xz:
+		return xzIndexedSize(f)
+	}
+	return 0, false, nil
+}
+
+// zstdContentSize returns the content size recorded
+// in the header of the first zstd frame in f, if any
+func zstdContentSize(f *os.File) (uint64, bool, error) {
+	b := make([]byte, zstd.HeaderMaxSize)
+	n, err := f.ReadAt(b, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, false, err
+	}
+	var h zstd.Header
+	err = h.Decode(b[:n])
+	if err != nil {
+		return 0, false, err
+	}
+	return h.FrameContentSize, h.HasFCS, nil
+}
+
+// xzIndexedSize returns the total uncompressed size of the
+// blocks listed in the index of the last xz stream in f
+func xzIndexedSize(f *os.File) (uint64, bool, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	end := info.Size()
+	footer := make([]byte, 12)
+	// streams may be followed by padding, in multiples of 4 zeros
+	for {
+		if end < 12 {
+			return 0, false, errors.New("xz stream has no footer")
+		}
+		_, err = f.ReadAt(footer, end-12)
+		if err != nil {
+			return 0, false, err
+		}
+		if !bytes.Equal(footer[8:], make([]byte, 4)) {
+			break
+		}
+		end -= 4
+	}
+	if string(footer[10:]) != "YZ" {
+		return 0, false, errors.New("xz stream has no footer")
+	}
+	backwardSize := (int64(binary.LittleEndian.Uint32(footer[4:8])) + 1) * 4
+	if backwardSize > end-12 {
+		return 0, false, errors.New("xz stream's index is larger than the file")
+	}
+	index := make([]byte, backwardSize)
+	_, err = f.ReadAt(index, end-12-backwardSize)
+	if err != nil {
+		return 0, false, err
+	}
+	if index[0] != 0 {
+		return 0, false, errors.New("xz stream's index is missing")
+	}
+	r := bytes.NewReader(index[1:])
+	records, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, false, err
+	}
+	size := uint64(0)
+	for i := uint64(0); i < records; i++ {
+		_, err = binary.ReadUvarint(r)
+		if err != nil {
+			return 0, false, err
+		}
+		uncompressed, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, false, err
+		}
+		size += uncompressed
+	}
+	return size, true, nil
+}
+
+// decompressor returns a reader which decompresses
+// the bytes read from r, assuming compression
+func decompressor(compression string, r io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case Xz:
+		x, err := xz.NewReader(r)
+		return io.NopCloser(x), err
+	}
+	return nil, fmt.Errorf("unknown compression %s, should be one of %v", compression, Compressions)
+}
+
+// contains returns true if s is one of all
+func contains(all []string, s string) bool {
+	for _, a := range all {
+		if a == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package internal_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"github.com/snasphysicist/go-copy/pkg/random"
+)
+
+// readAll opens s and reads all of its content,
+// failing the test on any error
+func readAll(t *testing.T, s interface {
+	Open() error
+	io.ReadCloser
+}) []byte {
+	err := s.Open()
+	if err != nil {
+		t.Fatalf("Failed to open source with %v", err)
+	}
+	defer s.Close()
+	b, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatalf("Failed to read source with %v", err)
+	}
+	return b
+}
+
+func TestCompressedSourceDecompressesToOriginalContent(t *testing.T) {
+	for _, compression := range internal.Compressions {
+		content := bytes.Repeat(random.Bytes(100), 50)
+		pr := internal.NewProgressReporter(uint64(len(content)), make(chan struct{}))
+		cs := internal.NewCompressingSource(&mockSource{toRead: bytes.NewBuffer(content)}, compression, &pr)
+		compressed := readAll(t, cs)
+		if len(compressed) >= len(content) {
+			t.Errorf("%s compressed %d repetitive bytes to %d", compression, len(content), len(compressed))
+		}
+		if pr.SourceBytesConsumed() != uint64(len(content)) {
+			t.Errorf("%s reported %d bytes consumed, expected %d", compression, pr.SourceBytesConsumed(), len(content))
+		}
+		ds := internal.NewDecompressingSource(
+			&mockSource{toRead: bytes.NewBuffer(compressed)},
+			internal.From(internal.NewProgressReporter(0, make(chan struct{}))),
+		)
+		decompressed := readAll(t, ds)
+		if !bytes.Equal(content, decompressed) {
+			t.Errorf("%s decompressed content did not match original", compression)
+		}
+	}
+}
+
+func TestDetectCompressionFindsFormatOfCompressedContent(t *testing.T) {
+	for _, compression := range internal.Compressions {
+		pr := internal.NewProgressReporter(0, make(chan struct{}))
+		cs := internal.NewCompressingSource(&mockSource{toRead: bytes.NewBuffer(random.Bytes(20))}, compression, &pr)
+		compressed := readAll(t, cs)
+		detected, err := internal.DetectCompression(bufio.NewReader(bytes.NewBuffer(compressed)))
+		if err != nil {
+			t.Errorf("Failed to detect %s compression with %v", compression, err)
+		}
+		if detected != compression {
+			t.Errorf("Detected %s compression, expected %s", detected, compression)
+		}
+	}
+}
+
+func TestDetectCompressionErrorsWhenContentNotCompressed(t *testing.T) {
+	_, err := internal.DetectCompression(bufio.NewReader(bytes.NewBufferString("not compressed")))
+	if err == nil {
+		t.Error("No error detecting compression of uncompressed content")
+	}
+}
+
+func TestDecompressedSizeIsReadFromZstdHeaderAndXzIndex(t *testing.T) {
+	content := bytes.Repeat(random.Bytes(100), 500)
+	compressed := func(compression string) []byte {
+		pr := internal.NewProgressReporter(0, make(chan struct{}))
+		return readAll(t, internal.NewCompressingSource(&mockSource{toRead: bytes.NewBuffer(content)}, compression, &pr))
+	}
+	e, _ := zstd.NewWriter(nil)
+	for name, c := range map[string]struct {
+		compressed []byte
+		known      bool
+	}{
+		"zstd":         {compressed: e.EncodeAll(content, nil), known: true},
+		"xz":           {compressed: compressed(internal.Xz), known: true},
+		"padded xz":    {compressed: append(compressed(internal.Xz), make([]byte, 8)...), known: true},
+		"gzip":         {compressed: compressed(internal.Gzip), known: false},
+		"uncompressed": {compressed: content, known: false},
+	} {
+		path := filepath.Join(t.TempDir(), "image")
+		writeFile(t, path, c.compressed)
+		size, known, err := internal.DecompressedSize(path)
+		if err != nil || known != c.known || (known && size != uint64(len(content))) {
+			t.Errorf("%s decompressed size %d known %t (error %v), expected %d known %t", name, size, known, err, len(content), c.known)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// DefaultDeltaBlockBytes is the default size of the blocks
+// compared by a deltaTarget, large enough that comparing
+// isn't slowed by many small reads of the destination
+const DefaultDeltaBlockBytes = 64 * 1024
+
+// deltaTarget is a wtarget writing onto an existing local file (or
+// block device) in place, comparing each block of what's written with
+// what's already there, at the same offset, & only writing the blocks
+// which differ, so that re-copying a large file which has changed
+// little rewrites little. Data which has shifted, rather than changed,
+// differs at its new offset, so is rewritten. Blocks are counted as
+// written to the ProgressReporter whether or not they differed, those
+// which did are reported with ReportBytesChanged.
+type deltaTarget struct {
+	path      string
+	blockSize uint64
+	pr        *ProgressReporter
+	f         *os.File
+	regular   bool
+	// offset is where pending starts in the destination
+	offset  uint64
+	pending []byte
+	// existing is what's at offset in the destination, for comparing
+	existing []byte
+	// changed is true if blocks have been written since the last sync
+	changed bool
+}
+
+// NewDeltaTarget creates a new target writing onto the local file
+// (or block device) at path in place, comparing blocks of blockSize
+// bytes (or DefaultDeltaBlockBytes if 0), reporting bytes changed to pr
+func NewDeltaTarget(path string, blockSize uint64, pr *ProgressReporter) *deltaTarget {
+	if blockSize == 0 {
+		blockSize = DefaultDeltaBlockBytes
+	}
+	return &deltaTarget{path: path, blockSize: blockSize, pr: pr}
+}
+
+// Initialise implements wtarget on deltaTarget, opening the
+// destination without truncating it, creating it if it's missing
+func (dt *deltaTarget) Initialise() error {
+	info, err := os.Stat(dt.path)
+	if err == nil && !info.Mode().IsRegular() && !IsBlockDevice(dt.path) {
+		return fmt.Errorf("%s is not a file or block device, which can only be copied onto in place", dt.path)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	f, err := os.OpenFile(dt.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	dt.f = f
+	dt.regular = !IsBlockDevice(dt.path)
+	dt.pending = make([]byte, 0, dt.blockSize)
+	dt.existing = make([]byte, dt.blockSize)
+	return nil
+}
+
+// Write implements wtarget on deltaTarget, comparing & writing
+// blocks as they're filled. Bytes are accepted even when comparing
+// or writing their block fails, which is tried again by the next Write
+// (so a Writer retrying from where it got to retries the block).
+func (dt *deltaTarget) Write(b []byte) (int, error) {
+	if uint64(len(dt.pending)) == dt.room() {
+		err := dt.flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	for n < len(b) {
+		take := min(dt.room()-uint64(len(dt.pending)), uint64(len(b)-n))
+		dt.pending = append(dt.pending, b[n:n+int(take)]...)
+		n += int(take)
+		if uint64(len(dt.pending)) == dt.room() {
+			err := dt.flush()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// room returns how many bytes pending can hold, which
+// fills it to the end of the block it starts in
+func (dt *deltaTarget) room() uint64 {
+	return dt.blockSize - dt.offset%dt.blockSize
+}
+
+// flush compares the pending bytes with those at the same
+// offset in the destination, writing them if they differ
+func (dt *deltaTarget) flush() error {
+	if len(dt.pending) == 0 {
+		return nil
+	}
+	existing := dt.existing[:len(dt.pending)]
+	n, err := dt.f.ReadAt(existing, int64(dt.offset))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if n < len(dt.pending) || !bytes.Equal(existing, dt.pending) {
+		_, err = dt.f.WriteAt(dt.pending, int64(dt.offset))
+		if err != nil {
+			return err
+		}
+		dt.changed = true
+		dt.pr.ReportBytesChanged(uint64(len(dt.pending)))
+	}
+	dt.offset += uint64(len(dt.pending))
+	dt.pending = dt.pending[:0]
+	return nil
+}
+
+// Seek implements io.Seeker on deltaTarget for a Writer retrying
+// from where it got to, which is only ever at or before the end of
+// the pending bytes, dropping any after offset (only io.SeekStart)
+func (dt *deltaTarget) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart || offset < 0 {
+		return 0, fmt.Errorf("can only seek %s from its start", dt.path)
+	}
+	at := uint64(offset)
+	if at >= dt.offset && at <= dt.offset+uint64(len(dt.pending)) {
+		dt.pending = dt.pending[:at-dt.offset]
+		return offset, nil
+	}
+	dt.offset = at
+	dt.pending = dt.pending[:0]
+	return offset, nil
+}
+
+// Sync implements wtarget on deltaTarget, comparing & writing
+// any partial block, then flushing the destination if
+// anything has been written to it since the last sync
+func (dt *deltaTarget) Sync() error {
+	err := dt.flush()
+	if err != nil || !dt.changed {
+		return err
+	}
+	dt.changed = false
+	return dt.f.Sync()
+}
+
+// Close implements wtarget on deltaTarget, comparing & writing any
+// partial block, then cutting a destination file which was longer
+// than what was written down to size, flushing it before closing
+func (dt *deltaTarget) Close() error {
+	err := dt.flush()
+	if err == nil && dt.regular {
+		err = dt.truncate()
+	}
+	if err == nil {
+		err = dt.Sync()
+	}
+	closeErr := dt.f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Abort implements aborter on deltaTarget, closing the
+// destination without cutting it down to what was written,
+// so what's after that can still be compared on a retry
+func (dt *deltaTarget) Abort() error {
+	return dt.f.Close()
+}
+
+// truncate cuts the destination file down to the bytes written
+func (dt *deltaTarget) truncate() error {
+	info, err := dt.f.Stat()
+	if err != nil || uint64(info.Size()) <= dt.offset {
+		return err
+	}
+	dt.changed = true
+	return dt.f.Truncate(int64(dt.offset))
+}
@@ -0,0 +1,106 @@
+package internal_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"github.com/snasphysicist/go-copy/pkg/random"
+)
+
+// deltaWrite writes content onto the file at path in place, in
+// pieces of piece bytes, comparing blocks of blockSize, syncing
+// each sync bytes, returning the bytes reported changed
+func deltaWrite(t *testing.T, path string, content []byte, piece int, blockSize uint64, sync int) uint64 {
+	pr := internal.NewProgressReporter(uint64(len(content)), nil)
+	dt := internal.NewDeltaTarget(path, blockSize, &pr)
+	err := dt.Initialise()
+	if err != nil {
+		t.Fatalf("Failed to initialise with %v", err)
+	}
+	for i := 0; i < len(content); i += piece {
+		_, err = dt.Write(content[i:min(i+piece, len(content))])
+		if err != nil {
+			t.Fatalf("Failed to write with %v", err)
+		}
+		if sync != 0 && (i+piece)%sync == 0 {
+			err = dt.Sync()
+			if err != nil {
+				t.Fatalf("Failed to sync with %v", err)
+			}
+		}
+	}
+	err = dt.Close()
+	if err != nil {
+		t.Fatalf("Failed to close with %v", err)
+	}
+	return pr.BytesChanged()
+}
+
+func TestDeltaTargetOnlyWritesBlocksWhichDiffer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image")
+	existing := random.Bytes(4096)
+	writeFile(t, path, existing)
+	content := bytes.Clone(existing)
+	content[100] ^= 0xff
+	content[3000] ^= 0xff
+	changed := deltaWrite(t, path, content, 300, 1024, 0)
+	if changed != 2048 {
+		t.Errorf("Changed %d bytes, expected the 2 blocks which differ", changed)
+	}
+	assertFileContent(t, path, content)
+}
+
+func TestDeltaTargetComparesPartialBlocksWhenSyncing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image")
+	existing := random.Bytes(4096)
+	writeFile(t, path, existing)
+	content := bytes.Clone(existing)
+	content[1600] ^= 0xff
+	// syncs at 1500, part way through the second block
+	changed := deltaWrite(t, path, content, 500, 1024, 1500)
+	if changed != 548 {
+		t.Errorf("Changed %d bytes, expected the rest of the second block after the sync", changed)
+	}
+	assertFileContent(t, path, content)
+}
+
+func TestDeltaTargetGrowsAndShrinksDestination(t *testing.T) {
+	dir := t.TempDir()
+	for name, c := range map[string]struct{ existing, written int }{
+		"missing": {existing: -1, written: 3000},
+		"longer":  {existing: 1000, written: 3000},
+		"shorter": {existing: 5000, written: 3000},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			content := random.Bytes(c.written)
+			if c.existing >= 0 {
+				writeFile(t, path, append(bytes.Clone(content[:min(c.existing, c.written)]), random.Bytes(max(c.existing-c.written, 0))...))
+			}
+			deltaWrite(t, path, content, 700, 1024, 0)
+			assertFileContent(t, path, content)
+		})
+	}
+}
+
+// writeFile writes content to the file at path, failing the test on error
+func writeFile(t *testing.T, path string, content []byte) {
+	err := os.WriteFile(path, content, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write %s with %v", path, err)
+	}
+}
+
+// assertFileContent checks that the file at path contains expected
+func assertFileContent(t *testing.T, path string, expected []byte) {
+	actual, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s with %v", path, err)
+	}
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("%s has %d bytes which don't match the %d expected", path, len(actual), len(expected))
+	}
+}
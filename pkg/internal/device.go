@@ -0,0 +1,256 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// defaultLogicalBlockSize is the logical block size assumed when
+// it can't be asked for, that of nearly every disk
+const defaultLogicalBlockSize = 512
+
+// Device describes a local device as read or written
+type Device struct {
+	// Block is true for block devices (disks), which have a
+	// size & are read & written in blocks, false for character
+	// devices (e.g. terminals, /dev/null) which are streams
+	Block bool
+	// Size is the size of a block device in bytes
+	Size uint64
+	// LogicalBlockSize is the size of the blocks a block device
+	// is read & written in, to which reads & writes are aligned
+	LogicalBlockSize uint64
+}
+
+// IsDevice returns true if path is a local block or character device
+func IsDevice(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&fs.ModeDevice != 0
+}
+
+// IsBlockDevice returns true if path is a local block device
+func IsBlockDevice(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&fs.ModeDevice != 0 && info.Mode()&fs.ModeCharDevice == 0
+}
+
+// DeviceOf describes the device open as f. A regular file is
+// described as a block device of its size, standing in for one.
+func DeviceOf(f *os.File) (Device, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return Device{}, err
+	}
+	switch {
+	case info.Mode().IsRegular():
+		return Device{Block: true, Size: uint64(info.Size()), LogicalBlockSize: defaultLogicalBlockSize}, nil
+	case info.Mode()&fs.ModeCharDevice != 0:
+		return Device{Block: false, LogicalBlockSize: 1}, nil
+	case info.Mode()&fs.ModeDevice != 0:
+		size, logical, err := blockDeviceGeometry(f)
+		if err != nil {
+			return Device{}, fmt.Errorf("failed to get the size of block device %s: %w", f.Name(), err)
+		}
+		return Device{Block: true, Size: size, LogicalBlockSize: max(logical, 1)}, nil
+	}
+	return Device{}, fmt.Errorf("%s is not a device", f.Name())
+}
+
+// deviceSource is an rsource reading a local block device,
+// in multiples of its logical block size
+type deviceSource struct {
+	path   string
+	f      *os.File
+	r      *bufio.Reader
+	device Device
+}
+
+// NewDeviceSource creates a new source reading the block
+// device (or a regular file standing in for one) at path
+func NewDeviceSource(path string) *deviceSource {
+	return &deviceSource{path: path}
+}
+
+// Size implements sizer on deviceSource, returning the size of the device
+func (ds *deviceSource) Size() (uint64, error) {
+	f, err := os.Open(ds.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	device, err := DeviceOf(f)
+	return device.Size, err
+}
+
+// Open implements rsource on deviceSource
+func (ds *deviceSource) Open() error {
+	f, err := os.Open(ds.path)
+	if err != nil {
+		return err
+	}
+	ds.device, err = DeviceOf(f)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	ds.f = f
+	// whole blocks are read into the buffer, from the start,
+	// so every read of the device is aligned
+	ds.r = bufio.NewReaderSize(f, int(64*ds.device.LogicalBlockSize))
+	return nil
+}
+
+// Read implements rsource on deviceSource
+func (ds *deviceSource) Read(b []byte) (int, error) {
+	return ds.r.Read(b)
+}
+
+// Seek implements io.Seeker on deviceSource, so that
+// reads can be retried from where they failed
+func (ds *deviceSource) Seek(offset int64, whence int) (int64, error) {
+	n, err := ds.f.Seek(offset, whence)
+	ds.r.Reset(ds.f)
+	return n, err
+}
+
+// Close implements rsource on deviceSource
+func (ds *deviceSource) Close() error {
+	return ds.f.Close()
+}
+
+// deviceTarget is a wtarget writing a raw image to a local device,
+// from its start, in multiples of its logical block size. Unlike
+// a file, the device isn't deleted & created afresh.
+type deviceTarget struct {
+	path   string
+	size   uint64
+	f      *os.File
+	w      *alignedWriter
+	device Device
+}
+
+// NewDeviceTarget creates a new target writing to the device (or a
+// regular file standing in for one) at path, size bytes if known
+// (else 0), which must fit on a block device
+func NewDeviceTarget(path string, size uint64) *deviceTarget {
+	return &deviceTarget{path: path, size: size}
+}
+
+// Initialise implements wtarget on deviceTarget, opening the
+// device & checking that what's to be written will fit on it.
+// Block devices are opened exclusively, which on Linux fails
+// if they're mounted or otherwise in use.
+func (dt *deviceTarget) Initialise() error {
+	flags := os.O_WRONLY
+	if IsBlockDevice(dt.path) {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(dt.path, flags, 0)
+	if errors.Is(err, syscall.EBUSY) {
+		return fmt.Errorf("%s is in use (e.g. mounted), so can't be written to: %w", dt.path, err)
+	}
+	if err != nil {
+		return err
+	}
+	dt.device, err = DeviceOf(f)
+	if err == nil && dt.device.Block && dt.size > dt.device.Size {
+		err = fmt.Errorf("%s will not fit on %s, which is only %s", FormatSize(dt.size), dt.path, FormatSize(dt.device.Size))
+	}
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	dt.f = f
+	dt.w = &alignedWriter{w: f, block: int(dt.device.LogicalBlockSize)}
+	return nil
+}
+
+// Write implements wtarget on deviceTarget
+func (dt *deviceTarget) Write(b []byte) (int, error) {
+	return dt.w.Write(b)
+}
+
+// Sync implements wtarget on deviceTarget, flushing the
+// device, though not any partial block yet to be written
+// (character devices have nothing to flush)
+func (dt *deviceTarget) Sync() error {
+	if !dt.device.Block {
+		return nil
+	}
+	return dt.f.Sync()
+}
+
+// Close implements wtarget on deviceTarget, writing
+// any partial block left at the end & flushing it
+func (dt *deviceTarget) Close() error {
+	err := dt.w.Flush()
+	if err == nil {
+		err = dt.Sync()
+	}
+	closeErr := dt.f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// alignedWriter writes to w only in multiples of block
+// bytes, holding back the rest until there's a whole
+// block or it's flushed
+type alignedWriter struct {
+	w       io.Writer
+	block   int
+	pending []byte
+}
+
+// Write implements io.Writer on alignedWriter. The bytes are always
+// taken, even if writing fails, in which case writing (e.g. nothing)
+// again retries writing what's pending.
+func (aw *alignedWriter) Write(b []byte) (int, error) {
+	aw.pending = append(aw.pending, b...)
+	aligned := len(aw.pending) / aw.block * aw.block
+	if aligned == 0 {
+		return len(b), nil
+	}
+	n, err := aw.w.Write(aw.pending[:aligned])
+	aw.pending = append(aw.pending[:0], aw.pending[n:]...)
+	return len(b), err
+}
+
+// Flush writes whatever's pending, even if not a whole block
+func (aw *alignedWriter) Flush() error {
+	n, err := aw.w.Write(aw.pending)
+	aw.pending = aw.pending[n:]
+	return err
+}
+
+// SHA256Device returns the SHA-256 of the first n bytes of the local
+// device (or a regular file standing in for one) at path, as read back
+// from the device itself rather than the system's cache of it,
+// calling count with the bytes hashed as it goes
+func SHA256Device(path string, n uint64, count func(uint64)) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	err = dropCache(f)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	read, err := io.Copy(h, &countingReader{r: io.LimitReader(f, int64(n)), count: count})
+	if err != nil {
+		return nil, err
+	}
+	if uint64(read) != n {
+		return nil, fmt.Errorf("could only read back %d of the %d bytes written to %s", read, n, path)
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// blockDeviceGeometry returns the size & logical block size
+// of the block device open as f, asking the kernel for them
+func blockDeviceGeometry(f *os.File) (uint64, uint64, error) {
+	var size uint64
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0, 0, errno
+	}
+	logical, err := unix.IoctlGetInt(int(f.Fd()), unix.BLKSSZGET)
+	if err != nil {
+		return 0, 0, err
+	}
+	return size, uint64(logical), nil
+}
+
+// dropCache flushes f & drops the system's cache of it, so that
+// it's read back from the device itself, not from memory
+func dropCache(f *os.File) error {
+	err := f.Sync()
+	if err != nil {
+		return err
+	}
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package internal
+
+import (
+	"io"
+	"os"
+)
+
+// blockDeviceGeometry returns the size & logical block size of the
+// block device open as f, its size being how far it can be sought
+// & its logical block size assumed to be the usual
+func blockDeviceGeometry(f *os.File) (uint64, uint64, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return uint64(size), defaultLogicalBlockSize, err
+}
+
+// dropCache tries to flush f, so that what's read back has at
+// least been written (the system's cache of it can't be dropped
+// here, and not every system can flush a file only open for reading)
+func dropCache(f *os.File) error {
+	_ = f.Sync()
+	return nil
+}
@@ -0,0 +1,112 @@
+package internal_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"github.com/snasphysicist/go-copy/pkg/random"
+)
+
+// standInDevice creates a regular file of size 0xff bytes,
+// standing in for a block device, returning its path
+func standInDevice(t *testing.T, size int) string {
+	path := filepath.Join(t.TempDir(), "device")
+	err := os.WriteFile(path, bytes.Repeat([]byte{0xff}, size), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create stand in device: %v", err)
+	}
+	return path
+}
+
+func TestDeviceTargetWritesOverDeviceWithoutTruncatingIt(t *testing.T) {
+	path := standInDevice(t, 4096)
+	image := random.Bytes(1000)
+	dt := internal.NewDeviceTarget(path, uint64(len(image)))
+	err := dt.Initialise()
+	if err != nil {
+		t.Fatalf("Failed to initialise device target: %v", err)
+	}
+	_, err = dt.Write(image)
+	if err != nil {
+		t.Fatalf("Failed to write image: %v", err)
+	}
+	err = dt.Close()
+	if err != nil {
+		t.Fatalf("Failed to close device target: %v", err)
+	}
+	written, _ := os.ReadFile(path)
+	if len(written) != 4096 {
+		t.Fatalf("Device is now %d bytes, expected it to keep its 4096", len(written))
+	}
+	if !bytes.Equal(written[:1000], image) || !bytes.Equal(written[1000:], bytes.Repeat([]byte{0xff}, 3096)) {
+		t.Errorf("Device did not have the image written over its start")
+	}
+}
+
+func TestDeviceTargetWritesWholeLogicalBlocksUntilClosed(t *testing.T) {
+	path := standInDevice(t, 4096)
+	dt := internal.NewDeviceTarget(path, 0)
+	err := dt.Initialise()
+	if err != nil {
+		t.Fatalf("Failed to initialise device target: %v", err)
+	}
+	_, _ = dt.Write(make([]byte, 700))
+	written, _ := os.ReadFile(path)
+	if !bytes.Equal(written[:512], make([]byte, 512)) || written[512] != 0xff {
+		t.Errorf("Expected only the first whole 512 byte block to be written before closing")
+	}
+	_ = dt.Close()
+	written, _ = os.ReadFile(path)
+	if !bytes.Equal(written[:700], make([]byte, 700)) || written[700] != 0xff {
+		t.Errorf("Expected all 700 bytes to be written once closed")
+	}
+}
+
+func TestDeviceTargetRefusesImageLargerThanDevice(t *testing.T) {
+	path := standInDevice(t, 4096)
+	dt := internal.NewDeviceTarget(path, 4097)
+	err := dt.Initialise()
+	if err == nil {
+		_ = dt.Close()
+		t.Errorf("Initialised device target for an image which doesn't fit")
+	}
+}
+
+func TestDeviceSourceReadsWholeDeviceAndKnowsItsSize(t *testing.T) {
+	path := standInDevice(t, 0)
+	content := random.Bytes(10000)
+	_ = os.WriteFile(path, content, 0644)
+	ds := internal.NewDeviceSource(path)
+	size, err := ds.Size()
+	if err != nil || size != 10000 {
+		t.Errorf("Device size was %d (error %v), expected 10000", size, err)
+	}
+	err = ds.Open()
+	if err != nil {
+		t.Fatalf("Failed to open device source: %v", err)
+	}
+	defer ds.Close()
+	read, err := io.ReadAll(ds)
+	if err != nil || !bytes.Equal(read, content) {
+		t.Errorf("Read %d bytes (error %v) which differ from the device's", len(read), err)
+	}
+}
+
+func TestCharacterDevicesAreStreams(t *testing.T) {
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Skipf("No %s: %v", os.DevNull, err)
+	}
+	defer f.Close()
+	device, err := internal.DeviceOf(f)
+	if err != nil || device.Block {
+		t.Errorf("%s described as %#v (error %v), expected a character device", os.DevNull, device, err)
+	}
+	if !internal.IsDevice(os.DevNull) || internal.IsBlockDevice(os.DevNull) {
+		t.Errorf("%s not recognised as a character device", os.DevNull)
+	}
+}
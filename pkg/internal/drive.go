@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Drives looks up what the kernel says about local drives,
+// in a sysfs tree & a list of what's mounted, which can be
+// replaced by fakes (e.g. for testing)
+type Drives struct {
+	// SysRoot is the root of the sysfs tree, usually /sys
+	SysRoot string
+	// MountsFile lists what's mounted, as /proc/self/mounts does
+	MountsFile string
+}
+
+// DefaultDrives looks up the drives of the running system
+var DefaultDrives = Drives{SysRoot: "/sys", MountsFile: "/proc/self/mounts"}
+
+// Drive describes a whole local drive
+type Drive struct {
+	// Name is the kernel's name for the drive, e.g. sdb
+	Name string
+	// Vendor & Model identify the drive, as it reports them
+	Vendor string
+	Model  string
+	// Size is the size of the drive in bytes
+	Size uint64
+	// Removable is true if the kernel says the drive's media is removable
+	Removable bool
+	// Partitions are the kernel's names for the drive's partitions
+	Partitions []string
+	// Mounted are the drive & partitions which are mounted (or
+	// otherwise held, e.g. by LVM), with where they're mounted
+	Mounted []string
+}
+
+// Describe returns a line describing d for the user to recognise it by
+func (d Drive) Describe() string {
+	name := strings.TrimSpace(d.Vendor + " " + d.Model)
+	if name == "" {
+		name = "unknown drive"
+	}
+	return fmt.Sprintf("%s (%s)", name, FormatSize(d.Size))
+}
+
+// block returns the path in the sysfs tree of the block device called name
+func (ds Drives) block(name string, parts ...string) string {
+	return filepath.Join(append([]string{ds.SysRoot, "class", "block", name}, parts...)...)
+}
+
+// read returns the trimmed content of the file at path in the
+// sysfs tree, or empty if there's no such file
+func (ds Drives) read(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// Lookup describes the whole drive whose device is at path
+// (e.g. /dev/sdb, or a link to it), erroring if it's a partition
+func (ds Drives) Lookup(path string) (Drive, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return Drive{}, err
+	}
+	d := Drive{Name: filepath.Base(resolved)}
+	_, err = os.Stat(ds.block(d.Name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return Drive{}, fmt.Errorf("%s is not a drive the kernel knows of", path)
+	}
+	if err != nil {
+		return Drive{}, err
+	}
+	if ds.read(ds.block(d.Name, "partition")) != "" {
+		return Drive{}, fmt.Errorf("%s is a partition, not a whole drive", path)
+	}
+	d.Vendor = ds.read(ds.block(d.Name, "device", "vendor"))
+	d.Model = ds.read(ds.block(d.Name, "device", "model"))
+	d.Removable = ds.read(ds.block(d.Name, "removable")) == "1"
+	// always in 512 byte sectors, whatever the drive's are
+	sectors, err := strconv.ParseUint(ds.read(ds.block(d.Name, "size")), 10, 64)
+	if err != nil {
+		return Drive{}, fmt.Errorf("failed to read the size of %s: %w", path, err)
+	}
+	d.Size = sectors * 512
+	entries, err := os.ReadDir(ds.block(d.Name))
+	if err != nil {
+		return Drive{}, err
+	}
+	for _, e := range entries {
+		if ds.read(ds.block(d.Name, e.Name(), "partition")) != "" {
+			d.Partitions = append(d.Partitions, e.Name())
+		}
+	}
+	d.Mounted, err = ds.mounted(append([]string{d.Name}, d.Partitions...))
+	return d, err
+}
+
+// mounted returns which of the block devices called names
+// are mounted or held by another device (e.g. LVM or RAID)
+func (ds Drives) mounted(names []string) ([]string, error) {
+	isOurs := make(map[string]bool)
+	for _, name := range names {
+		isOurs[name] = true
+	}
+	mounted := make([]string, 0)
+	for _, name := range names {
+		holders, _ := os.ReadDir(ds.block(name, "holders"))
+		for _, h := range holders {
+			mounted = append(mounted, fmt.Sprintf("%s (held by %s)", name, h.Name()))
+		}
+	}
+	f, err := os.Open(ds.MountsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/") {
+			continue
+		}
+		source := fields[0]
+		if resolved, err := filepath.EvalSymlinks(source); err == nil {
+			source = resolved
+		}
+		if isOurs[filepath.Base(source)] {
+			mounted = append(mounted, fmt.Sprintf("%s (mounted on %s)", filepath.Base(source), fields[1]))
+		}
+	}
+	return mounted, s.Err()
+}
+
+// CheckFlashable returns an error if d shouldn't be flashed,
+// because it's not removable or it's in use
+func (d Drive) CheckFlashable() error {
+	if !d.Removable {
+		return fmt.Errorf("%s, %s, is not removable, so it could be a system disk", d.Name, d.Describe())
+	}
+	if len(d.Mounted) > 0 {
+		return fmt.Errorf("%s, %s, is in use: %s", d.Name, d.Describe(), strings.Join(d.Mounted, ", "))
+	}
+	return nil
+}
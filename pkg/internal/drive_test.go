@@ -0,0 +1,106 @@
+package internal_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+// fakeDrives creates a fake sysfs tree with the files given, relative
+// to its class/block directory, & a mounts file listing mounts,
+// returning it & a function creating a stand-in device file
+func fakeDrives(t *testing.T, files map[string]string, mounts string) (internal.Drives, func(string) string) {
+	dir := t.TempDir()
+	for path, content := range files {
+		mustWrite(t, dir, "sys/class/block/"+path, content)
+	}
+	mustWrite(t, dir, "mounts", mounts)
+	device := func(name string) string {
+		mustWrite(t, dir, "dev/"+name, "")
+		return filepath.Join(dir, "dev", name)
+	}
+	return internal.Drives{SysRoot: filepath.Join(dir, "sys"), MountsFile: filepath.Join(dir, "mounts")}, device
+}
+
+// someDrives are a removable drive with a partition, a system disk
+// & a removable drive held by LVM, in a fake sysfs tree
+var someDrives = map[string]string{
+	"sdz/removable":      "1\n",
+	"sdz/size":           "8\n",
+	"sdz/device/vendor":  "Acme    \n",
+	"sdz/device/model":   "Stick 3000\n",
+	"sdz/sdz1/partition": "1\n",
+	"sdz/sdz1/size":      "6\n",
+	"sdz1/partition":     "1\n",
+	"sda/removable":      "0\n",
+	"sda/size":           "2000\n",
+	"sda/device/model":   "System Disk\n",
+	"sdy/removable":      "1\n",
+	"sdy/size":           "8\n",
+	"sdy/holders/dm-0":   "",
+	"sdy/device/model":   "LVM Stick\n",
+}
+
+func TestDrivesDescribesRemovableDriveAndItsPartitions(t *testing.T) {
+	drives, device := fakeDrives(t, someDrives, "/dev/sda1 / ext4 rw 0 0\n")
+	d, err := drives.Lookup(device("sdz"))
+	if err != nil {
+		t.Fatalf("Failed to look up drive: %v", err)
+	}
+	if d.Name != "sdz" || d.Size != 4096 || !d.Removable || !reflect.DeepEqual(d.Partitions, []string{"sdz1"}) {
+		t.Errorf("Drive described as %#v", d)
+	}
+	if d.Describe() != "Acme Stick 3000 (4.00kb)" {
+		t.Errorf("Drive described as %s", d.Describe())
+	}
+	if d.CheckFlashable() != nil {
+		t.Errorf("Removable drive not in use can't be flashed: %v", d.CheckFlashable())
+	}
+}
+
+func TestDrivesWhichCannotBeFlashedAreRefused(t *testing.T) {
+	for name, c := range map[string]struct {
+		device string
+		mounts string
+		reason string
+	}{
+		"not removable":     {device: "sda", reason: "not removable"},
+		"partition mounted": {device: "sdz", mounts: "/dev/sdz1 /media/stick vfat rw 0 0\n", reason: "/media/stick"},
+		"held by LVM":       {device: "sdy", reason: "dm-0"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			drives, device := fakeDrives(t, someDrives, c.mounts)
+			d, err := drives.Lookup(device(c.device))
+			if err != nil {
+				t.Fatalf("Failed to look up drive: %v", err)
+			}
+			err = d.CheckFlashable()
+			if err == nil || !strings.Contains(err.Error(), c.reason) {
+				t.Errorf("Expected flashing %s to be refused because %s, got %v", c.device, c.reason, err)
+			}
+		})
+	}
+}
+
+func TestDrivesRefusesPartitionsAndUnknownDevices(t *testing.T) {
+	drives, device := fakeDrives(t, someDrives, "")
+	for _, name := range []string{"sdz1", "sdq"} {
+		_, err := drives.Lookup(device(name))
+		if err == nil {
+			t.Errorf("Looked up %s as a whole drive", name)
+		}
+	}
+}
+
+func TestDefaultDrivesUseTheRunningSystem(t *testing.T) {
+	if _, err := os.Stat(internal.DefaultDrives.SysRoot); err != nil {
+		t.Skipf("No sysfs: %v", err)
+	}
+	if internal.DefaultDrives.MountsFile != "/proc/self/mounts" {
+		t.Errorf("Mounts are read from %s", internal.DefaultDrives.MountsFile)
+	}
+}
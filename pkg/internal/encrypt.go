@@ -0,0 +1,465 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted content has the following format, all integers big endian.
+//
+// A 40 byte header:
+//
+//	0-8   magic bytes "GOCPAEAD"
+//	8     format version, currently 1
+//	9     cipher, 1 for AES-256-GCM, 2 for ChaCha20-Poly1305
+//	10    key derivation, 0 for a raw key, 1 for scrypt (r=8, p=1)
+//	11    log2 of the scrypt cost parameter N (0 for a raw key)
+//	12-16 plaintext chunk size in bytes
+//	16-32 scrypt salt (zeros for a raw key)
+//	32-39 nonce prefix
+//	39    reserved, zero
+//
+// Followed by the chunks, each chunk being up to chunk size bytes
+// of plaintext sealed with the cipher, so chunk size + 16 bytes
+// long, except the last which may be shorter (even empty, 16 bytes).
+// Chunk i thus always starts at 40 + i * (chunk size + 16) bytes,
+// so chunks can be verified or decrypted independently.
+// The nonce for chunk i is the nonce prefix, then i as 4 bytes,
+// then 1 byte which is 1 for the last chunk and 0 for all others,
+// so removing, reordering or truncating chunks is detected.
+// The whole header is the additional authenticated data for every chunk.
+
+// The ciphers which can be used to encrypt
+const (
+	AES256GCM        = "aes-256-gcm"
+	ChaCha20Poly1305 = "chacha20-poly1305"
+)
+
+// Ciphers lists all supported ciphers
+var Ciphers = []string{AES256GCM, ChaCha20Poly1305}
+
+// cipherIDs are the ids of the ciphers in the header
+var cipherIDs = map[string]byte{AES256GCM: 1, ChaCha20Poly1305: 2}
+
+const (
+	encryptionMagic      = "GOCPAEAD"
+	encryptionVersion    = 1
+	encryptionHeaderSize = 40
+	encryptionChunkSize  = 64 * 1024
+	encryptionTagSize    = 16
+	encryptionKeySize    = 32
+	kdfNone              = 0
+	kdfScrypt            = 1
+	scryptLogN           = 16
+	// maxScryptLogN & maxEncryptionChunkSize limit what a (possibly
+	// corrupt or malicious) header can make decrypting use in memory
+	maxScryptLogN          = 20
+	maxEncryptionChunkSize = 16 * 1024 * 1024
+)
+
+// Key is the secret used to encrypt or decrypt, either
+// a raw 32 byte key or a passphrase from which one is derived
+type Key struct {
+	raw        []byte
+	passphrase []byte
+}
+
+// RawKey returns the Key which uses b directly,
+// which must be 32 bytes long
+func RawKey(b []byte) (Key, error) {
+	if len(b) != encryptionKeySize {
+		return Key{}, fmt.Errorf("key is %d bytes, must be %d", len(b), encryptionKeySize)
+	}
+	return Key{raw: b}, nil
+}
+
+// PassphraseKey returns the Key which is derived
+// from passphrase with scrypt
+func PassphraseKey(passphrase []byte) Key {
+	return Key{passphrase: passphrase}
+}
+
+// KeyFromFile reads a raw key from the file at path,
+// which must contain either exactly 32 bytes or those
+// 32 bytes hex encoded (surrounding whitespace is ignored)
+func KeyFromFile(path string) (Key, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Key{}, err
+	}
+	if len(b) == encryptionKeySize {
+		return RawKey(b)
+	}
+	decoded, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return Key{}, fmt.Errorf("key file %s is neither %d bytes nor hex encoded: %w", path, encryptionKeySize, err)
+	}
+	return RawKey(decoded)
+}
+
+// ChunkAuthenticationError is returned when a chunk of
+// encrypted content fails authentication, meaning it
+// has been tampered with or corrupted
+type ChunkAuthenticationError struct {
+	// Chunk is the index of the chunk, from 0
+	Chunk uint64
+	// Offset is where the chunk starts in the encrypted content
+	Offset uint64
+}
+
+// Error implements error on ChunkAuthenticationError
+func (e ChunkAuthenticationError) Error() string {
+	return fmt.Sprintf(
+		"chunk %d at byte %d of the encrypted content failed authentication, "+
+			"it has been tampered with or corrupted (or the key is wrong)",
+		e.Chunk, e.Offset,
+	)
+}
+
+// encryptionHeader is the parsed header of encrypted content
+type encryptionHeader struct {
+	raw       []byte
+	aead      cipher.AEAD
+	chunkSize uint64
+}
+
+// newEncryptionHeader creates the header to encrypt
+// with the named cipher & key, generating the salt & nonce
+func newEncryptionHeader(cipherName string, key Key) (encryptionHeader, error) {
+	id, ok := cipherIDs[cipherName]
+	if !ok {
+		return encryptionHeader{}, fmt.Errorf("unknown cipher %s, should be one of %v", cipherName, Ciphers)
+	}
+	raw := make([]byte, encryptionHeaderSize)
+	copy(raw, encryptionMagic)
+	raw[8] = encryptionVersion
+	raw[9] = id
+	binary.BigEndian.PutUint32(raw[12:16], encryptionChunkSize)
+	if key.passphrase != nil {
+		raw[10] = kdfScrypt
+		raw[11] = scryptLogN
+		_, err := rand.Read(raw[16:32])
+		if err != nil {
+			return encryptionHeader{}, err
+		}
+	}
+	_, err := rand.Read(raw[32:39])
+	if err != nil {
+		return encryptionHeader{}, err
+	}
+	return parseEncryptionHeader(raw, key)
+}
+
+// parseEncryptionHeader reads the encryption header from raw
+// and prepares the cipher from it with key
+func parseEncryptionHeader(raw []byte, key Key) (encryptionHeader, error) {
+	if len(raw) != encryptionHeaderSize || string(raw[:8]) != encryptionMagic {
+		return encryptionHeader{}, errors.New("content is not encrypted by go-copy")
+	}
+	if raw[8] != encryptionVersion {
+		return encryptionHeader{}, fmt.Errorf("unsupported encryption format version %d", raw[8])
+	}
+	if raw[11] > maxScryptLogN {
+		return encryptionHeader{}, fmt.Errorf("encrypted content has scrypt cost 2^%d, more than the maximum 2^%d", raw[11], maxScryptLogN)
+	}
+	chunkSize := uint64(binary.BigEndian.Uint32(raw[12:16]))
+	if chunkSize == 0 || chunkSize > maxEncryptionChunkSize {
+		return encryptionHeader{}, fmt.Errorf("encrypted content has chunk size of %d, not between 1 & %d", chunkSize, maxEncryptionChunkSize)
+	}
+	k, err := deriveKey(raw, key)
+	if err != nil {
+		return encryptionHeader{}, err
+	}
+	var aead cipher.AEAD
+	switch raw[9] {
+	case cipherIDs[AES256GCM]:
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return encryptionHeader{}, err
+		}
+		aead, err = cipher.NewGCM(block)
+		if err != nil {
+			return encryptionHeader{}, err
+		}
+	case cipherIDs[ChaCha20Poly1305]:
+		aead, err = chacha20poly1305.New(k)
+		if err != nil {
+			return encryptionHeader{}, err
+		}
+	default:
+		return encryptionHeader{}, fmt.Errorf("unknown cipher id %d", raw[9])
+	}
+	return encryptionHeader{raw: raw, aead: aead, chunkSize: chunkSize}, nil
+}
+
+// deriveKey gets the cipher key from key as
+// described by the header raw
+func deriveKey(raw []byte, key Key) ([]byte, error) {
+	switch raw[10] {
+	case kdfNone:
+		if key.raw == nil {
+			return nil, errors.New("content was encrypted with a key file, not a passphrase")
+		}
+		return key.raw, nil
+	case kdfScrypt:
+		if key.passphrase == nil {
+			return nil, errors.New("content was encrypted with a passphrase, not a key file")
+		}
+		return scrypt.Key(key.passphrase, raw[16:32], 1<<raw[11], 8, 1, encryptionKeySize)
+	}
+	return nil, fmt.Errorf("unknown key derivation %d", raw[10])
+}
+
+// nonce returns the nonce for chunk i
+func (h *encryptionHeader) nonce(i uint64, last bool) []byte {
+	n := make([]byte, h.aead.NonceSize())
+	copy(n, h.raw[32:39])
+	binary.BigEndian.PutUint32(n[7:11], uint32(i))
+	if last {
+		n[11] = 1
+	}
+	return n
+}
+
+// sealedChunkSize is the size of a full encrypted chunk
+func (h *encryptionHeader) sealedChunkSize() uint64 {
+	return h.chunkSize + encryptionTagSize
+}
+
+// open decrypts chunk i, returning a ChunkAuthenticationError if it fails
+func (h *encryptionHeader) open(i uint64, last bool, sealed []byte) ([]byte, error) {
+	if i > uint64(^uint32(0)) {
+		return nil, errors.New("encrypted content has too many chunks")
+	}
+	plain, err := h.aead.Open(nil, h.nonce(i, last), sealed, h.raw)
+	if err != nil {
+		return nil, ChunkAuthenticationError{Chunk: i, Offset: encryptionHeaderSize + i*h.sealedChunkSize()}
+	}
+	return plain, nil
+}
+
+// encryptingSource is an rsource which encrypts
+// the bytes from another rsource as they are read
+type encryptingSource struct {
+	source     rsource
+	cipherName string
+	key        Key
+	pr         *ProgressReporter
+	in         *bufio.Reader
+	h          encryptionHeader
+	pending    []byte
+	chunk      uint64
+	finished   bool
+}
+
+// NewEncryptingSource wraps source such that reading it reads
+// the source encrypted with the named cipher (one of Ciphers) and key,
+// the bytes consumed from the source itself are reported to pr,
+// unless pr is nil
+func NewEncryptingSource(source rsource, cipherName string, key Key, pr *ProgressReporter) *encryptingSource {
+	return &encryptingSource{source: source, cipherName: cipherName, key: key, pr: pr}
+}
+
+// Open implements rsource on encryptingSource, opening
+// the wrapped source and preparing the header
+func (es *encryptingSource) Open() error {
+	err := es.source.Open()
+	if err != nil {
+		return err
+	}
+	es.h, err = newEncryptionHeader(es.cipherName, es.key)
+	if err != nil {
+		return err
+	}
+	es.in = bufio.NewReader(consumedFrom(es.source, es.pr))
+	es.pending = append([]byte{}, es.h.raw...)
+	return nil
+}
+
+// Read implements rsource on encryptingSource,
+// reading the encrypted bytes
+func (es *encryptingSource) Read(b []byte) (int, error) {
+	if len(es.pending) == 0 && !es.finished {
+		err := es.sealNext()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(es.pending) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, es.pending)
+	es.pending = es.pending[n:]
+	return n, nil
+}
+
+// sealNext reads the next chunk from the source
+// and encrypts it into the pending bytes
+func (es *encryptingSource) sealNext() error {
+	if es.chunk > uint64(^uint32(0)) {
+		return errors.New("source too large to encrypt")
+	}
+	plain := make([]byte, es.h.chunkSize)
+	n, err := io.ReadFull(es.in, plain)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := err != nil
+	if !last {
+		_, err = es.in.Peek(1)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		last = err == io.EOF
+	}
+	es.pending = es.h.aead.Seal(nil, es.h.nonce(es.chunk, last), plain[:n], es.h.raw)
+	es.chunk++
+	es.finished = last
+	return nil
+}
+
+// Close implements rsource on encryptingSource,
+// closing the wrapped source
+func (es *encryptingSource) Close() error {
+	return es.source.Close()
+}
+
+// decryptingSource is an rsource which decrypts
+// the bytes from another rsource as they are read
+type decryptingSource struct {
+	source   rsource
+	key      Key
+	pr       *ProgressReporter
+	in       *bufio.Reader
+	h        encryptionHeader
+	pending  []byte
+	chunk    uint64
+	finished bool
+}
+
+// NewDecryptingSource wraps source such that reading it reads the
+// source decrypted with key, the bytes consumed from the (encrypted)
+// source itself are reported to pr, unless pr is nil.
+// A ChunkAuthenticationError is
+// returned from Read for the first chunk which fails authentication.
+func NewDecryptingSource(source rsource, key Key, pr *ProgressReporter) *decryptingSource {
+	return &decryptingSource{source: source, key: key, pr: pr}
+}
+
+// Open implements rsource on decryptingSource, opening
+// the wrapped source and reading the header
+func (ds *decryptingSource) Open() error {
+	err := ds.source.Open()
+	if err != nil {
+		return err
+	}
+	ds.in = bufio.NewReader(consumedFrom(ds.source, ds.pr))
+	raw := make([]byte, encryptionHeaderSize)
+	_, err = io.ReadFull(ds.in, raw)
+	if err != nil {
+		return fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	ds.h, err = parseEncryptionHeader(raw, ds.key)
+	return err
+}
+
+// Read implements rsource on decryptingSource,
+// reading the decrypted bytes
+func (ds *decryptingSource) Read(b []byte) (int, error) {
+	if len(ds.pending) == 0 && !ds.finished {
+		err := ds.openNext()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(ds.pending) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, ds.pending)
+	ds.pending = ds.pending[n:]
+	return n, nil
+}
+
+// openNext reads the next chunk from the source
+// and decrypts it into the pending bytes
+func (ds *decryptingSource) openNext() error {
+	sealed := make([]byte, ds.h.sealedChunkSize())
+	n, err := io.ReadFull(ds.in, sealed)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := err != nil
+	if !last {
+		_, err = ds.in.Peek(1)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		last = err == io.EOF
+	}
+	ds.pending, err = ds.h.open(ds.chunk, last, sealed[:n])
+	if err != nil {
+		return err
+	}
+	ds.chunk++
+	ds.finished = last
+	return nil
+}
+
+// Close implements rsource on decryptingSource,
+// closing the wrapped source
+func (ds *decryptingSource) Close() error {
+	return ds.source.Close()
+}
+
+// VerifyEncrypted checks every chunk of the encrypted content in r,
+// which is size bytes long, authenticates with key, independently
+// of one another, returning the ChunkAuthenticationError for each
+// which does not. An error is returned if the content can't be read at all.
+func VerifyEncrypted(r io.ReaderAt, size uint64, key Key) ([]ChunkAuthenticationError, error) {
+	raw := make([]byte, encryptionHeaderSize)
+	_, err := r.ReadAt(raw, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	h, err := parseEncryptionHeader(raw, key)
+	if err != nil {
+		return nil, err
+	}
+	if size < encryptionHeaderSize {
+		return nil, errors.New("encrypted content is shorter than its header")
+	}
+	body := size - encryptionHeaderSize
+	chunks := (body + h.sealedChunkSize() - 1) / h.sealedChunkSize()
+	failures := make([]ChunkAuthenticationError, 0)
+	if chunks == 0 {
+		// there is always at least a last chunk,
+		// so the content has been truncated
+		return append(failures, ChunkAuthenticationError{Chunk: 0, Offset: encryptionHeaderSize}), nil
+	}
+	for i := uint64(0); i < chunks; i++ {
+		offset := encryptionHeaderSize + i*h.sealedChunkSize()
+		sealed := make([]byte, Minimum(h.sealedChunkSize(), size-offset))
+		_, err := r.ReadAt(sealed, int64(offset))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		_, err = h.open(i, i == chunks-1, sealed)
+		var cae ChunkAuthenticationError
+		if errors.As(err, &cae) {
+			failures = append(failures, cae)
+		}
+	}
+	return failures, nil
+}
@@ -0,0 +1,148 @@
+package internal_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"github.com/snasphysicist/go-copy/pkg/random"
+)
+
+// encrypted returns content encrypted with cipher & key
+func encrypted(t *testing.T, content []byte, cipher string, key internal.Key) []byte {
+	pr := internal.NewProgressReporter(0, make(chan struct{}))
+	es := internal.NewEncryptingSource(&mockSource{toRead: bytes.NewBuffer(content)}, cipher, key, &pr)
+	return readAll(t, es)
+}
+
+// rawKey returns a random raw key, failing the test if it can't be created
+func rawKey(t *testing.T) internal.Key {
+	k, err := internal.RawKey(random.Bytes(32))
+	if err != nil {
+		t.Fatalf("Failed to create key with %v", err)
+	}
+	return k
+}
+
+func TestEncryptedSourceDecryptsToOriginalContent(t *testing.T) {
+	keys := map[string]internal.Key{"raw": rawKey(t), "passphrase": internal.PassphraseKey([]byte("secret"))}
+	for _, cipher := range internal.Ciphers {
+		for name, key := range keys {
+			for _, size := range []int{0, 10, 64 * 1024, 200 * 1024} {
+				content := random.Bytes(size)
+				e := encrypted(t, content, cipher, key)
+				if bytes.Contains(e, content) && size > 0 {
+					t.Errorf("%s with %s key left %d bytes of plaintext in encrypted content", cipher, name, size)
+				}
+				pr := internal.NewProgressReporter(0, make(chan struct{}))
+				ds := internal.NewDecryptingSource(&mockSource{toRead: bytes.NewBuffer(e)}, key, &pr)
+				decrypted := readAll(t, ds)
+				if !bytes.Equal(content, decrypted) {
+					t.Errorf("%s with %s key did not decrypt %d bytes to original content", cipher, name, size)
+				}
+				if pr.SourceBytesConsumed() != uint64(len(e)) {
+					t.Errorf("%d bytes reported consumed, expected %d", pr.SourceBytesConsumed(), len(e))
+				}
+			}
+		}
+	}
+}
+
+func TestDecryptingSourceReportsTamperedChunk(t *testing.T) {
+	key := rawKey(t)
+	e := encrypted(t, random.Bytes(200*1024), internal.AES256GCM, key)
+	tamperedAt := 40 + 2*(64*1024+16) + 100
+	e[tamperedAt] ^= 1
+	pr := internal.NewProgressReporter(0, make(chan struct{}))
+	ds := internal.NewDecryptingSource(&mockSource{toRead: bytes.NewBuffer(e)}, key, &pr)
+	err := ds.Open()
+	if err != nil {
+		t.Fatalf("Failed to open source with %v", err)
+	}
+	_, err = io.ReadAll(ds)
+	var cae internal.ChunkAuthenticationError
+	if !errors.As(err, &cae) {
+		t.Fatalf("Got error %v reading tampered content, expected a chunk authentication error", err)
+	}
+	if cae.Chunk != 2 {
+		t.Errorf("Chunk %d reported as tampered, expected 2", cae.Chunk)
+	}
+}
+
+func TestDecryptingSourceDetectsTruncation(t *testing.T) {
+	key := rawKey(t)
+	e := encrypted(t, random.Bytes(200*1024), internal.ChaCha20Poly1305, key)
+	truncated := e[:40+2*(64*1024+16)]
+	pr := internal.NewProgressReporter(0, make(chan struct{}))
+	ds := internal.NewDecryptingSource(&mockSource{toRead: bytes.NewBuffer(truncated)}, key, &pr)
+	err := ds.Open()
+	if err != nil {
+		t.Fatalf("Failed to open source with %v", err)
+	}
+	_, err = io.ReadAll(ds)
+	if err == nil {
+		t.Error("No error decrypting content with its last chunks removed")
+	}
+}
+
+func TestDecryptingSourceFailsWithWrongKey(t *testing.T) {
+	e := encrypted(t, random.Bytes(100), internal.AES256GCM, internal.PassphraseKey([]byte("right")))
+	pr := internal.NewProgressReporter(0, make(chan struct{}))
+	ds := internal.NewDecryptingSource(&mockSource{toRead: bytes.NewBuffer(e)}, internal.PassphraseKey([]byte("wrong")), &pr)
+	err := ds.Open()
+	if err != nil {
+		t.Fatalf("Failed to open source with %v", err)
+	}
+	_, err = io.ReadAll(ds)
+	if err == nil {
+		t.Error("No error decrypting content with the wrong passphrase")
+	}
+}
+
+func TestDecryptingSourceRejectsHeaderAskingForTooMuchMemory(t *testing.T) {
+	for name, tamper := range map[string]func([]byte){
+		"scrypt cost": func(e []byte) { e[11] = 40 },
+		"chunk size":  func(e []byte) { copy(e[12:16], []byte{0xff, 0xff, 0xff, 0xff}) },
+	} {
+		key := internal.PassphraseKey([]byte("secret"))
+		e := encrypted(t, random.Bytes(100), internal.AES256GCM, key)
+		tamper(e)
+		pr := internal.NewProgressReporter(0, make(chan struct{}))
+		ds := internal.NewDecryptingSource(&mockSource{toRead: bytes.NewBuffer(e)}, key, &pr)
+		err := ds.Open()
+		if err == nil {
+			_, err = io.ReadAll(ds)
+		}
+		if err == nil {
+			t.Errorf("No error decrypting content with header's %s too large", name)
+		}
+	}
+}
+
+func TestVerifyEncryptedReportsEachTamperedChunk(t *testing.T) {
+	key := rawKey(t)
+	e := encrypted(t, random.Bytes(300*1024), internal.AES256GCM, key)
+	e[40+1*(64*1024+16)+5] ^= 1
+	e[len(e)-1] ^= 1
+	failures, err := internal.VerifyEncrypted(bytes.NewReader(e), uint64(len(e)), key)
+	if err != nil {
+		t.Fatalf("Failed to verify with %v", err)
+	}
+	if len(failures) != 2 || failures[0].Chunk != 1 || failures[1].Chunk != 4 {
+		t.Errorf("%v reported as failures, expected chunks 1 & 4", failures)
+	}
+}
+
+func TestVerifyEncryptedReportsNothingForUntamperedContent(t *testing.T) {
+	key := rawKey(t)
+	e := encrypted(t, random.Bytes(128*1024), internal.ChaCha20Poly1305, key)
+	failures, err := internal.VerifyEncrypted(bytes.NewReader(e), uint64(len(e)), key)
+	if err != nil {
+		t.Fatalf("Failed to verify with %v", err)
+	}
+	if len(failures) != 0 {
+		t.Errorf("%v reported as failures for untampered content", failures)
+	}
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+)
+
+// EndpointOptions configures how sources & targets
+// other than local files & standard streams are accessed
+type EndpointOptions struct {
+	// HTTPSegments is how many segments of an http(s)
+	// source to download in parallel, 1 or fewer
+	// meaning a single sequential download
+	HTTPSegments int
+	// HTTPHeader are added to every http(s) request,
+	// e.g. for authentication
+	HTTPHeader http.Header
+	// SSHKeyFile is the private key to authenticate to sftp
+	// servers with, as well as any keys in the ssh agent.
+	// If empty, the usual keys in ~/.ssh are tried.
+	SSHKeyFile string
+	// SSHKnownHostsFile lists the keys of the sftp servers
+	// which can be trusted, if empty ~/.ssh/known_hosts
+	SSHKnownHostsFile string
+	// S3Endpoint is the URL of the S3 compatible service
+	// (e.g. MinIO) to use for s3 URLs, if empty that in the
+	// environment (AWS_ENDPOINT_URL) or else AWS itself
+	S3Endpoint string
+	// S3Region is the region to sign S3 requests for, if
+	// empty that in the environment (AWS_REGION) or else us-east-1
+	S3Region string
+	// TLSCAFile is the CA certificate to trust go-copy servers
+	// (gocopys URLs) with, if empty the system's CAs are used
+	TLSCAFile string
+	// TLSCertFile & TLSKeyFile are the certificate & key to
+	// identify this client to go-copy servers with, if they
+	// require it
+	TLSCertFile string
+	TLSKeyFile  string
+	// RemoteCommand is the command template run to reach the
+	// go-copy server for ssh URLs, if empty DefaultRemoteCommand
+	RemoteCommand string
+}
+
+// sizer is implemented by sources which
+// can report their size before being opened
+type sizer interface {
+	// Size returns the size of the source in bytes,
+	// 0 if the source can't tell
+	Size() (uint64, error)
+}
+
+// exactSizer is implemented by sources which can tell whether
+// their size is exactly the number of bytes which will be read
+type exactSizer interface {
+	// ExactSize returns the size of the source in
+	// bytes & true if it's exact, false if it's not
+	ExactSize() (uint64, bool, error)
+}
+
+// ExactSizeOf returns the size of source in bytes & true if it's
+// exactly the number of bytes which will be read from it (as for a
+// regular local file, going by its size now, as long as it doesn't
+// change), else false, the size only being an estimate if any
+func ExactSizeOf(source rsource) (uint64, bool) {
+	s, ok := source.(exactSizer)
+	if !ok {
+		return 0, false
+	}
+	size, exact, err := s.ExactSize()
+	if err != nil {
+		panic(err)
+	}
+	return size, exact
+}
+
+// EstimatedSizeOf returns the size of source in bytes if
+// it can report it, else 0 meaning that it is unknown
+func EstimatedSizeOf(source rsource) uint64 {
+	s, ok := source.(sizer)
+	if !ok {
+		return 0
+	}
+	size, err := s.Size()
+	if err != nil {
+		panic(err)
+	}
+	return size
+}
+
+// IsLocal returns true if path, as given by the user, is a
+// local file, directory or device, rather than a standard
+// stream or any of the URLs handled by SourceFor & TargetFor
+func IsLocal(path string) bool {
+	return path != StandardStream && !IsHTTP(path) && !IsSFTP(path) &&
+		!IsS3(path) && !IsSSH(path) && !IsGoCopy(path) && !IsZipMember(path)
+}
+
+// EndpointKind describes what kind of source or destination path
+// is, as it's treated by SourceFor & TargetFor (or a local directory)
+func EndpointKind(path string) string {
+	switch {
+	case path == StandardStream:
+		return "standard stream"
+	case IsHTTP(path):
+		return "http(s) URL"
+	case IsSFTP(path):
+		return "sftp URL"
+	case IsS3(path):
+		return "s3 URL"
+	case IsSSH(path):
+		return "ssh URL"
+	case IsGoCopy(path):
+		return "go-copy URL"
+	case IsZipMember(path):
+		return "zip archive member"
+	}
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return "missing local file"
+	case err != nil:
+		return "inaccessible local file"
+	case info.IsDir():
+		return "local directory"
+	case info.Mode()&fs.ModeDevice != 0 && info.Mode()&fs.ModeCharDevice != 0:
+		return "local character device"
+	case info.Mode()&fs.ModeDevice != 0:
+		return "local block device"
+	case !info.Mode().IsRegular():
+		return "local special file"
+	}
+	return "local file"
+}
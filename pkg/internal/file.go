@@ -1,8 +1,13 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 // FormatSize takes a size in bytes and
@@ -31,8 +36,36 @@ func FormatSize(s uint64) string {
 	}
 }
 
+// sizeUnits are the multipliers of the units understood by ParseSize
+var sizeUnits = map[string]uint64{
+	"":  1,
+	"b": 1,
+	"k": 1 << 10,
+	"m": 1 << 20,
+	"g": 1 << 30,
+	"t": 1 << 40,
+}
+
+// ParseSize parses a size in bytes, as a number optionally
+// followed by a unit as written by FormatSize (e.g. 64mb, or
+// 64M & 64MiB, which are the same), returning the number of bytes
+func ParseSize(s string) (uint64, error) {
+	lower := strings.ToLower(strings.TrimSpace(s))
+	number := strings.TrimRight(lower, "abcdefghijklmnopqrstuvwxyz")
+	unit := strings.TrimSuffix(strings.TrimSuffix(lower[len(number):], "b"), "i")
+	multiplier, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("%s is not a size, the unit must be one of b, kb, mb, gb or tb", s)
+	}
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("%s is not a size", s)
+	}
+	return uint64(f * float64(multiplier)), nil
+}
+
 // SizeOf returns the size of the file at given path
-// in bytes as reported by the os
+// in bytes as reported by the os, or of the block device
 func SizeOf(path string) uint64 {
 	f, err := os.Open(path)
 	if err != nil {
@@ -43,5 +76,33 @@ func SizeOf(path string) uint64 {
 	if err != nil {
 		panic(err)
 	}
+	if fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0 {
+		device, err := DeviceOf(f)
+		if err != nil {
+			panic(err)
+		}
+		return device.Size
+	}
 	return uint64(fi.Size())
 }
+
+// FreeSpace returns the bytes available to the user on the local
+// filesystem which path is (or would be, if it doesn't exist yet) on,
+// erroring with errors.ErrUnsupported where this can't be told
+func FreeSpace(path string) (uint64, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		_, err = os.Stat(path)
+		if !errors.Is(err, fs.ErrNotExist) || filepath.Dir(path) == path {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return freeBytes(path)
+}
@@ -121,3 +121,34 @@ func TestCorrectNumbersPrintedForEachByteValue(t *testing.T) {
 		}
 	}
 }
+
+func TestSizesWithAndWithoutUnitsAreParsed(t *testing.T) {
+	for s, expected := range map[string]uint64{
+		"0":      0,
+		"512":    512,
+		"512b":   512,
+		"64kb":   64 * 1024,
+		"64K":    64 * 1024,
+		"1.5mb":  1536 * 1024,
+		"100MiB": 100 * 1024 * 1024,
+		"2g":     2 * 1024 * 1024 * 1024,
+	} {
+		size, err := internal.ParseSize(s)
+		if err != nil || size != expected {
+			t.Errorf("Parsed %s as %d (error %v), expected %d", s, size, err, expected)
+		}
+	}
+	for _, s := range []string{"", "mb", "-1kb", "12 parsecs"} {
+		_, err := internal.ParseSize(s)
+		if err == nil {
+			t.Errorf("Parsed %q as a size", s)
+		}
+	}
+}
+
+func TestParsedFormattedSizeIsCloseToOriginal(t *testing.T) {
+	size, err := internal.ParseSize(internal.FormatSize(165 * 1024 * 1024))
+	if err != nil || size != 165*1024*1024 {
+		t.Errorf("Parsed formatted 165mb as %d (error %v)", size, err)
+	}
+}
@@ -0,0 +1,315 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheDirSignature starts every CACHEDIR.TAG file, as given
+// by the Cache Directory Tagging Specification
+const cacheDirSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+
+// FilterRule includes or excludes entries in a tree matching Pattern,
+// a glob as in .gitignore files: matched against the name of the
+// entry unless it has a / (other than at its end), when it's matched
+// against its path from the root, ending in / to only match directories,
+// ** matching any number of directories
+type FilterRule struct {
+	Pattern string
+	Include bool
+}
+
+// Filter decides which entries in a tree are copied, the zero
+// value including everything. Excluding a directory excludes
+// everything in it, & only files are filtered by size & age.
+type Filter struct {
+	// Rules are tried in order, as rsync does, the first
+	// one matching an entry including or excluding it
+	Rules []FilterRule
+	// IgnoreFile is the name of the files (e.g. .gitignore) whose
+	// rules, as in .gitignore files, exclude entries in the directory
+	// they're in & below, where none of Rules match, if not empty
+	IgnoreFile string
+	// ExcludeCaches excludes directories tagged as caches with
+	// a CACHEDIR.TAG file, where none of Rules match
+	ExcludeCaches bool
+	// MinSizeBytes & MaxSizeBytes (if not 0) exclude
+	// files smaller or larger than them
+	MinSizeBytes uint64
+	MaxSizeBytes uint64
+	// NewerThan (if not zero) excludes files
+	// last modified at or before it
+	NewerThan time.Time
+}
+
+// filterPattern is a FilterRule's pattern compiled to match paths
+type filterPattern struct {
+	re      *regexp.Regexp
+	dirOnly bool
+}
+
+// ignoreRule is a pattern read from an ignore file, which
+// includes what it matches if it's negated with a leading !
+type ignoreRule struct {
+	filterPattern
+	include bool
+}
+
+// compilePattern compiles a FilterRule's pattern
+func compilePattern(pattern string) (filterPattern, error) {
+	p := filterPattern{}
+	if strings.HasSuffix(pattern, "/") {
+		p.dirOnly = true
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	var re strings.Builder
+	re.WriteString("^")
+	if !anchored {
+		re.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return p, fmt.Errorf("%s has an unclosed [", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			re.WriteString(regexp.QuoteMeta(pattern[i+1 : i+2]))
+			i++
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	var err error
+	p.re, err = regexp.Compile(re.String())
+	if err != nil {
+		return p, fmt.Errorf("%s is not a valid pattern: %w", pattern, err)
+	}
+	return p, nil
+}
+
+// matches returns true if the entry at path (relative to
+// where the pattern applies from) is matched by the pattern
+func (p filterPattern) matches(path string, dir bool) bool {
+	return (dir || !p.dirOnly) && p.re.MatchString(path)
+}
+
+// ReadFilterRules reads rules from the file at path, one per line,
+// excluding what they match unless they start with "+ " (as rsync's
+// --exclude-from does), ignoring blank lines & those starting with #
+func ReadFilterRules(path string) ([]FilterRule, error) {
+	lines, err := readPatterns(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]FilterRule, 0, len(lines))
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "+ "):
+			rules = append(rules, FilterRule{Pattern: line[2:], Include: true})
+		case strings.HasPrefix(line, "- "):
+			rules = append(rules, FilterRule{Pattern: line[2:]})
+		default:
+			rules = append(rules, FilterRule{Pattern: line})
+		}
+	}
+	return rules, nil
+}
+
+// readPatterns returns the lines of the file at path,
+// except those which are blank or start with #
+func readPatterns(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	patterns := make([]string, 0)
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, line)
+		}
+	}
+	return patterns, s.Err()
+}
+
+// ParseNewerThan parses when files must be newer than, given either
+// as how long ago (a duration, e.g. 36h, or a number of days, e.g. 7d)
+// or as a date (2006-01-02) or time (RFC 3339)
+func ParseNewerThan(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if days, err := strconv.ParseUint(strings.TrimSuffix(s, "d"), 10, 64); err == nil && strings.HasSuffix(s, "d") {
+		return now.AddDate(0, 0, -int(days)), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%s is not a duration, number of days, date or time", s)
+}
+
+// Apply returns the entries (as returned by WalkTree) in the
+// tree under the directory root which f includes, in order
+func (f Filter) Apply(root string, entries []TreeEntry) ([]TreeEntry, error) {
+	rules := make([]filterPattern, 0, len(f.Rules))
+	for _, r := range f.Rules {
+		p, err := compilePattern(r.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, p)
+	}
+	ignores := make(map[string][]ignoreRule)
+	err := f.readIgnoreFile(root, "", ignores)
+	if err != nil {
+		return nil, err
+	}
+	excludedDirs := make(map[string]bool)
+	included := make([]TreeEntry, 0, len(entries))
+	for _, e := range entries {
+		if excludedDirs[path.Dir(e.Path)] {
+			if e.Info.IsDir() {
+				excludedDirs[e.Path] = true
+			}
+			continue
+		}
+		include, err := f.includes(root, e, rules, ignores)
+		if err != nil {
+			return nil, err
+		}
+		if !include && e.Info.IsDir() {
+			excludedDirs[e.Path] = true
+		}
+		if !include {
+			continue
+		}
+		if e.Info.IsDir() {
+			err = f.readIgnoreFile(root, e.Path, ignores)
+			if err != nil {
+				return nil, err
+			}
+		}
+		included = append(included, e)
+	}
+	return included, nil
+}
+
+// includes returns true if f includes e, in the tree under the
+// directory root, given f's compiled rules & the ignore files read
+func (f Filter) includes(root string, e TreeEntry, rules []filterPattern, ignores map[string][]ignoreRule) (bool, error) {
+	dir := e.Info.IsDir()
+	if e.Info.Mode().IsRegular() {
+		size := uint64(e.Info.Size())
+		if size < f.MinSizeBytes || (f.MaxSizeBytes != 0 && size > f.MaxSizeBytes) {
+			return false, nil
+		}
+		if !f.NewerThan.IsZero() && !e.Info.ModTime().After(f.NewerThan) {
+			return false, nil
+		}
+	}
+	for i, r := range rules {
+		if r.matches(e.Path, dir) {
+			return f.Rules[i].Include, nil
+		}
+	}
+	// the deepest ignore file with a matching rule decides
+	for d := path.Dir(e.Path); ; d = path.Dir(d) {
+		rel := strings.TrimPrefix(e.Path, d+"/")
+		decided := false
+		include := true
+		for _, r := range ignores[d] {
+			if r.matches(rel, dir) {
+				decided, include = true, r.include
+			}
+		}
+		if decided {
+			return include, nil
+		}
+		if d == "." {
+			break
+		}
+	}
+	if dir && f.ExcludeCaches {
+		cache, err := isCacheDir(filepath.Join(root, filepath.FromSlash(e.Path)))
+		return !cache, err
+	}
+	return true, nil
+}
+
+// readIgnoreFile reads the ignore file (if any) in the directory
+// at path relative to the root of the tree into ignores
+func (f Filter) readIgnoreFile(root string, dir string, ignores map[string][]ignoreRule) error {
+	if f.IgnoreFile == "" {
+		return nil
+	}
+	patterns, err := readPatterns(filepath.Join(root, filepath.FromSlash(dir), f.IgnoreFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if dir == "" {
+		dir = "."
+	}
+	for _, pattern := range patterns {
+		p, err := compilePattern(strings.TrimPrefix(pattern, "!"))
+		if err != nil {
+			return err
+		}
+		ignores[dir] = append(ignores[dir], ignoreRule{filterPattern: p, include: strings.HasPrefix(pattern, "!")})
+	}
+	return nil
+}
+
+// isCacheDir returns true if the local directory at path
+// is tagged as a cache with a CACHEDIR.TAG file
+func isCacheDir(path string) (bool, error) {
+	f, err := os.Open(filepath.Join(path, "CACHEDIR.TAG"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	b := make([]byte, len(cacheDirSignature))
+	n, _ := f.Read(b)
+	return string(b[:n]) == cacheDirSignature, nil
+}
@@ -0,0 +1,100 @@
+package internal_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+// filtered returns the paths of the entries in the
+// tree under dir which f includes, failing on error
+func filtered(t *testing.T, dir string, f internal.Filter) []string {
+	entries, err := internal.WalkTree(dir)
+	if err != nil {
+		t.Fatalf("Failed to walk tree with %v", err)
+	}
+	entries, err = f.Apply(dir, entries)
+	if err != nil {
+		t.Fatalf("Failed to filter tree with %v", err)
+	}
+	paths := make([]string, 0)
+	for _, e := range entries {
+		paths = append(paths, e.Path)
+	}
+	return paths
+}
+
+func TestFilterTriesRulesInOrderExcludingDirectoryContents(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite(t, dir, "keep.log", "")
+	mustWrite(t, dir, "drop.log", "")
+	mustWrite(t, dir, "src/main.go", "")
+	mustWrite(t, dir, "src/build/out.go", "")
+	mustWrite(t, dir, "build/out", "")
+	mustWrite(t, dir, "a/b/c/d.tmp", "")
+	paths := filtered(t, dir, internal.Filter{Rules: []internal.FilterRule{
+		{Pattern: "keep.log", Include: true},
+		{Pattern: "*.log"},
+		{Pattern: "/build/"},
+		{Pattern: "a/**/*.tmp"},
+	}})
+	expected := []string{"a", "a/b", "a/b/c", "keep.log", "src", "src/build", "src/build/out.go", "src/main.go"}
+	if !reflect.DeepEqual(expected, paths) {
+		t.Errorf("Filtered to %v, expected %v", paths, expected)
+	}
+}
+
+func TestFilterExcludesWhatIgnoreFilesListAndCaches(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite(t, dir, ".gitignore", "# objects\n*.o\nbin/\n")
+	mustWrite(t, dir, "main.o", "")
+	mustWrite(t, dir, "bin/tool", "")
+	mustWrite(t, dir, "lib/.gitignore", "!keep.o\n")
+	mustWrite(t, dir, "lib/keep.o", "")
+	mustWrite(t, dir, "lib/drop.o", "")
+	mustWrite(t, dir, "cache/CACHEDIR.TAG", "Signature: 8a477f597d28d172789f06886806bc55\n")
+	mustWrite(t, dir, "cache/blob", "")
+	mustWrite(t, dir, "notcache/CACHEDIR.TAG", "not a cache")
+	paths := filtered(t, dir, internal.Filter{IgnoreFile: ".gitignore", ExcludeCaches: true})
+	expected := []string{".gitignore", "lib", "lib/.gitignore", "lib/keep.o", "notcache", "notcache/CACHEDIR.TAG"}
+	if !reflect.DeepEqual(expected, paths) {
+		t.Errorf("Filtered to %v, expected %v", paths, expected)
+	}
+}
+
+func TestFilterExcludesFilesBySizeAndAge(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite(t, dir, "small", "1")
+	mustWrite(t, dir, "medium", "12345")
+	mustWrite(t, dir, "large", "1234567890")
+	mustWrite(t, dir, "old/medium", "12345")
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	_ = os.Chtimes(filepath.Join(dir, "old", "medium"), old, old)
+	paths := filtered(t, dir, internal.Filter{MinSizeBytes: 2, MaxSizeBytes: 9, NewerThan: old.Add(time.Hour)})
+	expected := []string{"medium", "old"}
+	if !reflect.DeepEqual(expected, paths) {
+		t.Errorf("Filtered to %v, expected %v", paths, expected)
+	}
+}
+
+func TestParseNewerThanAcceptsDurationsDaysAndDates(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	for s, expected := range map[string]time.Time{
+		"36h":                  now.Add(-36 * time.Hour),
+		"7d":                   now.AddDate(0, 0, -7),
+		"2024-01-02T03:04:05Z": time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	} {
+		actual, err := internal.ParseNewerThan(s, now)
+		if err != nil || !actual.Equal(expected) {
+			t.Errorf("Parsed %s as %v (error %v), expected %v", s, actual, err, expected)
+		}
+	}
+	_, err := internal.ParseNewerThan("yesterday", now)
+	if err == nil {
+		t.Error("Parsed yesterday")
+	}
+}
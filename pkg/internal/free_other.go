@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package internal
+
+import "errors"
+
+// freeBytes can't tell the bytes available on this platform
+func freeBytes(string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
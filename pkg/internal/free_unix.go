@@ -0,0 +1,16 @@
+//go:build linux || darwin
+
+package internal
+
+import "golang.org/x/sys/unix"
+
+// freeBytes returns the bytes available to the user
+// on the filesystem holding the existing path
+func freeBytes(path string) (uint64, error) {
+	var st unix.Statfs_t
+	err := unix.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
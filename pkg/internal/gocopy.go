@@ -0,0 +1,295 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// protocolAttempts is how many times a session with a go-copy
+// server is resumed after failing before giving up on the transfer
+const protocolAttempts = 5
+
+// protocolSource is an rsource reading a file from a go-copy
+// server, resuming from where it got to if the session fails
+type protocolSource struct {
+	url     string
+	dialer  protocolDialer
+	fc      *frameConn
+	offset  int64
+	pending []byte
+	drops   int
+}
+
+// NewGoCopySource creates a new source reading from
+// the gocopy(s) or ssh URL url, connecting as per eo
+func NewGoCopySource(url string, eo EndpointOptions) *protocolSource {
+	return &protocolSource{url: url, dialer: dialerFor(url, eo)}
+}
+
+// open opens a session of mode for the file from offset
+func open(dialer protocolDialer, mode string, offset int64) (*frameConn, protocolReply, error) {
+	var reply protocolReply
+	conn, path, err := dialer.dial()
+	if err != nil {
+		return nil, reply, err
+	}
+	fc := &frameConn{rwc: conn}
+	err = fc.sendJSON(frameOpen, protocolRequest{Version: protocolVersion, Mode: mode, Path: path, Offset: offset})
+	if err == nil {
+		err = fc.receiveJSON(frameOK, &reply)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, reply, err
+	}
+	return fc, reply, nil
+}
+
+// Size returns the size of the file on the server
+func (ps *protocolSource) Size() (uint64, error) {
+	fc, reply, err := open(ps.dialer, modeStat, 0)
+	if err != nil {
+		return 0, err
+	}
+	_ = fc.rwc.Close()
+	return uint64(reply.Size), nil
+}
+
+// Open implements rsource on protocolSource
+func (ps *protocolSource) Open() error {
+	var err error
+	ps.fc, _, err = open(ps.dialer, modeRead, 0)
+	return err
+}
+
+// Read implements rsource on protocolSource, checking each
+// frame of data against its checksum, & starting a new session
+// from the current offset if the session fails
+func (ps *protocolSource) Read(b []byte) (int, error) {
+	for len(ps.pending) == 0 {
+		t, p, err := ps.fc.receive()
+		if err == nil && t == frameEnd {
+			return 0, io.EOF
+		}
+		if err == nil && t != frameData {
+			err = fmt.Errorf("expected data, received frame %c", t)
+		}
+		if err == nil {
+			ps.pending, err = dataOf(p)
+		}
+		if err == nil {
+			ps.drops = 0
+			continue
+		}
+		ps.drops++
+		if ps.drops > protocolAttempts {
+			return 0, fmt.Errorf("reading %s failed %d times without progress: %w", ps.url, ps.drops, err)
+		}
+		log.Printf("WARNING: reading %s failed at byte %d (%v), resuming", ps.url, ps.offset, err)
+		_ = ps.fc.rwc.Close()
+		ps.fc, _, err = open(ps.dialer, modeRead, ps.offset)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, ps.pending)
+	ps.pending = ps.pending[n:]
+	ps.offset += int64(n)
+	return n, nil
+}
+
+// Close implements rsource on protocolSource
+func (ps *protocolSource) Close() error {
+	return ps.fc.rwc.Close()
+}
+
+// protocolTarget is a wtarget writing a file on a go-copy server.
+// Bytes are only reported as written once the server acknowledges
+// that it has flushed them to disk, until then they are retained
+// so that if the session fails, a new session can be started from
+// the last acknowledged offset and the rest sent again.
+type protocolTarget struct {
+	url      string
+	dialer   protocolDialer
+	report   func(uint64)
+	fc       *frameConn
+	retained []byte
+	// base is the offset of the first retained byte
+	base int64
+	// sent is the offset up to which bytes have been sent
+	sent      int64
+	receiving chan struct{}
+	l         sync.Mutex
+	acked     int64
+	done      bool
+	err       error
+}
+
+// NewGoCopyTarget creates a new target writing to
+// the gocopy(s) or ssh URL url, connecting as per eo
+func NewGoCopyTarget(url string, eo EndpointOptions) *protocolTarget {
+	return &protocolTarget{url: url, dialer: dialerFor(url, eo), report: func(uint64) {}}
+}
+
+// AcknowledgeTo implements acknowledger on protocolTarget
+func (pt *protocolTarget) AcknowledgeTo(report func(uint64)) {
+	pt.report = report
+}
+
+// Initialise implements wtarget on protocolTarget,
+// opening a session to write the file from the start
+func (pt *protocolTarget) Initialise() error {
+	return pt.open()
+}
+
+// open opens a session to write the file from the last
+// acknowledged offset, & starts receiving acknowledgements
+func (pt *protocolTarget) open() error {
+	fc, _, err := open(pt.dialer, modeWrite, pt.acked)
+	if err != nil {
+		return err
+	}
+	pt.fc = fc
+	pt.sent = pt.acked
+	pt.trim()
+	pt.err = nil
+	pt.receiving = make(chan struct{})
+	go pt.receive(fc)
+	return nil
+}
+
+// receive receives acknowledgements from the server on fc,
+// reporting the bytes acknowledged, until the server is done
+// or the session fails
+func (pt *protocolTarget) receive(fc *frameConn) {
+	defer close(pt.receiving)
+	for {
+		t, p, err := fc.receive()
+		var offset int64
+		if err == nil && t != frameSynced && t != frameDone {
+			err = fmt.Errorf("expected acknowledgement, received frame %c", t)
+		}
+		if err == nil {
+			offset, err = offsetOf(p)
+		}
+		pt.l.Lock()
+		if err != nil {
+			pt.err = err
+			pt.l.Unlock()
+			return
+		}
+		if offset > pt.acked {
+			pt.report(uint64(offset - pt.acked))
+			pt.acked = offset
+		}
+		pt.done = t == frameDone
+		pt.l.Unlock()
+		if t == frameDone {
+			return
+		}
+	}
+}
+
+// failed returns the error with which the session failed, if it has
+func (pt *protocolTarget) failed() error {
+	pt.l.Lock()
+	defer pt.l.Unlock()
+	return pt.err
+}
+
+// trim drops retained bytes which have been acknowledged
+func (pt *protocolTarget) trim() {
+	pt.l.Lock()
+	acked := pt.acked
+	pt.l.Unlock()
+	pt.retained = pt.retained[acked-pt.base:]
+	pt.base = acked
+}
+
+// Write implements wtarget on protocolTarget,
+// sending the bytes once there are enough for a frame
+func (pt *protocolTarget) Write(b []byte) (int, error) {
+	pt.retained = append(pt.retained, b...)
+	if pt.base+int64(len(pt.retained))-pt.sent < protocolDataBytes {
+		return len(b), nil
+	}
+	err := pt.flush(func() error { return nil })
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// flush sends all of the bytes not yet sent, then calls then,
+// starting a new session & trying again if the session fails
+func (pt *protocolTarget) flush(then func() error) error {
+	var err error
+	for attempt := 0; attempt < protocolAttempts; attempt++ {
+		if attempt > 0 {
+			log.Printf("WARNING: writing %s failed at byte %d (%v), resuming", pt.url, pt.acked, err)
+			_ = pt.fc.rwc.Close()
+			<-pt.receiving
+			err = pt.open()
+			if err != nil {
+				return err
+			}
+		}
+		err = pt.failed()
+		if err == nil {
+			pt.trim()
+			err = pt.fc.sendData(pt.retained[pt.sent-pt.base:])
+		}
+		if err == nil {
+			pt.sent = pt.base + int64(len(pt.retained))
+			err = then()
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("writing %s failed %d times: %w", pt.url, protocolAttempts, err)
+}
+
+// Sync implements wtarget on protocolTarget, sending anything
+// not yet sent, the server decides when to flush to disk
+// itself and acknowledges when it has
+func (pt *protocolTarget) Sync() error {
+	return pt.flush(func() error { return nil })
+}
+
+// Close implements wtarget on protocolTarget, sending anything
+// not yet sent, then ending the session & waiting until the server
+// has acknowledged that the whole file is flushed to disk
+func (pt *protocolTarget) Close() error {
+	err := pt.flush(func() error {
+		err := pt.fc.send(frameEnd, nil)
+		if err != nil {
+			return err
+		}
+		<-pt.receiving
+		pt.l.Lock()
+		defer pt.l.Unlock()
+		if pt.err == nil && !pt.done {
+			pt.err = io.ErrUnexpectedEOF
+		}
+		return pt.err
+	})
+	if err != nil {
+		return err
+	}
+	if pt.acked != pt.sent {
+		return fmt.Errorf("server acknowledged %d bytes of %s, but %d were sent", pt.acked, pt.url, pt.sent)
+	}
+	return pt.fc.rwc.Close()
+}
+
+// Abort implements aborter on protocolTarget, dropping the
+// session without ending it, so the server keeps what it
+// has flushed for the copy to be resumed
+func (pt *protocolTarget) Abort() error {
+	err := pt.fc.rwc.Close()
+	<-pt.receiving
+	return err
+}
@@ -0,0 +1,218 @@
+package internal_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"github.com/snasphysicist/go-copy/pkg/random"
+)
+
+// newGoCopyServer serves a read only export "ro" & a writable export
+// "rw" of temporary directories, with TLS if config isn't nil,
+// returning the address it's listening on & the directories
+func newGoCopyServer(t *testing.T, config *tls.Config) (string, string, string) {
+	ro := t.TempDir()
+	rw := t.TempDir()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen with %v", err)
+	}
+	if config != nil {
+		l = tls.NewListener(l, config)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	exports := []internal.Export{{Name: "ro", Dir: ro}, {Name: "rw", Dir: rw, Writable: true}}
+	go func() { _ = internal.NewServer(exports, 1024*1024, 256*1024).Serve(l) }()
+	return l.Addr().String(), ro, rw
+}
+
+// droppingProxy forwards connections to address, cutting off the
+// first connection after dropAfter bytes from the client, returning
+// the address it's listening on
+func droppingProxy(t *testing.T, address string, dropAfter int64) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen with %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	var connections int32
+	go func() {
+		for {
+			client, err := l.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", address)
+			if err != nil {
+				_ = client.Close()
+				continue
+			}
+			upstream := io.Reader(client)
+			if atomic.AddInt32(&connections, 1) == 1 {
+				upstream = io.LimitReader(client, dropAfter)
+			}
+			go func() {
+				_, _ = io.Copy(server, upstream)
+				_ = server.Close()
+				_ = client.Close()
+			}()
+			go func() {
+				_, _ = io.Copy(client, server)
+				_ = client.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestGoCopyTargetUploadsAndIsAcknowledged(t *testing.T) {
+	address, _, rw := newGoCopyServer(t, nil)
+	for _, size := range []int{0, 5000, 5*1024*1024 + 17} {
+		content := random.Bytes(size)
+		acknowledged, err := uploadInPieces(t, internal.NewGoCopyTarget("gocopy://"+address+"/rw/file.bin", internal.EndpointOptions{}), content)
+		if err != nil {
+			t.Fatalf("Failed to upload %d bytes with %v", size, err)
+		}
+		written, err := os.ReadFile(filepath.Join(rw, "file.bin"))
+		if err != nil {
+			t.Fatalf("Failed to read uploaded file with %v", err)
+		}
+		if !bytes.Equal(content, written) {
+			t.Errorf("Uploaded file of %d bytes did not match written content", size)
+		}
+		if acknowledged != uint64(size) {
+			t.Errorf("%d bytes acknowledged, expected %d", acknowledged, size)
+		}
+	}
+}
+
+func TestGoCopyTargetResumesWhenConnectionDrops(t *testing.T) {
+	address, _, rw := newGoCopyServer(t, nil)
+	proxy := droppingProxy(t, address, 3*1024*1024)
+	content := random.Bytes(8 * 1024 * 1024)
+	acknowledged, err := uploadInPieces(t, internal.NewGoCopyTarget("gocopy://"+proxy+"/rw/file.bin", internal.EndpointOptions{}), content)
+	if err != nil {
+		t.Fatalf("Failed to upload with %v", err)
+	}
+	written, _ := os.ReadFile(filepath.Join(rw, "file.bin"))
+	if !bytes.Equal(content, written) {
+		t.Error("Resumed upload did not match written content")
+	}
+	if acknowledged != uint64(len(content)) {
+		t.Errorf("%d bytes acknowledged, expected %d", acknowledged, len(content))
+	}
+}
+
+func TestGoCopySourceReadsFileAndSize(t *testing.T) {
+	address, ro, _ := newGoCopyServer(t, nil)
+	content := random.Bytes(3*1024*1024 + 5)
+	err := os.WriteFile(filepath.Join(ro, "file.bin"), content, 0644)
+	if err != nil {
+		t.Fatalf("Failed to create file with %v", err)
+	}
+	source := internal.SourceFor("gocopy://"+address+"/ro/file.bin", internal.EndpointOptions{})
+	size := internal.EstimatedSizeOf(source)
+	if size != uint64(len(content)) {
+		t.Errorf("Size reported as %d, expected %d", size, len(content))
+	}
+	if !bytes.Equal(content, readAll(t, source)) {
+		t.Error("Content read did not match file")
+	}
+}
+
+func TestGoCopyServerRefusesWritingReadOnlyExportsAndEscaping(t *testing.T) {
+	address, ro, rw := newGoCopyServer(t, nil)
+	err := os.Symlink(ro, filepath.Join(rw, "escape"))
+	if err != nil {
+		t.Fatalf("Failed to create symlink with %v", err)
+	}
+	for _, path := range []string{"/ro/file.bin", "/rw/escape/file.bin", "/missing/file.bin"} {
+		target := internal.NewGoCopyTarget("gocopy://"+address+path, internal.EndpointOptions{})
+		err := target.Initialise()
+		if err == nil {
+			_ = target.Close()
+			t.Errorf("Writing %s was allowed", path)
+		}
+	}
+	entries, _ := os.ReadDir(ro)
+	if len(entries) != 0 {
+		t.Errorf("Read only export has %d entries after refused writes", len(entries))
+	}
+}
+
+// writeCertificate writes a certificate for 127.0.0.1 & its key to
+// dir, signed by parent (or self signed if nil), returning the
+// certificate & key and the files written
+func writeCertificate(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key with %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate with %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return cert, key, certFile, keyFile
+}
+
+func TestGoCopyMutualTLSRequiresClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := writeCertificate(t, dir, "ca", nil, nil)
+	_, _, serverCert, serverKey := writeCertificate(t, dir, "server", ca, caKey)
+	_, _, clientCert, clientKey := writeCertificate(t, dir, "client", ca, caKey)
+	config, err := internal.ServerTLSConfig(serverCert, serverKey, caFile)
+	if err != nil {
+		t.Fatalf("Failed to configure TLS with %v", err)
+	}
+	address, _, rw := newGoCopyServer(t, config)
+	url := "gocopys://" + address + "/rw/file.bin"
+	content := random.Bytes(5000)
+	err = internal.NewGoCopyTarget(url, internal.EndpointOptions{TLSCAFile: caFile}).Initialise()
+	if err == nil {
+		t.Error("Server accepted a client without a certificate")
+	}
+	eo := internal.EndpointOptions{TLSCAFile: caFile, TLSCertFile: clientCert, TLSKeyFile: clientKey}
+	_, err = uploadInPieces(t, internal.NewGoCopyTarget(url, eo), content)
+	if err != nil {
+		t.Fatalf("Failed to upload with client certificate with %v", err)
+	}
+	written, _ := os.ReadFile(filepath.Join(rw, "file.bin"))
+	if !bytes.Equal(content, written) {
+		t.Error("Uploaded file did not match written content")
+	}
+}
@@ -0,0 +1,383 @@
+package internal
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// httpAttempts is how many times a request is
+// attempted before giving up on the transfer
+const httpAttempts = 5
+
+// httpSegmentSizeBytes is the size of the pieces
+// fetched in parallel by a segmented httpSource
+const httpSegmentSizeBytes = 4 * 1024 * 1024
+
+// IsHTTP returns true if path is an http(s) URL
+func IsHTTP(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// httpSource is an rsource reading from an http(s) URL,
+// resuming with Range requests when the connection drops,
+// optionally downloading several segments in parallel,
+// and checking the content against integrity headers
+type httpSource struct {
+	url      string
+	segments int
+	header   http.Header
+	client   *http.Client
+	length   int64
+	etag     string
+	ranges   bool
+	offset   int64
+	body     io.ReadCloser
+	pieces   chan chan httpPiece
+	piece    []byte
+	stop     chan struct{}
+	checks   []integrityCheck
+	drops    int
+}
+
+// httpPiece is one piece of a segmented download,
+// or the error that occurred downloading it
+type httpPiece struct {
+	b   []byte
+	err error
+}
+
+// integrityCheck is a hash of the content being calculated as it is
+// read, and the value (from some header) it should end up with
+type integrityCheck struct {
+	name     string
+	h        hash.Hash
+	expected []byte
+	// warnOnly is true if the value is only a guess at a hash
+	// (like an ETag), so not matching it is only warned about
+	warnOnly bool
+}
+
+// NewHTTPSource creates a new source reading from url,
+// in up to segments parallel ranges if the server supports it
+// (1 or fewer meaning a single sequential request),
+// adding header to each request
+func NewHTTPSource(url string, segments int, header http.Header) *httpSource {
+	return &httpSource{url: url, segments: segments, header: header, client: http.DefaultClient, length: -1}
+}
+
+// request creates a GET/HEAD request to the source's url with
+// its headers, for the byte range from offset to end (exclusive),
+// with end < 0 meaning to the end of the content, and offset
+// of 0 with end < 0 meaning the whole content (no Range)
+func (hs *httpSource) request(method string, offset int64, end int64) (*http.Request, error) {
+	req, err := newHTTPRequest(method, hs.url, nil, hs.header)
+	if err != nil {
+		return nil, err
+	}
+	if offset == 0 && end < 0 {
+		return req, nil
+	}
+	if end < 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, end-1))
+	}
+	if hs.etag != "" {
+		// so we'll not get a mix of two versions of the content
+		req.Header.Set("If-Range", hs.etag)
+	}
+	return req, nil
+}
+
+// Size returns the size of the content at the url
+// as reported by the server to a HEAD request,
+// or 0 if the server will not say
+func (hs *httpSource) Size() (uint64, error) {
+	req, err := hs.request(http.MethodHead, 0, -1)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+		return 0, nil
+	}
+	return uint64(resp.ContentLength), nil
+}
+
+// Open implements rsource on httpSource, making the initial request
+// and, if segmented, starting fetching the segments in parallel
+func (hs *httpSource) Open() error {
+	req, err := hs.request(http.MethodGet, 0, -1)
+	if err != nil {
+		return err
+	}
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return fmt.Errorf("GET %s returned %s", hs.url, resp.Status)
+	}
+	hs.length = resp.ContentLength
+	hs.etag = resp.Header.Get("ETag")
+	hs.ranges = resp.Header.Get("Accept-Ranges") == "bytes"
+	hs.checks = integrityChecks(resp.Header)
+	if hs.segments > 1 && hs.ranges && hs.length > httpSegmentSizeBytes {
+		// the pieces will be fetched separately
+		_ = resp.Body.Close()
+		hs.startSegments()
+		return nil
+	}
+	hs.body = resp.Body
+	return nil
+}
+
+// Read implements rsource on httpSource, reading the content
+// in order, whether or not it is being downloaded in segments.
+// Returns an error on EOF if the content does not match
+// the integrity headers sent by the server.
+func (hs *httpSource) Read(b []byte) (int, error) {
+	var n int
+	var err error
+	if hs.pieces != nil {
+		n, err = hs.readSegmented(b)
+	} else {
+		n, err = hs.readSequential(b)
+	}
+	for _, c := range hs.checks {
+		c.h.Write(b[:n])
+	}
+	hs.offset += int64(n)
+	if err == io.EOF {
+		err = hs.verify()
+		if err == nil {
+			err = io.EOF
+		}
+	}
+	return n, err
+}
+
+// readSequential reads from the single response body,
+// re-requesting from the current offset if it fails
+func (hs *httpSource) readSequential(b []byte) (int, error) {
+	n, err := hs.body.Read(b)
+	if err == nil || n > 0 {
+		hs.drops = 0
+		return n, nil
+	}
+	complete := hs.length < 0 || hs.offset >= hs.length
+	if err == io.EOF && complete {
+		return 0, io.EOF
+	}
+	if !hs.ranges {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, fmt.Errorf("connection to %s dropped and server does not support resuming: %w", hs.url, err)
+	}
+	hs.drops++
+	if hs.drops > httpAttempts {
+		return 0, fmt.Errorf("connection to %s dropped %d times without progress: %w", hs.url, hs.drops, err)
+	}
+	log.Printf("WARNING: connection to %s dropped at byte %d (%v), resuming", hs.url, hs.offset, err)
+	_ = hs.body.Close()
+	hs.body, err = hs.fetch(hs.offset, -1)
+	if err != nil {
+		return 0, err
+	}
+	return hs.readSequential(b)
+}
+
+// fetch requests the byte range from offset to end (exclusive),
+// end < 0 meaning until the end of the content, retrying with
+// backoff up to httpAttempts times, and returns the response body
+func (hs *httpSource) fetch(offset int64, end int64) (io.ReadCloser, error) {
+	var lastErr error
+	for attempt := 0; attempt < httpAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(100<<attempt) * time.Millisecond)
+		}
+		req, err := hs.request(http.MethodGet, offset, end)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := hs.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode == http.StatusPartialContent {
+			return resp.Body, nil
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil, fmt.Errorf("content at %s changed during the transfer", hs.url)
+		}
+		lastErr = fmt.Errorf("GET %s for bytes %d-%d returned %s", hs.url, offset, end, resp.Status)
+	}
+	return nil, lastErr
+}
+
+// startSegments starts fetching the content in pieces, up to
+// hs.segments at once, queuing them in order on hs.pieces
+func (hs *httpSource) startSegments() {
+	hs.pieces = make(chan chan httpPiece, hs.segments)
+	hs.stop = make(chan struct{})
+	go func() {
+		defer close(hs.pieces)
+		for start := int64(0); start < hs.length; start += httpSegmentSizeBytes {
+			end := start + httpSegmentSizeBytes
+			if end > hs.length {
+				end = hs.length
+			}
+			p := make(chan httpPiece, 1)
+			select {
+			case hs.pieces <- p:
+			case <-hs.stop:
+				return
+			}
+			go func(start int64, end int64) {
+				p <- hs.fetchPiece(start, end)
+			}(start, end)
+		}
+	}()
+}
+
+// fetchPiece downloads the piece from start to end
+// (exclusive) completely, resuming if it's interrupted
+func (hs *httpSource) fetchPiece(start int64, end int64) httpPiece {
+	b := make([]byte, 0, end-start)
+	for attempt := 0; attempt < httpAttempts; attempt++ {
+		body, err := hs.fetch(start+int64(len(b)), end)
+		if err != nil {
+			return httpPiece{err: err}
+		}
+		buf := make([]byte, 32*1024)
+		for int64(len(b)) < end-start {
+			n, err := body.Read(buf)
+			b = append(b, buf[:n]...)
+			if err != nil {
+				break
+			}
+		}
+		_ = body.Close()
+		if int64(len(b)) == end-start {
+			return httpPiece{b: b}
+		}
+	}
+	return httpPiece{err: fmt.Errorf("failed to fetch bytes %d-%d of %s after %d attempts", start, end, hs.url, httpAttempts)}
+}
+
+// readSegmented reads the pieces fetched in parallel in order
+func (hs *httpSource) readSegmented(b []byte) (int, error) {
+	if len(hs.piece) == 0 {
+		next, ok := <-hs.pieces
+		if !ok {
+			return 0, io.EOF
+		}
+		p := <-next
+		if p.err != nil {
+			return 0, p.err
+		}
+		hs.piece = p.b
+	}
+	n := copy(b, hs.piece)
+	hs.piece = hs.piece[n:]
+	return n, nil
+}
+
+// Close implements rsource on httpSource, abandoning
+// the response or any pieces still being fetched
+func (hs *httpSource) Close() error {
+	if hs.stop != nil {
+		close(hs.stop)
+	}
+	if hs.body != nil {
+		return hs.body.Close()
+	}
+	return nil
+}
+
+// verify checks the content read against the integrity headers
+func (hs *httpSource) verify() error {
+	if hs.length >= 0 && hs.offset != hs.length {
+		return fmt.Errorf("read %d bytes from %s, but it should have %d", hs.offset, hs.url, hs.length)
+	}
+	for _, c := range hs.checks {
+		actual := c.h.Sum(nil)
+		if string(actual) != string(c.expected) && c.warnOnly {
+			log.Printf(
+				"WARNING: content from %s has %s %s, not %s, which may not be an md5 sum",
+				hs.url, c.name, hex.EncodeToString(actual), hex.EncodeToString(c.expected),
+			)
+			continue
+		}
+		if string(actual) != string(c.expected) {
+			return fmt.Errorf(
+				"content from %s has %s %s, but the server said it should be %s",
+				hs.url, c.name, hex.EncodeToString(actual), hex.EncodeToString(c.expected),
+			)
+		}
+	}
+	return nil
+}
+
+// digestAlgorithms are the hashes which can be
+// checked from Digest & Content-Digest headers
+var digestAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// md5ETag matches an ETag which is (probably) an md5 sum of the content
+var md5ETag = regexp.MustCompile(`^"?([0-9a-fA-F]{32})"?$`)
+
+// integrityChecks returns the checks to make on the
+// content based on the Digest (RFC 3230), Content-Digest
+// (RFC 9530) & ETag (if it looks like an md5 sum, only
+// warning if it doesn't match, as it may be something else) headers
+func integrityChecks(header http.Header) []integrityCheck {
+	checks := make([]integrityCheck, 0)
+	for _, name := range []string{"Content-Digest", "Digest"} {
+		for _, v := range header.Values(name) {
+			for _, d := range strings.Split(v, ",") {
+				algorithm, value, found := strings.Cut(strings.TrimSpace(d), "=")
+				newHash, known := digestAlgorithms[strings.ToLower(algorithm)]
+				if !found || !known {
+					continue
+				}
+				expected, err := base64.StdEncoding.DecodeString(strings.Trim(value, ":"))
+				if err != nil {
+					continue
+				}
+				checks = append(checks, integrityCheck{name: name + " " + algorithm, h: newHash(), expected: expected})
+			}
+		}
+		if len(checks) > 0 {
+			return checks
+		}
+	}
+	m := md5ETag.FindStringSubmatch(header.Get("ETag"))
+	if m != nil {
+		expected, _ := hex.DecodeString(m[1])
+		checks = append(checks, integrityCheck{name: "ETag md5", h: md5.New(), expected: expected, warnOnly: true})
+	}
+	return checks
+}
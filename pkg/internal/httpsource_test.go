@@ -0,0 +1,151 @@
+package internal_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"github.com/snasphysicist/go-copy/pkg/random"
+)
+
+// serveContent serves content with support for ranges,
+// counting the requests made for ranges in ranged
+func serveContent(content []byte, ranged *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(ranged, 1)
+		}
+		http.ServeContent(w, r, "content", time.Unix(0, 0), bytes.NewReader(content))
+	}
+}
+
+func TestHTTPSourceReadsContentAndReportsSize(t *testing.T) {
+	content := random.Bytes(100000)
+	var ranged int32
+	server := httptest.NewServer(serveContent(content, &ranged))
+	defer server.Close()
+	hs := internal.NewHTTPSource(server.URL, 1, nil)
+	size, err := hs.Size()
+	if err != nil {
+		t.Fatalf("Failed to get size with %v", err)
+	}
+	if size != uint64(len(content)) {
+		t.Errorf("Size reported as %d, expected %d", size, len(content))
+	}
+	read := readAll(t, hs)
+	if !bytes.Equal(content, read) {
+		t.Error("Content read did not match content served")
+	}
+}
+
+func TestHTTPSourceResumesWithRangeWhenConnectionDrops(t *testing.T) {
+	content := random.Bytes(100000)
+	var ranged int32
+	serve := serveContent(content, &ranged)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			serve(w, r)
+			return
+		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", "100000")
+		_, _ = w.Write(content[:30000])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer server.Close()
+	read := readAll(t, internal.NewHTTPSource(server.URL, 1, nil))
+	if !bytes.Equal(content, read) {
+		t.Errorf("Content read (%d bytes) did not match content served (%d bytes)", len(read), len(content))
+	}
+	if atomic.LoadInt32(&ranged) == 0 {
+		t.Error("No range request was made to resume")
+	}
+}
+
+func TestHTTPSourceDownloadsSegmentsInParallel(t *testing.T) {
+	content := random.Bytes(10 * 1024 * 1024)
+	var ranged int32
+	server := httptest.NewServer(serveContent(content, &ranged))
+	defer server.Close()
+	read := readAll(t, internal.NewHTTPSource(server.URL, 3, nil))
+	if !bytes.Equal(content, read) {
+		t.Error("Content read did not match content served")
+	}
+	if atomic.LoadInt32(&ranged) != 3 {
+		t.Errorf("%d ranges requested, expected 3 for 10mb in 4mb segments", atomic.LoadInt32(&ranged))
+	}
+}
+
+func TestHTTPSourceErrorsWhenContentDoesNotMatchDigest(t *testing.T) {
+	content := random.Bytes(1000)
+	var ranged int32
+	serve := serveContent(content, &ranged)
+	for digest, shouldFail := range map[string]bool{
+		base64.StdEncoding.EncodeToString(random.Bytes(32)):  true,
+		base64.StdEncoding.EncodeToString(sha256Of(content)): false,
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Digest", "sha-256="+digest)
+			serve(w, r)
+		}))
+		hs := internal.NewHTTPSource(server.URL, 1, nil)
+		err := hs.Open()
+		if err != nil {
+			t.Fatalf("Failed to open with %v", err)
+		}
+		_, err = io.ReadAll(hs)
+		if shouldFail && err == nil {
+			t.Error("No error reading content not matching its digest")
+		}
+		if !shouldFail && err != nil {
+			t.Errorf("Error %v reading content matching its digest", err)
+		}
+		server.Close()
+	}
+}
+
+func TestHTTPSourceOnlyWarnsWhenContentDoesNotMatchETag(t *testing.T) {
+	content := random.Bytes(1000)
+	var ranged int32
+	serve := serveContent(content, &ranged)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"0123456789abcdef0123456789abcdef"`)
+		serve(w, r)
+	}))
+	defer server.Close()
+	hs := internal.NewHTTPSource(server.URL, 1, nil)
+	err := hs.Open()
+	if err != nil {
+		t.Fatalf("Failed to open with %v", err)
+	}
+	read, err := io.ReadAll(hs)
+	if err != nil || !bytes.Equal(read, content) {
+		t.Errorf("Failed to read content not matching a hex ETag (error %v)", err)
+	}
+}
+
+func TestHTTPSourceSendsHeaders(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+	_ = readAll(t, internal.NewHTTPSource(server.URL, 1, http.Header{"Authorization": {"Bearer token"}}))
+	if authorization != "Bearer token" {
+		t.Errorf("Authorization header was %s, expected Bearer token", authorization)
+	}
+}
+
+// sha256Of returns the sha256 sum of b
+func sha256Of(b []byte) []byte {
+	s := sha256.Sum256(b)
+	return s[:]
+}
@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpTarget is a wtarget which uploads
+// to an http(s) URL with a PUT request
+type httpTarget struct {
+	url      string
+	size     uint64
+	header   http.Header
+	client   *http.Client
+	w        *io.PipeWriter
+	response chan error
+}
+
+// NewHTTPTarget creates a new target which PUTs to url,
+// adding header to the request. If size is not 0, it must be
+// exactly what will be written, as it's sent as the Content-Length,
+// otherwise (e.g. when it's only an estimate) the upload is chunked.
+func NewHTTPTarget(url string, size uint64, header http.Header) *httpTarget {
+	return &httpTarget{url: url, size: size, header: header, client: http.DefaultClient}
+}
+
+// Initialise implements wtarget on httpTarget,
+// starting the request, to which written
+// bytes are streamed as the body
+func (ht *httpTarget) Initialise() error {
+	r, w := io.Pipe()
+	req, err := newHTTPRequest(http.MethodPut, ht.url, r, ht.header)
+	if err != nil {
+		return err
+	}
+	if ht.size != 0 {
+		req.ContentLength = int64(ht.size)
+	}
+	ht.w = w
+	ht.response = make(chan error, 1)
+	go func() {
+		resp, err := ht.client.Do(req)
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = fmt.Errorf("PUT %s returned %s", ht.url, resp.Status)
+			}
+		}
+		// unblock any write still waiting on the request
+		_ = r.CloseWithError(err)
+		ht.response <- err
+	}()
+	return nil
+}
+
+// Sync implements wtarget on httpTarget, there's no way
+// to ask the server to flush what it has received so far,
+// so this does nothing
+func (ht *httpTarget) Sync() error {
+	return nil
+}
+
+// Write implements wtarget on httpTarget,
+// streaming b into the request body
+func (ht *httpTarget) Write(b []byte) (int, error) {
+	return ht.w.Write(b)
+}
+
+// Close implements wtarget on httpTarget, finishing the request
+// body and returning an error if the upload did not succeed
+func (ht *httpTarget) Close() error {
+	_ = ht.w.Close()
+	return <-ht.response
+}
+
+// Abort implements aborter on httpTarget, failing the
+// request body so that the server doesn't take the
+// bytes written so far as the whole file
+func (ht *httpTarget) Abort() error {
+	_ = ht.w.CloseWithError(fmt.Errorf("upload to %s aborted", ht.url))
+	return <-ht.response
+}
+
+// newHTTPRequest creates a request with method to url
+// with body, adding all of header to it
+func newHTTPRequest(method string, url string, body io.Reader, header http.Header) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	return req, nil
+}
+
+// webDAVTreeTarget is a treeTarget under the
+// WebDAV collection at the root URL
+type webDAVTreeTarget struct {
+	root   string
+	header http.Header
+	client *http.Client
+}
+
+// NewWebDAVTreeTarget creates a new target for a tree of files
+// under the WebDAV collection at root, adding header to all requests
+func NewWebDAVTreeTarget(root string, header http.Header) *webDAVTreeTarget {
+	return &webDAVTreeTarget{root: strings.TrimSuffix(root, "/"), header: header, client: http.DefaultClient}
+}
+
+// url returns the URL for path relative to the root
+func (wtt *webDAVTreeTarget) url(path string) string {
+	if path == "" {
+		return wtt.root
+	}
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return wtt.root + "/" + strings.Join(segments, "/")
+}
+
+// Mkdir implements treeTarget on webDAVTreeTarget with MKCOL
+func (wtt *webDAVTreeTarget) Mkdir(path string) error {
+	req, err := newHTTPRequest("MKCOL", wtt.url(path), nil, wtt.header)
+	if err != nil {
+		return err
+	}
+	resp, err := wtt.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	// 405 Method Not Allowed is returned if it exists already
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+		return fmt.Errorf("MKCOL %s returned %s", wtt.url(path), resp.Status)
+	}
+	return nil
+}
+
+// File implements treeTarget on webDAVTreeTarget
+func (wtt *webDAVTreeTarget) File(path string, size uint64) wtarget {
+	return NewHTTPTarget(wtt.url(path), size, wtt.header)
+}
+
+// propfindBody requests just the properties we need for Identical
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/><D:getlastmodified/><D:resourcetype/></D:prop></D:propfind>`
+
+// multistatus is the part of a PROPFIND response we need
+type multistatus struct {
+	Responses []struct {
+		Propstats []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ContentLength string `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+				ResourceType  struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// Identical implements treeTarget on webDAVTreeTarget with PROPFIND.
+// The server sets the modification time of uploads itself, so a file
+// is considered identical if it has the same size & was modified
+// no earlier than the file described by info (or both are empty).
+func (wtt *webDAVTreeTarget) Identical(path string, info fs.FileInfo) (bool, error) {
+	req, err := newHTTPRequest("PROPFIND", wtt.url(path), strings.NewReader(propfindBody), wtt.header)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err := wtt.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return false, fmt.Errorf("PROPFIND %s returned %s", wtt.url(path), resp.Status)
+	}
+	var ms multistatus
+	err = xml.NewDecoder(resp.Body).Decode(&ms)
+	if err != nil {
+		return false, fmt.Errorf("PROPFIND %s returned invalid response: %w", wtt.url(path), err)
+	}
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstats {
+			if !strings.Contains(ps.Status, " 200 ") || ps.Prop.ResourceType.Collection != nil {
+				continue
+			}
+			size, err := strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+			if err != nil {
+				continue
+			}
+			modified, err := http.ParseTime(ps.Prop.LastModified)
+			if err != nil {
+				continue
+			}
+			// empty files are identical whenever they were modified
+			newEnough := size == 0 || !modified.Before(info.ModTime().Truncate(time.Second))
+			return size == info.Size() && newEnough, nil
+		}
+	}
+	return false, nil
+}
+
+// Symlink implements treeTarget on webDAVTreeTarget,
+// WebDAV has no symlinks so they are skipped with a warning
+func (wtt *webDAVTreeTarget) Symlink(path string, _ string) error {
+	log.Printf("WARNING: skipping symlink %s, WebDAV does not support symlinks", path)
+	return nil
+}
+
+// Finish implements treeTarget on webDAVTreeTarget, the server
+// decides on the metadata itself so this does nothing
+func (wtt *webDAVTreeTarget) Finish(_ string, _ fs.FileInfo) error {
+	return nil
+}
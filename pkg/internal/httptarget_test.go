@@ -0,0 +1,108 @@
+package internal_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"github.com/snasphysicist/go-copy/pkg/random"
+	"golang.org/x/net/webdav"
+)
+
+// newWebDAVServer starts a WebDAV server backed by memory
+func newWebDAVServer() (*httptest.Server, webdav.FileSystem) {
+	fs := webdav.NewMemFS()
+	return httptest.NewServer(&webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}), fs
+}
+
+// uploadTo writes content to target, as the Writer would
+func uploadTo(t *testing.T, target interface {
+	Initialise() error
+	io.WriteCloser
+}, content []byte) error {
+	err := target.Initialise()
+	if err != nil {
+		t.Fatalf("Failed to initialise with %v", err)
+	}
+	_, err = target.Write(content)
+	if err != nil {
+		t.Fatalf("Failed to write with %v", err)
+	}
+	return target.Close()
+}
+
+func TestHTTPTargetUploadsWithPut(t *testing.T) {
+	for _, size := range []uint64{0, 5000} {
+		server, _ := newWebDAVServer()
+		content := random.Bytes(5000)
+		err := uploadTo(t, internal.NewHTTPTarget(server.URL+"/file.bin", size, nil), content)
+		if err != nil {
+			t.Fatalf("Failed to upload with %v", err)
+		}
+		resp, err := http.Get(server.URL + "/file.bin")
+		if err != nil {
+			t.Fatalf("Failed to download with %v", err)
+		}
+		uploaded, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if !bytes.Equal(content, uploaded) {
+			t.Errorf("Uploaded content with size %d did not match written content", size)
+		}
+		server.Close()
+	}
+}
+
+func TestHTTPTargetErrorsOnCloseWhenUploadRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+	err := uploadTo(t, internal.NewHTTPTarget(server.URL+"/file.bin", 0, nil), random.Bytes(10))
+	if err == nil {
+		t.Error("No error closing target after upload was forbidden")
+	}
+}
+
+func TestWebDAVTreeTargetCreatesCollectionsAndDetectsIdenticalFiles(t *testing.T) {
+	server, fs := newWebDAVServer()
+	defer server.Close()
+	target := internal.TreeTargetFor(server.URL+"/backup", internal.EndpointOptions{})
+	for _, dir := range []string{"", "sub", "sub"} {
+		err := target.Mkdir(dir)
+		if err != nil {
+			t.Fatalf("Failed to create collection %s with %v", dir, err)
+		}
+	}
+	info, err := fs.Stat(nil, "/backup/sub")
+	if err != nil || !info.IsDir() {
+		t.Fatalf("Collection was not created, error %v", err)
+	}
+	local := t.TempDir()
+	mustWrite(t, local, "f.bin", "content")
+	past := time.Now().Add(-time.Hour)
+	_ = os.Chtimes(local+"/f.bin", past, past)
+	localInfo, _ := os.Stat(local + "/f.bin")
+	identical, err := target.Identical("sub/f.bin", localInfo)
+	if err != nil || identical {
+		t.Errorf("Missing file identical %t (error %v), expected false", identical, err)
+	}
+	err = uploadTo(t, target.File("sub/f.bin", 7), []byte("content"))
+	if err != nil {
+		t.Fatalf("Failed to upload with %v", err)
+	}
+	identical, err = target.Identical("sub/f.bin", localInfo)
+	if err != nil || !identical {
+		t.Errorf("Uploaded file identical %t (error %v), expected true", identical, err)
+	}
+	mustWrite(t, local, "f.bin", "changed content")
+	localInfo, _ = os.Stat(local + "/f.bin")
+	identical, err = target.Identical("sub/f.bin", localInfo)
+	if err != nil || identical {
+		t.Errorf("File changed since upload identical %t (error %v), expected false", identical, err)
+	}
+}
@@ -0,0 +1,286 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ManifestFile describes a single file in a Manifest
+type ManifestFile struct {
+	// Path is the path of the file relative to
+	// the root of the tree, with / separators
+	Path string `json:"path"`
+	// Size is the size of the file in bytes
+	Size int64 `json:"size"`
+	// Mode is the file's permissions, in octal
+	Mode string `json:"mode,omitempty"`
+	// MTime is the file's modification time
+	MTime *time.Time `json:"mtime,omitempty"`
+	// SHA256 is the hex encoded SHA-256 of the file's content
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest lists the files in a tree, as proof of what
+// was copied & to verify copies against later
+type Manifest struct {
+	// Root is the SHA-256 of the manifest as SHA256SUMS
+	// (see WriteSHA256Sums), identifying the whole tree
+	Root  string         `json:"root"`
+	Files []ManifestFile `json:"files"`
+}
+
+// NewManifest creates a manifest of files, in order of their paths
+func NewManifest(files []ManifestFile) Manifest {
+	m := Manifest{Files: files}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+	var sums bytes.Buffer
+	m.writeSums(&sums)
+	h := sha256.Sum256(sums.Bytes())
+	m.Root = hex.EncodeToString(h[:])
+	return m
+}
+
+// ManifestFileOf returns the entry in a manifest of the file
+// described by e, whose content has the SHA-256 sum
+func ManifestFileOf(e TreeEntry, sum []byte) ManifestFile {
+	return ManifestFile{
+		Path:   e.Path,
+		Size:   e.Info.Size(),
+		Mode:   fmt.Sprintf("%04o", e.Info.Mode().Perm()),
+		MTime:  From(e.Info.ModTime().UTC()),
+		SHA256: hex.EncodeToString(sum),
+	}
+}
+
+// WriteJSON writes m to the file at path as JSON
+func (m Manifest) WriteJSON(path string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// WriteSHA256Sums writes m to the file at path in the format
+// of coreutils' sha256sum, so it can be checked with sha256sum -c
+func (m Manifest) WriteSHA256Sums(path string) error {
+	var sums bytes.Buffer
+	m.writeSums(&sums)
+	return os.WriteFile(path, sums.Bytes(), 0644)
+}
+
+// writeSums writes m to w in the format of coreutils' sha256sum
+func (m Manifest) writeSums(w io.Writer) {
+	for _, f := range m.Files {
+		fmt.Fprintln(w, FormatChecksum(Checksum{Path: f.Path, Algorithm: SHA256, Sum: f.SHA256}, false))
+	}
+}
+
+// ReadManifest reads the manifest in the file at path,
+// either JSON or in the format of coreutils' sha256sum
+// (in which case only the paths & sums are known)
+func ReadManifest(path string) (Manifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Manifest{}, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		var m Manifest
+		err = json.Unmarshal(b, &m)
+		return m, err
+	}
+	checksums, improper, err := ReadChecksums(bytes.NewReader(b), SHA256)
+	if err != nil {
+		return Manifest{}, err
+	}
+	if improper > 0 {
+		return Manifest{}, fmt.Errorf("%s is not a manifest, %d lines are not a sum & path", path, improper)
+	}
+	files := make([]ManifestFile, 0, len(checksums))
+	for _, c := range checksums {
+		if c.Algorithm != SHA256 {
+			return Manifest{}, fmt.Errorf("%s is not a manifest, %s has a %s sum", path, c.Path, c.Algorithm)
+		}
+		files = append(files, ManifestFile{Path: c.Path, Size: -1, SHA256: c.Sum})
+	}
+	return NewManifest(files), nil
+}
+
+// hashingSource is an rsource which passes through
+// another rsource, hashing the bytes read from it
+type hashingSource struct {
+	source rsource
+	h      hash.Hash
+}
+
+// NewHashingSource wraps source such that the
+// SHA-256 of what's read from it is calculated
+func NewHashingSource(source rsource) *hashingSource {
+	return &hashingSource{source: source, h: sha256.New()}
+}
+
+// Open implements rsource on hashingSource
+func (hs *hashingSource) Open() error {
+	return hs.source.Open()
+}
+
+// ExactSize implements exactSizer on hashingSource,
+// passing through to the wrapped source
+func (hs *hashingSource) ExactSize() (uint64, bool, error) {
+	s, ok := hs.source.(exactSizer)
+	if !ok {
+		return 0, false, nil
+	}
+	return s.ExactSize()
+}
+
+// Read implements rsource on hashingSource
+func (hs *hashingSource) Read(b []byte) (int, error) {
+	n, err := hs.source.Read(b)
+	hs.h.Write(b[:n])
+	return n, err
+}
+
+// Close implements rsource on hashingSource
+func (hs *hashingSource) Close() error {
+	return hs.source.Close()
+}
+
+// Sum returns the SHA-256 of everything read so far
+func (hs *hashingSource) Sum() []byte {
+	return hs.h.Sum(nil)
+}
+
+// hashingTarget is a wtarget which passes through
+// to another wtarget, hashing the bytes written to it
+type hashingTarget struct {
+	target  wtarget
+	h       hash.Hash
+	written uint64
+}
+
+// NewHashingTarget wraps target such that the
+// SHA-256 of what's written to it is calculated
+func NewHashingTarget(target wtarget) *hashingTarget {
+	return &hashingTarget{target: target, h: sha256.New()}
+}
+
+// Initialise implements wtarget on hashingTarget
+func (ht *hashingTarget) Initialise() error {
+	return ht.target.Initialise()
+}
+
+// Write implements wtarget on hashingTarget
+func (ht *hashingTarget) Write(b []byte) (int, error) {
+	n, err := ht.target.Write(b)
+	ht.h.Write(b[:n])
+	ht.written += uint64(n)
+	return n, err
+}
+
+// Sync implements wtarget on hashingTarget
+func (ht *hashingTarget) Sync() error {
+	return ht.target.Sync()
+}
+
+// Close implements wtarget on hashingTarget
+func (ht *hashingTarget) Close() error {
+	return ht.target.Close()
+}
+
+// Abort implements aborter on hashingTarget
+func (ht *hashingTarget) Abort() error {
+	abort(ht.target)
+	return nil
+}
+
+// Sum returns the SHA-256 of everything written so far
+func (ht *hashingTarget) Sum() []byte {
+	return ht.h.Sum(nil)
+}
+
+// Written returns the number of bytes written so far
+func (ht *hashingTarget) Written() uint64 {
+	return ht.written
+}
+
+// SHA256File returns the SHA-256 of the content of the local file
+// at path & its size, calling count with the bytes hashed as it goes
+func SHA256File(path string, count func(uint64)) ([]byte, int64, error) {
+	return HashFile(path, SHA256, count)
+}
+
+// Verification is the result of verifying a tree against a manifest
+type Verification struct {
+	// Missing are in the manifest but not the tree
+	Missing []string
+	// Extra are in the tree but not the manifest
+	Extra []string
+	// Mismatched are in both, but with different
+	// content or size (permissions & modification
+	// times aren't compared, as not every
+	// filesystem can keep them)
+	Mismatched []string
+}
+
+// OK returns true if the tree matched the manifest
+func (v Verification) OK() bool {
+	return len(v.Missing) == 0 && len(v.Extra) == 0 && len(v.Mismatched) == 0
+}
+
+// VerifyWith verifies the tree under the local directory root against m,
+// hashing the files which are in both & the same size (the only
+// ones which need hashing) with hash, e.g. HashFiles
+func VerifyWith(root string, m Manifest, hash func([]Checksum) []HashResult) (Verification, error) {
+	entries, err := WalkTree(root)
+	if err != nil {
+		return Verification{}, err
+	}
+	inTree := make(map[string]fs.FileInfo)
+	for _, e := range entries {
+		if e.Info.Mode().IsRegular() {
+			inTree[e.Path] = e.Info
+		}
+	}
+	var v Verification
+	inManifest := make(map[string]bool)
+	toHash := make([]Checksum, 0, len(m.Files))
+	expected := make([]ManifestFile, 0, len(m.Files))
+	for _, f := range m.Files {
+		inManifest[f.Path] = true
+		info, ok := inTree[f.Path]
+		switch {
+		case !ok:
+			v.Missing = append(v.Missing, f.Path)
+		case f.Size >= 0 && info.Size() != f.Size:
+			v.Mismatched = append(v.Mismatched, f.Path)
+		default:
+			toHash = append(toHash, Checksum{Path: filepath.Join(root, filepath.FromSlash(f.Path)), Algorithm: SHA256})
+			expected = append(expected, f)
+		}
+	}
+	for i, r := range hash(toHash) {
+		if r.Err != nil || r.Checksum.Sum != expected[i].SHA256 {
+			v.Mismatched = append(v.Mismatched, expected[i].Path)
+		}
+	}
+	for p := range inTree {
+		if !inManifest[p] {
+			v.Extra = append(v.Extra, p)
+		}
+	}
+	sort.Strings(v.Missing)
+	sort.Strings(v.Extra)
+	sort.Strings(v.Mismatched)
+	return v, nil
+}
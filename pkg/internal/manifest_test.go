@@ -0,0 +1,114 @@
+package internal_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"github.com/snasphysicist/go-copy/pkg/random"
+)
+
+// manifestOf writes files (relative path to content) under a
+// temporary directory, returning it & a manifest of the files
+func manifestOf(t *testing.T, files map[string][]byte) (string, internal.Manifest) {
+	dir := t.TempDir()
+	listed := make([]internal.ManifestFile, 0)
+	for path, content := range files {
+		full := filepath.Join(dir, filepath.FromSlash(path))
+		_ = os.MkdirAll(filepath.Dir(full), 0755)
+		err := os.WriteFile(full, content, 0644)
+		if err != nil {
+			t.Fatalf("Failed to write %s with %v", path, err)
+		}
+		sum := sha256.Sum256(content)
+		listed = append(listed, internal.ManifestFile{Path: path, Size: int64(len(content)), SHA256: hex.EncodeToString(sum[:])})
+	}
+	return dir, internal.NewManifest(listed)
+}
+
+// verifyTree verifies the tree under root against m,
+// hashing the files with HashFiles, 2 in parallel
+func verifyTree(root string, m internal.Manifest) (internal.Verification, error) {
+	pr := internal.NewProgressReporter(0, nil)
+	return internal.VerifyWith(root, m, func(files []internal.Checksum) []internal.HashResult {
+		return internal.HashFiles(files, 2, &pr)
+	})
+}
+
+func TestManifestRoundTripsThroughJSONAndSHA256Sums(t *testing.T) {
+	_, m := manifestOf(t, map[string][]byte{"b": random.Bytes(10), "a/c": random.Bytes(20)})
+	dir := t.TempDir()
+	err := m.WriteJSON(filepath.Join(dir, "m.json"))
+	if err == nil {
+		err = m.WriteSHA256Sums(filepath.Join(dir, "SHA256SUMS"))
+	}
+	if err != nil {
+		t.Fatalf("Failed to write manifest with %v", err)
+	}
+	fromJSON, err := internal.ReadManifest(filepath.Join(dir, "m.json"))
+	if err != nil || !reflect.DeepEqual(m, fromJSON) {
+		t.Errorf("Manifest read from JSON %v (error %v) did not match that written %v", fromJSON, err, m)
+	}
+	fromSums, err := internal.ReadManifest(filepath.Join(dir, "SHA256SUMS"))
+	if err != nil || fromSums.Root != m.Root || len(fromSums.Files) != 2 {
+		t.Errorf("Manifest read from SHA256SUMS had root %s (error %v), expected %s", fromSums.Root, err, m.Root)
+	}
+	sums, _ := os.ReadFile(filepath.Join(dir, "SHA256SUMS"))
+	expected := fmt.Sprintf("%s  a/c\n%s  b\n", m.Files[0].SHA256, m.Files[1].SHA256)
+	if string(sums) != expected {
+		t.Errorf("SHA256SUMS was %q, expected %q", sums, expected)
+	}
+}
+
+func TestManifestSHA256SumsEscapesPathsAsCoreutilsDoes(t *testing.T) {
+	sum := hex.EncodeToString(random.Bytes(sha256.Size))
+	m := internal.NewManifest([]internal.ManifestFile{{Path: "new\nline", Size: -1, SHA256: sum}, {Path: `back\slash`, Size: -1, SHA256: sum}})
+	path := filepath.Join(t.TempDir(), "SHA256SUMS")
+	err := m.WriteSHA256Sums(path)
+	if err != nil {
+		t.Fatalf("Failed to write manifest with %v", err)
+	}
+	sums, _ := os.ReadFile(path)
+	expected := fmt.Sprintf("\\%s  back\\\\slash\n\\%s  new\\nline\n", sum, sum)
+	if string(sums) != expected {
+		t.Errorf("SHA256SUMS was %q, expected %q", sums, expected)
+	}
+	read, err := internal.ReadManifest(path)
+	if err != nil || !reflect.DeepEqual(read, m) {
+		t.Errorf("Manifest read from SHA256SUMS %v (error %v), expected %v", read, err, m)
+	}
+}
+
+func TestVerifyReportsMissingExtraAndMismatchedFiles(t *testing.T) {
+	dir, m := manifestOf(t, map[string][]byte{
+		"same":          random.Bytes(1000),
+		"sub/changed":   random.Bytes(1000),
+		"sub/truncated": random.Bytes(1000),
+		"missing":       random.Bytes(1000),
+	})
+	v, err := verifyTree(dir, m)
+	if err != nil || !v.OK() {
+		t.Fatalf("Verifying unchanged tree gave %+v (error %v)", v, err)
+	}
+	_ = os.WriteFile(filepath.Join(dir, "sub", "changed"), random.Bytes(1000), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "sub", "truncated"), random.Bytes(10), 0644)
+	_ = os.Remove(filepath.Join(dir, "missing"))
+	_ = os.WriteFile(filepath.Join(dir, "extra"), random.Bytes(10), 0644)
+	v, err = verifyTree(dir, m)
+	if err != nil {
+		t.Fatalf("Failed to verify with %v", err)
+	}
+	expected := internal.Verification{
+		Missing:    []string{"missing"},
+		Extra:      []string{"extra"},
+		Mismatched: []string{"sub/changed", "sub/truncated"},
+	}
+	if !reflect.DeepEqual(expected, v) {
+		t.Errorf("Verification was %+v, expected %+v", v, expected)
+	}
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultRemoteCommand is the command template run to reach a
+// go-copy server for ssh URLs, see commandDialer for the placeholders
+const DefaultRemoteCommand = "ssh -o BatchMode=yes {destination} go-copy serve --stdio"
+
+// commandCloseTimeout is how long a command is given
+// to exit once its session is over before it's killed
+const commandCloseTimeout = 10 * time.Second
+
+// IsSSH returns true if path is an ssh URL, of a file
+// reached by running go-copy serve --stdio over ssh
+func IsSSH(path string) bool {
+	return strings.HasPrefix(path, "ssh://")
+}
+
+// dialerFor returns the dialer for the
+// go-copy server in the URL url
+func dialerFor(url string, eo EndpointOptions) protocolDialer {
+	if IsSSH(url) {
+		return &commandDialer{url: url, eo: eo}
+	}
+	return &tcpDialer{url: url, eo: eo}
+}
+
+// commandDialer reaches the go-copy server in url by running
+// the command template in eo (or DefaultRemoteCommand), talking
+// to it over its stdin & stdout. In the template {destination}
+// is replaced by ssh://[user@]host[:port], {host} by the host,
+// {user} by the user (if any) and {port} by the port (if any).
+type commandDialer struct {
+	url string
+	eo  EndpointOptions
+}
+
+// dial implements protocolDialer on commandDialer
+func (cd *commandDialer) dial() (io.ReadWriteCloser, string, error) {
+	u, err := url.Parse(cd.url)
+	if err != nil {
+		return nil, "", err
+	}
+	template := cd.eo.RemoteCommand
+	if template == "" {
+		template = DefaultRemoteCommand
+	}
+	destination := url.URL{Scheme: "ssh", User: u.User, Host: u.Host}
+	replacer := strings.NewReplacer(
+		"{destination}", destination.String(),
+		"{host}", u.Hostname(),
+		"{user}", u.User.Username(),
+		"{port}", u.Port(),
+	)
+	fields := strings.Fields(template)
+	if len(fields) == 0 {
+		return nil, "", fmt.Errorf("remote command for %s is empty", cd.url)
+	}
+	for i := range fields {
+		fields[i] = replacer.Replace(fields[i])
+	}
+	cmd := exec.Command(fields[0], fields[1:]...)
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, "", err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, "", err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, "", err
+	}
+	return &commandConn{r: r, w: w, cmd: cmd}, u.Path, nil
+}
+
+// commandConn is a connection to a command over its stdin & stdout
+type commandConn struct {
+	r   io.Reader
+	w   io.WriteCloser
+	cmd *exec.Cmd
+}
+
+// Read implements io.Reader on commandConn, reading stdout
+func (cc *commandConn) Read(b []byte) (int, error) {
+	return cc.r.Read(b)
+}
+
+// Write implements io.Writer on commandConn, writing stdin
+func (cc *commandConn) Write(b []byte) (int, error) {
+	return cc.w.Write(b)
+}
+
+// Close implements io.Closer on commandConn, closing stdin
+// & waiting for the command to exit, killing it if it doesn't
+func (cc *commandConn) Close() error {
+	_ = cc.w.Close()
+	exited := make(chan struct{})
+	timer := time.AfterFunc(commandCloseTimeout, func() {
+		select {
+		case <-exited:
+		default:
+			_ = cc.cmd.Process.Kill()
+		}
+	})
+	defer timer.Stop()
+	// the command exiting with an error has already
+	// been reported to the client in the session
+	_ = cc.cmd.Wait()
+	close(exited)
+	return nil
+}
+
+// stdioConn is a connection over this process' stdin & stdout
+type stdioConn struct{}
+
+// StdioConn returns a connection over this process'
+// stdin & stdout, for serving a single session
+func StdioConn() io.ReadWriteCloser {
+	return stdioConn{}
+}
+
+// Read implements io.Reader on stdioConn, reading stdin
+func (stdioConn) Read(b []byte) (int, error) {
+	return os.Stdin.Read(b)
+}
+
+// Write implements io.Writer on stdioConn, writing stdout
+func (stdioConn) Write(b []byte) (int, error) {
+	return os.Stdout.Write(b)
+}
+
+// Close implements io.Closer on stdioConn, closing stdout
+// so the client knows that the session is over
+func (stdioConn) Close() error {
+	return os.Stdout.Close()
+}
@@ -0,0 +1,67 @@
+package internal_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"github.com/snasphysicist/go-copy/pkg/random"
+)
+
+// TestHelperServeStdio isn't a real test, it's the go-copy
+// serve --stdio run by the remote command in the tests below,
+// serving the directory in GO_COPY_TEST_SERVE_DIR
+func TestHelperServeStdio(t *testing.T) {
+	dir := os.Getenv("GO_COPY_TEST_SERVE_DIR")
+	if dir == "" {
+		t.Skip("only run as the remote command of other tests")
+	}
+	exports := []internal.Export{{Name: "", Dir: dir, Writable: true}}
+	internal.NewServer(exports, 1024*1024, 256*1024).ServeConn(internal.StdioConn())
+	// anything the test framework prints would be sent to the client
+	os.Exit(0)
+}
+
+// serveStdioEndpoint returns the endpoint options to reach a
+// go-copy serve --stdio of a temporary directory for ssh URLs
+// by running this test binary, & the directory
+func serveStdioEndpoint(t *testing.T) (internal.EndpointOptions, string) {
+	dir := t.TempDir()
+	t.Setenv("GO_COPY_TEST_SERVE_DIR", dir)
+	return internal.EndpointOptions{RemoteCommand: os.Args[0] + " -test.run=^TestHelperServeStdio$"}, dir
+}
+
+func TestSSHTargetUploadsOverRemoteCommand(t *testing.T) {
+	eo, dir := serveStdioEndpoint(t)
+	content := random.Bytes(3*1024*1024 + 11)
+	acknowledged, err := uploadInPieces(t, internal.NewGoCopyTarget("ssh://me@somewhere/file.bin", eo), content)
+	if err != nil {
+		t.Fatalf("Failed to upload with %v", err)
+	}
+	written, _ := os.ReadFile(filepath.Join(dir, "file.bin"))
+	if !bytes.Equal(content, written) {
+		t.Error("Uploaded file did not match written content")
+	}
+	if acknowledged != uint64(len(content)) {
+		t.Errorf("%d bytes acknowledged, expected %d", acknowledged, len(content))
+	}
+}
+
+func TestSSHSourceReadsOverRemoteCommand(t *testing.T) {
+	eo, dir := serveStdioEndpoint(t)
+	content := random.Bytes(2*1024*1024 + 3)
+	err := os.WriteFile(filepath.Join(dir, "file.bin"), content, 0644)
+	if err != nil {
+		t.Fatalf("Failed to create file with %v", err)
+	}
+	source := internal.SourceFor("ssh://somewhere:2222/file.bin", eo)
+	size := internal.EstimatedSizeOf(source)
+	if size != uint64(len(content)) {
+		t.Errorf("Size reported as %d, expected %d", size, len(content))
+	}
+	if !bytes.Equal(content, readAll(t, source)) {
+		t.Error("Content read did not match file")
+	}
+}
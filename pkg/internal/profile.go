@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Profile holds the settings to copy to a particular device
+// with, as recommended by go-copy bench
+type Profile struct {
+	// BufferSizeBytes is the size of the buffer
+	// between the reader & the writer
+	BufferSizeBytes uint64 `json:"buffer_size_bytes"`
+	// WriteBlockBytes is the most bytes written at once
+	WriteBlockBytes uint64 `json:"write_block_bytes"`
+	// SyncEachBytes is how many bytes are written between
+	// flushes to storage, 0 meaning they're left to the system
+	SyncEachBytes uint64 `json:"sync_each_bytes"`
+	// ThroughputBytesPerSecond is how fast go-copy bench measured
+	// copying to the device with these settings, 0 if not measured
+	ThroughputBytesPerSecond uint64 `json:"throughput_bytes_per_second,omitempty"`
+}
+
+// ProfilePath returns the path of the profile called name, a file in
+// the user's configuration directory, unless name is already a path
+// (has a directory or ends in .json)
+func ProfilePath(name string) (string, error) {
+	if strings.ContainsRune(name, filepath.Separator) || strings.HasSuffix(name, ".json") {
+		return name, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "go-copy", "profiles", name+".json"), nil
+}
+
+// ReadProfile reads the profile in the JSON file at path
+func ReadProfile(path string) (Profile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Profile{}, err
+	}
+	var p Profile
+	err = json.Unmarshal(b, &p)
+	return p, err
+}
+
+// WriteJSON writes p to the file at path as JSON,
+// creating the directory it's in if needed
+func (p Profile) WriteJSON(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
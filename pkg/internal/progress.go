@@ -1,20 +1,45 @@
 package internal
 
 import (
+	"fmt"
+	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 // ProgressReporter allows progress to be reported to it
 // and reports progress to the user
-// by printing it to the terminal.
+// by printing it to the terminal on stderr
+// (so stdout remains free to be a copy target).
+// toTransfer is only ever treated as an estimate,
+// with 0 meaning that the size is not known.
 // The application should report when it is being
 // shut down by closing the shutdown channel.
 type ProgressReporter struct {
-	read       uint64
-	written    uint64
-	toTransfer uint64
-	shutdown   <-chan struct{}
+	read           uint64
+	written        uint64
+	consumed       uint64
+	syncEach       uint64
+	retries        uint64
+	bad            uint64
+	changed        uint64
+	skipped        uint64
+	tracksSource   bool
+	comparesTarget bool
+	toTransfer     uint64
+	shutdown       <-chan struct{}
+	l              sync.Mutex
+	item           *progressItem
+}
+
+// progressItem is a single item (e.g. a file in
+// an archive) being transferred as part of the whole
+type progressItem struct {
+	name string
+	size uint64
+	// writtenBefore is the bytes written before the item
+	writtenBefore uint64
 }
 
 func NewProgressReporter(toTransfer uint64, shutdown <-chan struct{}) ProgressReporter {
@@ -33,6 +58,101 @@ func (pr *ProgressReporter) ReportBytesWritten(n uint64) {
 	atomic.AddUint64(&pr.written, n)
 }
 
+// TrackSource tells the reporter that the bytes read are
+// a transformation of the source (e.g. compressed), such that
+// bytes consumed from the source itself will be reported separately
+// with ReportSourceBytesConsumed. toTransfer is then taken to be
+// the size of the source & percentage/remaining time are based on it.
+// Must be called before reporting starts.
+func (pr *ProgressReporter) TrackSource() {
+	pr.tracksSource = true
+}
+
+// CompareTarget tells the reporter that bytes written are compared
+// with what's already at the target, only those which differ being
+// actually written, which are reported with ReportBytesChanged.
+// Must be called before reporting starts.
+func (pr *ProgressReporter) CompareTarget() {
+	pr.comparesTarget = true
+}
+
+// ReportBytesChanged tells the reporter that an additional n
+// bytes differed from what was at the target, so were written
+func (pr *ProgressReporter) ReportBytesChanged(n uint64) {
+	atomic.AddUint64(&pr.changed, n)
+}
+
+// BytesChanged returns the number of bytes reported to be changed
+func (pr *ProgressReporter) BytesChanged() uint64 {
+	return atomic.LoadUint64(&pr.changed)
+}
+
+// ReportBytesSkipped tells the reporter that an additional n bytes
+// weren't transferred, as they were already at the target, which
+// aren't part of what's to be transferred
+func (pr *ProgressReporter) ReportBytesSkipped(n uint64) {
+	atomic.AddUint64(&pr.skipped, n)
+}
+
+// BytesSkipped returns the number of bytes reported to be skipped
+func (pr *ProgressReporter) BytesSkipped() uint64 {
+	return atomic.LoadUint64(&pr.skipped)
+}
+
+// ReportSourceBytesConsumed tells the reporter that an additional
+// n bytes have been consumed from the source, before any transformation
+func (pr *ProgressReporter) ReportSourceBytesConsumed(n uint64) {
+	atomic.AddUint64(&pr.consumed, n)
+}
+
+// ReportItem tells the reporter that the bytes written from now
+// on are of the item called name, of size bytes (0 if unknown),
+// so that its progress is reported as well as the whole's
+func (pr *ProgressReporter) ReportItem(name string, size uint64) {
+	pr.l.Lock()
+	defer pr.l.Unlock()
+	pr.item = &progressItem{name: name, size: size, writtenBefore: pr.BytesWritten()}
+}
+
+// ReportSyncEach tells the reporter how many bytes are
+// currently being written between syncs to storage
+func (pr *ProgressReporter) ReportSyncEach(n uint64) {
+	atomic.StoreUint64(&pr.syncEach, n)
+}
+
+// SyncEach returns the number of bytes last reported
+// to be written between syncs, 0 if never reported
+func (pr *ProgressReporter) SyncEach() uint64 {
+	return atomic.LoadUint64(&pr.syncEach)
+}
+
+// ReportRetry tells the reporter that an operation
+// which failed with a transient error is being retried
+func (pr *ProgressReporter) ReportRetry() {
+	atomic.AddUint64(&pr.retries, 1)
+}
+
+// Retries returns the number of retries reported
+func (pr *ProgressReporter) Retries() uint64 {
+	return atomic.LoadUint64(&pr.retries)
+}
+
+// ReportBadBytes tells the reporter that n bytes of
+// the source are bad, having failed to be read
+func (pr *ProgressReporter) ReportBadBytes(n uint64) {
+	atomic.StoreUint64(&pr.bad, n)
+}
+
+// BadBytes returns the number of bytes last reported to be bad
+func (pr *ProgressReporter) BadBytes() uint64 {
+	return atomic.LoadUint64(&pr.bad)
+}
+
+// SourceBytesConsumed returns the number of bytes reported to be consumed from the source
+func (pr *ProgressReporter) SourceBytesConsumed() uint64 {
+	return atomic.LoadUint64(&pr.consumed)
+}
+
 // BytesRead returns the number of bytes reported to be read
 func (pr *ProgressReporter) BytesRead() uint64 {
 	return atomic.LoadUint64(&pr.read)
@@ -52,17 +172,78 @@ func (pr *ProgressReporter) printProgress(start time.Time, suffix string) {
 	elapsed := time.Since(start)
 	bytesRead := pr.BytesRead()
 	bytesWritten := pr.BytesWritten()
-	rate := (float64(Minimum(bytesRead, bytesWritten)) / float64(elapsed.Microseconds()/1000000))
-	remaining := (float64(pr.toTransfer) - float64(Minimum(bytesRead, bytesWritten))) / rate
-	print("\r")
-	print(
-		"Read ", FormatSize(bytesRead),
-		" Written ", FormatSize(bytesWritten),
+	transferred := Minimum(bytesRead, bytesWritten)
+	if pr.tracksSource {
+		transferred = pr.SourceBytesConsumed()
+	}
+	rate := 0.0
+	if elapsed.Seconds() > 0 {
+		rate = float64(transferred) / elapsed.Seconds()
+	}
+	fmt.Fprint(os.Stderr, "\r")
+	if pr.tracksSource {
+		fmt.Fprint(os.Stderr, "Source ", FormatSize(transferred))
+		if pr.totalKnown(transferred) {
+			fmt.Fprintf(os.Stderr, " (%.1f%%)", 100*float64(transferred)/float64(pr.toTransfer))
+		}
+		fmt.Fprint(os.Stderr, " ")
+	}
+	fmt.Fprint(os.Stderr, "Read ", FormatSize(bytesRead))
+	if pr.comparesTarget {
+		fmt.Fprint(os.Stderr, " Compared ", FormatSize(bytesWritten), " Changed ", FormatSize(pr.BytesChanged()))
+	} else {
+		fmt.Fprint(os.Stderr, " Written ", FormatSize(bytesWritten))
+	}
+	if !pr.tracksSource && pr.totalKnown(transferred) {
+		fmt.Fprintf(os.Stderr, " (%.1f%%)", 100*float64(transferred)/float64(pr.toTransfer))
+	}
+	if pr.tracksSource && transferred > 0 {
+		fmt.Fprintf(os.Stderr, " Ratio %.2f", float64(bytesRead)/float64(transferred))
+	}
+	fmt.Fprint(
+		os.Stderr,
 		" Speed ", FormatSize(uint64(rate)), "/s",
 		" Elapsed ", elapsed.Round(1*time.Second).String(),
-		" Remaining ", (time.Duration(remaining) * time.Second).String(),
-		"             ", suffix,
 	)
+	if pr.totalKnown(transferred) && rate > 0 {
+		remaining := (float64(pr.toTransfer) - float64(transferred)) / rate
+		fmt.Fprint(os.Stderr, " Remaining ", (time.Duration(remaining) * time.Second).String())
+	}
+	if skipped := pr.BytesSkipped(); skipped != 0 {
+		fmt.Fprint(os.Stderr, " Skipped ", FormatSize(skipped))
+	}
+	if bad := pr.BadBytes(); bad != 0 {
+		fmt.Fprint(os.Stderr, " Bad ", FormatSize(bad))
+	}
+	if retries := pr.Retries(); retries != 0 {
+		fmt.Fprint(os.Stderr, " Retries ", retries)
+	}
+	if syncEach := pr.SyncEach(); syncEach != 0 {
+		fmt.Fprint(os.Stderr, " Sync each ", FormatSize(syncEach))
+	}
+	pr.l.Lock()
+	item := pr.item
+	pr.l.Unlock()
+	if item != nil {
+		name := item.name
+		if len(name) > 40 {
+			name = "..." + name[len(name)-37:]
+		}
+		written := bytesWritten - item.writtenBefore
+		fmt.Fprint(os.Stderr, " Item ", name, " ", FormatSize(written))
+		if item.size != 0 && written <= item.size {
+			fmt.Fprintf(os.Stderr, " (%.1f%%)", 100*float64(written)/float64(item.size))
+		}
+	}
+	fmt.Fprint(os.Stderr, "             ", suffix)
+}
+
+// totalKnown returns true if the estimated total to transfer
+// can be used to report percentages & time remaining, which
+// isn't the case if no estimate was given or more than the
+// estimate has already been transferred (the source grew)
+func (pr *ProgressReporter) totalKnown(transferred uint64) bool {
+	return pr.toTransfer != 0 && transferred <= pr.toTransfer
 }
 
 // Report prints the progress reporter to the reporter
@@ -0,0 +1,291 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The go-copy protocol is a sequence of frames in each direction,
+// each a 1 byte frame type, a 4 byte big endian payload length,
+// then the payload. A client opens a session with a frameOpen
+// carrying a JSON protocolRequest, to which the server replies
+// with a frameOK carrying a JSON protocolReply, or a frameError
+// with a message (which can also be sent by the server at any
+// later point, ending the session).
+//
+// To write a file, the client then sends the content in frameData
+// frames, each payload being the CRC-32C of the data then the data,
+// ending with a frameEnd. Each time the server has flushed what it
+// has received to disk it sends a frameSynced, with the 8 byte
+// offset up to which the file is durable, then, once the client has
+// ended and the server has flushed & closed the file, a frameDone
+// with the final size.
+//
+// To read a file, the server sends the content from the requested
+// offset in frameData frames, then a frameEnd.
+const (
+	frameOpen   = 'O'
+	frameOK     = 'K'
+	frameError  = 'E'
+	frameData   = 'D'
+	frameEnd    = 'Z'
+	frameSynced = 'S'
+	frameDone   = 'F'
+)
+
+// protocolVersion is the version of the
+// protocol spoken by this version of go-copy
+const protocolVersion = 1
+
+// maxFrameBytes is the largest frame payload accepted
+const maxFrameBytes = 16 * 1024 * 1024
+
+// protocolDataBytes is the most data sent in each frameData
+const protocolDataBytes = 256 * 1024
+
+// The modes in which a session can be opened
+const (
+	modeRead  = "read"
+	modeWrite = "write"
+	modeStat  = "stat"
+)
+
+// castagnoli is the CRC-32C table for checksumming data frames
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// protocolRequest opens a session
+type protocolRequest struct {
+	Version int    `json:"version"`
+	Mode    string `json:"mode"`
+	// Path is the file to read/write, the first segment
+	// being the name of the export it's under
+	Path string `json:"path"`
+	// Offset is where to start reading/writing from,
+	// when resuming. When writing, anything after
+	// it in the file is removed.
+	Offset int64 `json:"offset"`
+}
+
+// protocolReply accepts a request to open a session
+type protocolReply struct {
+	// Size is the size of the file
+	Size int64 `json:"size"`
+}
+
+// IsGoCopy returns true if path is a gocopy(s) URL,
+// of a file served by go-copy serve
+func IsGoCopy(path string) bool {
+	return strings.HasPrefix(path, "gocopy://") || strings.HasPrefix(path, "gocopys://")
+}
+
+// frameConn sends & receives frames over a connection,
+// frames can be sent from several goroutines at once
+type frameConn struct {
+	rwc io.ReadWriteCloser
+	l   sync.Mutex
+}
+
+// send sends a frame of type t with payload p
+func (fc *frameConn) send(t byte, p []byte) error {
+	fc.l.Lock()
+	defer fc.l.Unlock()
+	header := make([]byte, 5, 5+len(p))
+	header[0] = t
+	binary.BigEndian.PutUint32(header[1:], uint32(len(p)))
+	_, err := fc.rwc.Write(append(header, p...))
+	return err
+}
+
+// sendJSON sends a frame of type t with v encoded as JSON as the payload
+func (fc *frameConn) sendJSON(t byte, v any) error {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return fc.send(t, p)
+}
+
+// sendOffset sends a frame of type t with offset as the payload
+func (fc *frameConn) sendOffset(t byte, offset int64) error {
+	return fc.send(t, binary.BigEndian.AppendUint64(nil, uint64(offset)))
+}
+
+// sendData sends b in frameData frames with checksums
+func (fc *frameConn) sendData(b []byte) error {
+	for len(b) > 0 {
+		n := min(len(b), protocolDataBytes)
+		p := binary.BigEndian.AppendUint32(make([]byte, 0, 4+n), crc32.Checksum(b[:n], castagnoli))
+		err := fc.send(frameData, append(p, b[:n]...))
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// receive receives the next frame, returning its type & payload.
+// A frameError is returned as an error with its message.
+func (fc *frameConn) receive() (byte, []byte, error) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(fc.rwc, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > maxFrameBytes {
+		return 0, nil, fmt.Errorf("frame of %d bytes is larger than the maximum %d", n, maxFrameBytes)
+	}
+	p := make([]byte, n)
+	_, err = io.ReadFull(fc.rwc, p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if header[0] == frameError {
+		return 0, nil, errors.New(string(p))
+	}
+	return header[0], p, nil
+}
+
+// receiveJSON receives the next frame, which must be of type t,
+// decoding its payload as JSON into v
+func (fc *frameConn) receiveJSON(t byte, v any) error {
+	rt, p, err := fc.receive()
+	if err != nil {
+		return err
+	}
+	if rt != t {
+		return fmt.Errorf("expected frame %c, received %c", t, rt)
+	}
+	return json.Unmarshal(p, v)
+}
+
+// offsetOf decodes the offset in the payload p of a frame
+func offsetOf(p []byte) (int64, error) {
+	if len(p) != 8 {
+		return 0, fmt.Errorf("offset should be 8 bytes, was %d", len(p))
+	}
+	return int64(binary.BigEndian.Uint64(p)), nil
+}
+
+// dataOf checks the checksum in the payload p of
+// a frameData, returning the data if it's correct
+func dataOf(p []byte) ([]byte, error) {
+	if len(p) < 4 {
+		return nil, fmt.Errorf("data frame of %d bytes has no checksum", len(p))
+	}
+	expected := binary.BigEndian.Uint32(p)
+	if crc32.Checksum(p[4:], castagnoli) != expected {
+		return nil, errors.New("data frame does not match its checksum")
+	}
+	return p[4:], nil
+}
+
+// protocolDialer makes connections to the
+// go-copy server in a gocopy(s) URL
+type protocolDialer interface {
+	// dial connects to the server, returning the
+	// connection and the path of the file on it
+	dial() (io.ReadWriteCloser, string, error)
+}
+
+// tcpDialer connects to the server in url
+// with TCP, with TLS if it's a gocopys URL
+type tcpDialer struct {
+	url string
+	eo  EndpointOptions
+}
+
+// dial implements protocolDialer on tcpDialer
+func (td *tcpDialer) dial() (io.ReadWriteCloser, string, error) {
+	u, err := url.Parse(td.url)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Port() == "" {
+		return nil, "", fmt.Errorf("%s has no port", td.url)
+	}
+	d := &net.Dialer{Timeout: 30 * time.Second}
+	if u.Scheme != "gocopys" {
+		conn, err := d.Dial("tcp", u.Host)
+		return conn, u.Path, err
+	}
+	config, err := clientTLSConfig(td.eo)
+	if err != nil {
+		return nil, "", err
+	}
+	config.ServerName = u.Hostname()
+	conn, err := tls.DialWithDialer(d, "tcp", u.Host, config)
+	return conn, u.Path, err
+}
+
+// clientTLSConfig returns the TLS configuration to connect to
+// a go-copy server, trusting the CA in eo (if any, else the system
+// roots), presenting the client certificate in eo (if any)
+func clientTLSConfig(eo EndpointOptions) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if eo.TLSCAFile != "" {
+		pool, err := certPool(eo.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if eo.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(eo.TLSCertFile, eo.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// ServerTLSConfig returns the TLS configuration for a go-copy
+// server with the certificate & key in the given files, requiring
+// clients to present a certificate signed by the CA in clientCAFile,
+// if it's not empty
+func ServerTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	if clientCAFile != "" {
+		pool, err := certPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// certPool returns a pool of the PEM certificates in file
+func certPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
@@ -15,11 +15,13 @@ type Reader struct {
 	pr              *ProgressReporter
 	toTransferBytes uint64
 	bufferSizeBytes uint64
+	retry           RetryPolicy
 }
 
 // NewReader creates a new Reader, reading from the file at path into the buffer b,
 // signalling when it's done on done, reporting progress to pr,
-// and knowing when its done when it has transferred toTransfer bytes.
+// and knowing when its done when it has transferred toTransfer bytes
+// (0 meaning that the number of bytes to transfer is unknown).
 // The Reader uses an internal buffer to transfer the bytes from the source
 // to the shared rbuffer, whose size is bufferSizeBytes - beware that if this is
 // larger than b will ever accept, it will be impossible to ever transfer anything.
@@ -53,32 +55,33 @@ type rsource interface {
 	io.ReadCloser
 }
 
+// RetryWith makes the reader retry opening & reading the source when
+// they fail with a transient error, as configured by p. Reads which
+// are retried continue from exactly where the last one got to.
+// Must be called before Start.
+func (r *Reader) RetryWith(p RetryPolicy) {
+	r.retry = p
+}
+
 // Start will uninterruptably start the reader
 // reading the input and moving the contents to the buffer.
 // It reports progress to the progress reporter as it reads,
 // and it closes the done channel when it has read toTransfer bytes.
 func (r *Reader) Start() {
-	err := r.source.Open()
+	err := r.retry.do("opening the source", r.pr, nil, r.source.Open)
 	if err != nil {
 		panic(err)
 	}
 	defer r.source.Close()
+	// pr may be shared by several Readers (e.g. in a tree copy)
+	read := uint64(0)
 	for {
 		buf := make([]byte, r.bufferSizeBytes)
-		n, err := r.source.Read(buf)
-		if err == io.EOF {
-			if r.pr.BytesRead() != r.toTransferBytes {
-				log.Printf(
-					"WARNING: transferred %d bytes, should have been %d",
-					r.pr.BytesRead(), r.toTransferBytes,
-				)
-			}
-			close(r.done)
-			return
-		}
+		n, err := r.read(buf, read)
 		if err != nil && err != io.EOF {
 			panic(err)
 		}
+		// sources may return the last bytes along with io.EOF
 		if n > 0 {
 			success := r.b.Offer(buf[:n])
 			for !success {
@@ -86,6 +89,39 @@ func (r *Reader) Start() {
 				time.Sleep(1 * time.Millisecond)
 			}
 		}
+		read += uint64(n)
 		r.pr.ReportBytesRead(uint64(n))
+		if err == io.EOF {
+			if r.toTransferBytes != 0 && read != r.toTransferBytes {
+				log.Printf(
+					"WARNING: transferred %d bytes, should have been %d",
+					read, r.toTransferBytes,
+				)
+			}
+			close(r.done)
+			return
+		}
 	}
 }
+
+// read reads from the source into b, which has had offset bytes
+// read from it so far, retrying if the read fails transiently
+func (r *Reader) read(b []byte, offset uint64) (int, error) {
+	var n int
+	err := r.retry.do(
+		"reading the source",
+		r.pr,
+		func() error { return seekTo(r.source, offset) },
+		func() error {
+			var err error
+			n, err = r.source.Read(b)
+			if n > 0 && r.retry.transient(err) {
+				// keep what was read, the next read will
+				// hit the error again if it persists
+				return nil
+			}
+			return err
+		},
+	)
+	return n, err
+}
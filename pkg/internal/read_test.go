@@ -188,3 +188,21 @@ func TestReaderReportsNumberOfBytesReadToProgressReporter(t *testing.T) {
 		t.Errorf("%d read bytes progress was reported, expected %d", pr.BytesRead(), len(bytesIn))
 	}
 }
+
+func TestReaderOffersBytesReturnedWithEOF(t *testing.T) {
+	done := make(chan struct{})
+	content := random.Bytes(5)
+	rw := mockReadWriter{rw: bytes.NewBuffer(content), err: io.EOF}
+	ms := mockSource{toRead: &rw}
+	offered := bytes.NewBuffer(make([]byte, 0))
+	pr := internal.NewProgressReporter(5, done)
+	r := internal.NewReader(&ms, &ReadWriterAsAcceptor{rw: offered}, done, &pr, 5, 10)
+	go r.Start()
+	await(func() bool { return ms.closed }, time.Second)
+	if !bytes.Equal(content, offered.Bytes()) {
+		t.Errorf("Reader offered %v, expected the bytes read along with EOF %v", offered.Bytes(), content)
+	}
+	if pr.BytesRead() != 5 {
+		t.Errorf("Reader reported %d bytes read, expected 5", pr.BytesRead())
+	}
+}
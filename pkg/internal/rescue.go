@@ -0,0 +1,379 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statuses of the ranges in a RescueMap, as in ddrescue's map files
+const (
+	// Untried ranges haven't been read yet
+	Untried = '?'
+	// Bad ranges couldn't be read, their sectors are filled in
+	Bad = '-'
+	// Rescued ranges have been read & written
+	Rescued = '+'
+)
+
+// RescueRange is a range of bytes of a source being rescued
+type RescueRange struct {
+	Start  int64
+	Length int64
+	Status byte
+}
+
+// end returns the offset just after the range
+func (rr RescueRange) end() int64 {
+	return rr.Start + rr.Length
+}
+
+// RescueMap records which ranges of a source being rescued have been
+// rescued & which are bad, so that later runs only retry what's
+// left. It's read & written in the format of ddrescue's map files.
+type RescueMap struct {
+	// Ranges cover the whole source, in order
+	Ranges []RescueRange
+	// Position & Phase are where the rescue had got to & what it was
+	// doing when the map was written, as ddrescue's current_pos &
+	// current_status: Untried while reading what's untried, Bad while
+	// retrying bad ranges & Rescued once done (or 0 if unknown)
+	Position int64
+	Phase    byte
+}
+
+// NewRescueMap creates a map of a source of
+// size bytes, none of which have been tried
+func NewRescueMap(size int64) *RescueMap {
+	m := &RescueMap{}
+	if size > 0 {
+		m.Ranges = []RescueRange{{Start: 0, Length: size, Status: Untried}}
+	}
+	return m
+}
+
+// Size returns the size of the source the map covers
+func (m *RescueMap) Size() int64 {
+	if len(m.Ranges) == 0 {
+		return 0
+	}
+	return m.Ranges[len(m.Ranges)-1].end()
+}
+
+// Set sets the status of the range of length bytes from start
+func (m *RescueMap) Set(start int64, length int64, status byte) {
+	end := start + length
+	pieces := []RescueRange{{Start: start, Length: length, Status: status}}
+	for _, r := range m.Ranges {
+		if r.end() <= start || r.Start >= end {
+			pieces = append(pieces, r)
+			continue
+		}
+		if r.Start < start {
+			pieces = append(pieces, RescueRange{Start: r.Start, Length: start - r.Start, Status: r.Status})
+		}
+		if r.end() > end {
+			pieces = append(pieces, RescueRange{Start: end, Length: r.end() - end, Status: r.Status})
+		}
+	}
+	sort.Slice(pieces, func(i, j int) bool { return pieces[i].Start < pieces[j].Start })
+	m.Ranges = make([]RescueRange, 0, len(pieces))
+	for _, p := range pieces {
+		last := len(m.Ranges) - 1
+		if last >= 0 && m.Ranges[last].Status == p.Status && m.Ranges[last].end() == p.Start {
+			m.Ranges[last].Length += p.Length
+			continue
+		}
+		m.Ranges = append(m.Ranges, p)
+	}
+}
+
+// Resize makes the map cover a source of size bytes, any
+// bytes not previously covered being untried
+func (m *RescueMap) Resize(size int64) {
+	current := m.Size()
+	if size > current {
+		m.Set(current, size-current, Untried)
+		return
+	}
+	kept := make([]RescueRange, 0, len(m.Ranges))
+	for _, r := range m.Ranges {
+		if r.Start >= size {
+			break
+		}
+		r.Length = min(r.Length, size-r.Start)
+		kept = append(kept, r)
+	}
+	m.Ranges = kept
+}
+
+// Bytes returns the number of bytes with status
+func (m *RescueMap) Bytes(status byte) int64 {
+	total := int64(0)
+	for _, r := range m.Ranges {
+		if r.Status == status {
+			total += r.Length
+		}
+	}
+	return total
+}
+
+// With returns the ranges with status
+func (m *RescueMap) With(status byte) []RescueRange {
+	ranges := make([]RescueRange, 0)
+	for _, r := range m.Ranges {
+		if r.Status == status {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// WriteFile writes m to the file at path in the format of
+// ddrescue's map files, replacing it only once fully written
+func (m *RescueMap) WriteFile(path string) error {
+	temporary := path + ".tmp"
+	f, err := os.Create(temporary)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "# Rescue map written by go-copy")
+	fmt.Fprintln(w, "# current_pos  current_status  current_pass")
+	fmt.Fprintf(w, "0x%08X     %c               1\n", m.Position, m.phase())
+	fmt.Fprintln(w, "#      pos        size  status")
+	for _, r := range m.Ranges {
+		fmt.Fprintf(w, "0x%08X  0x%08X  %c\n", r.Start, r.Length, r.Status)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(temporary, path)
+}
+
+// phase returns the phase to write to the map file, which
+// is Untried while any ranges are, whatever m.Phase says
+func (m *RescueMap) phase() byte {
+	if m.Bytes(Untried) > 0 {
+		return Untried
+	}
+	if m.Phase == 0 {
+		return Rescued
+	}
+	return m.Phase
+}
+
+// ReadRescueMap reads the map in the file at path, as written by
+// WriteFile or ddrescue (whose ranges which it hasn't finished
+// with, e.g. not yet trimmed, are taken to be bad)
+func ReadRescueMap(path string) (*RescueMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := &RescueMap{}
+	statusLine := true
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if statusLine {
+			// the position & pass of the run which wrote it
+			statusLine = false
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || len(fields[2]) != 1 {
+			return nil, fmt.Errorf("%s is not a rescue map, %q is not a range", path, line)
+		}
+		start, err := strconv.ParseInt(fields[0], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a rescue map, %q has no start: %w", path, line, err)
+		}
+		length, err := strconv.ParseInt(fields[1], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a rescue map, %q has no length: %w", path, line, err)
+		}
+		status := fields[2][0]
+		switch status {
+		case Untried, Bad, Rescued:
+		case '*', '/':
+			status = Bad
+		default:
+			return nil, fmt.Errorf("%s is not a rescue map, %q has unknown status %c", path, line, status)
+		}
+		m.Set(start, length, status)
+	}
+	return m, s.Err()
+}
+
+// RescueOptions configures Rescue
+type RescueOptions struct {
+	// BlockSize is how many bytes are read at once, until
+	// a read fails, whose block is then read by sector
+	BlockSize int64
+	// SectorSize is the smallest amount which can be read,
+	// so the size of the ranges which are bad
+	SectorSize int64
+	// Fill is repeated over the bad ranges in the target,
+	// zeros if empty
+	Fill []byte
+	// RetryPasses is how many times bad ranges are retried,
+	// sector by sector, after every untried range is read
+	RetryPasses int
+}
+
+// rescuer carries out a rescue with Rescue
+type rescuer struct {
+	source io.ReaderAt
+	target io.WriterAt
+	m      *RescueMap
+	o      RescueOptions
+	pr     *ProgressReporter
+	save   func() error
+	saved  time.Time
+	block  []byte
+}
+
+// rescueSaveInterval is how often the map is saved during a rescue
+const rescueSaveInterval = 5 * time.Second
+
+// Rescue copies what it can of source into the same place in target,
+// as recorded in m: first every untried range, a block at a time, then
+// sector by sector where a block can't be read, filling the sectors
+// which can't be read in target with o.Fill & recording them as bad,
+// then retrying the bad ranges o.RetryPasses times. The bytes tried for
+// the first time are reported to pr as read & written, & the bad bytes
+// in m as they change. save is called every so often to save m
+// (with where the rescue has got to, see RescueMap.Phase), after
+// each retry pass & once at the end.
+func Rescue(source io.ReaderAt, target io.WriterAt, m *RescueMap, o RescueOptions, pr *ProgressReporter, save func() error) error {
+	o.SectorSize = max(o.SectorSize, 1)
+	o.BlockSize = max(o.BlockSize/o.SectorSize*o.SectorSize, o.SectorSize)
+	if len(o.Fill) == 0 {
+		o.Fill = []byte{0}
+	}
+	r := rescuer{source: source, target: target, m: m, o: o, pr: pr, save: save, block: make([]byte, o.BlockSize), saved: time.Now()}
+	pr.ReportBadBytes(uint64(m.Bytes(Bad)))
+	m.Phase = Untried
+	for _, untried := range m.With(Untried) {
+		for offset := untried.Start; offset < untried.end(); {
+			// keep reads aligned to blocks, as the device's are
+			length := min(o.BlockSize-offset%o.BlockSize, untried.end()-offset)
+			err := r.rescueBlock(offset, length)
+			if err != nil {
+				return err
+			}
+			offset += length
+		}
+	}
+	m.Phase = Bad
+	for pass := 0; pass < o.RetryPasses && m.Bytes(Bad) > 0; pass++ {
+		for _, bad := range m.With(Bad) {
+			err := r.rescueSectors(bad.Start, bad.Length, false)
+			if err != nil {
+				return err
+			}
+		}
+		err := save()
+		if err != nil {
+			return err
+		}
+	}
+	m.Position, m.Phase = m.Size(), Rescued
+	return save()
+}
+
+// rescueBlock rescues the length bytes from offset, tried for the
+// first time, a single read of them all or else sector by sector
+func (r *rescuer) rescueBlock(offset int64, length int64) error {
+	r.m.Position = offset
+	b := r.block[:length]
+	n, err := r.source.ReadAt(b, offset)
+	if err == io.EOF && int64(n) == length {
+		err = nil
+	}
+	if err != nil {
+		return r.rescueSectors(offset, length, true)
+	}
+	_, err = r.target.WriteAt(b, offset)
+	if err != nil {
+		return err
+	}
+	r.m.Set(offset, length, Rescued)
+	r.pr.ReportBytesRead(uint64(length))
+	r.pr.ReportBytesWritten(uint64(length))
+	return r.saveEverySoOften()
+}
+
+// rescueSectors rescues the length bytes from offset sector by sector,
+// filling in those which can't be read if first (they have not been
+// tried before), reporting the bytes tried if first & saving the map
+func (r *rescuer) rescueSectors(offset int64, length int64, first bool) error {
+	end := offset + length
+	for sector := offset; sector < end; {
+		r.m.Position = sector
+		size := min(r.o.SectorSize-sector%r.o.SectorSize, end-sector)
+		b := r.block[:size]
+		n, err := r.source.ReadAt(b, sector)
+		if err == io.EOF && int64(n) == size {
+			err = nil
+		}
+		switch {
+		case err == nil:
+			_, err = r.target.WriteAt(b, sector)
+			if err != nil {
+				return err
+			}
+			r.m.Set(sector, size, Rescued)
+		case first:
+			_, err = r.target.WriteAt(r.fill(sector, size), sector)
+			if err != nil {
+				return err
+			}
+			r.m.Set(sector, size, Bad)
+		}
+		if first {
+			r.pr.ReportBytesRead(uint64(size))
+			r.pr.ReportBytesWritten(uint64(size))
+		}
+		r.pr.ReportBadBytes(uint64(r.m.Bytes(Bad)))
+		sector += size
+	}
+	return r.saveEverySoOften()
+}
+
+// saveEverySoOften saves the map if it's not been saved for a while
+func (r *rescuer) saveEverySoOften() error {
+	if time.Since(r.saved) < rescueSaveInterval {
+		return nil
+	}
+	r.saved = time.Now()
+	return r.save()
+}
+
+// fill returns size bytes of the fill pattern, as
+// it's repeated over the target from offset
+func (r *rescuer) fill(offset int64, size int64) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = r.o.Fill[(offset+int64(i))%int64(len(r.o.Fill))]
+	}
+	return b
+}
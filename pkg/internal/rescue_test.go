@@ -0,0 +1,224 @@
+package internal_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"github.com/snasphysicist/go-copy/pkg/random"
+)
+
+// failingDisk is a source which can't read the sectors in bad,
+// failing each read of them until they've been read fails times
+type failingDisk struct {
+	content []byte
+	bad     map[int64]int
+	fails   int
+}
+
+func (fd *failingDisk) ReadAt(b []byte, offset int64) (int, error) {
+	for sector := offset / 512; sector*512 < offset+int64(len(b)); sector++ {
+		if attempts, ok := fd.bad[sector]; ok && (fd.fails == 0 || attempts < fd.fails) {
+			fd.bad[sector]++
+			return 0, syscall.EIO
+		}
+	}
+	return bytes.NewReader(fd.content).ReadAt(b, offset)
+}
+
+// memoryTarget is a target held in memory
+type memoryTarget struct {
+	b []byte
+}
+
+func (mt *memoryTarget) WriteAt(b []byte, offset int64) (int, error) {
+	for int64(len(mt.b)) < offset+int64(len(b)) {
+		mt.b = append(mt.b, 0)
+	}
+	return copy(mt.b[offset:], b), nil
+}
+
+func noSave() error {
+	return nil
+}
+
+var rescueOptions = internal.RescueOptions{BlockSize: 4096, SectorSize: 512, Fill: []byte{0xde, 0xad}}
+
+func TestRescueFillsUnreadableSectorsAndMapsThem(t *testing.T) {
+	content := random.Bytes(10000)
+	disk := failingDisk{content: content, bad: map[int64]int{2: 0, 9: 0}}
+	target := memoryTarget{}
+	m := internal.NewRescueMap(int64(len(content)))
+	pr := internal.NewProgressReporter(0, nil)
+	err := internal.Rescue(&disk, &target, m, rescueOptions, &pr, noSave)
+	if err != nil {
+		t.Fatalf("Rescue failed: %v", err)
+	}
+	expected := append([]byte{}, content...)
+	for _, sector := range []int{2, 9} {
+		for i := sector * 512; i < (sector+1)*512; i++ {
+			expected[i] = []byte{0xde, 0xad}[i%2]
+		}
+	}
+	if !bytes.Equal(target.b, expected) {
+		t.Errorf("Rescued content was not the source with the bad sectors filled")
+	}
+	bad := m.With(internal.Bad)
+	if !reflect.DeepEqual(bad, []internal.RescueRange{{Start: 1024, Length: 512, Status: internal.Bad}, {Start: 4608, Length: 512, Status: internal.Bad}}) {
+		t.Errorf("Mapped %v as bad, expected sectors 2 & 9", bad)
+	}
+	if pr.BytesRead() != 10000 || pr.BytesWritten() != 10000 || pr.BadBytes() != 1024 {
+		t.Errorf("Reported %d read, %d written & %d bad", pr.BytesRead(), pr.BytesWritten(), pr.BadBytes())
+	}
+}
+
+func TestRescueAgainWithMapOnlyRetriesBadSectors(t *testing.T) {
+	content := random.Bytes(10000)
+	disk := failingDisk{content: content, bad: map[int64]int{5: 0}}
+	target := memoryTarget{}
+	m := internal.NewRescueMap(int64(len(content)))
+	first := internal.NewProgressReporter(0, nil)
+	err := internal.Rescue(&disk, &target, m, rescueOptions, &first, noSave)
+	if err != nil {
+		t.Fatalf("First rescue failed: %v", err)
+	}
+	disk.bad = map[int64]int{}
+	copy(target.b[:100], make([]byte, 100))
+	second := internal.NewProgressReporter(0, nil)
+	err = internal.Rescue(&disk, &target, m, internal.RescueOptions{BlockSize: 4096, SectorSize: 512, RetryPasses: 1}, &second, noSave)
+	if err != nil {
+		t.Fatalf("Second rescue failed: %v", err)
+	}
+	if !bytes.Equal(target.b[100:], content[100:]) {
+		t.Errorf("Second rescue did not fill in the bad sector")
+	}
+	if !bytes.Equal(target.b[:100], make([]byte, 100)) {
+		t.Errorf("Second rescue read again what was already rescued")
+	}
+	if m.Bytes(internal.Rescued) != 10000 || second.BadBytes() != 0 {
+		t.Errorf("%d bytes mapped rescued & %d reported bad, expected all rescued", m.Bytes(internal.Rescued), second.BadBytes())
+	}
+}
+
+func TestRescueRetryPassesRecoverSectorsWhichReadEventually(t *testing.T) {
+	content := random.Bytes(4096)
+	disk := failingDisk{content: content, bad: map[int64]int{3: 0}, fails: 3}
+	target := memoryTarget{}
+	m := internal.NewRescueMap(int64(len(content)))
+	pr := internal.NewProgressReporter(0, nil)
+	o := rescueOptions
+	o.RetryPasses = 2
+	err := internal.Rescue(&disk, &target, m, o, &pr, noSave)
+	if err != nil {
+		t.Fatalf("Rescue failed: %v", err)
+	}
+	if !bytes.Equal(target.b, content) || m.Bytes(internal.Bad) != 0 {
+		t.Errorf("Sector which read on the third attempt was not rescued, %v are bad", m.With(internal.Bad))
+	}
+}
+
+func TestRescueMapMergesRangesAndRoundTrips(t *testing.T) {
+	m := internal.NewRescueMap(4096)
+	m.Set(0, 1024, internal.Rescued)
+	m.Set(1024, 512, internal.Bad)
+	m.Set(1536, 512, internal.Rescued)
+	m.Set(1024, 512, internal.Rescued)
+	m.Set(3072, 512, internal.Bad)
+	expected := []internal.RescueRange{
+		{Start: 0, Length: 2048, Status: internal.Rescued},
+		{Start: 2048, Length: 1024, Status: internal.Untried},
+		{Start: 3072, Length: 512, Status: internal.Bad},
+		{Start: 3584, Length: 512, Status: internal.Untried},
+	}
+	if !reflect.DeepEqual(m.Ranges, expected) {
+		t.Errorf("Map has ranges %v, expected %v", m.Ranges, expected)
+	}
+	path := filepath.Join(t.TempDir(), "rescue.map")
+	err := m.WriteFile(path)
+	if err != nil {
+		t.Fatalf("Failed to write map: %v", err)
+	}
+	read, err := internal.ReadRescueMap(path)
+	if err != nil {
+		t.Fatalf("Failed to read map: %v", err)
+	}
+	if !reflect.DeepEqual(read.Ranges, expected) {
+		t.Errorf("Map read back with ranges %v, expected %v", read.Ranges, expected)
+	}
+	m.Resize(3000)
+	if m.Size() != 3000 || len(m.Ranges) != 2 {
+		t.Errorf("Shrunk map has ranges %v", m.Ranges)
+	}
+}
+
+// mapStatus returns the current_status written to the map file at path
+func mapStatus(t *testing.T, path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read map: %v", err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			return strings.Fields(line)[1]
+		}
+	}
+	t.Fatalf("Map has no status line")
+	return ""
+}
+
+func TestRescueMapRecordsPhaseOfRescue(t *testing.T) {
+	content := random.Bytes(4096)
+	disk := failingDisk{content: content, bad: map[int64]int{3: 0}}
+	m := internal.NewRescueMap(int64(len(content)))
+	path := filepath.Join(t.TempDir(), "rescue.map")
+	m.Set(0, 1024, internal.Rescued)
+	err := m.WriteFile(path)
+	if err != nil || mapStatus(t, path) != "?" {
+		t.Errorf("Map with untried ranges written with error %v", err)
+	}
+	phases := make([]string, 0)
+	o := rescueOptions
+	o.RetryPasses = 1
+	pr := internal.NewProgressReporter(0, nil)
+	err = internal.Rescue(&disk, &memoryTarget{}, m, o, &pr, func() error {
+		err := m.WriteFile(path)
+		phases = append(phases, mapStatus(t, path))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Rescue failed: %v", err)
+	}
+	if !reflect.DeepEqual(phases, []string{"-", "+"}) {
+		t.Errorf("Map saved in phases %v, expected retrying bad ranges then finished", phases)
+	}
+}
+
+func TestRescueMapsWrittenByDdrescueAreRead(t *testing.T) {
+	dir := t.TempDir()
+	ddrescueMap := "# Mapfile. Created by GNU ddrescue version 1.27\n" +
+		"# current_pos  current_status  current_pass\n" +
+		"0x00010000     *               1\n" +
+		"#      pos        size  status\n" +
+		"0x00000000  0x00008000  +\n" +
+		"0x00008000  0x00001000  *\n" +
+		"0x00009000  0x00001000  /\n" +
+		"0x0000A000  0x00006000  ?\n"
+	mustWrite(t, dir, "ddrescue.map", ddrescueMap)
+	m, err := internal.ReadRescueMap(filepath.Join(dir, "ddrescue.map"))
+	if err != nil {
+		t.Fatalf("Failed to read ddrescue map: %v", err)
+	}
+	expected := []internal.RescueRange{
+		{Start: 0, Length: 0x8000, Status: internal.Rescued},
+		{Start: 0x8000, Length: 0x2000, Status: internal.Bad},
+		{Start: 0xA000, Length: 0x6000, Status: internal.Untried},
+	}
+	if !reflect.DeepEqual(m.Ranges, expected) {
+		t.Errorf("Read ranges %v, expected %v", m.Ranges, expected)
+	}
+}
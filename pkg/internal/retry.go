@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// TransientErrors are the classes of error, by the name of
+// their errno, which a RetryPolicy can treat as transient
+var TransientErrors = map[string]syscall.Errno{
+	"EIO":       syscall.EIO,
+	"EAGAIN":    syscall.EAGAIN,
+	"ETIMEDOUT": syscall.ETIMEDOUT,
+	"EINTR":     syscall.EINTR,
+	"EBUSY":     syscall.EBUSY,
+	"ENXIO":     syscall.ENXIO,
+}
+
+// DefaultTransientErrors are those treated as transient by default,
+// as returned now & then by flaky USB hubs & network mounts
+var DefaultTransientErrors = []string{"EIO", "EAGAIN", "ETIMEDOUT", "EINTR"}
+
+// RetryPolicy configures retrying operations (opening, reading
+// & writing) which fail with a transient error. The zero value
+// never retries.
+type RetryPolicy struct {
+	// Retries is how many times an operation is retried
+	// after it first fails, before giving up
+	Retries int
+	// Backoff is how long to wait before the first retry,
+	// doubling before each retry after that
+	Backoff time.Duration
+	// MaxBackoff caps the wait between retries, if not 0
+	MaxBackoff time.Duration
+	// Transient are the errors (from TransientErrors)
+	// which are retried, any others failing immediately
+	Transient []syscall.Errno
+}
+
+// ParseTransientErrors parses a comma separated list
+// of the names of errors in TransientErrors
+func ParseTransientErrors(s string) ([]syscall.Errno, error) {
+	errnos := make([]syscall.Errno, 0)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		errno, ok := TransientErrors[name]
+		if !ok {
+			return nil, fmt.Errorf("%s is not one of the transient errors %v", name, transientErrorNames())
+		}
+		errnos = append(errnos, errno)
+	}
+	return errnos, nil
+}
+
+// transientErrorNames lists the names of TransientErrors
+func transientErrorNames() []string {
+	names := make([]string, 0, len(TransientErrors))
+	for name := range TransientErrors {
+		names = append(names, name)
+	}
+	return names
+}
+
+// transient returns true if err is one of the errors p retries
+func (p RetryPolicy) transient(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, errno := range p.Transient {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// do runs the operation called name with f, retrying it according to
+// p while it fails with a transient error, reporting each retry to pr.
+// Before each retry, restore (if not nil) is called to put things back
+// as they were before f was first called, an error from it counting
+// as a failed attempt.
+func (p RetryPolicy) do(name string, pr *ProgressReporter, restore func() error, f func() error) error {
+	err := f()
+	wait := p.Backoff
+	for attempt := 1; attempt <= p.Retries && p.transient(err); attempt++ {
+		log.Printf("WARNING: %s failed (%v), retrying in %s (%d of %d)", name, err, wait, attempt, p.Retries)
+		time.Sleep(wait)
+		wait *= 2
+		if p.MaxBackoff != 0 {
+			wait = min(wait, p.MaxBackoff)
+		}
+		pr.ReportRetry()
+		if restore != nil {
+			err = restore()
+			if err != nil {
+				continue
+			}
+		}
+		err = f()
+	}
+	return err
+}
+
+// seekTo seeks s to offset, so that a read or write which failed
+// part way through continues from exactly where it should, if s can
+// seek (pipes can't, but then there's nowhere else they could be)
+func seekTo(s any, offset uint64) error {
+	seeker, ok := s.(io.Seeker)
+	if !ok {
+		return nil
+	}
+	_, err := seeker.Seek(int64(offset), io.SeekStart)
+	if errors.Is(err, syscall.ESPIPE) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,248 @@
+package internal_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"github.com/snasphysicist/go-copy/pkg/random"
+)
+
+// retryImmediately retries transient I/O errors a few times without waiting
+var retryImmediately = internal.RetryPolicy{Retries: 3, Transient: []syscall.Errno{syscall.EIO}}
+
+// flakySource is a seekable source which fails every third read
+// with EIO, having moved on past bytes which it didn't return
+type flakySource struct {
+	r     *bytes.Reader
+	reads int
+}
+
+func (fs *flakySource) Open() error {
+	return nil
+}
+
+func (fs *flakySource) Read(b []byte) (int, error) {
+	fs.reads++
+	if fs.reads%3 == 0 {
+		_, _ = fs.r.Seek(7, io.SeekCurrent)
+		return 0, &wrappedErrno{syscall.EIO}
+	}
+	return fs.r.Read(b)
+}
+
+func (fs *flakySource) Seek(offset int64, whence int) (int64, error) {
+	return fs.r.Seek(offset, whence)
+}
+
+func (fs *flakySource) Close() error {
+	return nil
+}
+
+// wrappedErrno wraps an errno as the os package's errors do
+type wrappedErrno struct {
+	errno syscall.Errno
+}
+
+func (e *wrappedErrno) Error() string {
+	return "flaky: " + e.errno.Error()
+}
+
+func (e *wrappedErrno) Unwrap() error {
+	return e.errno
+}
+
+func TestReaderRetriesTransientErrorsFromWhereItGotTo(t *testing.T) {
+	content := random.Bytes(10000)
+	done := make(chan struct{})
+	read := bytes.NewBuffer(make([]byte, 0))
+	pr := internal.NewProgressReporter(0, nil)
+	r := internal.NewReader(&flakySource{r: bytes.NewReader(content)}, &ReadWriterAsAcceptor{rw: read}, done, &pr, 0, 100)
+	r.RetryWith(retryImmediately)
+	r.Start()
+	if !bytes.Equal(read.Bytes(), content) {
+		t.Errorf("Read %d bytes which differ from the %d in the source", read.Len(), len(content))
+	}
+	if pr.Retries() == 0 {
+		t.Errorf("No retries were reported")
+	}
+}
+
+func TestReaderGivesUpAfterRetriesRunOut(t *testing.T) {
+	done := make(chan struct{})
+	pr := internal.NewProgressReporter(0, nil)
+	source := mockSource{toRead: &mockReadWriter{rw: bytes.NewBuffer(nil), err: syscall.EIO}}
+	r := internal.NewReader(&source, &ReadWriterAsAcceptor{rw: bytes.NewBuffer(nil)}, done, &pr, 0, 100)
+	r.RetryWith(retryImmediately)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Reader did not fail on an error which persisted")
+		}
+		if pr.Retries() != 3 {
+			t.Errorf("Retried %d times, expected 3", pr.Retries())
+		}
+	}()
+	r.Start()
+}
+
+func TestReaderDoesNotRetryOtherErrors(t *testing.T) {
+	done := make(chan struct{})
+	pr := internal.NewProgressReporter(0, nil)
+	source := mockSource{toRead: &mockReadWriter{rw: bytes.NewBuffer(nil), err: syscall.EACCES}}
+	r := internal.NewReader(&source, &ReadWriterAsAcceptor{rw: bytes.NewBuffer(nil)}, done, &pr, 0, 100)
+	r.RetryWith(retryImmediately)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Reader did not fail on a permanent error")
+		}
+		if pr.Retries() != 0 {
+			t.Errorf("Retried a permanent error %d times", pr.Retries())
+		}
+	}()
+	r.Start()
+}
+
+// flakyTarget is a seekable target which fails every other write
+// with EIO, after writing half of the bytes & moving on past where
+// the rest would have gone
+type flakyTarget struct {
+	content []byte
+	offset  int
+	writes  int
+}
+
+func (ft *flakyTarget) Initialise() error {
+	return nil
+}
+
+func (ft *flakyTarget) Sync() error {
+	return nil
+}
+
+func (ft *flakyTarget) Close() error {
+	return nil
+}
+
+func (ft *flakyTarget) Seek(offset int64, whence int) (int64, error) {
+	ft.offset = int(offset)
+	return offset, nil
+}
+
+func (ft *flakyTarget) Write(b []byte) (int, error) {
+	ft.writes++
+	n := len(b)
+	var err error
+	if ft.writes%2 == 0 {
+		n = len(b) / 2
+		err = syscall.EIO
+	}
+	for len(ft.content) < ft.offset+n {
+		ft.content = append(ft.content, 0)
+	}
+	copy(ft.content[ft.offset:], b[:n])
+	ft.offset += n
+	if err != nil {
+		ft.offset += 3
+	}
+	return n, err
+}
+
+func TestWriterRetriesTransientErrorsFromWhereItGotTo(t *testing.T) {
+	content := random.Bytes(10000)
+	sourceDone := make(chan struct{})
+	done := make(chan struct{})
+	b := internal.NewBuffer(uint64(len(content)))
+	b.Offer(content)
+	pr := internal.NewProgressReporter(0, nil)
+	ft := flakyTarget{}
+	w := internal.NewWriter(&ft, &b, sourceDone, done, &pr, 1000)
+	w.RetryWith(retryImmediately)
+	go w.Start()
+	stopWriter(sourceDone, done)
+	if !bytes.Equal(ft.content, content) {
+		t.Errorf("Wrote %d bytes which differ from the %d given", len(ft.content), len(content))
+	}
+	if pr.Retries() == 0 {
+		t.Errorf("No retries were reported")
+	}
+}
+
+func TestTransientErrorsAreParsedByName(t *testing.T) {
+	errnos, err := internal.ParseTransientErrors("eio, ETIMEDOUT")
+	if err != nil || !reflect.DeepEqual(errnos, []syscall.Errno{syscall.EIO, syscall.ETIMEDOUT}) {
+		t.Errorf("Parsed %v (error %v), expected EIO & ETIMEDOUT", errnos, err)
+	}
+	_, err = internal.ParseTransientErrors("EIO,ENOTANERROR")
+	if err == nil {
+		t.Errorf("Parsed an unknown error")
+	}
+}
+
+func TestRetriesBackOffExponentially(t *testing.T) {
+	done := make(chan struct{})
+	pr := internal.NewProgressReporter(0, nil)
+	source := mockSource{toRead: &mockReadWriter{rw: bytes.NewBuffer(nil), err: syscall.EIO}}
+	r := internal.NewReader(&source, &ReadWriterAsAcceptor{rw: bytes.NewBuffer(nil)}, done, &pr, 0, 100)
+	r.RetryWith(internal.RetryPolicy{Retries: 3, Backoff: 10 * time.Millisecond, MaxBackoff: 25 * time.Millisecond, Transient: []syscall.Errno{syscall.EIO}})
+	start := time.Now()
+	defer func() {
+		err, _ := recover().(error)
+		if !errors.Is(err, syscall.EIO) {
+			t.Errorf("Failed with %v, expected EIO", err)
+		}
+		// 10ms, 20ms then 25ms (capped)
+		if took := time.Since(start); took < 55*time.Millisecond {
+			t.Errorf("Took %s to retry 3 times, expected at least 55ms", took)
+		}
+	}()
+	r.Start()
+}
+
+// failingSyncTarget is a target whose syncs
+// always fail with EIO, counting them
+type failingSyncTarget struct {
+	syncs int
+}
+
+func (ft *failingSyncTarget) Initialise() error {
+	return nil
+}
+
+func (ft *failingSyncTarget) Sync() error {
+	ft.syncs++
+	return syscall.EIO
+}
+
+func (ft *failingSyncTarget) Close() error {
+	return nil
+}
+
+func (ft *failingSyncTarget) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func TestWriterFailsWithoutRetryingWhenSyncFails(t *testing.T) {
+	sourceDone := make(chan struct{})
+	done := make(chan struct{})
+	b := internal.NewBuffer(100)
+	b.Offer(random.Bytes(50))
+	pr := internal.NewProgressReporter(0, nil)
+	ft := failingSyncTarget{}
+	w := internal.NewWriter(&ft, &b, sourceDone, done, &pr, 10)
+	w.RetryWith(retryImmediately)
+	defer func() {
+		err, _ := recover().(error)
+		if !errors.Is(err, syscall.EIO) {
+			t.Errorf("Failed with %v, expected EIO", err)
+		}
+		if ft.syncs != 1 || pr.Retries() != 0 {
+			t.Errorf("Synced %d times with %d retries, expected once without retrying", ft.syncs, pr.Retries())
+		}
+	}()
+	w.Start()
+}
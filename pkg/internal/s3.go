@@ -0,0 +1,595 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3PartSizeBytes is the smallest size of each part of a multipart
+// upload (other than the last), which S3 needs to be at least 5mb
+const s3PartSizeBytes = 8 * 1024 * 1024
+
+// s3MaxParts is the most parts S3 allows in a multipart upload
+const s3MaxParts = 10000
+
+// s3PartsPerDoubling is how many parts are uploaded, when the
+// size of the object isn't known, before the size of the parts
+// is doubled, so that the largest object S3 allows (5tb) fits
+// in s3MaxParts parts without any part being over S3's 5gb limit
+const s3PartsPerDoubling = 1000
+
+// s3Concurrency is how many parts are uploaded at once
+const s3Concurrency = 4
+
+// s3Attempts is how many times uploading each
+// part is attempted before giving up on the transfer
+const s3Attempts = 5
+
+// S3PartSize returns the size of the part with the (1 based)
+// number of a multipart upload of an object of the given size,
+// or of unknown size if it is 0. If it is known, all parts are
+// the same size, big enough that there are at most s3MaxParts,
+// otherwise they grow as more are used.
+func S3PartSize(size uint64, number int) int {
+	if size == 0 {
+		return s3PartSizeBytes << ((number - 1) / s3PartsPerDoubling)
+	}
+	return max(s3PartSizeBytes, int((size+s3MaxParts-1)/s3MaxParts))
+}
+
+// IsS3 returns true if path is an s3 URL
+func IsS3(path string) bool {
+	return strings.HasPrefix(path, "s3://")
+}
+
+// s3Client makes (signed, if there are credentials)
+// requests to an S3 compatible endpoint
+type s3Client struct {
+	endpoint string
+	client   *http.Client
+}
+
+// newS3Client creates a client for the endpoint & region in eo,
+// else the AWS_ENDPOINT_URL(_S3) & AWS_(DEFAULT_)REGION environment
+// variables, else AWS itself in us-east-1, signing requests with
+// the credentials in the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// & AWS_SESSION_TOKEN environment variables, if there are any
+func newS3Client(eo EndpointOptions) *s3Client {
+	region := firstNonEmpty(eo.S3Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	endpoint := firstNonEmpty(
+		eo.S3Endpoint,
+		os.Getenv("AWS_ENDPOINT_URL_S3"),
+		os.Getenv("AWS_ENDPOINT_URL"),
+		fmt.Sprintf("https://s3.%s.amazonaws.com", region),
+	)
+	client := http.DefaultClient
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	if accessKey != "" {
+		client = &http.Client{Transport: &sigV4Signer{
+			region:       region,
+			accessKey:    accessKey,
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			next:         http.DefaultTransport,
+			now:          time.Now,
+		}}
+	}
+	return &s3Client{endpoint: strings.TrimSuffix(endpoint, "/"), client: client}
+}
+
+// firstNonEmpty returns the first of values which isn't ""
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseS3 splits the s3 URL path into its bucket & key
+func parseS3(path string) (string, string, error) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(path, "s3://"), "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("s3 URL %s has no bucket", path)
+	}
+	return bucket, key, nil
+}
+
+// url returns the (path style) URL of key in bucket with query
+func (sc *s3Client) url(bucket string, key string, query url.Values) string {
+	u := sc.endpoint + "/" + s3Escape(bucket, true)
+	if key != "" {
+		u += "/" + s3Escape(key, false)
+	}
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// do makes a request with method to url with body (may be
+// nil) & header, returning an error if the response is not
+// a success, or it is but the body contains an S3 error (as
+// CompleteMultipartUpload can), otherwise the response body
+func (sc *s3Client) do(method string, url string, body []byte, header http.Header) (http.Header, []byte, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := newHTTPRequest(method, url, r, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	var s3Err struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}
+	isError := xml.Unmarshal(b, &s3Err) == nil
+	if isError || resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, &s3Error{method: method, url: url, status: resp.Status, code: s3Err.Code, message: s3Err.Message}
+	}
+	return resp.Header, b, nil
+}
+
+// s3Error is an error response from S3
+type s3Error struct {
+	method  string
+	url     string
+	status  string
+	code    string
+	message string
+}
+
+// Error implements error on s3Error
+func (se *s3Error) Error() string {
+	if se.code == "" {
+		return fmt.Sprintf("%s %s returned %s", se.method, se.url, se.status)
+	}
+	return fmt.Sprintf("%s %s returned %s (%s: %s)", se.method, se.url, se.status, se.code, se.message)
+}
+
+// NewS3Source creates a new source reading the object at the
+// s3 URL path, accessed as per eo, as an http(s) source, so with
+// ranged GETs to resume & download segments in parallel
+func NewS3Source(path string, eo EndpointOptions) *httpSource {
+	sc := newS3Client(eo)
+	bucket, key, err := parseS3(path)
+	if err != nil {
+		panic(err)
+	}
+	hs := NewHTTPSource(sc.url(bucket, key, nil), eo.HTTPSegments, nil)
+	hs.client = sc.client
+	return hs
+}
+
+// s3Part is one part of a multipart upload
+type s3Part struct {
+	Number int    `xml:"PartNumber" json:"number"`
+	ETag   string `xml:"ETag" json:"etag"`
+	SHA256 string `xml:"ChecksumSHA256" json:"sha256"`
+	b      []byte
+}
+
+// s3Checkpoint records the progress of a multipart upload,
+// so that it can be resumed if the copy is run again
+type s3Checkpoint struct {
+	UploadID      string         `json:"uploadId"`
+	PartSizeBytes int            `json:"partSizeBytes"`
+	Parts         map[int]s3Part `json:"parts"`
+}
+
+// s3Target is a wtarget uploading to an object in S3. Anything
+// up to a part in size is uploaded with a single PUT, otherwise
+// parts are uploaded concurrently, each retried if it fails,
+// with the progress recorded in a checkpoint file so that if
+// the copy is run again, parts already uploaded are not
+// uploaded again. Bytes are only reported as written once
+// the part they are in has been acknowledged.
+type s3Target struct {
+	client      *s3Client
+	bucket      string
+	key         string
+	size        uint64
+	report      func(uint64)
+	pending     []byte
+	checkpoint  s3Checkpoint
+	partsQueued int
+	parts       chan s3Part
+	uploaders   sync.WaitGroup
+	l           sync.Mutex
+	err         error
+}
+
+// NewS3Target creates a new target uploading to the object
+// at the s3 URL path, accessed as per eo, with parts sized
+// for an object of about size bytes (0 if it's unknown)
+func NewS3Target(path string, size uint64, eo EndpointOptions) *s3Target {
+	bucket, key, err := parseS3(path)
+	if err != nil {
+		panic(err)
+	}
+	return &s3Target{client: newS3Client(eo), bucket: bucket, key: key, size: size, report: func(uint64) {}}
+}
+
+// AcknowledgeTo implements acknowledger on s3Target
+func (st *s3Target) AcknowledgeTo(report func(uint64)) {
+	st.report = report
+}
+
+// Initialise implements wtarget on s3Target,
+// nothing is uploaded until there's a whole part
+func (st *s3Target) Initialise() error {
+	st.pending = make([]byte, 0, S3PartSize(st.size, 1))
+	return nil
+}
+
+// Write implements wtarget on s3Target, queuing each whole part
+// for upload, returning an error if any upload has failed
+// or the object won't fit in the parts S3 allows
+func (st *s3Target) Write(b []byte) (int, error) {
+	st.pending = append(st.pending, b...)
+	if st.partsQueued == s3MaxParts && len(st.pending) > 0 {
+		return 0, st.tooManyParts()
+	}
+	for size := S3PartSize(st.size, st.partsQueued+1); len(st.pending) >= size; size = S3PartSize(st.size, st.partsQueued+1) {
+		err := st.queue(st.pending[:size])
+		if err != nil {
+			return 0, err
+		}
+		st.pending = append(make([]byte, 0, size), st.pending[size:]...)
+	}
+	return len(b), nil
+}
+
+// tooManyParts returns the error for an object
+// not fitting in the most parts S3 allows
+func (st *s3Target) tooManyParts() error {
+	return fmt.Errorf("%s is too big to upload in the %d parts S3 allows", st.key, s3MaxParts)
+}
+
+// queue queues b as the next part for upload, starting
+// (or resuming) the multipart upload on the first part.
+// If the part was already uploaded before, it isn't again.
+func (st *s3Target) queue(b []byte) error {
+	if st.parts == nil {
+		err := st.start()
+		if err != nil {
+			return err
+		}
+	}
+	err := st.failed()
+	if err != nil {
+		return err
+	}
+	if st.partsQueued == s3MaxParts {
+		return st.tooManyParts()
+	}
+	md := sha256.Sum256(b)
+	p := s3Part{Number: st.partsQueued + 1, SHA256: base64.StdEncoding.EncodeToString(md[:]), b: b}
+	st.partsQueued++
+	st.l.Lock()
+	previous, uploaded := st.checkpoint.Parts[p.Number]
+	st.l.Unlock()
+	if uploaded && previous.SHA256 == p.SHA256 {
+		st.report(uint64(len(b)))
+		return nil
+	}
+	st.parts <- p
+	return nil
+}
+
+// failed returns the error with which any upload failed
+func (st *s3Target) failed() error {
+	st.l.Lock()
+	defer st.l.Unlock()
+	return st.err
+}
+
+// start resumes the multipart upload in the checkpoint
+// if there is one, else starts a new one, and starts
+// s3Concurrency goroutines uploading the queued parts
+func (st *s3Target) start() error {
+	object := st.client.url(st.bucket, st.key, nil)
+	c, err := loadS3Checkpoint(object)
+	first := S3PartSize(st.size, 1)
+	if err == nil && c.PartSizeBytes == first {
+		_, _, err = st.client.do(http.MethodGet, st.client.url(st.bucket, st.key, url.Values{"uploadId": {c.UploadID}}), nil, nil)
+		if err == nil {
+			log.Printf("WARNING: resuming upload to %s, %d parts already uploaded", object, len(c.Parts))
+			st.checkpoint = c
+		}
+	}
+	if st.checkpoint.UploadID == "" {
+		header := http.Header{"X-Amz-Checksum-Algorithm": {"SHA256"}}
+		_, b, err := st.client.do(http.MethodPost, st.client.url(st.bucket, st.key, url.Values{"uploads": {""}}), nil, header)
+		if err != nil {
+			return err
+		}
+		var initiated struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.Unmarshal(b, &initiated)
+		if err != nil {
+			return fmt.Errorf("POST %s returned invalid response: %w", object, err)
+		}
+		st.checkpoint = s3Checkpoint{UploadID: initiated.UploadID, PartSizeBytes: first, Parts: make(map[int]s3Part)}
+		err = saveS3Checkpoint(object, st.checkpoint)
+		if err != nil {
+			return err
+		}
+	}
+	st.parts = make(chan s3Part, s3Concurrency)
+	for i := 0; i < s3Concurrency; i++ {
+		st.uploaders.Add(1)
+		go func() {
+			defer st.uploaders.Done()
+			for p := range st.parts {
+				st.upload(p)
+			}
+		}()
+	}
+	return nil
+}
+
+// upload uploads the part p, retrying with backoff up to
+// s3Attempts times, then records it in the checkpoint & reports
+// its bytes as written, or records the error if it failed
+func (st *s3Target) upload(p s3Part) {
+	query := url.Values{"partNumber": {fmt.Sprint(p.Number)}, "uploadId": {st.checkpoint.UploadID}}
+	var err error
+	var header http.Header
+	for attempt := 0; attempt < s3Attempts; attempt++ {
+		if st.failed() != nil {
+			return
+		}
+		if attempt > 0 {
+			log.Printf("WARNING: uploading part %d of %s failed (%v), retrying", p.Number, st.key, err)
+			time.Sleep(time.Duration(100<<attempt) * time.Millisecond)
+		}
+		header, _, err = st.client.do(http.MethodPut, st.client.url(st.bucket, st.key, query), p.b, checksumHeaders(p.b))
+		if err == nil {
+			break
+		}
+	}
+	st.l.Lock()
+	defer st.l.Unlock()
+	if err != nil {
+		if st.err == nil {
+			st.err = fmt.Errorf("uploading part %d of %s failed %d times, run again to resume: %w", p.Number, st.key, s3Attempts, err)
+		}
+		return
+	}
+	st.checkpoint.Parts[p.Number] = s3Part{Number: p.Number, ETag: header.Get("ETag"), SHA256: p.SHA256}
+	err = saveS3Checkpoint(st.client.url(st.bucket, st.key, nil), st.checkpoint)
+	if err != nil {
+		log.Printf("WARNING: failed to save checkpoint, upload can't be resumed: %v", err)
+	}
+	st.report(uint64(len(p.b)))
+}
+
+// checksumHeaders returns the headers giving the checksums
+// of the body b, for the server to check it against
+func checksumHeaders(b []byte) http.Header {
+	m := md5.Sum(b)
+	s := sha256.Sum256(b)
+	return http.Header{
+		"Content-Md5":           {base64.StdEncoding.EncodeToString(m[:])},
+		"X-Amz-Checksum-Sha256": {base64.StdEncoding.EncodeToString(s[:])},
+		"X-Amz-Content-Sha256":  {hex.EncodeToString(s[:])},
+	}
+}
+
+// Sync implements wtarget on s3Target, parts are
+// durable as soon as they're acknowledged, and
+// nothing is reported as written before then,
+// so there's nothing to do
+func (st *s3Target) Sync() error {
+	return nil
+}
+
+// Close implements wtarget on s3Target, uploading what remains.
+// Either with a single PUT if there was less than a part in total,
+// otherwise as the last part, then completing the multipart upload
+// once all of the parts have been uploaded.
+func (st *s3Target) Close() error {
+	if st.parts == nil {
+		_, _, err := st.client.do(http.MethodPut, st.client.url(st.bucket, st.key, nil), st.pending, checksumHeaders(st.pending))
+		if err == nil {
+			st.report(uint64(len(st.pending)))
+		}
+		return err
+	}
+	var err error
+	if len(st.pending) > 0 {
+		err = st.queue(st.pending)
+	}
+	close(st.parts)
+	st.uploaders.Wait()
+	if err != nil {
+		return err
+	}
+	err = st.failed()
+	if err != nil {
+		return err
+	}
+	return st.complete()
+}
+
+// complete completes the multipart upload from the parts
+// queued, and removes the checkpoint as it's no longer needed
+func (st *s3Target) complete() error {
+	var completion struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}
+	for n := 1; n <= st.partsQueued; n++ {
+		completion.Parts = append(completion.Parts, st.checkpoint.Parts[n])
+	}
+	body, err := xml.Marshal(completion)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"uploadId": {st.checkpoint.UploadID}}
+	_, _, err = st.client.do(http.MethodPost, st.client.url(st.bucket, st.key, query), body, nil)
+	if err != nil {
+		return err
+	}
+	return removeS3Checkpoint(st.client.url(st.bucket, st.key, nil))
+}
+
+// s3CheckpointPath returns where the checkpoint for
+// a multipart upload to the object at url is kept
+func s3CheckpointPath(url string) (string, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	name := sha256.Sum256([]byte(url))
+	return filepath.Join(cache, "go-copy", "s3", hex.EncodeToString(name[:])+".json"), nil
+}
+
+// loadS3Checkpoint loads the checkpoint for
+// a multipart upload to the object at url
+func loadS3Checkpoint(url string) (s3Checkpoint, error) {
+	var c s3Checkpoint
+	path, err := s3CheckpointPath(url)
+	if err != nil {
+		return c, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// saveS3Checkpoint saves c as the checkpoint for
+// a multipart upload to the object at url
+func saveS3Checkpoint(url string, c s3Checkpoint) error {
+	path, err := s3CheckpointPath(url)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0600)
+}
+
+// removeS3Checkpoint removes the checkpoint for
+// a multipart upload to the object at url
+func removeS3Checkpoint(url string) error {
+	path, err := s3CheckpointPath(url)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// s3TreeTarget is a treeTarget under the
+// prefix of the s3 URL root
+type s3TreeTarget struct {
+	root   string
+	eo     EndpointOptions
+	client *s3Client
+}
+
+// NewS3TreeTarget creates a new target for a tree of files
+// under the prefix of the s3 URL root, accessed as per eo
+func NewS3TreeTarget(root string, eo EndpointOptions) *s3TreeTarget {
+	return &s3TreeTarget{root: strings.TrimSuffix(root, "/"), eo: eo, client: newS3Client(eo)}
+}
+
+// Mkdir implements treeTarget on s3TreeTarget, there are
+// no directories in S3 (just keys containing /) so this
+// does nothing
+func (stt *s3TreeTarget) Mkdir(_ string) error {
+	return nil
+}
+
+// File implements treeTarget on s3TreeTarget
+func (stt *s3TreeTarget) File(path string, size uint64) wtarget {
+	return NewS3Target(stt.root+"/"+path, size, stt.eo)
+}
+
+// Identical implements treeTarget on s3TreeTarget with HEAD.
+// S3 sets the modification time of objects itself, so an object
+// is considered identical if it has the same size & was modified
+// no earlier than the file described by info (or both are empty).
+func (stt *s3TreeTarget) Identical(path string, info fs.FileInfo) (bool, error) {
+	bucket, key, err := parseS3(stt.root + "/" + path)
+	if err != nil {
+		return false, err
+	}
+	req, err := newHTTPRequest(http.MethodHead, stt.client.url(bucket, key, nil), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := stt.client.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("HEAD %s returned %s", req.URL, resp.Status)
+	}
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return false, nil
+	}
+	newEnough := resp.ContentLength == 0 || !modified.Before(info.ModTime().Truncate(time.Second))
+	return resp.ContentLength == info.Size() && newEnough, nil
+}
+
+// Symlink implements treeTarget on s3TreeTarget,
+// S3 has no symlinks so they are skipped with a warning
+func (stt *s3TreeTarget) Symlink(path string, _ string) error {
+	log.Printf("WARNING: skipping symlink %s, S3 does not support symlinks", path)
+	return nil
+}
+
+// Finish implements treeTarget on s3TreeTarget, S3
+// decides on the metadata itself so this does nothing
+func (stt *s3TreeTarget) Finish(_ string, _ fs.FileInfo) error {
+	return nil
+}
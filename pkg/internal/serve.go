@@ -0,0 +1,441 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Export is a directory served by a Server
+type Export struct {
+	// Name is the first segment of the path of
+	// files in the directory in gocopy(s) URLs,
+	// or empty for the root export, which serves
+	// paths not under any other export
+	Name string
+	// Dir is the directory on the server
+	Dir string
+	// Writable allows files in the directory to be
+	// written, otherwise they can only be read
+	Writable bool
+}
+
+// ParseExport parses an export given as name=dir, with :rw
+// appended to make it writable, or optionally :ro to be explicit
+// that it's read only
+func ParseExport(s string) (Export, error) {
+	name, dir, found := strings.Cut(s, "=")
+	if !found || name == "" || strings.Contains(name, "/") || dir == "" {
+		return Export{}, fmt.Errorf("export %s should be like name=dir[:rw]", s)
+	}
+	e := Export{Name: name, Dir: dir}
+	if strings.HasSuffix(dir, ":rw") {
+		e.Dir = strings.TrimSuffix(dir, ":rw")
+		e.Writable = true
+	}
+	e.Dir = strings.TrimSuffix(e.Dir, ":ro")
+	return e, nil
+}
+
+// Server serves the files in its exports over the go-copy
+// protocol (described in protocol.go), reading & writing
+// them with the Reader & Writer as a local copy would
+type Server struct {
+	exports         map[string]Export
+	bufferSizeBytes uint64
+	syncEachBytes   uint64
+	l               sync.Mutex
+	writing         map[string]*sync.Mutex
+}
+
+// NewServer creates a new server of exports, using buffers of
+// bufferSizeBytes between reading & writing, and flushing
+// files being written to disk each syncEachBytes
+func NewServer(exports []Export, bufferSizeBytes uint64, syncEachBytes uint64) *Server {
+	s := &Server{
+		exports:         make(map[string]Export),
+		bufferSizeBytes: bufferSizeBytes,
+		syncEachBytes:   syncEachBytes,
+		writing:         make(map[string]*sync.Mutex),
+	}
+	for _, e := range exports {
+		s.exports[e.Name] = e
+	}
+	return s
+}
+
+// Serve serves each connection accepted from l
+// until l is closed, returning the error which
+// closed it (net.ErrClosed if closed deliberately)
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves the session on conn, closing it when done
+func (s *Server) ServeConn(conn io.ReadWriteCloser) {
+	defer conn.Close()
+	fc := &frameConn{rwc: conn}
+	var req protocolRequest
+	err := fc.receiveJSON(frameOpen, &req)
+	if err != nil {
+		log.Printf("WARNING: failed to receive request: %v", err)
+		return
+	}
+	err = s.serve(fc, req)
+	if err != nil {
+		log.Printf("WARNING: failed to %s %s: %v", req.Mode, req.Path, err)
+		_ = fc.send(frameError, []byte(err.Error()))
+		return
+	}
+	log.Printf("Finished %s %s", req.Mode, req.Path)
+}
+
+// serve serves the session requested by req on fc
+func (s *Server) serve(fc *frameConn, req protocolRequest) error {
+	if req.Version != protocolVersion {
+		return fmt.Errorf("protocol version %d is not supported, only %d", req.Version, protocolVersion)
+	}
+	clean := strings.TrimPrefix(path.Clean("/"+req.Path), "/")
+	name, rel, _ := strings.Cut(clean, "/")
+	e, ok := s.exports[name]
+	if !ok {
+		// paths not under any other export are under the root export
+		root, hasRoot := s.exports[""]
+		if !hasRoot {
+			return fmt.Errorf("there is no export %s", name)
+		}
+		e, rel = root, clean
+	}
+	if rel == "" {
+		return fmt.Errorf("no file given in export %s", name)
+	}
+	if req.Mode == modeWrite && !e.Writable {
+		return fmt.Errorf("export %s is read only", name)
+	}
+	if req.Offset < 0 {
+		return fmt.Errorf("offset %d is negative", req.Offset)
+	}
+	root, err := os.OpenRoot(e.Dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	rel = filepath.FromSlash(rel)
+	switch req.Mode {
+	case modeStat:
+		fi, err := root.Stat(rel)
+		if err != nil {
+			return err
+		}
+		return fc.sendJSON(frameOK, protocolReply{Size: fi.Size()})
+	case modeRead:
+		return s.serveRead(fc, root, rel, req.Offset)
+	case modeWrite:
+		// sessions writing the same file (e.g. one which failed
+		// & one resuming it) must not write at the same time
+		l := s.writeLock(filepath.Join(e.Dir, rel))
+		l.Lock()
+		defer l.Unlock()
+		return s.serveWrite(fc, root, rel, req.Offset)
+	default:
+		return fmt.Errorf("mode %s is not supported", req.Mode)
+	}
+}
+
+// writeLock returns the lock for writing the file at path
+func (s *Server) writeLock(path string) *sync.Mutex {
+	s.l.Lock()
+	defer s.l.Unlock()
+	l, ok := s.writing[path]
+	if !ok {
+		l = &sync.Mutex{}
+		s.writing[path] = l
+	}
+	return l
+}
+
+// serveRead sends the file at rel under root from offset
+func (s *Server) serveRead(fc *frameConn, root *os.Root, rel string, offset int64) error {
+	f, err := root.Open(rel)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err == nil && !fi.Mode().IsRegular() {
+		err = fmt.Errorf("%s is not a regular file", rel)
+	}
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err == nil {
+		err = fc.sendJSON(frameOK, protocolReply{Size: fi.Size()})
+	}
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	return s.transfer(&openedSource{f: f}, &frameTarget{fc: fc}, fc)
+}
+
+// serveWrite receives the file at rel under root from offset,
+// which must be no more than the size of the file, anything after
+// it being removed (offset 0 meaning to replace the whole file)
+func (s *Server) serveWrite(fc *frameConn, root *os.Root, rel string, offset int64) error {
+	f, err := root.OpenFile(rel, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.Size() < offset {
+		err = fmt.Errorf("cannot resume %s at %d, it only has %d bytes", rel, offset, fi.Size())
+	}
+	if err == nil {
+		err = f.Truncate(offset)
+	}
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err == nil {
+		err = fc.sendJSON(frameOK, protocolReply{Size: offset})
+	}
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	target := &acknowledgingTarget{f: f, fc: fc, durable: offset}
+	err = s.transfer(&frameSource{fc: fc}, target, fc)
+	if err != nil {
+		return err
+	}
+	return fc.sendOffset(frameDone, target.durable)
+}
+
+// transfer moves everything from source to target with
+// a Reader & Writer, as a local copy does, returning any
+// error with which either failed. If the Reader fails
+// (e.g. the client disconnected), the Writer is left to
+// write what was read. If the Writer fails, the session
+// on fc is ended, so that the Reader fails too,
+// and the target closed if it wasn't already.
+func (s *Server) transfer(source rsource, target wtarget, fc *frameConn) error {
+	b := NewBuffer(s.bufferSizeBytes)
+	readerDone := make(chan struct{})
+	writerDone := make(chan struct{})
+	pr := NewProgressReporter(0, nil)
+	reader := NewReader(source, &b, readerDone, &pr, 0, Minimum(protocolDataBytes, s.bufferSizeBytes))
+	writer := NewWriter(target, &b, readerDone, writerDone, &pr, s.syncEachBytes)
+	readerErr := make(chan error, 1)
+	writerErr := make(chan error, 1)
+	go func() { readerErr <- recovered(reader.Start) }()
+	go func() { writerErr <- recovered(writer.Start) }()
+	select {
+	case err := <-readerErr:
+		if err != nil {
+			close(readerDone)
+		}
+		return errors.Join(err, <-writerErr)
+	case err := <-writerErr:
+		if err == nil {
+			// the Reader finished first, it's just not returned yet
+			return <-readerErr
+		}
+		abort(target)
+		_ = fc.send(frameError, []byte(err.Error()))
+		_ = fc.rwc.Close()
+		// the Reader may be waiting for room in the buffer
+		for {
+			select {
+			case <-readerErr:
+				return err
+			default:
+				_, _ = b.Pop()
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+}
+
+// recovered calls f, returning what it panics with as an error
+func recovered(f func()) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	f()
+	return nil
+}
+
+// openedSource is an rsource reading from a file
+// which has already been opened (e.g. to check it)
+type openedSource struct {
+	f *os.File
+}
+
+// Open implements rsource on openedSource,
+// the file is already open so this does nothing
+func (o *openedSource) Open() error {
+	return nil
+}
+
+// Read implements rsource on openedSource
+func (o *openedSource) Read(b []byte) (int, error) {
+	return o.f.Read(b)
+}
+
+// Close implements rsource on openedSource
+func (o *openedSource) Close() error {
+	return o.f.Close()
+}
+
+// frameSource is an rsource reading the data sent by the
+// client in a session, checking it against its checksums
+type frameSource struct {
+	fc      *frameConn
+	pending []byte
+}
+
+// Open implements rsource on frameSource,
+// the session is already open so this does nothing
+func (fs *frameSource) Open() error {
+	return nil
+}
+
+// Read implements rsource on frameSource,
+// returning io.EOF when the client ends
+func (fs *frameSource) Read(b []byte) (int, error) {
+	for len(fs.pending) == 0 {
+		t, p, err := fs.fc.receive()
+		if err != nil {
+			return 0, err
+		}
+		if t == frameEnd {
+			return 0, io.EOF
+		}
+		if t != frameData {
+			return 0, fmt.Errorf("expected data, received frame %c", t)
+		}
+		fs.pending, err = dataOf(p)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, fs.pending)
+	fs.pending = fs.pending[n:]
+	return n, nil
+}
+
+// Close implements rsource on frameSource, the
+// session is closed once finished, so this does nothing
+func (fs *frameSource) Close() error {
+	return nil
+}
+
+// frameTarget is a wtarget sending the data
+// written to the client in a session
+type frameTarget struct {
+	fc *frameConn
+}
+
+// Initialise implements wtarget on frameTarget,
+// the session is already open so this does nothing
+func (ft *frameTarget) Initialise() error {
+	return nil
+}
+
+// Write implements wtarget on frameTarget
+func (ft *frameTarget) Write(b []byte) (int, error) {
+	err := ft.fc.sendData(b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Sync implements wtarget on frameTarget, the
+// client has the bytes once sent, so this does nothing
+func (ft *frameTarget) Sync() error {
+	return nil
+}
+
+// Close implements wtarget on frameTarget, telling
+// the client that everything has been sent
+func (ft *frameTarget) Close() error {
+	return ft.fc.send(frameEnd, nil)
+}
+
+// Abort implements aborter on frameTarget, the client
+// is sent the error instead of the end of the file
+// (see Server.transfer), so this does nothing
+func (ft *frameTarget) Abort() error {
+	return nil
+}
+
+// acknowledgingTarget is a wtarget writing to a file, which
+// tells the client the offset up to which the file is durable
+// each time it's flushed to disk
+type acknowledgingTarget struct {
+	f       *os.File
+	fc      *frameConn
+	durable int64
+}
+
+// Initialise implements wtarget on acknowledgingTarget,
+// the file is already open so this does nothing
+func (at *acknowledgingTarget) Initialise() error {
+	return nil
+}
+
+// Write implements wtarget on acknowledgingTarget
+func (at *acknowledgingTarget) Write(b []byte) (int, error) {
+	return at.f.Write(b)
+}
+
+// Sync implements wtarget on acknowledgingTarget, flushing
+// the file to disk & acknowledging that it's durable
+func (at *acknowledgingTarget) Sync() error {
+	position, err := at.f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		err = at.f.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	at.durable = position
+	// the client may be gone, it'll resume from what it last heard
+	_ = at.fc.sendOffset(frameSynced, position)
+	return nil
+}
+
+// Close implements wtarget on acknowledgingTarget,
+// flushing the file to disk before closing it
+func (at *acknowledgingTarget) Close() error {
+	err := at.Sync()
+	if err != nil {
+		_ = at.f.Close()
+		return err
+	}
+	return at.f.Close()
+}
+
+// Abort implements aborter on acknowledgingTarget,
+// closing the file, which may already be closed,
+// acknowledging nothing more
+func (at *acknowledgingTarget) Abort() error {
+	return at.f.Close()
+}
@@ -0,0 +1,618 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpAttempts is how many times connecting to an sftp
+// server is attempted before giving up on the transfer
+const sftpAttempts = 5
+
+// defaultSSHKeys are the private keys, relative to the
+// home directory, tried when no key file is given
+var defaultSSHKeys = []string{".ssh/id_ed25519", ".ssh/id_ecdsa", ".ssh/id_rsa"}
+
+// IsSFTP returns true if path is an sftp URL
+func IsSFTP(path string) bool {
+	return strings.HasPrefix(path, "sftp://")
+}
+
+// sftpConnection is a connection to an sftp server,
+// which can be re-established if it drops
+type sftpConnection struct {
+	address string
+	config  *ssh.ClientConfig
+	ssh     *ssh.Client
+	client  *sftp.Client
+	// noFsync is set once the server is found
+	// to not support fsync@openssh.com
+	noFsync bool
+}
+
+// newSFTPConnection prepares (but doesn't yet make) a connection
+// to the server in u, authenticating as the user in u with the
+// password in u if any, the keys held by the ssh agent, and the
+// key file in eo (or the default keys if there isn't one)
+// and checking the server's key against the known hosts in eo
+// (or ~/.ssh/known_hosts if there are none)
+func newSFTPConnection(u *url.URL, eo EndpointOptions) (*sftpConnection, error) {
+	home, _ := os.UserHomeDir()
+	knownHostsFile := eo.SSHKnownHostsFile
+	if knownHostsFile == "" {
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known hosts to check %s against: %w", u.Host, err)
+	}
+	auth := make([]ssh.AuthMethod, 0)
+	if password, ok := u.User.Password(); ok {
+		auth = append(auth, ssh.Password(password))
+	}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		conn, err := net.Dial("unix", socket)
+		if err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		} else {
+			log.Printf("WARNING: could not connect to ssh agent at %s: %v", socket, err)
+		}
+	}
+	keyFiles := []string{eo.SSHKeyFile}
+	if eo.SSHKeyFile == "" {
+		keyFiles = make([]string, 0, len(defaultSSHKeys))
+		for _, k := range defaultSSHKeys {
+			keyFiles = append(keyFiles, filepath.Join(home, k))
+		}
+	}
+	signers, err := sshSigners(keyFiles, eo.SSHKeyFile != "")
+	if err != nil {
+		return nil, err
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	user := u.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "22")
+	}
+	return &sftpConnection{
+		address: address,
+		config: &ssh.ClientConfig{
+			User:              user,
+			Auth:              auth,
+			HostKeyCallback:   hostKeyCallback,
+			HostKeyAlgorithms: knownHostKeyAlgorithms(hostKeyCallback, address),
+			Timeout:           30 * time.Second,
+		},
+	}, nil
+}
+
+// knownHostKeyAlgorithms returns the algorithms of the keys which
+// callback knows for the server at address, so that the server is
+// asked for one of those rather than any other keys it has, or nil
+// (any algorithm) if the server isn't known, to fail checking it
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, address string) []string {
+	var keyErr *knownhosts.KeyError
+	err := callback(address, &net.TCPAddr{IP: net.IPv4zero}, unknownKey{})
+	if !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+		return nil
+	}
+	algorithms := make([]string, 0, len(keyErr.Want))
+	for _, k := range keyErr.Want {
+		if k.Key.Type() == ssh.KeyAlgoRSA {
+			// RSA keys are also used with SHA-2 signatures
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, k.Key.Type())
+	}
+	return algorithms
+}
+
+// unknownKey is an ssh.PublicKey which is in no known hosts
+// file, so that checking it lists the keys which are
+type unknownKey struct{}
+
+// Type implements ssh.PublicKey on unknownKey
+func (unknownKey) Type() string {
+	return "unknown"
+}
+
+// Marshal implements ssh.PublicKey on unknownKey
+func (unknownKey) Marshal() []byte {
+	return []byte{}
+}
+
+// Verify implements ssh.PublicKey on unknownKey, nothing is signed by it
+func (unknownKey) Verify([]byte, *ssh.Signature) error {
+	return errors.New("unknown key signs nothing")
+}
+
+// sshSigners loads the private keys in files, skipping
+// those which don't exist or are protected by a passphrase
+// (which should be added to the agent instead) unless
+// required, in which case failing to load them is an error
+func sshSigners(files []string, required bool) ([]ssh.Signer, error) {
+	signers := make([]ssh.Signer, 0)
+	for _, f := range files {
+		pem, err := os.ReadFile(f)
+		if os.IsNotExist(err) && !required {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) && !required {
+			log.Printf("WARNING: skipping key %s, which needs a passphrase, add it to the ssh agent to use it", f)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key %s: %w", f, err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// connect connects to the server, if not already connected
+func (sc *sftpConnection) connect() error {
+	if sc.client != nil {
+		return nil
+	}
+	sshClient, err := ssh.Dial("tcp", sc.address, sc.config)
+	if err != nil {
+		return err
+	}
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		_ = sshClient.Close()
+		return err
+	}
+	sc.ssh = sshClient
+	sc.client = client
+	return nil
+}
+
+// reconnect drops the current connection and connects
+// again, retrying with backoff up to sftpAttempts times
+func (sc *sftpConnection) reconnect() error {
+	_ = sc.Close()
+	var err error
+	for attempt := 0; attempt < sftpAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(100<<attempt) * time.Millisecond)
+		}
+		err = sc.connect()
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to reconnect to %s after %d attempts: %w", sc.address, sftpAttempts, err)
+}
+
+// Close closes the connection, if connected
+func (sc *sftpConnection) Close() error {
+	if sc.client == nil {
+		return nil
+	}
+	_ = sc.client.Close()
+	err := sc.ssh.Close()
+	sc.client = nil
+	sc.ssh = nil
+	return err
+}
+
+// parseSFTP splits the sftp URL raw into the URL itself and
+// the path on the server, which is absolute unless it
+// starts with /~/, when it's relative to the home directory
+func parseSFTP(raw string) (*url.URL, string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Host == "" {
+		return nil, "", fmt.Errorf("sftp URL %s has no host", raw)
+	}
+	return u, strings.TrimPrefix(u.Path, "/~/"), nil
+}
+
+// sftpSource is an rsource reading a file from an sftp
+// server, reconnecting and resuming from where it got
+// to if the connection drops
+type sftpSource struct {
+	url    string
+	eo     EndpointOptions
+	path   string
+	conn   *sftpConnection
+	f      *sftp.File
+	offset int64
+	drops  int
+}
+
+// NewSFTPSource creates a new source reading
+// from the sftp URL url, accessed as per eo
+func NewSFTPSource(url string, eo EndpointOptions) *sftpSource {
+	return &sftpSource{url: url, eo: eo}
+}
+
+// connect connects to the server, if not already connected
+func (ss *sftpSource) connect() error {
+	if ss.conn == nil {
+		u, path, err := parseSFTP(ss.url)
+		if err != nil {
+			return err
+		}
+		ss.path = path
+		ss.conn, err = newSFTPConnection(u, ss.eo)
+		if err != nil {
+			return err
+		}
+	}
+	return ss.conn.connect()
+}
+
+// Size returns the size of the file on the server
+func (ss *sftpSource) Size() (uint64, error) {
+	err := ss.connect()
+	if err != nil {
+		return 0, err
+	}
+	fi, err := ss.conn.client.Stat(ss.path)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(fi.Size()), nil
+}
+
+// Open implements rsource on sftpSource
+func (ss *sftpSource) Open() error {
+	err := ss.connect()
+	if err != nil {
+		return err
+	}
+	ss.f, err = ss.conn.client.Open(ss.path)
+	return err
+}
+
+// Read implements rsource on sftpSource, reconnecting
+// and continuing from the current offset if it fails
+func (ss *sftpSource) Read(b []byte) (int, error) {
+	n, err := ss.f.Read(b)
+	ss.offset += int64(n)
+	if err == nil || n > 0 {
+		ss.drops = 0
+		return n, nil
+	}
+	if err == io.EOF {
+		return 0, io.EOF
+	}
+	ss.drops++
+	if ss.drops > sftpAttempts {
+		return 0, fmt.Errorf("connection to %s dropped %d times without progress: %w", ss.url, ss.drops, err)
+	}
+	log.Printf("WARNING: reading %s failed at byte %d (%v), resuming", ss.url, ss.offset, err)
+	err = ss.conn.reconnect()
+	if err != nil {
+		return 0, err
+	}
+	ss.f, err = ss.conn.client.Open(ss.path)
+	if err != nil {
+		return 0, err
+	}
+	_, err = ss.f.Seek(ss.offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	return ss.Read(b)
+}
+
+// Close implements rsource on sftpSource,
+// closing the file & the connection
+func (ss *sftpSource) Close() error {
+	if ss.f != nil {
+		_ = ss.f.Close()
+	}
+	return ss.conn.Close()
+}
+
+// sftpTarget is a wtarget writing a file on an sftp server,
+// reconnecting and resuming from where it got to if the
+// connection drops, and flushing to the server's storage
+// with the fsync@openssh.com extension
+type sftpTarget struct {
+	url    string
+	eo     EndpointOptions
+	path   string
+	conn   *sftpConnection
+	shared bool
+	f      *sftp.File
+	offset int64
+}
+
+// NewSFTPTarget creates a new target writing
+// to the sftp URL url, accessed as per eo
+func NewSFTPTarget(url string, eo EndpointOptions) *sftpTarget {
+	return &sftpTarget{url: url, eo: eo}
+}
+
+// Initialise implements wtarget on sftpTarget, connecting and
+// replacing any existing file at the path with an empty one
+func (st *sftpTarget) Initialise() error {
+	if st.conn == nil {
+		u, path, err := parseSFTP(st.url)
+		if err != nil {
+			return err
+		}
+		st.path = path
+		st.conn, err = newSFTPConnection(u, st.eo)
+		if err != nil {
+			return err
+		}
+	}
+	err := st.conn.connect()
+	if err != nil {
+		return err
+	}
+	st.f, err = st.conn.client.OpenFile(st.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	return err
+}
+
+// Write implements wtarget on sftpTarget. Writes are acknowledged
+// by the server, so if the connection fails it reconnects and
+// writes b again from the end of the last acknowledged write.
+// Errors from the server itself (e.g. no space) aren't retried.
+func (st *sftpTarget) Write(b []byte) (int, error) {
+	var err error
+	for attempt := 0; attempt < sftpAttempts; attempt++ {
+		if attempt > 0 {
+			log.Printf("WARNING: writing %s failed at byte %d (%v), resuming", st.url, st.offset, err)
+			err = st.resume()
+			if err != nil {
+				return 0, err
+			}
+		}
+		_, err = st.f.Write(b)
+		if err == nil {
+			st.offset += int64(len(b))
+			return len(b), nil
+		}
+		if !isConnectionError(err) {
+			return 0, fmt.Errorf("writing %s failed: %w", st.url, err)
+		}
+	}
+	return 0, fmt.Errorf("writing %s failed %d times: %w", st.url, sftpAttempts, err)
+}
+
+// isConnectionError returns whether err is from the connection to
+// an sftp server failing, rather than the server refusing a request
+func isConnectionError(err error) bool {
+	var ne net.Error
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) ||
+		errors.Is(err, sftp.ErrSSHFxNoConnection) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.As(err, &ne)
+}
+
+// resume reconnects and reopens the file
+// (without truncating it) at the current offset
+func (st *sftpTarget) resume() error {
+	err := st.conn.reconnect()
+	if err != nil {
+		return err
+	}
+	st.f, err = st.conn.client.OpenFile(st.path, os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	_, err = st.f.Seek(st.offset, io.SeekStart)
+	return err
+}
+
+// Sync implements wtarget on sftpTarget with the fsync@openssh.com
+// extension. If the server doesn't support it, there's no way to
+// know that what it has received is durable, so a warning is
+// logged (once per connection) and nothing is done.
+func (st *sftpTarget) Sync() error {
+	if st.conn.noFsync {
+		return nil
+	}
+	err := st.f.Sync()
+	var se *sftp.StatusError
+	if errors.As(err, &se) && se.FxCode() == sftp.ErrSSHFxOpUnsupported {
+		log.Printf("WARNING: %s does not support fsync, cannot ensure written bytes are on disk", st.conn.address)
+		st.conn.noFsync = true
+		return nil
+	}
+	return err
+}
+
+// Close implements wtarget on sftpTarget, syncing and
+// closing the file, then closing the connection
+// unless it is shared with a tree target
+func (st *sftpTarget) Close() error {
+	err := st.Sync()
+	if err != nil {
+		_ = st.Abort()
+		return err
+	}
+	err = st.f.Close()
+	if err != nil {
+		return err
+	}
+	if st.shared {
+		return nil
+	}
+	return st.conn.Close()
+}
+
+// Abort implements aborter on sftpTarget, closing the
+// file & connection (unless shared) without syncing
+func (st *sftpTarget) Abort() error {
+	err := st.f.Close()
+	if st.shared {
+		return err
+	}
+	return errors.Join(err, st.conn.Close())
+}
+
+// sftpTreeTarget is a treeTarget under the
+// directory root on an sftp server
+type sftpTreeTarget struct {
+	url  string
+	root string
+	eo   EndpointOptions
+	conn *sftpConnection
+}
+
+// NewSFTPTreeTarget creates a new target for a tree of files
+// under the directory at the sftp URL root, accessed as per eo
+func NewSFTPTreeTarget(root string, eo EndpointOptions) *sftpTreeTarget {
+	return &sftpTreeTarget{url: strings.TrimSuffix(root, "/"), eo: eo}
+}
+
+// remote returns the path on the server for path relative to
+// the root, connecting to the server if not already connected
+func (stt *sftpTreeTarget) remote(p string) (string, error) {
+	if stt.conn == nil {
+		u, root, err := parseSFTP(stt.url)
+		if err != nil {
+			return "", err
+		}
+		stt.root = root
+		stt.conn, err = newSFTPConnection(u, stt.eo)
+		if err != nil {
+			return "", err
+		}
+	}
+	err := stt.conn.connect()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(stt.root, p), nil
+}
+
+// Mkdir implements treeTarget on sftpTreeTarget
+func (stt *sftpTreeTarget) Mkdir(p string) error {
+	r, err := stt.remote(p)
+	if err != nil {
+		return err
+	}
+	return stt.conn.client.MkdirAll(r)
+}
+
+// File implements treeTarget on sftpTreeTarget,
+// the file is written over the tree's connection
+func (stt *sftpTreeTarget) File(p string, _ uint64) wtarget {
+	r, err := stt.remote(p)
+	if err != nil {
+		panic(err)
+	}
+	return &sftpTarget{url: stt.url + "/" + p, eo: stt.eo, path: r, conn: stt.conn, shared: true}
+}
+
+// Identical implements treeTarget on sftpTreeTarget, a file is
+// considered identical when its size & modification time match
+// (to the second, the resolution sftp has)
+func (stt *sftpTreeTarget) Identical(p string, info fs.FileInfo) (bool, error) {
+	r, err := stt.remote(p)
+	if err != nil {
+		return false, err
+	}
+	fi, err := stt.conn.client.Lstat(r)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	sameTime := fi.ModTime().Unix() == info.ModTime().Unix()
+	return fi.Mode().IsRegular() && fi.Size() == info.Size() && sameTime, nil
+}
+
+// Existing implements inspectableTreeTarget on sftpTreeTarget
+func (stt *sftpTreeTarget) Existing(p string) (fs.FileInfo, error) {
+	r, err := stt.remote(p)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := stt.conn.client.Lstat(r)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return fi, err
+}
+
+// SHA256 implements inspectableTreeTarget on sftpTreeTarget,
+// reading the whole file over the tree's connection
+func (stt *sftpTreeTarget) SHA256(p string) ([]byte, error) {
+	r, err := stt.remote(p)
+	if err != nil {
+		return nil, err
+	}
+	f, err := stt.conn.client.Open(r)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Symlink implements treeTarget on sftpTreeTarget,
+// replacing anything which is already at path
+func (stt *sftpTreeTarget) Symlink(p string, link string) error {
+	r, err := stt.remote(p)
+	if err != nil {
+		return err
+	}
+	err = stt.conn.client.Remove(r)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return stt.conn.client.Symlink(link, r)
+}
+
+// Finish implements treeTarget on sftpTreeTarget,
+// preserving permissions & the modification time
+func (stt *sftpTreeTarget) Finish(p string, info fs.FileInfo) error {
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+	r, err := stt.remote(p)
+	if err != nil {
+		return err
+	}
+	err = stt.conn.client.Chmod(r, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	return stt.conn.client.Chtimes(r, time.Now(), info.ModTime())
+}
@@ -0,0 +1,292 @@
+package internal_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"github.com/snasphysicist/go-copy/pkg/random"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpServer is an in-process ssh server serving sftp
+// from the local filesystem, to keys in its authorised keys
+type sftpServer struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+	// unknownHostKey is another host key, of a type clients
+	// prefer, which isn't in the known hosts
+	unknownHostKey ssh.Signer
+	authorised     ssh.PublicKey
+	// dropAfter, if not 0, is the number of bytes after which
+	// the first connection to the server is dropped
+	dropAfter   int64
+	connections int32
+}
+
+// newSFTPServer starts an sftp server, accepting connections
+// authenticated with the key written to the returned file,
+// whose host key is in the returned known hosts file
+func newSFTPServer(t *testing.T, dropAfter int64) (*sftpServer, internal.EndpointOptions) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	_, hostPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, _ := ssh.NewSignerFromKey(hostPrivate)
+	unknownPrivate, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	unknownHostKey, _ := ssh.NewSignerFromKey(unknownPrivate)
+	clientPublic, clientPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	authorised, _ := ssh.NewPublicKey(clientPublic)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen with %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	s := &sftpServer{listener: listener, hostKey: hostKey, unknownHostKey: unknownHostKey, authorised: authorised, dropAfter: dropAfter}
+	go s.serve()
+
+	dir := t.TempDir()
+	block, _ := ssh.MarshalPrivateKey(clientPrivate, "")
+	keyFile := filepath.Join(dir, "id_ed25519")
+	mustWrite(t, dir, "id_ed25519", string(pem.EncodeToMemory(block)))
+	mustWrite(t, dir, "known_hosts", knownhosts.Line([]string{listener.Addr().String()}, hostKey.PublicKey())+"\n")
+	return s, internal.EndpointOptions{SSHKeyFile: keyFile, SSHKnownHostsFile: filepath.Join(dir, "known_hosts")}
+}
+
+// url returns the sftp URL of the absolute path on the server
+func (s *sftpServer) url(path string) string {
+	return "sftp://tester@" + s.listener.Addr().String() + filepath.ToSlash(path)
+}
+
+// serve accepts connections until the listener is closed
+func (s *sftpServer) serve() {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), s.authorised.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(s.hostKey)
+	config.AddHostKey(s.unknownHostKey)
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn, config)
+	}
+}
+
+// handle serves sftp on the sessions of the connection conn
+func (s *sftpServer) handle(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	first := atomic.AddInt32(&s.connections, 1) == 1
+	for nc := range channels {
+		if nc.ChannelType() != "session" {
+			_ = nc.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, requests, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				isSFTP := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(isSFTP, nil)
+				if !isSFTP {
+					continue
+				}
+				var rwc io.ReadWriteCloser = channel
+				if first && s.dropAfter != 0 {
+					rwc = &droppingChannel{Channel: channel, conn: serverConn, remaining: s.dropAfter}
+				}
+				server, _ := sftp.NewServer(rwc)
+				_ = server.Serve()
+				_ = server.Close()
+			}
+		}()
+	}
+}
+
+// droppingChannel drops the connection conn once
+// remaining bytes have passed through the channel
+type droppingChannel struct {
+	ssh.Channel
+	conn      *ssh.ServerConn
+	remaining int64
+}
+
+// count drops the connection if n more bytes
+// having passed means there are none remaining
+func (dc *droppingChannel) count(n int) {
+	if atomic.AddInt64(&dc.remaining, -int64(n)) <= 0 {
+		_ = dc.conn.Close()
+	}
+}
+
+// Read implements io.Reader on droppingChannel
+func (dc *droppingChannel) Read(b []byte) (int, error) {
+	n, err := dc.Channel.Read(b)
+	dc.count(n)
+	return n, err
+}
+
+// Write implements io.Writer on droppingChannel
+func (dc *droppingChannel) Write(b []byte) (int, error) {
+	n, err := dc.Channel.Write(b)
+	dc.count(n)
+	return n, err
+}
+
+func TestSFTPSourceReadsContentAndReportsSize(t *testing.T) {
+	server, eo := newSFTPServer(t, 0)
+	content := random.Bytes(300000)
+	path := filepath.Join(t.TempDir(), "file.bin")
+	_ = os.WriteFile(path, content, 0644)
+	ss := internal.NewSFTPSource(server.url(path), eo)
+	size, err := ss.Size()
+	if err != nil {
+		t.Fatalf("Failed to get size with %v", err)
+	}
+	if size != uint64(len(content)) {
+		t.Errorf("Size reported as %d, expected %d", size, len(content))
+	}
+	read := readAll(t, ss)
+	if !bytes.Equal(content, read) {
+		t.Error("Content read did not match content on server")
+	}
+}
+
+func TestSFTPSourceResumesWhenConnectionDrops(t *testing.T) {
+	server, eo := newSFTPServer(t, 200000)
+	content := random.Bytes(1000000)
+	path := filepath.Join(t.TempDir(), "file.bin")
+	_ = os.WriteFile(path, content, 0644)
+	read := readAll(t, internal.NewSFTPSource(server.url(path), eo))
+	if !bytes.Equal(content, read) {
+		t.Errorf("Content read (%d bytes) did not match content on server (%d bytes)", len(read), len(content))
+	}
+	if atomic.LoadInt32(&server.connections) < 2 {
+		t.Error("Source did not reconnect to resume")
+	}
+}
+
+func TestSFTPTargetUploadsAndResumesWhenConnectionDrops(t *testing.T) {
+	for _, dropAfter := range []int64{0, 200000} {
+		server, eo := newSFTPServer(t, dropAfter)
+		content := random.Bytes(1000000)
+		path := filepath.Join(t.TempDir(), "file.bin")
+		target := internal.NewSFTPTarget(server.url(path), eo)
+		err := target.Initialise()
+		if err != nil {
+			t.Fatalf("Failed to initialise with %v", err)
+		}
+		for i := 0; i < len(content); i += 50000 {
+			_, err = target.Write(content[i : i+50000])
+			if err != nil {
+				t.Fatalf("Failed to write with %v", err)
+			}
+			// the test server doesn't support fsync, which is not an error
+			err = target.Sync()
+			if err != nil {
+				t.Fatalf("Failed to sync with %v", err)
+			}
+		}
+		err = target.Close()
+		if err != nil {
+			t.Fatalf("Failed to close with %v", err)
+		}
+		uploaded, _ := os.ReadFile(path)
+		if !bytes.Equal(content, uploaded) {
+			t.Errorf("Uploaded content (%d bytes) dropping after %d did not match written content", len(uploaded), dropAfter)
+		}
+	}
+}
+
+func TestSFTPRefusesServerNotInKnownHosts(t *testing.T) {
+	server, eo := newSFTPServer(t, 0)
+	other, _ := newSFTPServer(t, 0)
+	eo.SSHKnownHostsFile = filepath.Join(t.TempDir(), "known_hosts")
+	mustWrite(t, filepath.Dir(eo.SSHKnownHostsFile), "known_hosts",
+		knownhosts.Line([]string{server.listener.Addr().String()}, other.hostKey.PublicKey())+"\n")
+	err := internal.NewSFTPSource(server.url("/etc/hostname"), eo).Open()
+	if err == nil {
+		t.Error("No error connecting to server whose key does not match known hosts")
+	}
+}
+
+func TestSFTPChecksServerKeyOfTypeInKnownHosts(t *testing.T) {
+	server, eo := newSFTPServer(t, 0)
+	err := internal.NewSFTPSource(server.url("/etc/hostname"), eo).Open()
+	if err != nil {
+		t.Errorf("Failed to connect to server with a known key & a preferred unknown one with %v", err)
+	}
+}
+
+func TestSFTPTargetDoesNotRetryErrorsFromServer(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skipf("No /dev/full to run out of space writing to: %v", err)
+	}
+	server, eo := newSFTPServer(t, 0)
+	target := internal.NewSFTPTarget(server.url("/dev/full"), eo)
+	err := target.Initialise()
+	if err != nil {
+		t.Fatalf("Failed to initialise with %v", err)
+	}
+	_, err = target.Write(random.Bytes(1000))
+	if err == nil {
+		t.Error("No error writing to a full device")
+	}
+	if connections := atomic.LoadInt32(&server.connections); connections != 1 {
+		t.Errorf("Connected %d times, expected no reconnecting to retry", connections)
+	}
+}
+
+func TestSFTPTreeTargetCreatesDirectoriesAndDetectsIdenticalFiles(t *testing.T) {
+	server, eo := newSFTPServer(t, 0)
+	remote := filepath.Join(t.TempDir(), "backup")
+	target := internal.TreeTargetFor(server.url(remote), eo)
+	err := target.Mkdir("sub")
+	if err != nil {
+		t.Fatalf("Failed to create directory with %v", err)
+	}
+	local := t.TempDir()
+	mustWrite(t, local, "f.bin", "content")
+	past := time.Now().Add(-time.Hour)
+	_ = os.Chtimes(local+"/f.bin", past, past)
+	localInfo, _ := os.Stat(local + "/f.bin")
+	identical, err := target.Identical("sub/f.bin", localInfo)
+	if err != nil || identical {
+		t.Errorf("Missing file identical %t (error %v), expected false", identical, err)
+	}
+	err = uploadTo(t, target.File("sub/f.bin", 7), []byte("content"))
+	if err != nil {
+		t.Fatalf("Failed to upload with %v", err)
+	}
+	err = target.Finish("sub/f.bin", localInfo)
+	if err != nil {
+		t.Fatalf("Failed to finish with %v", err)
+	}
+	identical, err = target.Identical("sub/f.bin", localInfo)
+	if err != nil || !identical {
+		t.Errorf("Uploaded file identical %t (error %v), expected true", identical, err)
+	}
+}
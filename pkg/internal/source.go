@@ -3,6 +3,7 @@ package internal
 import (
 	"io"
 	"os"
+	"syscall"
 )
 
 // SourceFile represents a file as a source
@@ -19,8 +20,13 @@ func NewSourceFile(path string) SourceFile {
 }
 
 // Open attempts to open the file for reading
-// at sf.path, returning an error when this fails
+// at sf.path, returning an error when this fails.
+// If sf.path is StandardStream, stdin is read instead.
 func (sf *SourceFile) Open() error {
+	if sf.path == StandardStream {
+		sf.rc = os.Stdin
+		return nil
+	}
 	rc, err := os.Open(sf.path)
 	sf.rc = rc
 	return err
@@ -32,8 +38,70 @@ func (sf *SourceFile) Read(b []byte) (int, error) {
 	return sf.rc.Read(b)
 }
 
+// Seek implements io.Seeker on SourceFile, passing through to
+// the underlying file, so that reads can be retried from where
+// they failed. Stdin can't be sought, as it may not have been
+// at its start, so this fails with syscall.ESPIPE as for a pipe.
+func (sf *SourceFile) Seek(offset int64, whence int) (int64, error) {
+	f, ok := sf.rc.(*os.File)
+	if !ok || sf.path == StandardStream {
+		return 0, syscall.ESPIPE
+	}
+	return f.Seek(offset, whence)
+}
+
 // Close implements io.ReadCloser on SourceFile,
 // passes through to Close on the underlying file
 func (sf *SourceFile) Close() error {
 	return sf.rc.Close()
 }
+
+// Size returns the size of the file in bytes as
+// reported by the os, or 0 for stdin, whose size
+// can't be known
+func (sf *SourceFile) Size() (uint64, error) {
+	if sf.path == StandardStream {
+		return 0, nil
+	}
+	return SizeOf(sf.path), nil
+}
+
+// ExactSize implements exactSizer on SourceFile, the size of
+// a regular file being exact, unlike that of stdin or /proc files
+func (sf *SourceFile) ExactSize() (uint64, bool, error) {
+	if sf.path == StandardStream {
+		return 0, false, nil
+	}
+	info, err := os.Stat(sf.path)
+	if err != nil {
+		return 0, false, err
+	}
+	return uint64(info.Size()), info.Mode().IsRegular() && info.Size() > 0, nil
+}
+
+// SourceFor returns the source to read from for the given
+// path, as given by the user, which may be a local file,
+// StandardStream, an http(s) URL, an sftp URL, an s3 URL,
+// a gocopy(s) or ssh URL or a member of a local zip archive
+// (archive.zip!/member)
+func SourceFor(path string, eo EndpointOptions) rsource {
+	if IsHTTP(path) {
+		return NewHTTPSource(path, eo.HTTPSegments, eo.HTTPHeader)
+	}
+	if IsSFTP(path) {
+		return NewSFTPSource(path, eo)
+	}
+	if IsS3(path) {
+		return NewS3Source(path, eo)
+	}
+	if IsGoCopy(path) || IsSSH(path) {
+		return NewGoCopySource(path, eo)
+	}
+	if IsZipMember(path) {
+		return NewZipMemberSource(path)
+	}
+	if IsBlockDevice(path) {
+		return NewDeviceSource(path)
+	}
+	return From(NewSourceFile(path))
+}
@@ -0,0 +1,6 @@
+package internal
+
+// StandardStream is the path which, given as a
+// source, means read from stdin and, given as a
+// target, means write to stdout
+const StandardStream = "-"
@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"archive/tar"
+	"bufio"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tarSuffixes are the file name suffixes of tar archives,
+// with the compression they imply (empty for none)
+var tarSuffixes = map[string]string{
+	".tar":     "",
+	".tar.gz":  Gzip,
+	".tgz":     Gzip,
+	".tar.zst": Zstd,
+	".tar.xz":  Xz,
+}
+
+// IsTar returns true if path names a tar archive
+// (possibly compressed) by its suffix
+func IsTar(path string) bool {
+	_, ok := TarCompression(path)
+	return ok
+}
+
+// TarCompression returns the compression implied by the suffix
+// of path (one of Compressions, or empty for none), and
+// false if path doesn't name a tar archive at all
+func TarCompression(path string) (string, bool) {
+	lower := strings.ToLower(path)
+	for suffix, compression := range tarSuffixes {
+		if strings.HasSuffix(lower, suffix) {
+			return compression, true
+		}
+	}
+	return "", false
+}
+
+// tarSource is an rsource which reads a tar archive of the entries
+// in a tree of local files, written as it's read
+type tarSource struct {
+	root    string
+	entries []TreeEntry
+	mtime   *time.Time
+	r       *io.PipeReader
+}
+
+// NewTarSource creates a source reading a tar archive of entries,
+// found under the local directory root by WalkTree, in order.
+// If mtime is not nil, every entry gets it as its modification
+// time & no owner, so that archives of the same files are identical.
+func NewTarSource(root string, entries []TreeEntry, mtime *time.Time) *tarSource {
+	return &tarSource{root: root, entries: entries, mtime: mtime}
+}
+
+// Size implements sizer on tarSource, estimating the size of
+// the archive from the size of the entries & their headers
+func (ts *tarSource) Size() (uint64, error) {
+	// two empty blocks end the archive
+	size := uint64(2 * 512)
+	for _, e := range ts.entries {
+		size += 512
+		if e.Info.Mode().IsRegular() {
+			size += (uint64(e.Info.Size()) + 511) / 512 * 512
+		}
+	}
+	return size, nil
+}
+
+// Open implements rsource on tarSource, starting writing the archive
+func (ts *tarSource) Open() error {
+	r, w := io.Pipe()
+	ts.r = r
+	go func() {
+		tw := tar.NewWriter(w)
+		for _, e := range ts.entries {
+			err := ts.write(tw, e)
+			if err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+		w.CloseWithError(tw.Close())
+	}()
+	return nil
+}
+
+// write writes the entry e to tw
+func (ts *tarSource) write(tw *tar.Writer, e TreeEntry) error {
+	local := filepath.Join(ts.root, filepath.FromSlash(e.Path))
+	var link string
+	switch {
+	case e.Info.Mode()&fs.ModeSymlink != 0:
+		var err error
+		link, err = os.Readlink(local)
+		if err != nil {
+			return err
+		}
+	case !e.Info.IsDir() && !e.Info.Mode().IsRegular():
+		log.Printf("WARNING: skipping %s, which is not a file, directory or symlink", local)
+		return nil
+	}
+	header, err := tar.FileInfoHeader(e.Info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = e.Path
+	if e.Info.IsDir() {
+		header.Name += "/"
+	}
+	if ts.mtime != nil {
+		header.ModTime = *ts.mtime
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+		header.Uid, header.Gid = 0, 0
+		header.Uname, header.Gname = "", ""
+	}
+	err = tw.WriteHeader(header)
+	if err != nil || !e.Info.Mode().IsRegular() {
+		return err
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(tw, io.LimitReader(f, header.Size))
+	if err != nil {
+		return err
+	}
+	if n < header.Size {
+		// the header is already written, so the size can't change
+		log.Printf("WARNING: %s shrank while being archived, padding it with zeros", local)
+		_, err = io.CopyN(tw, zeroes{}, header.Size-n)
+		return err
+	}
+	extra, _ := f.Read(make([]byte, 1))
+	if extra > 0 {
+		log.Printf("WARNING: %s grew while being archived, only the first %d bytes were archived", local, header.Size)
+	}
+	return nil
+}
+
+// Read implements rsource on tarSource, reading the archive
+func (ts *tarSource) Read(b []byte) (int, error) {
+	return ts.r.Read(b)
+}
+
+// Close implements rsource on tarSource,
+// stopping writing the archive if not finished
+func (ts *tarSource) Close() error {
+	return ts.r.Close()
+}
+
+// zeroes is an endless reader of zero bytes
+type zeroes struct{}
+
+// Read implements io.Reader on zeroes
+func (zeroes) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+// tarArchive reads the entries of a tar archive from a source,
+// which is decompressed if it's compressed
+type tarArchive struct {
+	source rsource
+	pr     *ProgressReporter
+	r      io.ReadCloser
+	tr     *tar.Reader
+	guard  extractionGuard
+}
+
+// NewTarArchive creates a new reader of the tar archive in source,
+// the bytes consumed from the source being reported to pr, unless
+// pr is nil (e.g. when source is itself a transformation which
+// reports the bytes consumed from the original source)
+func NewTarArchive(source rsource, pr *ProgressReporter) *tarArchive {
+	return &tarArchive{source: source, pr: pr, guard: newExtractionGuard()}
+}
+
+// Open opens the source & starts reading the archive
+func (ta *tarArchive) Open() error {
+	err := ta.source.Open()
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(consumedFrom(ta.source, ta.pr))
+	ta.r = io.NopCloser(br)
+	compression, err := DetectCompression(br)
+	if err == nil {
+		ta.r, err = decompressor(compression, br)
+		if err != nil {
+			return err
+		}
+	}
+	ta.tr = tar.NewReader(ta.r)
+	return nil
+}
+
+// Next moves on to the next entry in the archive, returning it &
+// what it links to if it's a symlink, or io.EOF at the end. Entries
+// which can't be extracted (e.g. hard links) are skipped with a
+// warning, as are those which would be extracted outside of the
+// destination (e.g. through a symlink extracted earlier).
+func (ta *tarArchive) Next() (TreeEntry, string, error) {
+	for {
+		header, err := ta.tr.Next()
+		if err != nil {
+			return TreeEntry{}, "", err
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		if header.Typeflag == tar.TypeLink {
+			log.Printf("WARNING: skipping %s, a hard link to %s, as hard links can't be extracted", header.Name, header.Linkname)
+			continue
+		}
+		info := header.FileInfo()
+		p, ok := ta.guard.allow(header.Name, info)
+		if !ok {
+			continue
+		}
+		return TreeEntry{Path: p, Info: info}, header.Linkname, nil
+	}
+}
+
+// Entry returns a source reading the content of the current entry,
+// which must be read before moving on to the next entry
+func (ta *tarArchive) Entry() rsource {
+	return &archiveEntry{r: ta.tr}
+}
+
+// Close closes the archive & its source
+func (ta *tarArchive) Close() error {
+	if ta.r != nil {
+		_ = ta.r.Close()
+	}
+	return ta.source.Close()
+}
@@ -1,13 +1,17 @@
 package internal
 
-import "os"
+import (
+	"os"
+	"syscall"
+)
 
 // writingFile provides deletion,
 // creation, writing and flushing
 // on a file being written to
 type writingFile struct {
-	path string
-	f    *os.File
+	path     string
+	f        *os.File
+	syncable bool
 }
 
 // NewWritingFile provides the writingFile's
@@ -20,7 +24,13 @@ func NewWritingFile(path string) writingFile {
 // at wf.path and creates a fresh one there,
 // making it ready for writing. An error
 // is returned if deletion or creation fails.
+// If wf.path is StandardStream, stdout is
+// written to instead.
 func (wf *writingFile) Initialise() error {
+	if wf.path == StandardStream {
+		wf.f = os.Stdout
+		return wf.checkSyncable()
+	}
 	err := os.Remove(wf.path)
 	becauseFileNotExists := os.IsNotExist(err)
 	if err != nil && !becauseFileNotExists {
@@ -31,11 +41,30 @@ func (wf *writingFile) Initialise() error {
 		return err
 	}
 	wf.f = f
+	return wf.checkSyncable()
+}
+
+// checkSyncable records whether the opened file
+// is one which can be flushed to storage, pipes
+// & terminals for example cannot be
+func (wf *writingFile) checkSyncable() error {
+	fi, err := wf.f.Stat()
+	if err != nil {
+		return err
+	}
+	wf.syncable = fi.Mode().IsRegular()
 	return nil
 }
 
-// Sync calls os.File.Sync on the underlying os.File
+// Sync calls os.File.Sync on the underlying os.File.
+// When the file is not a regular file (e.g. a pipe)
+// there is no storage to flush to, the bytes
+// are already with the reader on the other end,
+// so this does nothing.
 func (wf *writingFile) Sync() error {
+	if !wf.syncable {
+		return nil
+	}
 	return wf.f.Sync()
 }
 
@@ -44,7 +73,42 @@ func (wf *writingFile) Write(b []byte) (int, error) {
 	return wf.f.Write(b)
 }
 
+// Seek exposes io.Seeker on the underlying file, so that
+// writes can be retried from where they failed. Stdout can't
+// be sought, as it may not have been at its start (e.g. when
+// appending), so this fails with syscall.ESPIPE as for a pipe.
+func (wf *writingFile) Seek(offset int64, whence int) (int64, error) {
+	if wf.path == StandardStream {
+		return 0, syscall.ESPIPE
+	}
+	return wf.f.Seek(offset, whence)
+}
+
 // Close exposes io.Closer on the underlying file
 func (wf *writingFile) Close() error {
 	return wf.f.Close()
 }
+
+// TargetFor returns the target to write to for the given path,
+// as given by the user, which may be a local file, StandardStream,
+// an sftp URL, an s3 URL, a gocopy(s) or ssh URL or an http(s) URL, for
+// which size is used as the Content-Length if it is not 0, so it must
+// be exact (see ExactSizeOf)
+func TargetFor(path string, size uint64, eo EndpointOptions) wtarget {
+	if IsHTTP(path) {
+		return NewHTTPTarget(path, size, eo.HTTPHeader)
+	}
+	if IsSFTP(path) {
+		return NewSFTPTarget(path, eo)
+	}
+	if IsS3(path) {
+		return NewS3Target(path, size, eo)
+	}
+	if IsGoCopy(path) || IsSSH(path) {
+		return NewGoCopyTarget(path, eo)
+	}
+	if IsDevice(path) {
+		return NewDeviceTarget(path, size)
+	}
+	return From(NewWritingFile(path))
+}
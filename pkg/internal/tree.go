@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TreeEntry is a file, directory or symlink
+// found in a tree of files being copied
+type TreeEntry struct {
+	// Path is the path of the entry relative to
+	// the root of the tree, with / separators
+	Path string
+	// Info describes the entry itself
+	// (not what it links to, for a symlink)
+	Info fs.FileInfo
+}
+
+// IsDir returns true if there is a directory
+// (or a link to one) at path on the local filesystem
+func IsDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// WalkTree returns all of the entries in the tree under the
+// directory root (but not root itself) in lexical order,
+// so each directory comes before its contents.
+// Symlinks are returned as they are, not followed.
+func WalkTree(root string) ([]TreeEntry, error) {
+	entries := make([]TreeEntry, 0)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, TreeEntry{Path: filepath.ToSlash(rel), Info: info})
+		return nil
+	})
+	return entries, err
+}
+
+// treeTarget is where a tree of files is copied to
+type treeTarget interface {
+	// Mkdir creates the directory at path relative
+	// to the root of the target, "" being the root
+	// itself, doing nothing if it already exists
+	Mkdir(path string) error
+	// File returns the target to write the file at path
+	// relative to the root of the target, whose size will
+	// be size (0 if not known)
+	File(path string, size uint64) wtarget
+	// Identical returns true if there is already a file
+	// at path relative to the root of the target which
+	// appears to be identical to the one described by info
+	Identical(path string, info fs.FileInfo) (bool, error)
+	// Symlink creates a symlink at path relative
+	// to the root of the target, linking to link
+	Symlink(path string, link string) error
+	// Finish applies the metadata in info to the
+	// file/directory at path relative to the root of the
+	// target, once it has been completely written
+	Finish(path string, info fs.FileInfo) error
+}
+
+// TreeTargetFor returns where to copy a tree of files to for the
+// given path, as given by the user, which may be a local directory,
+// an sftp URL of a directory, an s3 URL of a prefix or an http(s)
+// URL of a WebDAV collection. Trees can't be copied to go-copy servers.
+func TreeTargetFor(path string, eo EndpointOptions) treeTarget {
+	if IsGoCopy(path) || IsSSH(path) {
+		panic(fmt.Sprintf("Cannot copy a directory to %s, go-copy servers only accept files", path))
+	}
+	if IsHTTP(path) {
+		return NewWebDAVTreeTarget(path, eo.HTTPHeader)
+	}
+	if IsSFTP(path) {
+		return NewSFTPTreeTarget(path, eo)
+	}
+	if IsS3(path) {
+		return NewS3TreeTarget(path, eo)
+	}
+	return &localTreeTarget{root: path}
+}
+
+// Identifier is the part of a treeTarget which
+// tells whether a file in it is identical to another
+type Identifier interface {
+	Identical(path string, info fs.FileInfo) (bool, error)
+}
+
+// inspectableTreeTarget is a treeTarget which can describe the
+// files already in it in more detail than treeTarget.Identical
+type inspectableTreeTarget interface {
+	// Existing describes what's at path relative to the
+	// root of the target, nil if there's nothing there
+	Existing(path string) (fs.FileInfo, error)
+	// SHA256 returns the SHA-256 of the content of the
+	// file at path relative to the root of the target
+	SHA256(path string) ([]byte, error)
+}
+
+// UpToDate returns true if the file at path relative to the root of t
+// needn't be copied from the one described by info, because it appears
+// identical (see treeTarget.Identical), or where t can be inspected
+// (local directories & sftp), because it was modified after it or
+// (if sum is given, returning the SHA-256 of the file to be copied)
+// it's the same size & has the same SHA-256
+func UpToDate(t Identifier, path string, info fs.FileInfo, sum func() ([]byte, error)) (bool, error) {
+	identical, err := t.Identical(path, info)
+	if err != nil || identical {
+		return identical, err
+	}
+	it, ok := t.(inspectableTreeTarget)
+	if !ok {
+		return false, nil
+	}
+	existing, err := it.Existing(path)
+	if err != nil || existing == nil || !existing.Mode().IsRegular() {
+		return false, err
+	}
+	if existing.ModTime().After(info.ModTime()) {
+		return true, nil
+	}
+	if sum == nil || existing.Size() != info.Size() {
+		return false, nil
+	}
+	expected, err := sum()
+	if err != nil {
+		return false, err
+	}
+	actual, err := it.SHA256(path)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(expected, actual), nil
+}
+
+// ExistingManifestFile returns the entry in a manifest of the file at
+// path relative to the root of t as it already is there, hashing it,
+// ok being false if t can't be inspected (see UpToDate) or it's not a file
+func ExistingManifestFile(t Identifier, path string) (f ManifestFile, ok bool, err error) {
+	it, inspectable := t.(inspectableTreeTarget)
+	if !inspectable {
+		return ManifestFile{}, false, nil
+	}
+	existing, err := it.Existing(path)
+	if err != nil || existing == nil || !existing.Mode().IsRegular() {
+		return ManifestFile{}, false, err
+	}
+	sum, err := it.SHA256(path)
+	if err != nil {
+		return ManifestFile{}, false, err
+	}
+	return ManifestFileOf(TreeEntry{Path: path, Info: existing}, sum), true, nil
+}
+
+// localTreeTarget is a treeTarget in the local
+// filesystem, under the directory root
+type localTreeTarget struct {
+	root string
+}
+
+// local returns the local path for path relative to the root
+func (ltt *localTreeTarget) local(path string) string {
+	return filepath.Join(ltt.root, filepath.FromSlash(path))
+}
+
+// Mkdir implements treeTarget on localTreeTarget
+func (ltt *localTreeTarget) Mkdir(path string) error {
+	return os.MkdirAll(ltt.local(path), 0755)
+}
+
+// File implements treeTarget on localTreeTarget
+func (ltt *localTreeTarget) File(path string, _ uint64) wtarget {
+	return From(NewWritingFile(ltt.local(path)))
+}
+
+// Identical implements treeTarget on localTreeTarget, a file is
+// considered identical when its size & modification time match
+func (ltt *localTreeTarget) Identical(path string, info fs.FileInfo) (bool, error) {
+	fi, err := os.Lstat(ltt.local(path))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return fi.Mode().IsRegular() && fi.Size() == info.Size() && fi.ModTime().Equal(info.ModTime()), nil
+}
+
+// Existing implements inspectableTreeTarget on localTreeTarget
+func (ltt *localTreeTarget) Existing(path string) (fs.FileInfo, error) {
+	fi, err := os.Lstat(ltt.local(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return fi, err
+}
+
+// SHA256 implements inspectableTreeTarget on localTreeTarget
+func (ltt *localTreeTarget) SHA256(path string) ([]byte, error) {
+	sum, _, err := SHA256File(ltt.local(path), func(uint64) {})
+	return sum, err
+}
+
+// Symlink implements treeTarget on localTreeTarget,
+// replacing anything which is already at path
+func (ltt *localTreeTarget) Symlink(path string, link string) error {
+	err := os.Remove(ltt.local(path))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(link, ltt.local(path))
+}
+
+// Finish implements treeTarget on localTreeTarget,
+// preserving permissions & the modification time
+func (ltt *localTreeTarget) Finish(path string, info fs.FileInfo) error {
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+	err := os.Chmod(ltt.local(path), info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(ltt.local(path), time.Now(), info.ModTime())
+}
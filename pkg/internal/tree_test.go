@@ -0,0 +1,107 @@
+package internal_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+)
+
+// mustWrite writes content to path under dir,
+// creating any parent directories, failing the test on error
+func mustWrite(t *testing.T, dir string, path string, content string) {
+	full := filepath.Join(dir, filepath.FromSlash(path))
+	err := os.MkdirAll(filepath.Dir(full), 0755)
+	if err != nil {
+		t.Fatalf("Failed to create directory for %s with %v", path, err)
+	}
+	err = os.WriteFile(full, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write %s with %v", path, err)
+	}
+}
+
+func TestWalkTreeReturnsEntriesInLexicalOrderDirectoriesFirst(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite(t, dir, "b/c.txt", "c")
+	mustWrite(t, dir, "a.txt", "a")
+	mustWrite(t, dir, "b/a/d.txt", "d")
+	entries, err := internal.WalkTree(dir)
+	if err != nil {
+		t.Fatalf("Failed to walk tree with %v", err)
+	}
+	paths := make([]string, 0)
+	for _, e := range entries {
+		paths = append(paths, e.Path)
+	}
+	expected := []string{"a.txt", "b", "b/a", "b/a/d.txt", "b/c.txt"}
+	if !reflect.DeepEqual(expected, paths) {
+		t.Errorf("Walked %v, expected %v", paths, expected)
+	}
+}
+
+func TestLocalTreeTargetFileIsIdenticalOnlyOnceFinished(t *testing.T) {
+	from := t.TempDir()
+	mustWrite(t, from, "f.txt", "content")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	err := os.Chtimes(filepath.Join(from, "f.txt"), mtime, mtime)
+	if err != nil {
+		t.Fatalf("Failed to set modification time with %v", err)
+	}
+	info, _ := os.Stat(filepath.Join(from, "f.txt"))
+	to := t.TempDir()
+	target := internal.TreeTargetFor(to, internal.EndpointOptions{})
+	identical, err := target.Identical("f.txt", info)
+	if err != nil || identical {
+		t.Errorf("Missing file identical %t (error %v), expected false", identical, err)
+	}
+	mustWrite(t, to, "f.txt", "content")
+	identical, err = target.Identical("f.txt", info)
+	if err != nil || identical {
+		t.Errorf("File with different modification time identical %t (error %v), expected false", identical, err)
+	}
+	err = target.Finish("f.txt", info)
+	if err != nil {
+		t.Fatalf("Failed to finish with %v", err)
+	}
+	identical, err = target.Identical("f.txt", info)
+	if err != nil || !identical {
+		t.Errorf("Finished file identical %t (error %v), expected true", identical, err)
+	}
+}
+
+func TestUpToDateSkipsNewerAndSameContentOnlyWhenChecksummed(t *testing.T) {
+	from := t.TempDir()
+	to := t.TempDir()
+	mustWrite(t, from, "f.txt", "content")
+	mustWrite(t, to, "f.txt", "content")
+	older := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	target := internal.TreeTargetFor(to, internal.EndpointOptions{})
+	sum := func() ([]byte, error) {
+		sum, _, err := internal.SHA256File(filepath.Join(from, "f.txt"), func(uint64) {})
+		return sum, err
+	}
+	for name, c := range map[string]struct {
+		source, destination time.Time
+		sum                 func() ([]byte, error)
+		expected            bool
+	}{
+		"destination older":               {source: newer, destination: older, expected: false},
+		"destination newer":               {source: older, destination: newer, expected: true},
+		"destination older, same content": {source: newer, destination: older, sum: sum, expected: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_ = os.Chtimes(filepath.Join(from, "f.txt"), c.source, c.source)
+			_ = os.Chtimes(filepath.Join(to, "f.txt"), c.destination, c.destination)
+			info, _ := os.Stat(filepath.Join(from, "f.txt"))
+			upToDate, err := internal.UpToDate(target, "f.txt", info, c.sum)
+			if err != nil || upToDate != c.expected {
+				t.Errorf("Up to date %t (error %v), expected %t", upToDate, err, c.expected)
+			}
+		})
+	}
+}
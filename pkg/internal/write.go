@@ -10,19 +10,68 @@ import (
 type Writer struct {
 	target     wtarget
 	b          wbuffer
+	sourceDone <-chan struct{}
 	done       chan struct{}
 	pr         *ProgressReporter
-	toTransfer uint64
 	syncEach   uint64
+	syncGap    time.Duration
+	retry      RetryPolicy
+	written    uint64
 }
 
+// minAdaptiveSyncBytes & maxAdaptiveSyncBytes bound
+// the interval chosen when adapting how often to sync
+const (
+	minAdaptiveSyncBytes = 4096
+	maxAdaptiveSyncBytes = 4 * 1024 * 1024 * 1024
+)
+
 // NewWriter creates a new Writer, writing to the file at path from the buffer b,
-// signalling when it's done on done, reporting progress to pr,
-// and knowing when its done when it has transferred toTransfer bytes.
+// signalling when it's done on done, reporting progress to pr.
+// It knows it is done once sourceDone is closed (i.e. the source
+// reached EOF) and it has emptied the buffer, so the source's
+// size is never relied on, it may be unknown or wrong.
 // When at least each syncEach bytes have been transferred,
-// Sync will be called on the wbuffer to flush to the underlying storage.
-func NewWriter(target wtarget, b wbuffer, done chan struct{}, pr *ProgressReporter, toTransfer uint64, syncEach uint64) Writer {
-	return Writer{target: target, b: b, done: done, pr: pr, toTransfer: toTransfer, syncEach: syncEach}
+// Sync will be called on the wbuffer to flush to the underlying storage,
+// unless syncEach is 0, in which case flushing is left to the target.
+func NewWriter(
+	target wtarget,
+	b wbuffer,
+	sourceDone <-chan struct{},
+	done chan struct{},
+	pr *ProgressReporter,
+	syncEach uint64,
+) Writer {
+	return Writer{
+		target:     target,
+		b:          b,
+		sourceDone: sourceDone,
+		done:       done,
+		pr:         pr,
+		syncEach:   syncEach,
+	}
+}
+
+// AdaptSyncTo makes the writer adjust how many bytes it writes
+// between syncs as it goes, from syncEach, so that each sync takes
+// about gap, by measuring how quickly the target flushes. The written
+// bytes reported can then only be around gap ahead of those actually
+// flushed, whatever the target. Does nothing if syncEach is 0.
+// Carries on from the interval chosen by any earlier writer
+// reporting to the same ProgressReporter (e.g. in a tree copy).
+// Must be called before Start.
+func (w *Writer) AdaptSyncTo(gap time.Duration) {
+	w.syncGap = gap
+}
+
+// RetryWith makes the writer retry initialising & writing the target
+// when they fail with a transient error, as configured by p. Writes
+// which are retried continue from exactly where the last one got to.
+// Syncs are never retried, a failed sync may have dropped what it
+// was flushing (as Linux does), so a retry could wrongly succeed.
+// Must be called before Start.
+func (w *Writer) RetryWith(p RetryPolicy) {
+	w.retry = p
 }
 
 // wbuffer has the required method on the buffer that the Writer takes from
@@ -41,38 +90,134 @@ type wtarget interface {
 	io.WriteCloser
 }
 
+// acknowledger is implemented by targets which only know that
+// bytes have been safely written some time after they were given
+// them (e.g. once the part of an upload they are in is acknowledged),
+// so report the bytes written themselves, with the function given
+// to AcknowledgeTo, rather than the Writer reporting them when written
+type acknowledger interface {
+	AcknowledgeTo(report func(uint64))
+}
+
+// aborter is implemented by targets for which closing would
+// finish what was written as if it were all there (e.g. ending
+// an upload), so which are aborted instead once writing fails
+type aborter interface {
+	Abort() error
+}
+
+// abort closes target after writing to it failed,
+// aborting it rather than closing it if it can be
+func abort(target wtarget) {
+	a, aborts := target.(aborter)
+	if aborts {
+		_ = a.Abort()
+		return
+	}
+	_ = target.Close()
+}
+
 // Start starts the writer writing to the output
 // uninterruptably. It first deletes the file
 // before starting to pull from the buffer and
 // write the buffer contents out to the file.
 // It reports progress to the progress reporter
-// as it goes, and will close done when it has
-// written out toTransfer bytes.
+// as it goes, and will close done when the source
+// is done and there is nothing left to write.
+// If writing fails the target is closed (or
+// aborted) before panicing.
 func (w *Writer) Start() {
-	err := w.target.Initialise()
+	ack, acknowledges := w.target.(acknowledger)
+	if acknowledges {
+		ack.AcknowledgeTo(w.pr.ReportBytesWritten)
+	}
+	err := w.retry.do("initialising the target", w.pr, nil, w.target.Initialise)
 	if err != nil {
 		panic(err)
 	}
-	defer w.target.Close()
-	syncIncrement := uint64(0)
+	if w.syncGap != 0 && w.syncEach != 0 && w.pr.SyncEach() != 0 {
+		w.syncEach = w.pr.SyncEach()
+	}
+	w.pr.ReportSyncEach(w.syncEach)
+	sinceSync := uint64(0)
 	for {
+		sourceDrained := isClosed(w.sourceDone)
 		next, err := w.b.Pop()
 		n := len(next)
 		if n == 0 {
 			time.Sleep(1 * time.Millisecond)
 		}
-		if err == nil {
-			w.target.Write(next)
-			w.pr.ReportBytesWritten(uint64(n))
+		if err == nil && n > 0 {
+			err = w.write(next)
+			if err != nil {
+				abort(w.target)
+				panic(err)
+			}
+			if !acknowledges {
+				w.pr.ReportBytesWritten(uint64(n))
+			}
+			sinceSync += uint64(n)
 		}
-		newSyncIncrement := w.pr.BytesWritten() / w.syncEach
-		if syncIncrement != newSyncIncrement {
-			w.target.Sync()
-			syncIncrement = newSyncIncrement
+		if w.syncEach != 0 && sinceSync >= w.syncEach {
+			w.sync(sinceSync)
+			sinceSync = 0
 		}
-		if w.pr.BytesWritten() >= w.toTransfer {
+		if sourceDrained && n == 0 {
+			// closed before signalling done, as for some
+			// targets it's only now we know if all went well
+			err = w.target.Close()
+			if err != nil {
+				panic(err)
+			}
 			close(w.done)
 			return
 		}
 	}
 }
+
+// sync syncs the target, which has had pending bytes written since
+// it was last synced, adapting the interval between syncs if set to,
+// panicing if the sync fails
+func (w *Writer) sync(pending uint64) {
+	start := time.Now()
+	err := w.target.Sync()
+	if err != nil {
+		abort(w.target)
+		panic(err)
+	}
+	took := time.Since(start)
+	if w.syncGap == 0 {
+		return
+	}
+	// the bytes the target can flush in the gap, going by this sync,
+	// averaged with the previous interval so one odd sync doesn't swing it
+	flushable := uint64(float64(pending) * w.syncGap.Seconds() / max(took.Seconds(), 1e-6))
+	w.syncEach = min(max((w.syncEach+flushable)/2, minAdaptiveSyncBytes), maxAdaptiveSyncBytes)
+	w.pr.ReportSyncEach(w.syncEach)
+}
+
+// write writes all of b to the target, retrying
+// from where it got to if writing fails transiently
+func (w *Writer) write(b []byte) error {
+	offset := w.written
+	return w.retry.do(
+		"writing to the target",
+		w.pr,
+		func() error { return seekTo(w.target, w.written) },
+		func() error {
+			n, err := w.target.Write(b[w.written-offset:])
+			w.written += uint64(n)
+			return err
+		},
+	)
+}
+
+// isClosed returns true only if c has been closed, without blocking
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
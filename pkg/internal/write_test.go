@@ -1,6 +1,7 @@
 package internal_test
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 	"time"
@@ -75,19 +76,31 @@ func ensureStopped(b Acceptor, done chan struct{}) {
 	}
 }
 
+// stopWriter signals to a writer that its source is done
+// by closing sourceDone, then waits for it to finish
+func stopWriter(sourceDone chan struct{}, done chan struct{}) {
+	close(sourceDone)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		panic("Failed to shut down")
+	}
+}
+
 func TestWriterInitialisesTarget(t *testing.T) {
+	sourceDone := make(chan struct{})
 	done := make(chan struct{})
 	mt := mockTarget{}
 	b := internal.NewBuffer(100)
 	w := internal.NewWriter(
 		&mt,
 		&b,
+		sourceDone,
 		done,
 		internal.From(internal.NewProgressReporter(100, done)),
-		100,
 		1000,
 	)
-	defer ensureStopped(&b, done)
+	defer stopWriter(sourceDone, done)
 	go w.Start()
 	await(func() bool { return (&mt).wasInitialised }, 2*time.Second)
 	if !(&mt).wasInitialised {
@@ -96,18 +109,19 @@ func TestWriterInitialisesTarget(t *testing.T) {
 }
 
 func TestWriterTakesFromBufferPutsToTargetWhenAvailable(t *testing.T) {
+	sourceDone := make(chan struct{})
 	done := make(chan struct{})
 	mt := mockTarget{}
 	b := internal.NewBuffer(100)
 	w := internal.NewWriter(
 		&mt,
 		&b,
+		sourceDone,
 		done,
 		internal.From(internal.NewProgressReporter(100, done)),
-		100,
 		1000,
 	)
-	defer ensureStopped(&b, done)
+	defer stopWriter(sourceDone, done)
 	go w.Start()
 	firstData := random.Bytes(50)
 	b.Offer(firstData)
@@ -130,6 +144,7 @@ func TestWriterTakesFromBufferPutsToTargetWhenAvailable(t *testing.T) {
 }
 
 func TestWriterReportsWrittenBytesToProgressReporter(t *testing.T) {
+	sourceDone := make(chan struct{})
 	done := make(chan struct{})
 	mt := mockTarget{}
 	b := internal.NewBuffer(100)
@@ -137,12 +152,12 @@ func TestWriterReportsWrittenBytesToProgressReporter(t *testing.T) {
 	w := internal.NewWriter(
 		&mt,
 		&b,
+		sourceDone,
 		done,
 		&pr,
-		100,
 		1000,
 	)
-	defer ensureStopped(&b, done)
+	defer stopWriter(sourceDone, done)
 	go w.Start()
 	firstData := random.Bytes(50)
 	b.Offer(firstData)
@@ -153,6 +168,7 @@ func TestWriterReportsWrittenBytesToProgressReporter(t *testing.T) {
 }
 
 func TestWriterSyncsWhenEnoughBytesTakenFromBuffer(t *testing.T) {
+	sourceDone := make(chan struct{})
 	done := make(chan struct{})
 	mt := mockTarget{}
 	b := internal.NewBuffer(100)
@@ -160,12 +176,12 @@ func TestWriterSyncsWhenEnoughBytesTakenFromBuffer(t *testing.T) {
 	w := internal.NewWriter(
 		&mt,
 		&b,
+		sourceDone,
 		done,
 		&pr,
-		100,
 		15,
 	)
-	defer ensureStopped(&b, done)
+	defer stopWriter(sourceDone, done)
 	go w.Start()
 	b.Offer(random.Bytes(15))
 	await(func() bool { return len(mt.destination) == 15 }, 2*time.Second)
@@ -190,30 +206,186 @@ func TestWriterSyncsWhenEnoughBytesTakenFromBuffer(t *testing.T) {
 	}
 }
 
-func TestWriterClosesTargetWhenTargetBytesWritten(t *testing.T) {
+func TestWriterLeavesSyncingToTargetWhenSyncEachIsZero(t *testing.T) {
+	sourceDone := make(chan struct{})
 	done := make(chan struct{})
 	mt := mockTarget{}
-	b := internal.NewBuffer(2)
+	b := internal.NewBuffer(100)
+	pr := internal.NewProgressReporter(100, done)
+	w := internal.NewWriter(
+		&mt,
+		&b,
+		sourceDone,
+		done,
+		&pr,
+		0,
+	)
+	defer stopWriter(sourceDone, done)
+	go w.Start()
+	b.Offer(random.Bytes(50))
+	await(func() bool { return len(mt.buffer) == 50 }, 2*time.Second)
+	if !(len(mt.destination) == 0) || !(len(mt.buffer) == 50) {
+		t.Errorf("%d bytes in destination, %d in buffer, should be 0 and 50 without syncing",
+			len(mt.destination), len(mt.buffer),
+		)
+	}
+}
+
+// slowSyncTarget is a target whose syncs take perKiB
+// for each KiB written since the last sync
+type slowSyncTarget struct {
+	pending int
+	perKiB  time.Duration
+}
+
+func (t *slowSyncTarget) Initialise() error {
+	return nil
+}
+
+func (t *slowSyncTarget) Sync() error {
+	time.Sleep(time.Duration(t.pending) * t.perKiB / 1024)
+	t.pending = 0
+	return nil
+}
+
+func (t *slowSyncTarget) Close() error {
+	return nil
+}
+
+func (t *slowSyncTarget) Write(b []byte) (int, error) {
+	t.pending += len(b)
+	return len(b), nil
+}
+
+// adaptedSyncEach writes size bytes to a target whose syncs take perKiB,
+// adapting from syncEach to gap, returning the final interval
+func adaptedSyncEach(syncEach uint64, gap time.Duration, perKiB time.Duration, size int) uint64 {
+	sourceDone := make(chan struct{})
+	done := make(chan struct{})
+	b := internal.NewBuffer(uint64(size))
+	pr := internal.NewProgressReporter(uint64(size), nil)
+	w := internal.NewWriter(&slowSyncTarget{perKiB: perKiB}, &b, sourceDone, done, &pr, syncEach)
+	w.AdaptSyncTo(gap)
+	b.Offer(random.Bytes(size))
+	go w.Start()
+	stopWriter(sourceDone, done)
+	return pr.SyncEach()
+}
+
+func TestWriterSyncsLessOftenWhenTargetFlushesQuickly(t *testing.T) {
+	// flushes 10MiB/s, so 512KiB in 50ms
+	syncEach := adaptedSyncEach(16*1024, 50*time.Millisecond, 100*time.Microsecond, 4*1024*1024)
+	if syncEach < 128*1024 {
+		t.Errorf("Adapted to syncing each %d bytes, expected over 128KiB", syncEach)
+	}
+}
+
+func TestWriterSyncsMoreOftenWhenTargetFlushesSlowly(t *testing.T) {
+	// flushes 1MiB/s, so 10KiB in 10ms
+	syncEach := adaptedSyncEach(256*1024, 10*time.Millisecond, time.Millisecond, 1024*1024)
+	if syncEach > 64*1024 {
+		t.Errorf("Adapted to syncing each %d bytes, expected under 64KiB", syncEach)
+	}
+}
+
+func TestWriterKeepsSyncIntervalWhenNotAdapting(t *testing.T) {
+	syncEach := adaptedSyncEach(16*1024, 0, time.Microsecond, 256*1024)
+	if syncEach != 16*1024 {
+		t.Errorf("Synced each %d bytes, expected the configured 16KiB", syncEach)
+	}
+}
+
+func TestWriterKeepsWritingPastEstimatedSizeUntilSourceDone(t *testing.T) {
+	sourceDone := make(chan struct{})
+	done := make(chan struct{})
+	mt := mockTarget{}
+	b := internal.NewBuffer(100)
 	pr := internal.NewProgressReporter(20, done)
 	w := internal.NewWriter(
 		&mt,
 		&b,
+		sourceDone,
+		done,
+		&pr,
+		100,
+	)
+	go w.Start()
+	b.Offer(random.Bytes(30))
+	await(func() bool { return pr.BytesWritten() == 30 }, 2*time.Second)
+	if mt.wasClosed {
+		t.Errorf("The target was closed after the estimated %d bytes, before the source was done", 20)
+	}
+	close(sourceDone)
+	await(func() bool { return mt.wasClosed }, 2*time.Second)
+	if !mt.wasClosed {
+		t.Error("The target was not closed 2 seconds after the source was done")
+	}
+	if !(pr.BytesWritten() == 30) {
+		t.Errorf("%d bytes written at close, expected 30", pr.BytesWritten())
+	}
+}
+
+func TestWriterClosesTargetWhenSourceDoneAndBufferEmpty(t *testing.T) {
+	sourceDone := make(chan struct{})
+	done := make(chan struct{})
+	mt := mockTarget{}
+	b := internal.NewBuffer(100)
+	pr := internal.NewProgressReporter(0, done)
+	w := internal.NewWriter(
+		&mt,
+		&b,
+		sourceDone,
 		done,
 		&pr,
-		20,
 		100,
 	)
-	defer ensureStopped(&b, done)
 	go w.Start()
-	await(func() bool {
-		b.Offer(random.Bytes(1))
-		time.Sleep(10 * time.Millisecond)
-		return mt.wasClosed
-	}, 2*time.Second)
+	b.Offer(random.Bytes(30))
+	await(func() bool { return pr.BytesWritten() == 30 }, 2*time.Second)
+	if mt.wasClosed {
+		t.Error("The target was closed before the source was done")
+	}
+	b.Offer(random.Bytes(12))
+	close(sourceDone)
+	await(func() bool { return mt.wasClosed }, 2*time.Second)
 	if !mt.wasClosed {
-		t.Errorf("The target has not been closed despite %d bytes transfered", pr.BytesWritten())
+		t.Error("The target was not closed 2 seconds after the source was done")
 	}
-	if !(pr.BytesWritten() == 20) {
-		t.Errorf("%d bytes written at close, expected 20", pr.BytesWritten())
+	if !(pr.BytesWritten() == 42) {
+		t.Errorf("%d bytes written at close, expected 42", pr.BytesWritten())
 	}
 }
+
+// failingTarget is a mockTarget which fails to write
+type failingTarget struct {
+	mockTarget
+}
+
+func (t *failingTarget) Write(b []byte) (int, error) {
+	return 0, errors.New("no space left on device")
+}
+
+func TestWriterClosesTargetBeforePanicingWhenWritingFails(t *testing.T) {
+	sourceDone := make(chan struct{})
+	done := make(chan struct{})
+	ft := failingTarget{}
+	b := internal.NewBuffer(100)
+	w := internal.NewWriter(
+		&ft,
+		&b,
+		sourceDone,
+		done,
+		internal.From(internal.NewProgressReporter(0, done)),
+		100,
+	)
+	b.Offer(random.Bytes(30))
+	defer func() {
+		if recover() == nil {
+			t.Error("Writer did not panic when writing failed")
+		}
+		if !ft.wasClosed {
+			t.Error("The target was not closed when writing failed")
+		}
+	}()
+	w.Start()
+}
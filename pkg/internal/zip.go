@@ -0,0 +1,350 @@
+package internal
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// zipMemberSeparator separates the path of a zip archive
+// from the path of a member in it, archive.zip!/member
+const zipMemberSeparator = "!/"
+
+// IsZip returns true if path names a zip archive by its suffix
+func IsZip(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), ".zip")
+}
+
+// IsZipMember returns true if path names a member of a
+// zip archive, like archive.zip!/inner/file.bin
+func IsZipMember(path string) bool {
+	archive, _, found := strings.Cut(path, zipMemberSeparator)
+	return found && IsZip(archive)
+}
+
+// zipSource is an rsource which reads a zip archive of the entries
+// in a tree of local files, written as it's read. Zip64 is used
+// where entries or the archive are too large for plain zip.
+type zipSource struct {
+	root    string
+	entries []TreeEntry
+	mtime   *time.Time
+	method  uint16
+	r       *io.PipeReader
+}
+
+// NewZipSource creates a source reading a zip archive of entries,
+// found under the local directory root by WalkTree, in order.
+// Files are deflated, unless store is set. If mtime is not nil,
+// every entry gets it as its modification time, so that archives
+// of the same files are identical.
+func NewZipSource(root string, entries []TreeEntry, mtime *time.Time, store bool) *zipSource {
+	method := zip.Deflate
+	if store {
+		method = zip.Store
+	}
+	return &zipSource{root: root, entries: entries, mtime: mtime, method: method}
+}
+
+// Size implements sizer on zipSource, estimating the size of the
+// archive from the size of the entries (as if stored) & their headers
+func (zs *zipSource) Size() (uint64, error) {
+	// the end of central directory record, with zip64
+	size := uint64(22 + 56 + 20)
+	for _, e := range zs.entries {
+		// local header, data descriptor & central directory header
+		size += 30 + 24 + 46 + 2*uint64(len(e.Path)+1)
+		if e.Info.Mode().IsRegular() {
+			size += uint64(e.Info.Size())
+		}
+	}
+	return size, nil
+}
+
+// Open implements rsource on zipSource, starting writing the archive
+func (zs *zipSource) Open() error {
+	r, w := io.Pipe()
+	zs.r = r
+	go func() {
+		zw := zip.NewWriter(w)
+		for _, e := range zs.entries {
+			err := zs.write(zw, e)
+			if err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+		w.CloseWithError(zw.Close())
+	}()
+	return nil
+}
+
+// write writes the entry e to zw
+func (zs *zipSource) write(zw *zip.Writer, e TreeEntry) error {
+	local := filepath.Join(zs.root, filepath.FromSlash(e.Path))
+	isSymlink := e.Info.Mode()&fs.ModeSymlink != 0
+	if !isSymlink && !e.Info.IsDir() && !e.Info.Mode().IsRegular() {
+		log.Printf("WARNING: skipping %s, which is not a file, directory or symlink", local)
+		return nil
+	}
+	header, err := zip.FileInfoHeader(e.Info)
+	if err != nil {
+		return err
+	}
+	header.Name = e.Path
+	header.Method = zs.method
+	if e.Info.IsDir() {
+		header.Name += "/"
+		header.Method = zip.Store
+	}
+	if zs.mtime != nil {
+		header.Modified = *zs.mtime
+	}
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	switch {
+	case isSymlink:
+		// as zip does on unix, the content of a symlink is what it links to
+		link, err := os.Readlink(local)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, link)
+		return err
+	case e.Info.IsDir():
+		return nil
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Read implements rsource on zipSource, reading the archive
+func (zs *zipSource) Read(b []byte) (int, error) {
+	return zs.r.Read(b)
+}
+
+// Close implements rsource on zipSource,
+// stopping writing the archive if not finished
+func (zs *zipSource) Close() error {
+	return zs.r.Close()
+}
+
+// countingReaderAt passes reads through to ra,
+// calling count with the number of bytes read each time
+type countingReaderAt struct {
+	ra    io.ReaderAt
+	count func(uint64)
+}
+
+// ReadAt implements io.ReaderAt on countingReaderAt
+func (cra *countingReaderAt) ReadAt(b []byte, offset int64) (int, error) {
+	n, err := cra.ra.ReadAt(b, offset)
+	cra.count(uint64(n))
+	return n, err
+}
+
+// openZip opens the local zip archive at path, reporting the
+// bytes read from it as consumed from the source to pr, unless
+// pr is nil, returning the archive & the file to close with it
+func openZip(path string, pr *ProgressReporter) (*zip.Reader, *os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	var ra io.ReaderAt = f
+	if pr != nil {
+		ra = &countingReaderAt{ra: f, count: pr.ReportSourceBytesConsumed}
+	}
+	zr, err := zip.NewReader(ra, fi.Size())
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, fmt.Errorf("failed to read zip archive %s: %w", path, err)
+	}
+	return zr, f, nil
+}
+
+// zipArchive reads the entries of a local zip archive.
+// The content of each entry is checked against its CRC-32
+// once read, a mismatch failing the read.
+type zipArchive struct {
+	path  string
+	pr    *ProgressReporter
+	f     *os.File
+	files []*zip.File
+	next  int
+	entry io.ReadCloser
+	guard extractionGuard
+}
+
+// NewZipArchive creates a new reader of the local zip archive
+// at path, the bytes read from it being reported to pr as
+// consumed from the source. Zip archives can't be read from
+// anywhere else, as their index is at their end.
+func NewZipArchive(path string, pr *ProgressReporter) *zipArchive {
+	return &zipArchive{path: path, pr: pr, guard: newExtractionGuard()}
+}
+
+// Open opens the archive & reads its index
+func (za *zipArchive) Open() error {
+	zr, f, err := openZip(za.path, za.pr)
+	if err != nil {
+		return err
+	}
+	za.f = f
+	za.files = zr.File
+	return nil
+}
+
+// Next moves on to the next entry in the archive, returning it &
+// what it links to if it's a symlink, or io.EOF at the end. Entries
+// which would be extracted outside of the destination (e.g. through
+// a symlink extracted earlier) are skipped with a warning.
+func (za *zipArchive) Next() (TreeEntry, string, error) {
+	za.closeEntry()
+	for za.next < len(za.files) {
+		zf := za.files[za.next]
+		za.next++
+		info := zf.FileInfo()
+		p, ok := za.guard.allow(zf.Name, info)
+		if !ok {
+			continue
+		}
+		if zf.Method != zip.Store && zf.Method != zip.Deflate {
+			return TreeEntry{}, "", fmt.Errorf("%s in %s is compressed with unsupported method %d", p, za.path, zf.Method)
+		}
+		var err error
+		za.entry, err = zf.Open()
+		if err != nil {
+			return TreeEntry{}, "", err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			b, err := io.ReadAll(io.LimitReader(za.entry, 4096))
+			if err != nil {
+				return TreeEntry{}, "", err
+			}
+			link = string(b)
+		}
+		return TreeEntry{Path: p, Info: info}, link, nil
+	}
+	return TreeEntry{}, "", io.EOF
+}
+
+// closeEntry closes the current entry, if there is one
+func (za *zipArchive) closeEntry() {
+	if za.entry != nil {
+		_ = za.entry.Close()
+		za.entry = nil
+	}
+}
+
+// Entry returns a source reading the content of the current entry,
+// which must be read before moving on to the next entry
+func (za *zipArchive) Entry() rsource {
+	return &archiveEntry{r: za.entry}
+}
+
+// Close closes the archive
+func (za *zipArchive) Close() error {
+	za.closeEntry()
+	if za.f == nil {
+		return nil
+	}
+	return za.f.Close()
+}
+
+// zipMemberSource is an rsource reading a single member of a local
+// zip archive, checked against its CRC-32 once read
+type zipMemberSource struct {
+	archive string
+	member  string
+	f       *os.File
+	r       io.ReadCloser
+}
+
+// NewZipMemberSource creates a new source reading the
+// member of a local zip archive given as archive.zip!/member
+func NewZipMemberSource(path string) *zipMemberSource {
+	archive, member, _ := strings.Cut(path, zipMemberSeparator)
+	return &zipMemberSource{archive: archive, member: member}
+}
+
+// find returns the member in zr
+func (zms *zipMemberSource) find(zr *zip.Reader) (*zip.File, error) {
+	for _, zf := range zr.File {
+		if zf.Name == zms.member {
+			return zf, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no member %s", zms.archive, zms.member)
+}
+
+// Size implements sizer on zipMemberSource,
+// returning the uncompressed size of the member
+func (zms *zipMemberSource) Size() (uint64, error) {
+	zr, f, err := openZip(zms.archive, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	zf, err := zms.find(zr)
+	if err != nil {
+		return 0, err
+	}
+	return zf.UncompressedSize64, nil
+}
+
+// Open implements rsource on zipMemberSource
+func (zms *zipMemberSource) Open() error {
+	zr, f, err := openZip(zms.archive, nil)
+	if err != nil {
+		return err
+	}
+	zf, err := zms.find(zr)
+	if err == nil && zf.Mode().IsDir() {
+		err = fmt.Errorf("%s in %s is a directory", zms.member, zms.archive)
+	}
+	if err == nil {
+		zms.r, err = zf.Open()
+	}
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	zms.f = f
+	return nil
+}
+
+// Read implements rsource on zipMemberSource
+func (zms *zipMemberSource) Read(b []byte) (int, error) {
+	n, err := zms.r.Read(b)
+	if errors.Is(err, zip.ErrChecksum) {
+		err = fmt.Errorf("%s in %s does not match its CRC-32: %w", zms.member, zms.archive, err)
+	}
+	return n, err
+}
+
+// Close implements rsource on zipMemberSource
+func (zms *zipMemberSource) Close() error {
+	_ = zms.r.Close()
+	return zms.f.Close()
+}
@@ -0,0 +1,77 @@
+package internal_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/snasphysicist/go-copy/pkg/internal"
+	"github.com/snasphysicist/go-copy/pkg/random"
+)
+
+// writeZip writes a zip archive of members (name to content)
+// to a temporary file with method, returning its path
+func writeZip(t *testing.T, members map[string][]byte, method uint16) string {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for name, content := range members {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			t.Fatalf("Failed to add %s to zip with %v", name, err)
+		}
+		_, _ = w.Write(content)
+	}
+	_ = zw.Close()
+	path := filepath.Join(t.TempDir(), "archive.zip")
+	err := os.WriteFile(path, b.Bytes(), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write zip with %v", err)
+	}
+	return path
+}
+
+func TestZipMemberSourceReadsSingleMember(t *testing.T) {
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		member := random.Bytes(100000)
+		path := writeZip(t, map[string][]byte{"other": random.Bytes(10), "inner/file.bin": member}, method)
+		source := internal.SourceFor(path+"!/inner/file.bin", internal.EndpointOptions{})
+		size := internal.EstimatedSizeOf(source)
+		if size != uint64(len(member)) {
+			t.Errorf("Size reported as %d, expected %d", size, len(member))
+		}
+		if !bytes.Equal(member, readAll(t, source)) {
+			t.Errorf("Content read with method %d did not match member", method)
+		}
+	}
+}
+
+func TestZipMemberSourceFailsWhenMemberDoesNotMatchCRC(t *testing.T) {
+	member := []byte(strings.Repeat("all work and no play ", 100))
+	path := writeZip(t, map[string][]byte{"file.txt": member}, zip.Store)
+	archive, _ := os.ReadFile(path)
+	i := bytes.Index(archive, []byte("no play"))
+	archive[i] = 'N'
+	_ = os.WriteFile(path, archive, 0644)
+	source := internal.NewZipMemberSource(path + "!/file.txt")
+	err := source.Open()
+	if err != nil {
+		t.Fatalf("Failed to open member with %v", err)
+	}
+	defer source.Close()
+	_, err = io.ReadAll(source)
+	if err == nil || !strings.Contains(err.Error(), "CRC-32") {
+		t.Errorf("Reading corrupted member gave error %v, expected a CRC-32 mismatch", err)
+	}
+}
+
+func TestZipMemberSourceFailsForMissingMember(t *testing.T) {
+	path := writeZip(t, map[string][]byte{"file.txt": random.Bytes(10)}, zip.Deflate)
+	err := internal.NewZipMemberSource(path + "!/missing.txt").Open()
+	if err == nil {
+		t.Error("Opening a missing member did not fail")
+	}
+}